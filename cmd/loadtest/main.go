@@ -0,0 +1,560 @@
+// Command loadtest simulates users chatting with a running server over real
+// WebSockets and reports latency percentiles and error rates, so hub changes
+// can be benchmarked. Each user logs in, connects, and sends direct messages
+// and typing indicators to other simulated users at random, at the configured
+// average rates.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"whatsdown/internal/models"
+
+	"github.com/gorilla/websocket"
+)
+
+// Messages carry this prefix and their send time, so recipients can measure
+// delivery latency
+const contentPrefix = "loadtest"
+
+type options struct {
+	server       string
+	users        int
+	prefix       string
+	duration     time.Duration
+	ramp         time.Duration
+	drain        time.Duration
+	messageRate  float64
+	typingRate   float64
+	messageBytes int
+	interval     time.Duration
+	subprotocol  string
+}
+
+// envelope is a frame with its payload left encoded
+type envelope struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// stats are shared by every simulated user
+type stats struct {
+	connected atomic.Int64
+	sent      atomic.Int64
+	accepted  atomic.Int64
+	delivered atomic.Int64
+	typing    atomic.Int64
+
+	mu        sync.Mutex
+	acceptLat []time.Duration // Send until the server echoes the message back
+	deliveLat []time.Duration // Send until the recipient has it
+	errors    map[string]int
+}
+
+func (s *stats) fail(kind string) {
+	s.mu.Lock()
+	s.errors[kind]++
+	s.mu.Unlock()
+}
+
+func (s *stats) errorCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := 0
+	for _, n := range s.errors {
+		total += n
+	}
+	return total
+}
+
+// user is one simulated user with one connection
+type user struct {
+	name  string
+	conn  *websocket.Conn
+	stats *stats
+
+	// Writes to conn are serialized
+	writeMu sync.Mutex
+
+	// Sends not yet echoed back: tempId -> when sent
+	mu      sync.Mutex
+	pending map[string]time.Time
+	nextID  int
+
+	// Set once the run is over, so closing isn't counted as a failure
+	stopping atomic.Bool
+
+	// Closed when the connection drops, which stops the user sending
+	gone chan struct{}
+}
+
+func main() {
+	opts := options{}
+	flag.StringVar(&opts.server, "server", "http://localhost:8080", "server base URL")
+	flag.IntVar(&opts.users, "users", 50, "simulated users")
+	flag.StringVar(&opts.prefix, "prefix", "load", "username prefix; users are <prefix>_<n>")
+	flag.DurationVar(&opts.duration, "duration", 30*time.Second, "how long to send for once every user has connected")
+	flag.DurationVar(&opts.ramp, "ramp", 5*time.Second, "time over which users connect")
+	flag.DurationVar(&opts.drain, "drain", 5*time.Second, "how long to wait for outstanding messages after sending stops")
+	flag.Float64Var(&opts.messageRate, "rate", 1, "messages per second per user")
+	flag.Float64Var(&opts.typingRate, "typing", 0.5, "typing indicators per second per user")
+	flag.IntVar(&opts.messageBytes, "size", 64, "message content length in bytes")
+	flag.DurationVar(&opts.interval, "interval", 5*time.Second, "how often to print progress; 0 disables it")
+	flag.StringVar(&opts.subprotocol, "subprotocol", "whatsdown.json.v2", "WebSocket subprotocol; only JSON encodings are supported")
+	flag.Parse()
+
+	if opts.users < 2 {
+		log.Fatal("Invalid options: -users must be at least 2")
+	}
+	if opts.messageRate < 0 || opts.typingRate < 0 || opts.duration <= 0 || opts.ramp < 0 || opts.drain < 0 {
+		log.Fatal("Invalid options: -rate, -typing, -ramp and -drain must not be negative and -duration must be positive")
+	}
+	if !strings.HasPrefix(opts.subprotocol, "whatsdown.json") {
+		log.Fatal("Invalid options: -subprotocol must be a JSON encoding")
+	}
+	base, err := url.Parse(opts.server)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") {
+		log.Fatal("Invalid options: -server must be an http:// or https:// URL")
+	}
+	minLength := len(contentPrefix) + 21
+	if opts.messageBytes < minLength {
+		opts.messageBytes = minLength
+	}
+
+	st := &stats{errors: make(map[string]int)}
+	names := make([]string, opts.users)
+	for i := range names {
+		names[i] = fmt.Sprintf("%s_%d", opts.prefix, i)
+	}
+
+	fmt.Printf("Connecting %d users to %s over %v\n", opts.users, opts.server, opts.ramp)
+	users := connectAll(base, names, opts, st)
+	if len(users) < 2 {
+		log.Fatalf("Only %d users connected; %s", len(users), describeErrors(st))
+	}
+	fmt.Printf("%d users connected; sending for %v\n", len(users), opts.duration)
+
+	stop := make(chan struct{})
+	var senders sync.WaitGroup
+	for _, u := range users {
+		senders.Add(1)
+		go func(u *user) {
+			defer senders.Done()
+			u.send(names, opts, stop)
+		}(u)
+	}
+
+	started := time.Now()
+	progressDone := make(chan struct{})
+	go progress(st, opts.interval, started, stop, progressDone)
+
+	time.Sleep(opts.duration)
+	close(stop)
+	senders.Wait()
+	<-progressDone
+	elapsed := time.Since(started)
+
+	// Give messages in flight time to arrive before counting them lost
+	deadline := time.Now().Add(opts.drain)
+	for time.Now().Before(deadline) && outstanding(users) > 0 {
+		time.Sleep(100 * time.Millisecond)
+	}
+	for _, u := range users {
+		u.close()
+	}
+	if lost := outstanding(users); lost > 0 {
+		st.mu.Lock()
+		st.errors["unacknowledged"] += lost
+		st.mu.Unlock()
+	}
+
+	report(st, opts, len(users), elapsed)
+}
+
+// connectAll logs in and connects every user, spreading connections over
+// opts.ramp, and returns those that connected
+func connectAll(base *url.URL, names []string, opts options, st *stats) []*user {
+	var mu sync.Mutex
+	var users []*user
+	var wg sync.WaitGroup
+	delay := time.Duration(0)
+	if len(names) > 1 {
+		delay = opts.ramp / time.Duration(len(names)-1)
+	}
+	for i, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			u, err := connect(base, name, opts.subprotocol, st)
+			if err != nil {
+				log.Printf("%s failed to connect: %v", name, err)
+				return
+			}
+			mu.Lock()
+			users = append(users, u)
+			mu.Unlock()
+		}(name)
+		if i < len(names)-1 {
+			time.Sleep(delay)
+		}
+	}
+	wg.Wait()
+	return users
+}
+
+// connect logs name in and opens its WebSocket
+func connect(base *url.URL, name, subprotocol string, st *stats) (*user, error) {
+	body, _ := json.Marshal(map[string]string{"username": name})
+	resp, err := http.Post(base.JoinPath("/api/login").String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		st.fail("login")
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		st.fail("login")
+		return nil, fmt.Errorf("login: %s", resp.Status)
+	}
+	var session *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "session_id" {
+			session = cookie
+		}
+	}
+	if session == nil {
+		st.fail("login")
+		return nil, errors.New("login: no session cookie")
+	}
+
+	wsURL := *base
+	wsURL.Scheme = "ws"
+	if base.Scheme == "https" {
+		wsURL.Scheme = "wss"
+	}
+	wsURL.Path = strings.TrimSuffix(wsURL.Path, "/") + "/ws"
+	header := http.Header{}
+	header.Set("Cookie", session.Name+"="+session.Value)
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocol}, HandshakeTimeout: 10 * time.Second}
+	conn, resp, err := dialer.Dial(wsURL.String(), header)
+	if err != nil {
+		st.fail("connect")
+		if resp != nil {
+			return nil, fmt.Errorf("%v (%s)", err, resp.Status)
+		}
+		return nil, err
+	}
+
+	u := &user{name: name, conn: conn, stats: st, pending: make(map[string]time.Time), gone: make(chan struct{})}
+	st.connected.Add(1)
+	go u.read()
+	return u, nil
+}
+
+// send sends messages and typing indicators to random other users until stop
+// is closed. Gaps between sends are exponentially distributed, so sends
+// arrive as a Poisson process at the configured rates.
+func (u *user) send(names []string, opts options, stop <-chan struct{}) {
+	nextMessage := nextAfter(opts.messageRate)
+	nextTyping := nextAfter(opts.typingRate)
+	for {
+		wait := min(time.Until(nextMessage), time.Until(nextTyping))
+		timer := time.NewTimer(max(wait, 0))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-u.gone:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		if !now.Before(nextTyping) {
+			u.sendTyping(u.peer(names))
+			nextTyping = nextAfter(opts.typingRate)
+		}
+		if !now.Before(nextMessage) {
+			u.sendMessage(u.peer(names), opts.messageBytes)
+			nextMessage = nextAfter(opts.messageRate)
+		}
+	}
+}
+
+// nextAfter returns when the next of a Poisson process of rate per second
+// falls, or effectively never for rate 0
+func nextAfter(rate float64) time.Time {
+	if rate <= 0 {
+		return time.Now().Add(365 * 24 * time.Hour)
+	}
+	return time.Now().Add(time.Duration(rand.ExpFloat64() / rate * float64(time.Second)))
+}
+
+// peer picks another simulated user at random
+func (u *user) peer(names []string) string {
+	for {
+		if name := names[rand.Intn(len(names))]; name != u.name {
+			return name
+		}
+	}
+}
+
+func (u *user) sendMessage(to string, size int) {
+	u.mu.Lock()
+	u.nextID++
+	tempID := strconv.Itoa(u.nextID)
+	sentAt := time.Now()
+	u.pending[tempID] = sentAt
+	u.mu.Unlock()
+
+	content := contentPrefix + " " + strconv.FormatInt(sentAt.UnixNano(), 10) + " "
+	content += strings.Repeat("x", max(size-len(content), 0))
+	if u.write("message", &models.InboundMessage{To: to, Content: content, TempID: tempID}) {
+		u.stats.sent.Add(1)
+	} else {
+		u.mu.Lock()
+		delete(u.pending, tempID)
+		u.mu.Unlock()
+	}
+}
+
+func (u *user) sendTyping(to string) {
+	if u.write("typing", &models.TypingEvent{To: to, IsTyping: true}) {
+		u.stats.typing.Add(1)
+	}
+}
+
+func (u *user) write(msgType string, payload interface{}) bool {
+	u.writeMu.Lock()
+	defer u.writeMu.Unlock()
+	u.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := u.conn.WriteJSON(&models.WSMessage{Type: msgType, Payload: payload}); err != nil {
+		if !u.stopping.Load() {
+			u.stats.fail("write")
+		}
+		return false
+	}
+	return true
+}
+
+// read handles frames until the connection closes
+func (u *user) read() {
+	defer close(u.gone)
+	for {
+		_, data, err := u.conn.ReadMessage()
+		if err != nil {
+			if !u.stopping.Load() {
+				u.stats.fail("disconnected")
+				u.stats.connected.Add(-1)
+			}
+			return
+		}
+		var frame envelope
+		if err := json.Unmarshal(data, &frame); err != nil {
+			u.stats.fail("undecodable frame")
+			continue
+		}
+		u.handle(frame)
+	}
+}
+
+func (u *user) handle(frame envelope) {
+	switch frame.Type {
+	case "batch":
+		var frames []envelope
+		if err := json.Unmarshal(frame.Payload, &frames); err != nil {
+			u.stats.fail("undecodable frame")
+			return
+		}
+		for _, inner := range frames {
+			u.handle(inner)
+		}
+
+	case "message":
+		var message models.OutboundMessage
+		if err := json.Unmarshal(frame.Payload, &message); err != nil {
+			u.stats.fail("undecodable frame")
+			return
+		}
+		if message.From == u.name {
+			u.accepted(message.TempID)
+		} else {
+			u.received(message.Content)
+		}
+
+	case "error":
+		var event models.ErrorEvent
+		json.Unmarshal(frame.Payload, &event)
+		u.forget(event.TempID)
+		u.stats.fail("error: " + event.Code)
+	}
+}
+
+// accepted records the server echoing back one of this user's messages
+func (u *user) accepted(tempID string) {
+	u.mu.Lock()
+	sentAt, pending := u.pending[tempID]
+	delete(u.pending, tempID)
+	u.mu.Unlock()
+	if !pending {
+		return
+	}
+	latency := time.Since(sentAt)
+	u.stats.accepted.Add(1)
+	u.stats.mu.Lock()
+	u.stats.acceptLat = append(u.stats.acceptLat, latency)
+	u.stats.mu.Unlock()
+}
+
+// received records a message from another simulated user arriving
+func (u *user) received(content string) {
+	fields := strings.Fields(content)
+	if len(fields) < 2 || fields[0] != contentPrefix {
+		return
+	}
+	sentAt, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return
+	}
+	latency := time.Since(time.Unix(0, sentAt))
+	u.stats.delivered.Add(1)
+	u.stats.mu.Lock()
+	u.stats.deliveLat = append(u.stats.deliveLat, latency)
+	u.stats.mu.Unlock()
+}
+
+// forget stops waiting for a message the server refused
+func (u *user) forget(tempID string) {
+	if tempID == "" {
+		return
+	}
+	u.mu.Lock()
+	delete(u.pending, tempID)
+	u.mu.Unlock()
+}
+
+func (u *user) close() {
+	u.stopping.Store(true)
+	u.writeMu.Lock()
+	u.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	u.writeMu.Unlock()
+	u.conn.Close()
+}
+
+// outstanding counts messages sent but not yet echoed back
+func outstanding(users []*user) int {
+	total := 0
+	for _, u := range users {
+		u.mu.Lock()
+		total += len(u.pending)
+		u.mu.Unlock()
+	}
+	return total
+}
+
+// progress prints throughput every interval until stop is closed
+func progress(st *stats, interval time.Duration, started time.Time, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lastSent, lastDelivered int64
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		sent, delivered := st.sent.Load(), st.delivered.Load()
+		seconds := interval.Seconds()
+		fmt.Printf("[%5.0fs] %d connected, %.1f msg/s sent, %.1f msg/s delivered, %d errors\n",
+			time.Since(started).Seconds(), st.connected.Load(),
+			float64(sent-lastSent)/seconds, float64(delivered-lastDelivered)/seconds, st.errorCount())
+		lastSent, lastDelivered = sent, delivered
+	}
+}
+
+func report(st *stats, opts options, users int, elapsed time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sent := st.sent.Load()
+	seconds := elapsed.Seconds()
+	fmt.Println()
+	fmt.Printf("Users:       %d of %d connected\n", users, opts.users)
+	fmt.Printf("Duration:    %v\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("Messages:    %d sent (%.1f/s), %d accepted, %d delivered (%.1f/s)\n",
+		sent, float64(sent)/seconds, st.accepted.Load(), st.delivered.Load(), float64(st.delivered.Load())/seconds)
+	fmt.Printf("Typing:      %d sent\n", st.typing.Load())
+	fmt.Println()
+	fmt.Println("Latency      p50        p90        p99        max")
+	printLatencies("accepted", st.acceptLat)
+	printLatencies("delivered", st.deliveLat)
+	fmt.Println()
+
+	errorCount := 0
+	for _, n := range st.errors {
+		errorCount += n
+	}
+	attempts := sent + int64(st.errors["write"])
+	rate := 0.0
+	if attempts > 0 {
+		rate = float64(errorCount) / float64(attempts) * 100
+	}
+	fmt.Printf("Errors:      %d (%.2f%% of sends)\n", errorCount, rate)
+	kinds := make([]string, 0, len(st.errors))
+	for kind := range st.errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Printf("  %-24s %d\n", kind, st.errors[kind])
+	}
+	if errorCount > 0 {
+		os.Exit(1)
+	}
+}
+
+func printLatencies(name string, latencies []time.Duration) {
+	if len(latencies) == 0 {
+		fmt.Printf("%-12s (none)\n", name)
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	fmt.Printf("%-12s %-10v %-10v %-10v %v\n", name,
+		percentile(latencies, 0.50), percentile(latencies, 0.90), percentile(latencies, 0.99), percentile(latencies, 1))
+}
+
+// percentile returns the p-th percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted))*p+0.999999) - 1
+	return sorted[max(i, 0)].Round(10 * time.Microsecond)
+}
+
+func describeErrors(st *stats) string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	parts := make([]string, 0, len(st.errors))
+	for kind, n := range st.errors {
+		parts = append(parts, fmt.Sprintf("%s: %d", kind, n))
+	}
+	sort.Strings(parts)
+	return "errors " + strings.Join(parts, ", ")
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"log"
 	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"whatsdown/internal/server"
 )
@@ -14,24 +19,281 @@ import (
 var webFiles embed.FS
 
 func main() {
+	cfg := server.LoadConfig()
+	server.ConfigureSessions(cfg)
+
+	if cfg.MaxFrameBytes <= 0 {
+		log.Fatal("Invalid size limit configuration: WHATSDOWN_MAX_FRAME_BYTES must be positive")
+	}
+	if cfg.MaxConversationMessages < 0 || cfg.MaxHistoryBytes < 0 {
+		log.Fatal("Invalid history configuration: WHATSDOWN_MAX_CONVERSATION_MESSAGES and WHATSDOWN_MAX_HISTORY_BYTES must not be negative")
+	}
+	if cfg.ResumeWindow > 0 && cfg.ResumeBuffer <= 0 {
+		log.Fatal("Invalid resume configuration: WHATSDOWN_RESUME_BUFFER must be positive")
+	}
+	if !server.ValidCompression(cfg.Compression, cfg.CompressionThreshold, cfg.CompressionLevel) {
+		log.Fatal("Invalid compression configuration: WHATSDOWN_WS_COMPRESSION must be off, on or threshold, WHATSDOWN_WS_COMPRESSION_THRESHOLD non-negative and WHATSDOWN_WS_COMPRESSION_LEVEL between 1 and 9")
+	}
+	if cfg.PingInterval <= 0 || cfg.PongTimeout <= cfg.PingInterval || cfg.MaxPingInterval < cfg.PingInterval || cfg.WriteTimeout <= 0 {
+		log.Fatal("Invalid heartbeat configuration: WHATSDOWN_WS_PONG_TIMEOUT must exceed a positive WHATSDOWN_WS_PING_INTERVAL, WHATSDOWN_WS_MAX_PING_INTERVAL be at least the ping interval and WHATSDOWN_WS_WRITE_TIMEOUT positive")
+	}
+	if !server.ValidSlowClientPolicy(cfg.SlowClientPolicy) || cfg.SlowClientBuffer <= 0 {
+		log.Fatal("Invalid slow client configuration: WHATSDOWN_SLOW_CLIENT_POLICY must be disconnect, grow, drop_oldest or spill and WHATSDOWN_SLOW_CLIENT_BUFFER positive")
+	}
+	if cfg.DeliveryWorkers < 0 {
+		log.Fatal("Invalid delivery configuration: WHATSDOWN_DELIVERY_WORKERS must not be negative")
+	}
+	if cfg.MaxConnections < 0 || cfg.MaxConnectionsPerIP < 0 || cfg.MaxUsers < 0 {
+		log.Fatal("Invalid capacity configuration: WHATSDOWN_MAX_CONNECTIONS, WHATSDOWN_MAX_CONNECTIONS_PER_IP and WHATSDOWN_MAX_USERS must not be negative")
+	}
+	if cfg.ShutdownTimeout <= 0 || cfg.ReconnectAfter < 0 {
+		log.Fatal("Invalid shutdown configuration: WHATSDOWN_SHUTDOWN_TIMEOUT must be positive and WHATSDOWN_RECONNECT_AFTER not negative")
+	}
+	if cfg.PollTimeout <= 0 {
+		log.Fatal("Invalid long-poll configuration: WHATSDOWN_POLL_TIMEOUT must be positive")
+	}
+	if cfg.MediaURLTTL <= 0 {
+		log.Fatal("Invalid media URL configuration: WHATSDOWN_MEDIA_URL_TTL must be positive")
+	}
+	if cfg.WSTicketTTL <= 0 {
+		log.Fatal("Invalid WebSocket ticket configuration: WHATSDOWN_WS_TICKET_TTL must be positive")
+	}
+	if len(cfg.Admins) > 0 && cfg.AdminToken == "" {
+		log.Println("WHATSDOWN_ADMINS is set without WHATSDOWN_ADMIN_TOKEN; admin endpoints are disabled")
+	}
+
+	ipFilter, err := server.NewIPFilter(cfg.IPAllowlist, cfg.IPDenylist)
+	if err != nil {
+		log.Fatal("Invalid IP filter configuration:", err)
+	}
+
+	audit, err := server.NewAuditLog(cfg.AuditLogPath)
+	if err != nil {
+		log.Fatal("Failed to open audit log:", err)
+	}
+	audit.Limit = cfg.AuditEventLimit
+
+	sanitizer, err := server.NewSanitizerPipeline(cfg.MessageSanitizers)
+	if err != nil {
+		log.Fatal("Invalid sanitizer configuration:", err)
+	}
+
+	filters, err := server.NewFilterPipeline(cfg)
+	if err != nil {
+		log.Fatal("Invalid message filter configuration:", err)
+	}
+
+	scheduler, err := server.NewScheduler(cfg.ScheduledMessagesPath)
+	if err != nil {
+		log.Fatal("Failed to load scheduled messages:", err)
+	}
+
+	media, err := server.NewMediaStore(cfg.MediaDir)
+	if err != nil {
+		log.Fatal("Failed to open media directory:", err)
+	}
+	if cfg.FFmpegPath != "" {
+		if path, err := exec.LookPath(cfg.FFmpegPath); err == nil {
+			media.FFmpegPath = path
+		} else {
+			log.Printf("ffmpeg not found (%v); videos will have no poster frames", err)
+		}
+	}
+	media.StartThumbnailer(cfg.ThumbnailWorkers)
+
+	var pushProviders []server.PushProvider
+	if cfg.FCMCredentialsFile != "" {
+		fcm, err := server.NewFCMProvider(cfg.FCMCredentialsFile)
+		if err != nil {
+			log.Fatal("Invalid FCM configuration:", err)
+		}
+		pushProviders = append(pushProviders, fcm)
+	}
+	if cfg.APNsEnabled() {
+		apns, err := server.NewAPNsProvider(cfg.APNsKeyFile, cfg.APNsKeyID, cfg.APNsTeamID, cfg.APNsTopic, cfg.APNsSandbox)
+		if err != nil {
+			log.Fatal("Invalid APNs configuration:", err)
+		}
+		pushProviders = append(pushProviders, apns)
+	}
+	var webPush *server.WebPushProvider
+	if cfg.VAPIDSubject != "" {
+		webPush, err = server.NewWebPushProvider(cfg.VAPIDSubject, cfg.VAPIDPrivateKey, cfg.WebPushHosts)
+		if err != nil {
+			log.Fatal("Invalid Web Push configuration:", err)
+		}
+		pushProviders = append(pushProviders, webPush)
+	}
+
 	hub := server.NewHub()
+	hub.Sanitizer = sanitizer
+	hub.Filters = filters
+	hub.MaxPinnedMessages = cfg.MaxPinnedMessages
+	hub.UrgentPerHour = cfg.UrgentPerHour
+	hub.DuplicateRecipientLimit = cfg.DuplicateRecipientLimit
+	hub.DuplicateWindow = cfg.DuplicateWindow
+	hub.MaxFrameBytes = cfg.MaxFrameBytes
+	hub.MaxMessageLength = cfg.MaxMessageLength
+	hub.MaxConversationMessages = cfg.MaxConversationMessages
+	hub.MaxHistoryBytes = cfg.MaxHistoryBytes
+	hub.FrameRateLimit = cfg.FrameRateLimit
+	hub.FrameRateBurst = cfg.FrameRateBurst
+	hub.PingInterval = cfg.PingInterval
+	hub.MaxPingInterval = cfg.MaxPingInterval
+	hub.PongTimeout = cfg.PongTimeout
+	hub.WriteTimeout = cfg.WriteTimeout
+	hub.ContactsOnly = cfg.ContactsOnly
+	hub.PresenceBroadcast = cfg.PresenceBroadcast
+	hub.IdleTimeout = cfg.IdleTimeout
+	hub.ResumeWindow = cfg.ResumeWindow
+	hub.ResumeBuffer = cfg.ResumeBuffer
+	hub.Compression = cfg.Compression
+	hub.CompressionThreshold = cfg.CompressionThreshold
+	hub.CompressionLevel = cfg.CompressionLevel
+	hub.CoalesceWrites = cfg.CoalesceWrites
+	hub.ReconnectAfter = cfg.ReconnectAfter
+	hub.ReconnectGrace = cfg.ReconnectGrace
+	hub.OfflineEventLimit = cfg.OfflineEventLimit
+	hub.PollTimeout = cfg.PollTimeout
+	hub.SlowClientPolicy = cfg.SlowClientPolicy
+	hub.SlowClientBuffer = cfg.SlowClientBuffer
+	hub.SpillDir = cfg.SpillDir
+	hub.MaxConnections = cfg.MaxConnections
+	hub.MaxConnectionsPerIP = cfg.MaxConnectionsPerIP
+	hub.MaxUsers = cfg.MaxUsers
+	hub.Scheduler = scheduler
+	hub.Push = server.NewPushService(pushProviders...)
+	hub.Media = media
+	if err := hub.LoadOfflineQueues(cfg.OfflineQueueDir); err != nil {
+		log.Fatal("Failed to load offline queues:", err)
+	}
+	hub.Bot.SetWelcome(cfg.BotWelcome)
+	if cfg.TranslationURL != "" {
+		hub.Translator = server.NewHTTPTranslator(cfg.TranslationURL, cfg.TranslationAPIKey)
+	}
+	// NATS relays events if it's configured; Redis then only shares presence
+	var broker server.Broker
+	switch {
+	case cfg.NATSURL != "":
+		broker, err = server.NewNATSBroker(cfg.NATSURL, cfg.NATSPrefix)
+		if err != nil {
+			log.Fatal("Invalid NATS configuration:", err)
+		}
+	case cfg.RedisURL != "":
+		broker, err = server.NewRedisBroker(cfg.RedisURL, cfg.RedisPrefix)
+		if err != nil {
+			log.Fatal("Invalid Redis configuration:", err)
+		}
+	}
+	if broker != nil {
+		if err := hub.UseBroker(broker); err != nil {
+			log.Fatal("Broker subscribe failed:", err)
+		}
+		defer broker.Close()
+	}
+	if cfg.RedisURL != "" {
+		if cfg.PresenceHeartbeat <= 0 {
+			log.Fatal("Invalid presence configuration: WHATSDOWN_PRESENCE_HEARTBEAT must be positive")
+		}
+		presence, err := server.NewRedisPresenceStore(cfg.RedisURL, cfg.RedisPrefix)
+		if err != nil {
+			log.Fatal("Invalid Redis configuration:", err)
+		}
+		hub.StartPresenceSync(presence, cfg.PresenceHeartbeat)
+		defer presence.Close()
+	}
+	if len(cfg.KafkaBrokers) > 0 {
+		firehose, err := server.NewKafkaProducer(cfg.KafkaBrokers, cfg.KafkaTopic)
+		if err != nil {
+			log.Fatal("Invalid Kafka configuration:", err)
+		}
+		hub.Firehose = firehose
+		defer firehose.Close()
+	}
+	hub.StartDelivery(cfg.DeliveryWorkers)
 	go hub.Run()
+	hub.StartScheduler()
+	hub.StartIdleDetector()
 
-	handlers := &server.HTTPHandlers{Hub: hub}
+	handlers := &server.HTTPHandlers{
+		Hub:        hub,
+		Config:     cfg,
+		IPFilter:   ipFilter,
+		Audit:      audit,
+		Keys:       server.NewKeyStore(),
+		Moderation: server.NewModerationQueue(),
+		WebPush:    webPush,
+		MediaURLs:  server.NewMediaSigner(cfg.MediaURLSecret, cfg.MediaURLTTL, cfg.MediaURLBaseURL),
+		WSTickets:  server.NewTicketSigner(cfg.WSTicketSecret, cfg.WSTicketTTL),
+	}
+
+	api := http.NewServeMux()
 
 	// API routes
-	http.HandleFunc("/api/login", handlers.HandleLogin)
-	http.HandleFunc("/api/logout", handlers.HandleLogout)
-	http.HandleFunc("/api/me", handlers.HandleMe)
-	http.HandleFunc("/api/users", handlers.HandleSearchUsers)
-	http.HandleFunc("/api/conversations", handlers.HandleGetConversations)
-	http.HandleFunc("/api/conversations/", handlers.HandleGetConversation)
-
-	// WebSocket endpoint
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+	api.HandleFunc("/api/login", handlers.HandleLogin)
+	api.HandleFunc("/api/logout", handlers.HandleLogout)
+	api.HandleFunc("/api/me", handlers.HandleMe)
+	api.HandleFunc("/api/me/status", handlers.HandleMyStatus)
+	api.HandleFunc("/api/me/privacy", handlers.HandlePresencePrivacy)
+	api.HandleFunc("/api/me/devices", handlers.HandleDevices)
+	api.HandleFunc("/api/me/devices/", handlers.HandleDevice)
+	api.HandleFunc("/api/me/profile", handlers.HandleMyProfile)
+	api.HandleFunc("/api/me/nicknames", handlers.HandleNicknames)
+	api.HandleFunc("/api/users", handlers.HandleSearchUsers)
+	api.HandleFunc("/api/users/", handlers.HandleUser)
+	api.HandleFunc("/api/contacts", handlers.HandleContacts)
+	api.HandleFunc("/api/contacts/", handlers.HandleContact)
+	api.HandleFunc("/api/conversations", handlers.HandleGetConversations)
+	api.HandleFunc("/api/conversations/", handlers.HandleGetConversation)
+	api.HandleFunc("/api/sessions", handlers.HandleSessions)
+	api.HandleFunc("/api/sessions/", handlers.HandleSession)
+	api.HandleFunc("/api/sessions/refresh", handlers.HandleRefreshSession)
+	api.HandleFunc("/api/messages/", handlers.HandleMessage)
+	api.HandleFunc("/api/starred", handlers.HandleStarred)
+	api.HandleFunc("/api/scheduled", handlers.HandleScheduled)
+	api.HandleFunc("/api/scheduled/", handlers.HandleScheduledMessage)
+	api.HandleFunc("/api/groups", handlers.HandleCreateGroup)
+	api.HandleFunc("/api/groups/", handlers.HandleGroup)
+	api.HandleFunc("/api/channels", handlers.HandleChannels)
+	api.HandleFunc("/api/channels/", handlers.HandleChannel)
+	api.HandleFunc("/api/keys", handlers.HandleKeys)
+	api.HandleFunc("/api/keys/", handlers.HandleKeyBundle)
+	api.HandleFunc("/api/media", handlers.HandleUploadMedia)
+	api.HandleFunc("/api/media/", handlers.HandleMedia)
+	api.HandleFunc("/api/uploads", handlers.HandleUploads)
+	api.HandleFunc("/api/stickers", handlers.HandleStickers)
+	api.HandleFunc("/api/translation", handlers.HandleTranslation)
+	api.HandleFunc("/api/push/devices", handlers.HandlePushDevices)
+	api.HandleFunc("/api/push/devices/", handlers.HandlePushDevice)
+	api.HandleFunc("/api/push/preferences", handlers.HandlePushPreferences)
+	api.HandleFunc("/api/push/webpush", handlers.HandleWebPush)
+
+	// Admin routes
+	api.HandleFunc("/api/admin/bans", handlers.HandleBans)
+	api.HandleFunc("/api/admin/audit", handlers.HandleAudit)
+	api.HandleFunc("/api/admin/metrics", handlers.HandleMetrics)
+	api.HandleFunc("/api/admin/reports", handlers.HandleReports)
+	api.HandleFunc("/api/admin/reports/", handlers.HandleReport)
+	api.HandleFunc("/api/admin/stickers", handlers.HandleAdminStickers)
+	api.HandleFunc("/api/admin/stickers/", handlers.HandleAdminStickerPack)
+
+	// WebSocket endpoint, and tickets for clients that can't send the cookie
+	api.HandleFunc("/api/ws-ticket", handlers.HandleWSTicket)
+	api.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		handlers.HandleWebSocket(hub, w, r)
 	})
 
+	// Long-polling fallback for clients that can't hold a WebSocket open
+	api.HandleFunc("/api/poll", handlers.HandlePoll)
+	api.HandleFunc("/api/poll/send", handlers.HandlePollSend)
+
+	// IP filtering runs before any auth checks
+	http.Handle("/api/", ipFilter.Middleware(api))
+	http.Handle("/ws", ipFilter.Middleware(api))
+
+	// Signed media downloads, which need no session and may sit behind a CDN
+	http.Handle("/media/", ipFilter.Middleware(http.HandlerFunc(handlers.HandleSignedMedia)))
+
 	// Serve static files (SPA)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Path
@@ -74,8 +336,40 @@ func main() {
 		w.Write(data)
 	})
 
-	log.Println("Server starting on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	// Security headers apply to both the SPA and the API
+	handler := server.SecurityHeaders(cfg, http.DefaultServeMux)
+
+	srv := &http.Server{Addr: ":8080", Handler: handler}
+
+	// On SIGTERM or interrupt, drain WebSocket connections, then let
+	// in-flight requests finish before exiting
+	stopped := make(chan struct{})
+	go func() {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+		defer stop()
+		<-ctx.Done()
+
+		log.Println("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		hub.Shutdown(shutdownCtx)
+		hub.StopPresenceSync()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Println("HTTP shutdown:", err)
+		}
+		close(stopped)
+	}()
+
+	if cfg.TLSEnabled() {
+		log.Println("Server starting on :8080 (TLS)")
+		err = srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+	} else {
+		log.Println("Server starting on :8080")
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
 		log.Fatal("Server failed to start:", err)
 	}
+	<-stopped
+	log.Println("Server stopped")
 }
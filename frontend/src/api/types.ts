@@ -3,6 +3,13 @@ export interface User {
   online: boolean;
 }
 
+export interface MessageEntity {
+  type: 'bold' | 'italic' | 'code' | 'link';
+  offset: number; // In Unicode code points
+  length: number;
+  url?: string;
+}
+
 export interface Message {
   id: string;
   from: string;
@@ -10,6 +17,8 @@ export interface Message {
   content: string;
   timestamp: string;
   status: 'sent' | 'delivered';
+  entities?: MessageEntity[];
+  tempId?: string; // Sender's copy only
 }
 
 export interface Conversation {
@@ -32,6 +41,8 @@ export interface OutboundMessage {
   content: string;
   timestamp: string;
   status: 'sent' | 'delivered';
+  entities?: MessageEntity[];
+  tempId?: string;
 }
 
 export interface TypingEvent {
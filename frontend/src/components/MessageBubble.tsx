@@ -1,4 +1,5 @@
-import { Message } from '../api/types';
+import { ReactNode } from 'react';
+import { Message, MessageEntity } from '../api/types';
 import { useApp } from '../store/AppContext';
 import { format } from 'date-fns';
 
@@ -6,6 +7,53 @@ interface MessageBubbleProps {
   message: Message;
 }
 
+// Renders content with its formatting entities. The server strips the
+// markers, so the entities are the only record of them. Offsets count code
+// points; an entity overlapping an earlier one (a link inside bold text) is
+// shown unformatted.
+function renderContent(content: string, entities: MessageEntity[] = []): ReactNode[] {
+  const chars = Array.from(content);
+  const sorted = [...entities].sort((a, b) => a.offset - b.offset);
+  const parts: ReactNode[] = [];
+  let pos = 0;
+
+  for (const [i, entity] of sorted.entries()) {
+    const end = entity.offset + entity.length;
+    if (entity.offset < pos || end > chars.length) {
+      continue;
+    }
+    if (entity.offset > pos) {
+      parts.push(chars.slice(pos, entity.offset).join(''));
+    }
+    const text = chars.slice(entity.offset, end).join('');
+    switch (entity.type) {
+      case 'bold':
+        parts.push(<strong key={i}>{text}</strong>);
+        break;
+      case 'italic':
+        parts.push(<em key={i}>{text}</em>);
+        break;
+      case 'code':
+        parts.push(<code key={i} className="font-mono">{text}</code>);
+        break;
+      case 'link':
+        parts.push(
+          <a key={i} href={entity.url} target="_blank" rel="noopener noreferrer" className="underline">
+            {text}
+          </a>
+        );
+        break;
+      default:
+        parts.push(text);
+    }
+    pos = end;
+  }
+  if (pos < chars.length) {
+    parts.push(chars.slice(pos).join(''));
+  }
+  return parts;
+}
+
 export default function MessageBubble({ message }: MessageBubbleProps) {
   const { currentUser } = useApp();
   const isOwn = message.from === currentUser?.username;
@@ -27,7 +75,9 @@ export default function MessageBubble({ message }: MessageBubbleProps) {
             : 'bg-white text-gray-900 border border-gray-200 rounded-bl-none'
         }`}
       >
-        <p className="text-sm break-words">{message.content}</p>
+        <p className="text-sm break-words">
+          {renderContent(message.content, message.entities)}
+        </p>
         <div className={`flex items-center justify-end mt-1 space-x-2 ${
           isOwn ? 'text-primary-100' : 'text-gray-500'
         }`}>
@@ -52,12 +52,14 @@ export function AppProvider({ children }: { children: ReactNode }) {
         console.log('Message already exists, skipping:', message.id);
         return prev;
       }
-      // If this is a message we sent, check if there's a temp message with same content to replace
+      // If this is a message we sent, replace its temp message. The server strips
+      // formatting markers, so match on the echoed tempId rather than content.
       if (message.from === currentUser?.username) {
-        const tempIndex = existing.findIndex(m => 
-          m.id.startsWith('temp-') && 
-          m.content === message.content &&
-          Math.abs(new Date(m.timestamp).getTime() - new Date(message.timestamp).getTime()) < 5000
+        const tempIndex = existing.findIndex(m =>
+          m.id.startsWith('temp-') && (message.tempId ? m.id === message.tempId : (
+            m.content === message.content &&
+            Math.abs(new Date(m.timestamp).getTime() - new Date(message.timestamp).getTime()) < 5000
+          ))
         );
         if (tempIndex >= 0) {
           // Replace temp message with real one
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"sort"
 	"strings"
 	"time"
@@ -8,10 +9,18 @@ import (
 
 // User represents a user in the system
 type User struct {
-	Username    string
-	Online      bool
-	CurrentConn interface{} // *Client from server package
-	LastSeen    time.Time
+	Username string
+	Online   bool // true while any of the user's devices is connected
+	LastSeen time.Time
+
+	// Connected but idle on every device
+	Away bool
+
+	// The viewer's private nickname for the user; only set on per-viewer copies
+	Nickname string
+
+	// Custom status such as "In a meeting"; empty when unset
+	StatusText string
 }
 
 // Message represents a chat message
@@ -21,45 +30,842 @@ type Message struct {
 	To        string    `json:"to"`
 	Content   string    `json:"content"`
 	Timestamp time.Time `json:"timestamp"`
-	Status    string    `json:"status"` // "sent", "delivered"
+	Status    string    `json:"status"` // "sent", "delivered", "read"
+
+	// Position in the conversation, starting at 1 with no gaps
+	Seq int64 `json:"seq"`
+
+	// Sender's display name when the message was sent; empty if they had none
+	FromName string `json:"fromName,omitempty"`
+
+	// Set for end-to-end encrypted messages, in which case Content is empty
+	Encrypted *EncryptedPayload `json:"encrypted,omitempty"`
+
+	// Set for group messages, in which case To is empty
+	GroupID string `json:"groupId,omitempty"`
+
+	// Set for channel posts, in which case To is empty
+	ChannelID string `json:"channelId,omitempty"`
+
+	// Deleted marks a message tombstoned for everyone; its content is cleared
+	Deleted bool `json:"deleted,omitempty"`
+
+	// Users who deleted the message for themselves only
+	HiddenFor []string `json:"-"`
+
+	// Reactions: emoji -> usernames who reacted with it. Each user has at most one reaction.
+	Reactions map[string][]string `json:"reactions,omitempty"`
+
+	// Set when the message replies to an earlier one in the same conversation
+	ReplyTo *QuotedMessage `json:"replyTo,omitempty"`
+
+	// Set on thread replies to the ID of the thread's root message
+	ThreadID string `json:"threadId,omitempty"`
+
+	// Set on thread roots
+	ThreadReplies     int        `json:"threadReplies,omitempty"`
+	ThreadLastReplyAt *time.Time `json:"threadLastReplyAt,omitempty"`
+
+	// Group members who have read the message; a group message is "read" once all have
+	ReadBy []string `json:"readBy,omitempty"`
+
+	// Translations fetched for recipients, by target language; nil entries
+	// mean none was needed
+	Translations map[string]*Translation `json:"-"`
+
+	// Set on urgent messages, which alert recipients despite mutes and disabled notifications
+	Urgent bool `json:"urgent,omitempty"`
+
+	// Devices the message reached; it is "delivered" once any recipient device has it
+	Deliveries []*Delivery `json:"-"`
+
+	// Group members mentioned with @username
+	Mentions []string `json:"mentions,omitempty"`
+
+	// Formatted ranges of Content; formatting markers are stripped on ingest
+	Entities []MessageEntity `json:"entities,omitempty"`
+
+	// Set for polls, in which case Content is the question
+	Poll *Poll `json:"poll,omitempty"`
+
+	// Set for shared locations
+	Location *Location `json:"location,omitempty"`
+
+	// Set for shared contact cards
+	Contact *ContactCard `json:"contact,omitempty"`
+
+	// Set for voice notes
+	Voice *VoiceNote `json:"voice,omitempty"`
+
+	// Set for stickers and custom emoji sent on their own
+	Sticker *Sticker `json:"sticker,omitempty"`
+
+	// Uploaded files sent with the message
+	Attachments []*Attachment `json:"attachments,omitempty"`
+
+	// Client-generated ID the sender used, echoed back only to them
+	TempID string `json:"-"`
+
+	// Set once a disappearing message's timer starts, and when it has run out
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Expired   bool       `json:"-"`
+}
+
+// Supported formatting entity types
+const (
+	EntityBold   = "bold"   // *text*
+	EntityItalic = "italic" // _text_
+	EntityCode   = "code"   // `text`
+	EntityLink   = "link"   // http(s) URLs, detected automatically
+)
+
+// MessageEntity marks a formatted range of message content. Offset and Length
+// count Unicode code points.
+type MessageEntity struct {
+	Type   string `json:"type"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+	URL    string `json:"url,omitempty"`
+}
+
+// QuotedMessage is the excerpt of a replied-to message shown above a reply
+type QuotedMessage struct {
+	ID      string `json:"id"`
+	From    string `json:"from"`
+	Snippet string `json:"snippet"`
+
+	// Set once the quoted message is deleted or disappears, when the
+	// snippet is cleared too
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// Maximum length of a quoted snippet in runes
+const quoteSnippetRunes = 100
+
+// Quote returns an excerpt of the message for use in replies
+func (m *Message) Quote() *QuotedMessage {
+	snippet := []rune(m.Preview())
+	if len(snippet) > quoteSnippetRunes {
+		snippet = append(snippet[:quoteSnippetRunes], '…')
+	}
+	return &QuotedMessage{
+		ID:      m.ID,
+		From:    m.From,
+		Snippet: string(snippet),
+	}
+}
+
+// Snapshot returns a copy of the message safe to use outside the hub lock
+func (m *Message) Snapshot() *Message {
+	snapshot := *m
+	snapshot.HiddenFor = append([]string(nil), m.HiddenFor...)
+	snapshot.ReadBy = append([]string(nil), m.ReadBy...)
+	snapshot.Deliveries = append([]*Delivery(nil), m.Deliveries...)
+	snapshot.Mentions = append([]string(nil), m.Mentions...)
+	snapshot.Entities = append([]MessageEntity(nil), m.Entities...)
+	if m.Poll != nil {
+		snapshot.Poll = m.Poll.Snapshot()
+	}
+	if m.Location != nil {
+		location := *m.Location
+		snapshot.Location = &location
+	}
+	if m.Reactions != nil {
+		snapshot.Reactions = make(map[string][]string, len(m.Reactions))
+		for emoji, usernames := range m.Reactions {
+			snapshot.Reactions[emoji] = append([]string(nil), usernames...)
+		}
+	}
+	return &snapshot
+}
+
+// React sets username's reaction to emoji, replacing any previous one. An
+// empty emoji removes the reaction.
+func (m *Message) React(username, emoji string) {
+	for existing, usernames := range m.Reactions {
+		usernames = removeString(usernames, username)
+		if len(usernames) == 0 {
+			delete(m.Reactions, existing)
+		} else {
+			m.Reactions[existing] = usernames
+		}
+	}
+	if emoji == "" {
+		return
+	}
+	if m.Reactions == nil {
+		m.Reactions = make(map[string][]string)
+	}
+	m.Reactions[emoji] = append(m.Reactions[emoji], username)
+}
+
+// ConvKey returns the key of the conversation the message belongs to
+func (m *Message) ConvKey() string {
+	switch {
+	case m.GroupID != "":
+		return GroupConvKey(m.GroupID)
+	case m.ChannelID != "":
+		return ChannelConvKey(m.ChannelID)
+	default:
+		return ConvKey(m.From, m.To)
+	}
+}
+
+// HiddenFrom reports whether username deleted the message for themselves, or
+// it has disappeared for everyone
+func (m *Message) HiddenFrom(username string) bool {
+	return m.Expired || containsString(m.HiddenFor, username)
+}
+
+// Preview returns a short description of the message for conversation lists
+func (m *Message) Preview() string {
+	switch {
+	case m.Deleted:
+		return "This message was deleted"
+	case m.Encrypted != nil:
+		return "Encrypted message"
+	case m.Poll != nil:
+		return "Poll: " + m.Content
+	case m.Location != nil && m.Location.Label != "":
+		return "Location: " + m.Location.Label
+	case m.Location != nil:
+		return "Location"
+	case m.Contact != nil && m.Contact.DisplayName != "":
+		return "Contact: " + m.Contact.DisplayName
+	case m.Contact != nil:
+		return "Contact: " + m.Contact.Username
+	case m.Voice != nil:
+		return "Voice message"
+	case m.Sticker != nil:
+		return "Sticker :" + m.Sticker.Shortcode + ":"
+	case len(m.Attachments) > 0 && m.Content == "":
+		return "Attachment: " + m.Attachments[0].Name
+	default:
+		return m.Content
+	}
+}
+
+// Poll is a question with options members vote on. Each voter appears in at
+// most one option unless MultipleChoice is set.
+type Poll struct {
+	Options        []*PollOption `json:"options"`
+	MultipleChoice bool          `json:"multipleChoice"`
+}
+
+// PollOption is one answer to a poll and who chose it
+type PollOption struct {
+	Text   string   `json:"text"`
+	Voters []string `json:"voters"`
+}
+
+// Vote replaces username's choices with the given option indexes; an empty
+// list withdraws their vote. It reports false, changing nothing, for invalid
+// choices.
+func (p *Poll) Vote(username string, options []int) bool {
+	if len(options) > 1 && !p.MultipleChoice {
+		return false
+	}
+	chosen := make(map[int]bool, len(options))
+	for _, i := range options {
+		if i < 0 || i >= len(p.Options) || chosen[i] {
+			return false
+		}
+		chosen[i] = true
+	}
+
+	for i, option := range p.Options {
+		option.Voters = removeString(option.Voters, username)
+		if chosen[i] {
+			option.Voters = append(option.Voters, username)
+		}
+	}
+	return true
+}
+
+// Snapshot returns a copy of the poll safe to use outside the hub lock
+func (p *Poll) Snapshot() *Poll {
+	snapshot := &Poll{MultipleChoice: p.MultipleChoice}
+	for _, option := range p.Options {
+		snapshot.Options = append(snapshot.Options, &PollOption{
+			Text:   option.Text,
+			Voters: append([]string{}, option.Voters...),
+		})
+	}
+	return snapshot
+}
+
+// Location is a shared place. While Live, the sender streams position
+// updates until LiveUntil.
+type Location struct {
+	Latitude  float64    `json:"latitude"`
+	Longitude float64    `json:"longitude"`
+	Label     string     `json:"label,omitempty"`
+	Live      bool       `json:"live,omitempty"`
+	LiveUntil *time.Time `json:"liveUntil,omitempty"`
+}
+
+// ContactCard shares another user's details
+type ContactCard struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName,omitempty"`
+	AvatarURL   string `json:"avatarUrl,omitempty"`
+}
+
+// Message kinds, telling clients how to render a message
+const (
+	KindText       = "text"
+	KindPoll       = "poll"
+	KindLocation   = "location"
+	KindContact    = "contact"
+	KindVoice      = "voice"
+	KindSticker    = "sticker"
+	KindAttachment = "attachment"
+)
+
+// Kind returns how the message should be rendered
+func (m *Message) Kind() string {
+	switch {
+	case m.Poll != nil:
+		return KindPoll
+	case m.Location != nil:
+		return KindLocation
+	case m.Contact != nil:
+		return KindContact
+	case m.Voice != nil:
+		return KindVoice
+	case m.Sticker != nil:
+		return KindSticker
+	case len(m.Attachments) > 0:
+		return KindAttachment
+	default:
+		return KindText
+	}
+}
+
+// Translation is message content machine-translated for a recipient
+type Translation struct {
+	Language       string `json:"language"`
+	SourceLanguage string `json:"sourceLanguage,omitempty"`
+	Text           string `json:"text"`
+}
+
+// VoiceNote is a recorded audio message
+type VoiceNote struct {
+	MediaID  string  `json:"mediaId"`
+	URL      string  `json:"url"`
+	Duration float64 `json:"duration"` // Seconds
+	Peaks    []int   `json:"peaks"`    // Waveform bar heights, 0-100
+}
+
+// Sticker is an image in a sticker or custom emoji pack
+type Sticker struct {
+	ID        string `json:"id"`
+	PackID    string `json:"packId"`
+	Shortcode string `json:"shortcode"`
+	MediaID   string `json:"mediaId"`
+	URL       string `json:"url"`
+}
+
+// StickerPack is an admin-managed set of stickers or custom emoji
+type StickerPack struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Kind      string     `json:"kind"` // "sticker" or "emoji"
+	Stickers  []*Sticker `json:"stickers"`
+	CreatedBy string     `json:"createdBy"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// Snapshot returns a copy of the pack safe to use outside the store lock
+func (p *StickerPack) Snapshot() *StickerPack {
+	snapshot := *p
+	snapshot.Stickers = make([]*Sticker, len(p.Stickers))
+	for i, sticker := range p.Stickers {
+		copied := *sticker
+		snapshot.Stickers[i] = &copied
+	}
+	return &snapshot
+}
+
+// Attachment is an uploaded file sent with a message
+type Attachment struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	Type        string `json:"type"` // "image", "audio", "video" or "file"
+	URL         string `json:"url"`
+
+	// Thumbnail URLs by size ("small", "medium"), for images
+	Thumbnails map[string]string `json:"thumbnails,omitempty"`
+
+	// Audio and video metadata, when the server could read it
+	Codec    string  `json:"codec,omitempty"`
+	Duration float64 `json:"duration,omitempty"` // Seconds
+	Width    int     `json:"width,omitempty"`
+	Height   int     `json:"height,omitempty"`
+	Poster   string  `json:"poster,omitempty"` // first frame URL, for videos
+}
+
+// GalleryItem is one attachment, voice note or link shared in a conversation
+type GalleryItem struct {
+	MessageID string    `json:"messageId"`
+	Seq       int64     `json:"seq"`
+	From      string    `json:"from"`
+	Timestamp time.Time `json:"timestamp"`
+
+	// An attachment type ("image", "video", "audio", "file") or "link"
+	Type       string      `json:"type"`
+	Attachment *Attachment `json:"attachment,omitempty"`
+	Voice      *VoiceNote  `json:"voice,omitempty"`
+	URL        string      `json:"url,omitempty"` // for links
+}
+
+// MediaGallery is a page of a conversation's shared media, newest first
+type MediaGallery struct {
+	Items []*GalleryItem `json:"items"`
+
+	// Pass as beforeSeq to fetch the next page; 0 on the last page
+	NextBeforeSeq int64 `json:"nextBeforeSeq,omitempty"`
+}
+
+// SignedMedia holds expiring URLs for media that need no session to fetch
+type SignedMedia struct {
+	URL        string            `json:"url"`
+	Thumbnails map[string]string `json:"thumbnails,omitempty"`
+	Poster     string            `json:"poster,omitempty"`
+	ExpiresAt  time.Time         `json:"expiresAt"`
+}
+
+// Media is an uploaded file. MessageIDs lists the messages referencing it;
+// their participants may download it.
+type Media struct {
+	ID          string    `json:"id"`
+	Owner       string    `json:"owner"`
+	Kind        string    `json:"kind"`
+	Name        string    `json:"name,omitempty"` // original file name, for attachments
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	Codec       string    `json:"codec,omitempty"`
+	Duration    float64   `json:"duration,omitempty"` // Seconds, for audio
+	Peaks       []int     `json:"peaks,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	MessageIDs  []string  `json:"-"`
+
+	// Thumbnail sizes generated so far, for images and videos
+	Thumbnails []string `json:"thumbnails,omitempty"`
+
+	// Dimensions, for videos
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+}
+
+// Snapshot returns a copy of the media record safe to use outside the store lock
+func (m *Media) Snapshot() *Media {
+	snapshot := *m
+	snapshot.MessageIDs = append([]string(nil), m.MessageIDs...)
+	return &snapshot
+}
+
+// Group represents a multi-user conversation
+type Group struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Members   []string  `json:"members"`
+	Admins    []string  `json:"admins"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// IsMember reports whether username belongs to the group
+func (g *Group) IsMember(username string) bool {
+	return containsString(g.Members, username)
+}
+
+// IsAdmin reports whether username administers the group
+func (g *Group) IsAdmin(username string) bool {
+	return containsString(g.Admins, username)
+}
+
+// Snapshot returns a copy of the group safe to use outside the hub lock
+func (g *Group) Snapshot() *Group {
+	snapshot := *g
+	snapshot.Members = append([]string(nil), g.Members...)
+	snapshot.Admins = append([]string(nil), g.Admins...)
+	return &snapshot
 }
 
 // Session represents an HTTP session
 type Session struct {
-	Username  string
-	ExpiresAt time.Time
+	ID           string // Public identifier, safe to expose to clients
+	Username     string
+	CreatedAt    time.Time
+	LastActivity time.Time
+	ExpiresAt    time.Time // Earlier of the idle and absolute deadlines
+	IP           string
+	UserAgent    string
 }
 
-// Conversation represents a conversation between two users
+// AuditEvent represents an entry in the security audit log
+type AuditEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Username  string    `json:"username"`
+	IP        string    `json:"ip"`
+	Detail    string    `json:"detail,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Report is a user's complaint about a message, queued for moderator review.
+// Message is a snapshot taken when the report was filed.
+type Report struct {
+	ID         string     `json:"id"`
+	MessageID  string     `json:"messageId"`
+	Sender     string     `json:"sender"`
+	Reporter   string     `json:"reporter"`
+	Reason     string     `json:"reason"`
+	Message    *Message   `json:"message"`
+	Status     string     `json:"status"` // "open", "dismissed", "deleted", "sanctioned"
+	CreatedAt  time.Time  `json:"createdAt"`
+	ResolvedBy string     `json:"resolvedBy,omitempty"`
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
+}
+
+// Snapshot returns a copy of the report safe to use outside the queue lock
+func (r *Report) Snapshot() *Report {
+	snapshot := *r
+	return &snapshot
+}
+
+// Channel represents a one-to-many broadcast channel. Only the owner and
+// publishers can post; any user can subscribe.
+type Channel struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Owner       string    `json:"owner"`
+	Publishers  []string  `json:"publishers"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// CanPublish reports whether username may post to the channel
+func (c *Channel) CanPublish(username string) bool {
+	return c.Owner == username || containsString(c.Publishers, username)
+}
+
+// Snapshot returns a copy of the channel safe to use outside the hub lock
+func (c *Channel) Snapshot() *Channel {
+	snapshot := *c
+	snapshot.Publishers = append([]string(nil), c.Publishers...)
+	return &snapshot
+}
+
+// Conversation represents a conversation with a peer, a group, or a channel
 type Conversation struct {
 	PeerUsername      string    `json:"peerUsername"`
 	LastMessagePreview string   `json:"lastMessagePreview"`
 	LastMessageTime   time.Time `json:"lastMessageTime"`
 	PeerOnline        bool      `json:"peerOnline"`
 	UnreadCount       int       `json:"unreadCount"`
+
+	// Sequence number of the conversation's latest message
+	LastSeq int64 `json:"lastSeq"`
+
+	// When the peer was last online; omitted while they are
+	PeerLastSeen *time.Time `json:"peerLastSeen,omitempty"`
+
+	// Set while the peer is connected but idle
+	PeerAway bool `json:"peerAway,omitempty"`
+
+	// The user's private nickname for the peer
+	PeerNickname string `json:"peerNickname,omitempty"`
+
+	// The peer's custom status
+	PeerStatusText string `json:"peerStatusText,omitempty"`
+
+	// Set while the user has the conversation muted
+	Muted bool `json:"muted,omitempty"`
+
+	// Set while the user has the conversation archived
+	Archived bool `json:"archived,omitempty"`
+
+	// Set for group conversations, in which case PeerUsername is empty
+	GroupID   string `json:"groupId,omitempty"`
+	GroupName string `json:"groupName,omitempty"`
+
+	// Set for subscribed broadcast channels
+	ChannelID   string `json:"channelId,omitempty"`
+	ChannelName string `json:"channelName,omitempty"`
 }
 
 // WSMessage represents a WebSocket message envelope
 type WSMessage struct {
 	Type    string      `json:"type"`
+	Seq     int64       `json:"seq,omitempty"` // Position in the device's event stream
 	Payload interface{} `json:"payload"`
 }
 
-// InboundMessage represents a message from client to server
+// ReceivedEvent acknowledges every event up to Seq on the connection's stream
+type ReceivedEvent struct {
+	Seq int64 `json:"seq"`
+}
+
+// HelloEvent is the first frame on a connection, giving the negotiated
+// protocol version and heartbeat timings in seconds. The server pings every
+// PingInterval and drops a client that hasn't answered one in PongTimeout.
+type HelloEvent struct {
+	ProtocolVersion int     `json:"protocolVersion"`
+	PingInterval    float64 `json:"pingInterval"`
+	PongTimeout     float64 `json:"pongTimeout"`
+	WriteTimeout    float64 `json:"writeTimeout"`
+	MaxPingInterval float64 `json:"maxPingInterval"`
+
+	// How long the device's stream is kept for resuming after a disconnect,
+	// and how long peers keep seeing the user online meanwhile
+	ResumeWindow   float64 `json:"resumeWindow"`
+	ReconnectGrace float64 `json:"reconnectGrace"`
+}
+
+// TimeRequest asks the server for its clock. ClientTime is the client's
+// clock when sending, in Unix milliseconds, and is echoed back.
+type TimeRequest struct {
+	ClientTime int64 `json:"clientTime"`
+}
+
+// TimeEvent answers a TimeRequest with the server's clock, in Unix
+// milliseconds, when the request arrived and when the reply left. With the
+// client's clock on receipt, t3, the client's offset from the server is
+// ((ServerReceived - ClientTime) + (ServerSent - t3)) / 2.
+type TimeEvent struct {
+	ClientTime     int64 `json:"clientTime"`
+	ServerReceived int64 `json:"serverReceived"`
+	ServerSent     int64 `json:"serverSent"`
+}
+
+// ShutdownEvent warns a client the server is shutting down and its
+// connection is about to close; it should reconnect after ReconnectAfter
+// seconds
+type ShutdownEvent struct {
+	ReconnectAfter float64 `json:"reconnectAfter"`
+}
+
+// ServerMetrics reports WebSocket connections and users against their limits,
+// and how many upgrades and logins were refused for each since startup. A
+// limit of 0 means unlimited.
+type ServerMetrics struct {
+	Connections         int   `json:"connections"`
+	ConnectionAddresses int   `json:"connectionAddresses"` // Distinct client IPs connected
+	MaxConnections      int   `json:"maxConnections"`
+	MaxConnectionsPerIP int   `json:"maxConnectionsPerIp"`
+	Users               int   `json:"users"`
+	MaxUsers            int   `json:"maxUsers"`
+	RefusedConnections  int64 `json:"refusedConnections"`
+	RefusedPerIP        int64 `json:"refusedPerIp"`
+	RefusedUsers        int64 `json:"refusedUsers"`
+}
+
+// WSTicket is a single-use ticket authenticating one WebSocket upgrade with
+// ?ticket=, for clients that can't send the session cookie
+type WSTicket struct {
+	Ticket    string    `json:"ticket"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// FirehoseEvent is one record on the event firehose: a message stored, a
+// message delivered to or read by a user, or a presence change
+type FirehoseEvent struct {
+	Type      string            `json:"type"` // "message", "delivery" or "presence"
+	Timestamp time.Time         `json:"timestamp"`
+	Message   *OutboundMessage  `json:"message,omitempty"`
+	Delivery  *FirehoseDelivery `json:"delivery,omitempty"`
+	Presence  *FirehosePresence `json:"presence,omitempty"`
+}
+
+// FirehoseDelivery reports a message reaching one of a user's devices
+// ("delivered") or being read by the user ("read")
+type FirehoseDelivery struct {
+	MessageID       string `json:"messageId"`
+	ConversationKey string `json:"conversationKey"`
+	Username        string `json:"username"`
+	DeviceID        string `json:"deviceId,omitempty"`
+	Status          string `json:"status"`
+}
+
+// FirehosePresence is a user's presence after a change
+type FirehosePresence struct {
+	Username string     `json:"username"`
+	Online   bool       `json:"online"`
+	Away     bool       `json:"away"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+// PollResponse answers a long poll with the events after the cursor the
+// client sent, each encoded as it would be on a WebSocket. Cursor is the seq
+// of the last event included; pass it with the stream ID on the next poll.
+// Reset means events were lost, because the stream was replaced or the
+// client fell too far behind, and the client should refetch what it shows.
+type PollResponse struct {
+	StreamID string            `json:"streamId,omitempty"`
+	Cursor   int64             `json:"cursor"`
+	Reset    bool              `json:"reset,omitempty"`
+	Events   []json.RawMessage `json:"events"`
+
+	// Set once the server has disconnected the client, with the close code
+	// and reason a WebSocket would have been closed with
+	Closed      bool   `json:"closed,omitempty"`
+	CloseCode   int    `json:"closeCode,omitempty"`
+	CloseReason string `json:"closeReason,omitempty"`
+}
+
+// StreamEvent follows the hello event on a connection, identifying its event
+// stream and whether a requested resume succeeded
+type StreamEvent struct {
+	StreamID string `json:"streamId"`
+	Seq      int64  `json:"seq"` // Latest event before any replay
+	Resumed  bool   `json:"resumed"`
+	Replayed int    `json:"replayed,omitempty"`
+}
+
+// InboundMessage represents a message from client to server. Exactly one of
+// To, GroupID and ChannelID is set.
 type InboundMessage struct {
-	To      string `json:"to"`
-	Content string `json:"content"`
-	TempID  string `json:"tempId,omitempty"`
+	To        string `json:"to,omitempty"`
+	GroupID   string `json:"groupId,omitempty"`
+	ChannelID string `json:"channelId,omitempty"`
+	Content   string `json:"content"`
+	TempID    string `json:"tempId,omitempty"`
+	ReplyToID string `json:"replyToId,omitempty"`
+	ThreadID  string `json:"threadId,omitempty"`
+
+	// Makes the message a poll with Content as the question
+	Poll *PollRequest `json:"poll,omitempty"`
+
+	// Shares a location, optionally live
+	Location *LocationRequest `json:"location,omitempty"`
+
+	// Shares a user's contact card
+	Contact *ContactCard `json:"contact,omitempty"`
+
+	// Sends an uploaded voice note
+	Voice *VoiceRequest `json:"voice,omitempty"`
+
+	// Sends a sticker from a pack
+	Sticker *StickerRequest `json:"sticker,omitempty"`
+
+	// Sends files uploaded to /api/uploads
+	AttachmentIDs []string `json:"attachmentIds,omitempty"`
+
+	// Alerts recipients even if they muted the conversation or disabled
+	// notifications; rate-limited per sender
+	Urgent bool `json:"urgent,omitempty"`
+
+	// If in the future, the message is held until then instead of sent now
+	SendAt *time.Time `json:"sendAt,omitempty"`
+}
+
+// PollRequest creates a poll
+type PollRequest struct {
+	Options        []string `json:"options"`
+	MultipleChoice bool     `json:"multipleChoice"`
+}
+
+// LocationRequest shares a location. LiveFor (a Go duration, 15m-8h) starts
+// live sharing.
+type LocationRequest struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Label     string  `json:"label,omitempty"`
+	LiveFor   string  `json:"liveFor,omitempty"`
+}
+
+// VoiceRequest sends a voice note uploaded to /api/media
+type VoiceRequest struct {
+	MediaID string `json:"mediaId"`
+}
+
+// StickerRequest sends a sticker from GET /api/stickers
+type StickerRequest struct {
+	PackID    string `json:"packId"`
+	StickerID string `json:"stickerId"`
+}
+
+// ScheduledMessage is a message waiting for its send time
+type ScheduledMessage struct {
+	ID        string         `json:"id"`
+	From      string         `json:"from"`
+	Message   InboundMessage `json:"message"`
+	SendAt    time.Time      `json:"sendAt"`
+	CreatedAt time.Time      `json:"createdAt"`
+}
+
+// InboundEncryptedMessage represents an end-to-end encrypted message from client
+// to server. The server relays the payload without inspecting it.
+type InboundEncryptedMessage struct {
+	To     string `json:"to"`
+	TempID string `json:"tempId,omitempty"`
+	EncryptedPayload
+}
+
+// EncryptedPayload is an opaque Signal-style ciphertext
+type EncryptedPayload struct {
+	Type       int    `json:"type"`       // 1 = whisper message, 3 = prekey message
+	Ciphertext string `json:"ciphertext"` // Base64-encoded
 }
 
 // OutboundMessage represents a message from server to client
 type OutboundMessage struct {
-	ID        string `json:"id"`
-	From      string `json:"from"`
-	To        string `json:"to"`
-	Content   string `json:"content"`
-	Timestamp string `json:"timestamp"`
-	Status    string `json:"status"`
+	ID        string            `json:"id"`
+	From      string            `json:"from"`
+	FromName  string            `json:"fromName,omitempty"`
+	To        string            `json:"to"`
+	Content   string            `json:"content"`
+	Encrypted *EncryptedPayload `json:"encrypted,omitempty"`
+	GroupID   string            `json:"groupId,omitempty"`
+	ChannelID string            `json:"channelId,omitempty"`
+	Timestamp string            `json:"timestamp"`
+	Status    string            `json:"status"`
+	Seq       int64             `json:"seq"`
+	Deleted   bool              `json:"deleted,omitempty"`
+	ReplyTo   *QuotedMessage    `json:"replyTo,omitempty"`
+	ThreadID  string            `json:"threadId,omitempty"`
+	Mentions  []string          `json:"mentions,omitempty"`
+	Entities  []MessageEntity   `json:"entities,omitempty"`
+	Poll      *Poll             `json:"poll,omitempty"`
+	Location  *Location         `json:"location,omitempty"`
+	Contact   *ContactCard      `json:"contact,omitempty"`
+	Voice     *VoiceNote        `json:"voice,omitempty"`
+	Sticker   *Sticker          `json:"sticker,omitempty"`
+	Kind      string            `json:"kind"`
+	Urgent    bool              `json:"urgent,omitempty"`
+	Silent    bool              `json:"silent,omitempty"` // recipient's settings say not to alert
+	TempID    string            `json:"tempId,omitempty"` // Sender's copy only
+
+	// Content in the recipient's preferred language, when it differs
+	Translation *Translation `json:"translation,omitempty"`
+
+	// Files sent with the message
+	Attachments []*Attachment `json:"attachments,omitempty"`
+}
+
+// PreKey is a public one-time prekey
+type PreKey struct {
+	KeyID     int    `json:"keyId"`
+	PublicKey string `json:"publicKey"`
+}
+
+// SignedPreKey is a medium-term prekey signed by the identity key
+type SignedPreKey struct {
+	KeyID     int    `json:"keyId"`
+	PublicKey string `json:"publicKey"`
+	Signature string `json:"signature"`
+}
+
+// KeyBundle is what a client fetches to start an encrypted session with a user
+type KeyBundle struct {
+	Username      string        `json:"username"`
+	IdentityKey   string        `json:"identityKey"`
+	SignedPreKey  *SignedPreKey `json:"signedPreKey"`
+	OneTimePreKey *PreKey       `json:"oneTimePreKey,omitempty"`
 }
 
 // TypingEvent represents a typing indicator event
@@ -69,16 +875,350 @@ type TypingEvent struct {
 	IsTyping bool   `json:"isTyping"`
 }
 
+// PresenceSubscription names the users a connection starts or stops
+// watching the presence of
+type PresenceSubscription struct {
+	Usernames []string `json:"usernames"`
+}
+
+// ContactRequest asks To to become From's contact
+type ContactRequest struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ContactRequests lists a user's pending contact requests
+type ContactRequests struct {
+	Incoming []*ContactRequest `json:"incoming"`
+	Outgoing []*ContactRequest `json:"outgoing"`
+}
+
+// ContactEvent reports the outcome of a contact request
+type ContactEvent struct {
+	Username string `json:"username"`
+	Status   string `json:"status"` // "requested" or "accepted"
+}
+
+// Profile is how a user presents themselves to others
+type Profile struct {
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName"`
+	Bio         string `json:"bio"`
+	AvatarURL   string `json:"avatarUrl"`
+	Pronouns    string `json:"pronouns"`
+}
+
+// Device is a client a user has connected from over WebSocket
+type Device struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name,omitempty"`
+	UserAgent   string    `json:"userAgent"`
+	Platform    string    `json:"platform"`
+	Subprotocol string    `json:"subprotocol,omitempty"` // Negotiated on the device's latest WebSocket
+	ConnectedAt time.Time `json:"connectedAt"`
+	LastActive  time.Time `json:"lastActive"`
+	Online      bool      `json:"online"`
+	SessionID   string    `json:"-"` // Session the device last connected with
+}
+
+// PresencePrivacy controls who sees a user's online status, last seen and
+// profile avatar and bio. Each is "everyone", "contacts" or "nobody"; users in
+// HiddenFrom see none of them.
+type PresencePrivacy struct {
+	LastSeen   string   `json:"lastSeen"`
+	Online     string   `json:"online"`
+	Avatar     string   `json:"avatar"`
+	Bio        string   `json:"bio"`
+	HiddenFrom []string `json:"hiddenFrom"`
+}
+
 // StatusEvent represents an online/offline status event
 type StatusEvent struct {
 	Username string `json:"username"`
 	Online   bool   `json:"online"`
+	Away     bool   `json:"away,omitempty"`
+
+	// When the user went offline; omitted while online
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+
+	StatusText string `json:"statusText,omitempty"`
+}
+
+// DeleteEvent tells clients to redact or hide a message
+type DeleteEvent struct {
+	MessageID string `json:"messageId"`
+	Scope     string `json:"scope"` // "me", "everyone"
+	DeletedBy string `json:"deletedBy"`
+}
+
+// ClearEvent tells a client that a direct conversation's history was
+// cleared. Peer is the other participant from the receiving user's side.
+type ClearEvent struct {
+	Peer      string `json:"peer"`
+	Scope     string `json:"scope"` // "me", "everyone"
+	ClearedBy string `json:"clearedBy"`
+}
+
+// ReactionEvent represents a reaction from client to server, and the
+// resulting update pushed to conversation participants
+type ReactionEvent struct {
+	MessageID string              `json:"messageId"`
+	Emoji     string              `json:"emoji"` // Empty removes the reaction
+	From      string              `json:"from,omitempty"`
+	Reactions map[string][]string `json:"reactions,omitempty"`
+}
+
+// VoteEvent is a client's vote in a poll: the indexes of their chosen options
+type VoteEvent struct {
+	MessageID string `json:"messageId"`
+	Options   []int  `json:"options"`
+}
+
+// PollEvent carries a poll's updated tally after a vote
+type PollEvent struct {
+	MessageID string `json:"messageId"`
+	From      string `json:"from"`
+	Poll      *Poll  `json:"poll"`
+}
+
+// LocationUpdate is a client's new position for a live location it is
+// sharing, or a request to stop sharing
+type LocationUpdate struct {
+	MessageID string  `json:"messageId"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Stop      bool    `json:"stop,omitempty"`
+}
+
+// LocationEvent carries a live location's current state to participants
+type LocationEvent struct {
+	MessageID string   `json:"messageId"`
+	Location  Location `json:"location"`
+}
+
+// TranslationEvent follows a delivered message once its content has been
+// translated into the recipient's preferred language
+type TranslationEvent struct {
+	MessageID   string       `json:"messageId"`
+	Translation *Translation `json:"translation"`
+}
+
+// OfflineOverflowEvent tells a reconnecting user how many events were dropped
+// because too many were held while they were offline, so the client knows to
+// resync rather than trust what it was sent
+type OfflineOverflowEvent struct {
+	Dropped int `json:"dropped"`
+}
+
+// ThreadEvent summarizes a thread after a new reply
+type ThreadEvent struct {
+	ThreadID    string `json:"threadId"`
+	ReplyCount  int    `json:"replyCount"`
+	LastReplyAt string `json:"lastReplyAt"`
+	LastReplyBy string `json:"lastReplyBy"`
+}
+
+// ReadEvent is sent by a client when it views a conversation. Exactly one of
+// Peer, GroupID and ChannelID is set. If UpTo is set, only messages up to and
+// including that message are marked read.
+type ReadEvent struct {
+	Peer      string `json:"peer,omitempty"`
+	GroupID   string `json:"groupId,omitempty"`
+	ChannelID string `json:"channelId,omitempty"`
+	UpTo      string `json:"upTo,omitempty"`
+}
+
+// ReadMarkerEvent syncs how far a user has read a conversation to their
+// clients. UpTo is the last read message's ID.
+type ReadMarkerEvent struct {
+	Peer        string `json:"peer,omitempty"`
+	GroupID     string `json:"groupId,omitempty"`
+	ChannelID   string `json:"channelId,omitempty"`
+	UpTo        string `json:"upTo,omitempty"`
+	UnreadCount int    `json:"unreadCount"`
+}
+
+// PinEvent notifies participants that a message was pinned or unpinned
+type PinEvent struct {
+	MessageID string `json:"messageId"`
+	Pinned    bool   `json:"pinned"`
+	By        string `json:"by"`
+}
+
+// StarEvent syncs a starred-message change to the user's other clients
+type StarEvent struct {
+	MessageID string `json:"messageId"`
+	Starred   bool   `json:"starred"`
+}
+
+// Draft is an unsent message a user has typed in a conversation. It is also
+// the payload of "draft" events that sync drafts across a user's clients.
+type Draft struct {
+	Peer      string    `json:"peer"`
+	Content   string    `json:"content"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Mute is a user's mute state for a conversation, also sent as "mute" events
+// to sync it across their clients. Exactly one of Peer, GroupID and ChannelID
+// is set; Until is nil when muted indefinitely.
+type Mute struct {
+	Peer      string     `json:"peer,omitempty"`
+	GroupID   string     `json:"groupId,omitempty"`
+	ChannelID string     `json:"channelId,omitempty"`
+	Muted     bool       `json:"muted"`
+	Until     *time.Time `json:"until,omitempty"`
+}
+
+// Archive is a user's archive state for a conversation, also sent as "archive"
+// events to sync it across their clients. Exactly one of Peer, GroupID and
+// ChannelID is set.
+type Archive struct {
+	Peer      string `json:"peer,omitempty"`
+	GroupID   string `json:"groupId,omitempty"`
+	ChannelID string `json:"channelId,omitempty"`
+	Archived  bool   `json:"archived"`
+}
+
+// PushDevice is a mobile device or browser registered for push notifications
+type PushDevice struct {
+	Platform  string    `json:"platform"` // "fcm", "apns" or "webpush"
+	Token     string    `json:"token"`    // Subscription endpoint for webpush
+	CreatedAt time.Time `json:"createdAt"`
+
+	// Browser subscription keys, set for webpush only
+	Keys *WebPushKeys `json:"-"`
+}
+
+// WebPushKeys are a browser push subscription's encryption keys (base64url)
+type WebPushKeys struct {
+	P256dh string `json:"p256dh"`
+	Auth   string `json:"auth"`
+}
+
+// NotificationPreferences control which messages alert a user, by push and
+// on their connected clients
+type NotificationPreferences struct {
+	Enabled     bool `json:"enabled"`
+	ShowPreview bool `json:"showPreview"` // false replaces message text with a generic body
+
+	// "all", "mentions" or "none", for direct messages and groups
+	DirectMessages string `json:"directMessages"`
+	Groups         string `json:"groups"`
+}
+
+// DefaultNotificationPreferences applies until a user changes their settings
+func DefaultNotificationPreferences() NotificationPreferences {
+	return NotificationPreferences{Enabled: true, ShowPreview: true, DirectMessages: "all", Groups: "all"}
+}
+
+// PushNotification is the platform-neutral content of a push notification
+type PushNotification struct {
+	Title     string `json:"title"`
+	Body      string `json:"body"`
+	MessageID string `json:"messageId"`
+	From      string `json:"from"`
+	GroupID   string `json:"groupId,omitempty"`
+	Urgent    bool   `json:"urgent,omitempty"`
+}
+
+// MentionEvent notifies a group member that they were mentioned
+type MentionEvent struct {
+	MessageID string `json:"messageId"`
+	GroupID   string `json:"groupId"`
+	From      string `json:"from"`
+	Preview   string `json:"preview"`
+}
+
+// DisappearingEvent announces a change to a conversation's disappearing
+// message timer. Exactly one of Peer and GroupID is set; an empty Duration
+// means the timer was turned off.
+type DisappearingEvent struct {
+	Peer     string `json:"peer,omitempty"`
+	GroupID  string `json:"groupId,omitempty"`
+	Duration string `json:"duration"`
+	By       string `json:"by"`
+}
+
+// ExpiredEvent tells clients a disappearing message's timer ran out
+type ExpiredEvent struct {
+	MessageID string `json:"messageId"`
+}
+
+// ErrorEvent reports a problem with something the client sent. Limit names
+// the exceeded limit for size errors; TempID identifies the refused message.
+type ErrorEvent struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Limit   int    `json:"limit,omitempty"`
+	TempID  string `json:"tempId,omitempty"`
+	Type    string `json:"type,omitempty"` // Type of the offending frame, if known
+}
+
+// Delivery records a message reaching one of a recipient's devices
+type Delivery struct {
+	Username    string
+	DeviceID    string
+	DeliveredAt time.Time  // Written to the device's connection
+	ReceivedAt  *time.Time // Acknowledged by the device; nil until then
+}
+
+// DeliveryInfo details where a message has been delivered and read, for its sender
+type DeliveryInfo struct {
+	MessageID  string               `json:"messageId"`
+	Status     string               `json:"status"`
+	Recipients []*RecipientDelivery `json:"recipients"`
+}
+
+// RecipientDelivery is one recipient's devices that received a message
+type RecipientDelivery struct {
+	Username string            `json:"username"`
+	Devices  []*DeviceDelivery `json:"devices"`
+	Read     bool              `json:"read"`
+}
+
+// DeviceDelivery is when a message reached one device
+type DeviceDelivery struct {
+	DeviceID    string     `json:"deviceId"`
+	DeliveredAt time.Time  `json:"deliveredAt"`
+	ReceivedAt  *time.Time `json:"receivedAt,omitempty"`
 }
 
 // AckEvent represents a message acknowledgment
 type AckEvent struct {
 	MessageID string `json:"messageId"`
-	Status    string `json:"status"`
+	TempID    string `json:"tempId,omitempty"`
+	Status    string `json:"status"` // "sent", "delivered", "read"
+}
+
+// ChannelConvKey generates the conversation key for a broadcast channel
+func ChannelConvKey(channelID string) string {
+	return "channel:" + channelID
+}
+
+// GroupConvKey generates the conversation key for a group
+func GroupConvKey(groupID string) string {
+	return "group:" + groupID
+}
+
+func removeString(items []string, item string) []string {
+	result := make([]string, 0, len(items))
+	for _, i := range items {
+		if i != item {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+func containsString(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
 }
 
 // ConvKey generates a normalized conversation key for two users
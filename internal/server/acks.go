@@ -0,0 +1,63 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+// ack records that the client received every frame up to seq and returns
+// the IDs of messages among the newly acknowledged frames. Acknowledged
+// frames leave the replay buffer.
+func (s *eventStream) ack(seq int64) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seq <= s.acked || seq > s.seq {
+		return nil
+	}
+	var messageIDs []string
+	kept := s.frames[:0]
+	for _, frame := range s.frames {
+		switch {
+		case frame.seq > seq:
+			kept = append(kept, frame)
+		case frame.seq > s.acked && frame.messageID != "":
+			messageIDs = append(messageIDs, frame.messageID)
+		}
+	}
+	s.frames = kept
+	s.acked = seq
+	return messageIDs
+}
+
+// handleReceived processes a client's acknowledgement of the events it has
+// received, marking the messages among them received on that device
+func (h *Hub) handleReceived(client *Client, event *models.ReceivedEvent) {
+	if client.stream == nil {
+		return
+	}
+	messageIDs := client.stream.ack(event.Seq)
+	if len(messageIDs) == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for _, messageID := range messageIDs {
+		message, exists := h.message(messageID)
+		if !exists || message.From == client.Username {
+			continue
+		}
+		h.recordDelivery(message, client)
+		for _, delivery := range message.Deliveries {
+			if delivery.Username == client.Username && delivery.DeviceID == client.DeviceID && delivery.ReceivedAt == nil {
+				delivery.ReceivedAt = &now
+			}
+		}
+	}
+	log.Printf("Client %s (device %s) acknowledged events up to %d", client.Username, client.DeviceID, event.Seq)
+}
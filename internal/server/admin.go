@@ -0,0 +1,121 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+// BanRequest represents a request to temporarily ban an IP or CIDR
+type BanRequest struct {
+	CIDR     string `json:"cidr"`
+	Duration string `json:"duration"` // Go duration, e.g. "30m"
+}
+
+// requireAdmin resolves the caller's session and checks they are an admin.
+// Usernames aren't secret and anyone can log in as one, so the admin token
+// is required as well.
+func (h *HTTPHandlers) requireAdmin(w http.ResponseWriter, r *http.Request) (*models.Session, bool) {
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	if !h.Config.IsAdmin(session.Username) || !h.Config.IsAdminToken(r.Header.Get("X-Admin-Token")) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+
+	return session, true
+}
+
+// HandleBans handles GET, POST and DELETE /api/admin/bans
+func (h *HTTPHandlers) HandleBans(w http.ResponseWriter, r *http.Request) {
+	admin, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.IPFilter.Bans())
+
+	case http.MethodPost:
+		var req BanRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		duration, err := time.ParseDuration(req.Duration)
+		if err != nil || duration <= 0 {
+			http.Error(w, "Duration must be a positive Go duration such as \"1h\"", http.StatusBadRequest)
+			return
+		}
+
+		ban, err := h.IPFilter.Ban(strings.TrimSpace(req.CIDR), duration)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		h.Audit.Record(AuditAdminAction, admin.Username, clientIP(r), fmt.Sprintf("ban %s for %s", ban.CIDR, duration))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(ban)
+
+	case http.MethodDelete:
+		cidr := strings.TrimSpace(r.URL.Query().Get("cidr"))
+		if !h.IPFilter.Unban(cidr) {
+			http.Error(w, "Ban not found", http.StatusNotFound)
+			return
+		}
+		h.Audit.Record(AuditAdminAction, admin.Username, clientIP(r), "unban "+cidr)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleAudit handles GET /api/admin/audit?user=<username>&since=<RFC3339>&until=<RFC3339>
+func (h *HTTPHandlers) HandleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, ok := h.requireAdmin(w, r); !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	var since, until time.Time
+	if value := query.Get("since"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, "since must be an RFC3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	if value := query.Get("until"); value != "" {
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, "until must be an RFC3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		until = t
+	}
+
+	events := h.Audit.Query(strings.TrimSpace(query.Get("user")), since, until)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
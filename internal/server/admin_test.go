@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAdminToken(t *testing.T) {
+	audit, _ := NewAuditLog("")
+	cfg := DefaultConfig()
+	cfg.Admins = []string{"root"}
+	h := &HTTPHandlers{Hub: NewHub(), Config: cfg, Audit: audit}
+	admin := sessionStore.CreateSession("root", "192.0.2.1", "test")
+	user := sessionStore.CreateSession("mallory", "192.0.2.1", "test")
+
+	tests := []struct {
+		name       string
+		session    string
+		configured string
+		token      string
+		want       int
+	}{
+		{"admin with token", admin, "s3cret", "s3cret", http.StatusOK},
+		{"admin without token", admin, "s3cret", "", http.StatusForbidden},
+		{"admin with wrong token", admin, "s3cret", "s3cre", http.StatusForbidden},
+		{"no token configured", admin, "", "", http.StatusForbidden},
+		{"token without admin", user, "s3cret", "s3cret", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		cfg.AdminToken = tt.configured
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/audit", nil)
+		req.AddCookie(&http.Cookie{Name: "session_id", Value: tt.session})
+		if tt.token != "" {
+			req.Header.Set("X-Admin-Token", tt.token)
+		}
+		rec := httptest.NewRecorder()
+		h.HandleAudit(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"whatsdown/internal/models"
+)
+
+// Values of GET /api/conversations?filter=
+const (
+	ConversationFilterActive   = ""         // default: archived conversations are left out
+	ConversationFilterArchived = "archived" // only archived conversations
+	ConversationFilterAll      = "all"
+)
+
+// SetArchived archives or unarchives a conversation for username and syncs the
+// change to their client. archive identifies the conversation.
+func (h *Hub) SetArchived(username, convKey string, archive *models.Archive, archived bool) *models.Archive {
+	h.mu.Lock()
+
+	s := h.shard(convKey)
+	s.mu.Lock()
+	if archived {
+		users, exists := s.archived[convKey]
+		if !exists {
+			users = make(map[string]bool)
+			s.archived[convKey] = users
+		}
+		users[username] = true
+	} else {
+		delete(s.archived[convKey], username)
+		if len(s.archived[convKey]) == 0 {
+			delete(s.archived, convKey)
+		}
+	}
+	s.mu.Unlock()
+	archive.Archived = archived
+
+	clients := h.clientsOf(username)
+	h.mu.Unlock()
+
+	for _, client := range clients {
+		h.sendToClient(client, "archive", archive)
+	}
+	return archive
+}
+
+// unarchive brings a conversation back to everyone's main list when a new
+// message arrives in it. Callers must hold the conversation's shard lock.
+func (s *hubShard) unarchive(convKey string) {
+	delete(s.archived, convKey)
+}
+
+// isArchived reports whether username has archived a conversation
+func (h *Hub) isArchived(username, convKey string) bool {
+	s := h.shard(convKey)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.archived[convKey][username]
+}
+
+// filterConversations keeps the conversations matching a
+// GET /api/conversations filter
+func filterConversations(conversations []*models.Conversation, filter string) []*models.Conversation {
+	if filter == ConversationFilterAll {
+		return conversations
+	}
+
+	wantArchived := filter == ConversationFilterArchived
+	filtered := []*models.Conversation{}
+	for _, conversation := range conversations {
+		if conversation.Archived == wantArchived {
+			filtered = append(filtered, conversation)
+		}
+	}
+	return filtered
+}
+
+// handleArchive serves POST on a conversation's /archive and /unarchive
+// paths. archive identifies the conversation.
+func (h *HTTPHandlers) handleArchive(w http.ResponseWriter, r *http.Request, username, convKey, action string, archive *models.Archive) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	archive = h.Hub.SetArchived(username, convKey, archive, action == "archive")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(archive)
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Number of bars in a voice note waveform
+const waveformBars = 64
+
+var errUnsupportedAudio = errors.New("unsupported audio format")
+
+// audioInfo is what the server can learn from an audio file without a codec library
+type audioInfo struct {
+	Codec    string
+	Duration time.Duration
+	Peaks    []int // waveformBars values from 0 to 100
+}
+
+// probeAudio reads WAV (PCM) and Ogg (Opus or Vorbis) files
+func probeAudio(data []byte) (*audioInfo, error) {
+	switch {
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WAVE":
+		return probeWAV(data)
+	case len(data) >= 4 && string(data[:4]) == "OggS":
+		return probeOgg(data)
+	default:
+		return nil, errUnsupportedAudio
+	}
+}
+
+// probeWAV decodes PCM samples to compute exact duration and peak levels
+func probeWAV(data []byte) (*audioInfo, error) {
+	var channels, bitsPerSample int
+	var sampleRate int
+	var samples []byte
+
+	for offset := 12; offset+8 <= len(data); {
+		id := string(data[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		body := data[offset+8:]
+		if size > len(body) {
+			size = len(body)
+		}
+		body = body[:size]
+
+		switch id {
+		case "fmt ":
+			if len(body) < 16 || binary.LittleEndian.Uint16(body[0:2]) != 1 {
+				return nil, errUnsupportedAudio // not PCM
+			}
+			channels = int(binary.LittleEndian.Uint16(body[2:4]))
+			sampleRate = int(binary.LittleEndian.Uint32(body[4:8]))
+			bitsPerSample = int(binary.LittleEndian.Uint16(body[14:16]))
+		case "data":
+			samples = body
+		}
+		// Chunks are padded to an even size
+		offset += 8 + size + size%2
+	}
+
+	if channels == 0 || sampleRate == 0 || (bitsPerSample != 8 && bitsPerSample != 16) || samples == nil {
+		return nil, errUnsupportedAudio
+	}
+
+	frameSize := channels * bitsPerSample / 8
+	frames := len(samples) / frameSize
+	info := &audioInfo{
+		Codec:    "pcm",
+		Duration: time.Duration(frames) * time.Second / time.Duration(sampleRate),
+	}
+
+	levels := make([]float64, waveformBars)
+	for frame := 0; frame < frames; frame++ {
+		// First channel is representative enough for a waveform
+		var level float64
+		if bitsPerSample == 8 {
+			level = float64(int(samples[frame*frameSize])-128) / 128
+		} else {
+			level = float64(int16(binary.LittleEndian.Uint16(samples[frame*frameSize:]))) / 32768
+		}
+		if level < 0 {
+			level = -level
+		}
+		bar := frame * waveformBars / frames
+		if level > levels[bar] {
+			levels[bar] = level
+		}
+	}
+	info.Peaks = normalizePeaks(levels)
+	return info, nil
+}
+
+// Longest audio or video the probes accept; larger sample counts would
+// overflow a Duration
+const maxMediaDuration = 24 * time.Hour
+
+// mediaDuration converts count samples (or timescale ticks) at perSecond a
+// second into a Duration, failing beyond maxMediaDuration
+func mediaDuration(count, perSecond uint64) (time.Duration, bool) {
+	if perSecond == 0 || count/perSecond >= uint64(maxMediaDuration/time.Second) {
+		return 0, false
+	}
+	// Whole seconds and the rest apart, as count times a second can overflow
+	// at high rates
+	return time.Duration(count/perSecond)*time.Second + time.Duration(count%perSecond*uint64(time.Second)/perSecond), true
+}
+
+// probeOgg walks Ogg pages: the largest granule position gives the duration,
+// and since Opus and Vorbis are variable bitrate, page sizes over time give
+// an approximate loudness envelope without decoding. Granules are taken from
+// the file as they are, so nothing assumes they only go up.
+func probeOgg(data []byte) (*audioInfo, error) {
+	info := &audioInfo{}
+	rate := 0
+	preSkip := int64(0)
+	var maxGranule int64
+
+	type page struct {
+		granule int64
+		size    int
+	}
+	var pages []page
+
+	for offset := 0; offset+27 <= len(data); {
+		if string(data[offset:offset+4]) != "OggS" {
+			return nil, errUnsupportedAudio
+		}
+		granule := int64(binary.LittleEndian.Uint64(data[offset+6 : offset+14]))
+		segments := int(data[offset+26])
+		if offset+27+segments > len(data) {
+			break
+		}
+		size := 0
+		for _, lacing := range data[offset+27 : offset+27+segments] {
+			size += int(lacing)
+		}
+		body := data[offset+27+segments:]
+		if size > len(body) {
+			size = len(body)
+		}
+		body = body[:size]
+
+		if info.Codec == "" {
+			switch {
+			case bytes.HasPrefix(body, []byte("OpusHead")) && len(body) >= 12:
+				info.Codec = "opus"
+				rate = 48000 // Opus granules always count 48 kHz samples
+				preSkip = int64(binary.LittleEndian.Uint16(body[10:12]))
+			case bytes.HasPrefix(body, []byte("\x01vorbis")) && len(body) >= 16:
+				info.Codec = "vorbis"
+				rate = int(binary.LittleEndian.Uint32(body[12:16]))
+			default:
+				return nil, errUnsupportedAudio
+			}
+		}
+
+		// Header pages have granule 0 and -1 marks pages where no packet finishes
+		if granule > 0 {
+			maxGranule = max(maxGranule, granule)
+			pages = append(pages, page{granule: granule, size: size})
+		}
+		offset += 27 + segments + size
+	}
+
+	if info.Codec == "" || rate <= 0 || maxGranule <= preSkip {
+		return nil, errUnsupportedAudio
+	}
+	duration, ok := mediaDuration(uint64(maxGranule-preSkip), uint64(rate))
+	if !ok {
+		return nil, errUnsupportedAudio
+	}
+	info.Duration = duration
+
+	levels := make([]float64, waveformBars)
+	for _, p := range pages {
+		bar := int(float64(p.granule) / float64(maxGranule) * waveformBars)
+		bar = min(max(bar, 0), waveformBars-1)
+		levels[bar] += float64(p.size)
+	}
+	info.Peaks = normalizePeaks(levels)
+	return info, nil
+}
+
+// normalizePeaks scales levels so the loudest bar is 100
+func normalizePeaks(levels []float64) []int {
+	max := 0.0
+	for _, level := range levels {
+		if level > max {
+			max = level
+		}
+	}
+	peaks := make([]int, len(levels))
+	if max == 0 {
+		return peaks
+	}
+	for i, level := range levels {
+		peaks[i] = int(level / max * 100)
+	}
+	return peaks
+}
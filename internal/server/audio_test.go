@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// oggPage builds one Ogg page carrying body in a single segment run
+func oggPage(granule int64, body []byte) []byte {
+	page := []byte("OggS\x00\x00")
+	page = binary.LittleEndian.AppendUint64(page, uint64(granule))
+	page = append(page, make([]byte, 12)...) // Serial, sequence and CRC
+	var lacing []byte
+	for n := len(body); ; n -= 255 {
+		if n < 255 {
+			lacing = append(lacing, byte(n))
+			break
+		}
+		lacing = append(lacing, 255)
+	}
+	page = append(page, byte(len(lacing)))
+	page = append(page, lacing...)
+	return append(page, body...)
+}
+
+func opusHead(preSkip uint16) []byte {
+	head := []byte("OpusHead\x01\x01")
+	return binary.LittleEndian.AppendUint16(head, preSkip)
+}
+
+func vorbisHead(rate uint32) []byte {
+	head := []byte("\x01vorbis\x00\x00\x00\x00\x01")
+	return binary.LittleEndian.AppendUint32(head, rate)
+}
+
+// wavFile builds a mono 16-bit PCM WAV file from samples
+func wavFile(rate uint32, samples []int16) []byte {
+	var data []byte
+	for _, sample := range samples {
+		data = binary.LittleEndian.AppendUint16(data, uint16(sample))
+	}
+	fmtChunk := binary.LittleEndian.AppendUint16(nil, 1) // PCM
+	fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, 1)
+	fmtChunk = binary.LittleEndian.AppendUint32(fmtChunk, rate)
+	fmtChunk = binary.LittleEndian.AppendUint32(fmtChunk, rate*2)
+	fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, 2)
+	fmtChunk = binary.LittleEndian.AppendUint16(fmtChunk, 16)
+
+	file := []byte("RIFF\x00\x00\x00\x00WAVE")
+	file = append(file, "fmt "...)
+	file = binary.LittleEndian.AppendUint32(file, uint32(len(fmtChunk)))
+	file = append(file, fmtChunk...)
+	file = append(file, "data"...)
+	file = binary.LittleEndian.AppendUint32(file, uint32(len(data)))
+	return append(file, data...)
+}
+
+func TestProbeAudio(t *testing.T) {
+	opus := func(pages ...[]byte) []byte {
+		return bytes.Join(append([][]byte{oggPage(0, opusHead(312))}, pages...), nil)
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		codec    string
+		duration time.Duration
+		err      bool
+	}{
+		{
+			name:     "opus",
+			data:     opus(oggPage(48312, make([]byte, 100)), oggPage(96312, make([]byte, 50))),
+			codec:    "opus",
+			duration: 2 * time.Second,
+		},
+		{
+			name:     "vorbis",
+			data:     bytes.Join([][]byte{oggPage(0, vorbisHead(44100)), oggPage(44100, make([]byte, 10))}, nil),
+			codec:    "vorbis",
+			duration: time.Second,
+		},
+		{
+			name:     "granules going backwards",
+			data:     opus(oggPage(96312, make([]byte, 10)), oggPage(48312, make([]byte, 10))),
+			codec:    "opus",
+			duration: 2 * time.Second,
+		},
+		{
+			name: "granule overflowing duration",
+			data: opus(oggPage(1<<62, make([]byte, 10))),
+			err:  true,
+		},
+		{
+			name: "fuzz repro",
+			data: []byte("OggS0000000002000000000000\x010OpusHead0000"),
+			err:  true,
+		},
+		{
+			name:     "wav",
+			data:     wavFile(8000, make([]int16, 4000)),
+			codec:    "pcm",
+			duration: 500 * time.Millisecond,
+		},
+		{name: "empty", data: nil, err: true},
+		{name: "not audio", data: []byte("GIF89a..."), err: true},
+		{name: "truncated ogg", data: []byte("OggS"), err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := probeAudio(tt.data)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("probeAudio = %+v, want error", info)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("probeAudio: %v", err)
+			}
+			if info.Codec != tt.codec || info.Duration != tt.duration {
+				t.Errorf("probeAudio = %s %v, want %s %v", info.Codec, info.Duration, tt.codec, tt.duration)
+			}
+			if len(info.Peaks) != waveformBars {
+				t.Errorf("got %d peaks, want %d", len(info.Peaks), waveformBars)
+			}
+		})
+	}
+}
+
+func TestProbeWAVPeaks(t *testing.T) {
+	samples := make([]int16, 6400)
+	for i := 3200; i < len(samples); i++ {
+		samples[i] = 16384
+	}
+	info, err := probeAudio(wavFile(8000, samples))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Peaks[0] != 0 || info.Peaks[waveformBars-1] != 100 {
+		t.Errorf("peaks = %v, want silence then full scale", info.Peaks)
+	}
+}
+
+func FuzzProbeAudio(f *testing.F) {
+	f.Add([]byte("OggS0000000002000000000000\x010OpusHead0000"))
+	f.Add(bytes.Join([][]byte{oggPage(0, opusHead(0)), oggPage(960, []byte{1, 2, 3})}, nil))
+	f.Add(bytes.Join([][]byte{oggPage(0, vorbisHead(8000)), oggPage(-1, nil), oggPage(8000, []byte{1})}, nil))
+	f.Add(wavFile(8000, []int16{1, -1, 300}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		info, err := probeAudio(data)
+		if err != nil {
+			return
+		}
+		if info.Duration < 0 || len(info.Peaks) != waveformBars {
+			t.Errorf("probeAudio = %+v", info)
+		}
+		for _, peak := range info.Peaks {
+			if peak < 0 || peak > 100 {
+				t.Errorf("peak %d out of range", peak)
+			}
+		}
+	})
+}
@@ -0,0 +1,155 @@
+package server
+
+import "encoding/binary"
+
+// MPEG-1 and MPEG-2/2.5 Layer III bitrates in kbit/s, by header index
+var (
+	mp3BitratesV1 = [16]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}
+	mp3BitratesV2 = [16]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0}
+	mp3Rates      = [3]int{44100, 48000, 32000}
+)
+
+// probeAudioMetadata reads the codec and duration of an audio attachment.
+// Unlike probeAudio it accepts formats it can't draw a waveform for.
+func probeAudioMetadata(data []byte) (*audioInfo, error) {
+	switch {
+	case len(data) >= 4 && string(data[:4]) == "fLaC":
+		return probeFLAC(data)
+	case isMP4(data):
+		info, err := probeMP4(data)
+		if err != nil {
+			return nil, err
+		}
+		track, ok := info.track("soun")
+		if !ok {
+			return nil, errUnsupportedAudio
+		}
+		return &audioInfo{Codec: track.Codec, Duration: info.Duration}, nil
+	}
+	if info, err := probeAudio(data); err == nil {
+		info.Peaks = nil
+		return info, nil
+	}
+	return probeMP3(data)
+}
+
+// probeFLAC reads total samples and sample rate from the STREAMINFO block,
+// which the format requires to come first
+func probeFLAC(data []byte) (*audioInfo, error) {
+	if len(data) < 8+34 || data[4]&0x7F != 0 {
+		return nil, errUnsupportedAudio
+	}
+	info := data[8:]
+	rate := int(info[10])<<12 | int(info[11])<<4 | int(info[12])>>4
+	samples := uint64(info[13]&0x0F)<<32 | uint64(binary.BigEndian.Uint32(info[14:18]))
+	duration, ok := mediaDuration(samples, uint64(rate))
+	if !ok {
+		return nil, errUnsupportedAudio
+	}
+	return &audioInfo{Codec: "flac", Duration: duration}, nil
+}
+
+// mp3Frame is a parsed Layer III frame header
+type mp3Frame struct {
+	mpeg1      bool
+	mono       bool
+	sampleRate int
+	length     int // bytes, including the header
+}
+
+// samples is the number of PCM samples per channel in the frame
+func (f mp3Frame) samples() int {
+	if f.mpeg1 {
+		return 1152
+	}
+	return 576
+}
+
+func parseMP3Frame(header []byte) (mp3Frame, bool) {
+	if len(header) < 4 || header[0] != 0xFF || header[1]&0xE0 != 0xE0 {
+		return mp3Frame{}, false
+	}
+	version := header[1] >> 3 & 3 // 3: MPEG-1, 2: MPEG-2, 0: MPEG-2.5
+	layer := header[1] >> 1 & 3   // 1: Layer III
+	bitrateIndex := header[2] >> 4
+	rateIndex := header[2] >> 2 & 3
+	if version == 1 || layer != 1 || rateIndex == 3 {
+		return mp3Frame{}, false
+	}
+
+	frame := mp3Frame{mpeg1: version == 3, mono: header[3]>>6 == 3}
+	bitrate := mp3BitratesV2[bitrateIndex]
+	frame.sampleRate = mp3Rates[rateIndex]
+	switch version {
+	case 3:
+		bitrate = mp3BitratesV1[bitrateIndex]
+	case 2:
+		frame.sampleRate /= 2
+	case 0:
+		frame.sampleRate /= 4
+	}
+	if bitrate == 0 {
+		return mp3Frame{}, false // free format isn't supported
+	}
+	padding := int(header[2] >> 1 & 1)
+	frame.length = frame.samples()/8*bitrate*1000/frame.sampleRate + padding
+	return frame, true
+}
+
+// probeMP3 uses the Xing/Info frame count when present, and otherwise walks
+// every frame, which also handles variable bitrate files without one
+func probeMP3(data []byte) (*audioInfo, error) {
+	offset := 0
+	if len(data) >= 10 && string(data[:3]) == "ID3" {
+		// ID3v2 sizes are syncsafe: 7 bits per byte
+		size := int(data[6]&0x7F)<<21 | int(data[7]&0x7F)<<14 | int(data[8]&0x7F)<<7 | int(data[9]&0x7F)
+		offset = 10 + size
+		if data[5]&0x10 != 0 {
+			offset += 10 // footer
+		}
+	}
+
+	first, ok := mp3Frame{}, false
+	for ; offset+4 <= len(data); offset++ {
+		if first, ok = parseMP3Frame(data[offset:]); ok {
+			break
+		}
+	}
+	if !ok {
+		return nil, errUnsupportedAudio
+	}
+	info := &audioInfo{Codec: "mp3"}
+
+	// The Xing/Info tag sits after the side information of the first frame
+	sideInfo := 17
+	if first.mpeg1 && !first.mono {
+		sideInfo = 32
+	} else if !first.mpeg1 && first.mono {
+		sideInfo = 9
+	}
+	if tag := offset + 4 + sideInfo; tag+12 <= len(data) {
+		id := string(data[tag : tag+4])
+		flags := binary.BigEndian.Uint32(data[tag+4 : tag+8])
+		if (id == "Xing" || id == "Info") && flags&1 != 0 {
+			frames := uint64(binary.BigEndian.Uint32(data[tag+8 : tag+12]))
+			if info.Duration, ok = mediaDuration(frames*uint64(first.samples()), uint64(first.sampleRate)); !ok {
+				return nil, errUnsupportedAudio
+			}
+			return info, nil
+		}
+	}
+
+	var samples uint64
+	for offset+4 <= len(data) {
+		frame, ok := parseMP3Frame(data[offset:])
+		if !ok || frame.sampleRate != first.sampleRate {
+			break
+		}
+		samples += uint64(frame.samples())
+		offset += frame.length
+	}
+	if info.Duration, ok = mediaDuration(samples, uint64(first.sampleRate)); !ok {
+		return nil, errUnsupportedAudio
+	}
+	return info, nil
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// flacFile builds a FLAC stream with just its STREAMINFO block
+func flacFile(rate int, samples uint64) []byte {
+	info := make([]byte, 34)
+	info[10] = byte(rate >> 12)
+	info[11] = byte(rate >> 4)
+	info[12] = byte(rate<<4) | 0x02 // Stereo
+	info[13] = 0xF0 | byte(samples>>32)
+	binary.BigEndian.PutUint32(info[14:18], uint32(samples))
+	return append([]byte("fLaC\x80\x00\x00\x22"), info...)
+}
+
+// mp3Frames builds count MPEG-1 Layer III frames at 128kbit/s and 44.1kHz
+func mp3Frames(count int) []byte {
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0x00})
+	return bytes.Repeat(frame, count)
+}
+
+// mp3Xing builds a first frame carrying an Xing header with a frame count
+func mp3Xing(frames uint32) []byte {
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0x00})
+	tag := 4 + 32
+	copy(frame[tag:], "Xing")
+	binary.BigEndian.PutUint32(frame[tag+4:], 1)
+	binary.BigEndian.PutUint32(frame[tag+8:], frames)
+	return frame
+}
+
+func TestProbeAudioMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		codec    string
+		duration time.Duration
+		err      bool
+	}{
+		{name: "flac", data: flacFile(44100, 88200), codec: "flac", duration: 2 * time.Second},
+		{name: "flac hour", data: flacFile(655350, 655350*3600), codec: "flac", duration: time.Hour},
+		{name: "flac overflowing duration", data: flacFile(1, 1<<36-1), err: true},
+		{name: "flac no rate", data: flacFile(0, 100), err: true},
+		{name: "flac truncated", data: []byte("fLaC\x00\x00\x00\x22"), err: true},
+		{name: "mp3 frames", data: mp3Frames(38), codec: "mp3", duration: 38 * 1152 * time.Second / 44100},
+		{name: "mp3 after id3", data: append([]byte("ID3\x03\x00\x00\x00\x00\x00\x02\x00\x00"), mp3Frames(1)...), codec: "mp3", duration: 1152 * time.Second / 44100},
+		{name: "mp3 xing", data: mp3Xing(44100), codec: "mp3", duration: 1152 * time.Second},
+		{name: "mp3 xing overflowing duration", data: mp3Xing(1<<32 - 1), err: true},
+		{name: "ogg", data: bytes.Join([][]byte{oggPage(0, vorbisHead(8000)), oggPage(8000, []byte{1})}, nil), codec: "vorbis", duration: time.Second},
+		{name: "mp4", data: mp4File(1000, 5000, mp4Trak("soun", "mp4a")), codec: "aac", duration: 5 * time.Second},
+		{name: "mp4 without audio", data: mp4File(1000, 5000, mp4Trak("vide", "avc1")), err: true},
+		{name: "empty", data: nil, err: true},
+		{name: "not audio", data: []byte("GIF89a..."), err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := probeAudioMetadata(tt.data)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("probeAudioMetadata = %+v, want error", info)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("probeAudioMetadata: %v", err)
+			}
+			if info.Codec != tt.codec || info.Duration != tt.duration {
+				t.Errorf("probeAudioMetadata = %s %v, want %s %v", info.Codec, info.Duration, tt.codec, tt.duration)
+			}
+		})
+	}
+}
+
+func FuzzProbeAudioMetadata(f *testing.F) {
+	f.Add(flacFile(48000, 480000))
+	f.Add(mp3Frames(3))
+	f.Add(mp3Xing(10))
+	f.Add(mp4File(600, 1200, mp4Trak("soun", "Opus")))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		info, err := probeAudioMetadata(data)
+		if err != nil {
+			return
+		}
+		if info.Duration < 0 {
+			t.Errorf("probeAudioMetadata = %+v", info)
+		}
+	})
+}
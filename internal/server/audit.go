@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"whatsdown/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// Audit event types
+const (
+	AuditLogin          = "login"
+	AuditLoginFailed    = "login_failed"
+	AuditLogout         = "logout"
+	AuditSessionRevoked = "session_revoked"
+	AuditDeviceRevoked  = "device_revoked"
+	AuditAdminAction    = "admin_action"
+)
+
+// AuditLog is an append-only record of security-relevant events. Events are
+// kept in memory for querying and, if a path is configured, mirrored to a
+// JSON-lines file so they survive restarts.
+type AuditLog struct {
+	// Once Limit is reached, a ring whose oldest event is at events[oldest]
+	events []*models.AuditEvent
+	oldest int
+	file   *os.File
+	mu     sync.RWMutex
+
+	// Most events kept in memory for querying; once reached the oldest is
+	// dropped (it stays in the file). 0 keeps them all.
+	Limit int
+}
+
+// NewAuditLog creates an audit log, appending to the file at path if non-empty
+func NewAuditLog(path string) (*AuditLog, error) {
+	a := &AuditLog{}
+	if path == "" {
+		return a, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	a.file = file
+	return a, nil
+}
+
+// Record appends an event to the log
+func (a *AuditLog) Record(eventType, username, ip, detail string) {
+	event := &models.AuditEvent{
+		ID:        uuid.New().String(),
+		Type:      eventType,
+		Username:  username,
+		IP:        ip,
+		Detail:    detail,
+		Timestamp: time.Now(),
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.Limit > 0 && len(a.events) >= a.Limit {
+		a.events[a.oldest] = event
+		a.oldest = (a.oldest + 1) % len(a.events)
+	} else {
+		a.events = append(a.events, event)
+	}
+
+	if a.file != nil {
+		data, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Error marshaling audit event: %v", err)
+			return
+		}
+		if _, err := a.file.Write(append(data, '\n')); err != nil {
+			log.Printf("Error writing audit event: %v", err)
+		}
+	}
+}
+
+// Query returns events for username (all users if empty) within [since, until].
+// Zero times leave that end of the range open.
+func (a *AuditLog) Query(username string, since, until time.Time) []*models.AuditEvent {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	results := []*models.AuditEvent{}
+	for i := range a.events {
+		event := a.events[(a.oldest+i)%len(a.events)]
+		if username != "" && event.Username != username {
+			continue
+		}
+		if !since.IsZero() && event.Timestamp.Before(since) {
+			continue
+		}
+		if !until.IsZero() && event.Timestamp.After(until) {
+			continue
+		}
+		results = append(results, event)
+	}
+	return results
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuditLogLimit(t *testing.T) {
+	audit, err := NewAuditLog("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.Limit = 3
+	for _, username := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		audit.Record(AuditLogin, username, "192.0.2.1", "")
+	}
+
+	events := audit.Query("", time.Time{}, time.Time{})
+	if len(events) != 3 {
+		t.Fatalf("kept %d events, want 3", len(events))
+	}
+	for i, want := range []string{"e", "f", "g"} {
+		if events[i].Username != want {
+			t.Errorf("event %d is for %q, want %q", i, events[i].Username, want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"log"
+
+	"whatsdown/internal/models"
+)
+
+// Most events carried in one "batch" frame; longer runs are split
+const maxBatchEvents = 100
+
+// supportsBatches reports whether the client understands "batch" frames,
+// which protocol version 1 clients don't
+func (c *Client) supportsBatches() bool {
+	return c.protocolVersion >= 2
+}
+
+// coalesces reports whether writePump joins the client's queued frames
+func (c *Client) coalesces() bool {
+	return c.Hub.CoalesceWrites && c.supportsBatches()
+}
+
+// writeCoalesced writes message and the n frames queued behind it as "batch"
+// frames of up to maxBatchEvents, so a burst costs one write instead of one
+// per event. Frames already batched go out as they are, between the runs
+// around them, so order is kept.
+func (c *Client) writeCoalesced(message []byte, n int) error {
+	run := c.coalesced[:0]
+	flush := func() error {
+		var err error
+		switch len(run) {
+		case 0:
+		case 1:
+			err = c.writeFrame(run[0])
+		default:
+			err = c.writeFrame(c.codec.MarshalBatch(run))
+		}
+		clear(run)
+		run = run[:0]
+		return err
+	}
+	defer func() { c.coalesced = run }()
+
+	for i := 0; i <= n; i++ {
+		if i > 0 {
+			message = <-c.Send
+		}
+		if c.codec.IsBatch(message) {
+			if err := flush(); err != nil {
+				return err
+			}
+			if err := c.writeFrame(message); err != nil {
+				return err
+			}
+			continue
+		}
+		run = append(run, message)
+		if len(run) == maxBatchEvents {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// sendBatch sends events to client coalesced into "batch" frames, each event
+// keeping its own type, payload and stream seq, or one frame per event to
+// clients that don't support batches. Like sendToClient, the events are
+// encoded later by a delivery worker.
+func (h *Hub) sendBatch(client *Client, events []*models.WSMessage) {
+	if len(events) == 0 {
+		return
+	}
+	h.dispatch(client, func() {
+		h.deliverBatch(client, events)
+	})
+}
+
+func (h *Hub) deliverBatch(client *Client, events []*models.WSMessage) {
+	if !client.supportsBatches() || len(events) < 2 {
+		for _, event := range events {
+			h.deliver(client, event.Type, event.Payload)
+		}
+		return
+	}
+
+	for len(events) > 0 {
+		n := min(len(events), maxBatchEvents)
+		var queued bool
+		if client.stream != nil {
+			queued = client.stream.sendBatch(events[:n])
+		} else {
+			queued = client.enqueue(newBatchFrame(client.codec, events[:n], client.codec.Marshal))
+		}
+		if queued {
+			log.Printf("Batch of %d events queued for client %s", n, client.Username)
+		}
+		events = events[n:]
+	}
+}
+
+// sendBatch numbers events and keeps each for replay like send, queueing
+// them as a single batch frame
+func (s *eventStream) sendBatch(events []*models.WSMessage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	frame := newBatchFrame(s.codec, events, func(event *models.WSMessage) ([]byte, error) {
+		data, err := s.codec.Marshal(&models.WSMessage{Type: event.Type, Seq: s.seq + 1, Payload: event.Payload})
+		if err == nil {
+			s.record(data, event.Payload)
+		}
+		return data, err
+	})
+
+	if s.client == nil {
+		return false
+	}
+	return s.client.enqueue(frame)
+}
+
+// newBatchFrame encodes each event with encode, skipping any that fail, and
+// wraps them in one batch frame
+func newBatchFrame(codec wireCodec, events []*models.WSMessage, encode func(*models.WSMessage) ([]byte, error)) outboxFrame {
+	var frame outboxFrame
+	frames := make([][]byte, 0, len(events))
+	for _, event := range events {
+		data, err := encode(event)
+		if err != nil {
+			log.Printf("Error marshaling message: %v", err)
+			continue
+		}
+		frames = append(frames, data)
+		if messageID := outboundMessageID(event.Payload); messageID != "" {
+			frame.messageIDs = append(frame.messageIDs, messageID)
+		}
+	}
+	frame.data = codec.MarshalBatch(frames)
+	return frame
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"whatsdown/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// BotUsername is the built-in system user. Nobody can log in as it.
+const BotUsername = "whatsdown"
+
+// BotCommandHandler answers a bot command. args is the text after the
+// command name; an empty reply sends nothing.
+type BotCommandHandler func(from, args string) string
+
+type botCommand struct {
+	description string
+	handler     BotCommandHandler
+}
+
+// Bot is the built-in system user. It greets new accounts and answers
+// /commands sent to it; operators add commands with HandleCommand.
+type Bot struct {
+	hub      *Hub
+	welcome  string
+	commands map[string]*botCommand
+	mu       sync.RWMutex
+}
+
+// NewBot creates the bot with its built-in /help command
+func NewBot(hub *Hub) *Bot {
+	bot := &Bot{
+		hub:      hub,
+		welcome:  DefaultConfig().BotWelcome,
+		commands: make(map[string]*botCommand),
+	}
+	bot.HandleCommand("help", "List the commands I understand", bot.help)
+	return bot
+}
+
+// SetWelcome sets the greeting sent to new accounts. "{username}" is replaced
+// with the new user's name; an empty message disables the greeting.
+func (b *Bot) SetWelcome(message string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.welcome = message
+}
+
+// HandleCommand registers handler for /name, replacing any existing command
+func (b *Bot) HandleCommand(name, description string, handler BotCommandHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.commands[strings.ToLower(strings.TrimPrefix(name, "/"))] = &botCommand{
+		description: description,
+		handler:     handler,
+	}
+}
+
+// Welcome greets a newly created account
+func (b *Bot) Welcome(username string) {
+	b.mu.RLock()
+	welcome := b.welcome
+	b.mu.RUnlock()
+
+	if welcome != "" {
+		b.send(username, strings.ReplaceAll(welcome, "{username}", username))
+	}
+}
+
+// receive marks a message to the bot read and answers it
+func (b *Bot) receive(message *models.Message) {
+	b.hub.mu.Lock()
+	message.Status = "read"
+	senders := b.hub.clientsOf(message.From)
+	b.hub.mu.Unlock()
+
+	for _, sender := range senders {
+		b.hub.sendToClient(sender, "ack", &models.AckEvent{
+			MessageID: message.ID,
+			TempID:    message.TempID,
+			Status:    "read",
+		})
+	}
+
+	if reply := b.reply(message); reply != "" {
+		b.send(message.From, reply)
+	}
+}
+
+// reply works out the answer to a message
+func (b *Bot) reply(message *models.Message) string {
+	if message.Encrypted != nil {
+		return "I can't read encrypted messages. Send /help without encryption to see what I can do."
+	}
+
+	content := strings.TrimSpace(message.Content)
+	if !strings.HasPrefix(content, "/") {
+		return "I only understand commands. Send /help to see them."
+	}
+
+	name, args, _ := strings.Cut(strings.TrimPrefix(content, "/"), " ")
+	b.mu.RLock()
+	command, exists := b.commands[strings.ToLower(name)]
+	b.mu.RUnlock()
+
+	if !exists {
+		return fmt.Sprintf("Unknown command /%s. Send /help to see what I understand.", name)
+	}
+	return command.handler(message.From, strings.TrimSpace(args))
+}
+
+// help lists the registered commands
+func (b *Bot) help(from, args string) string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	names := make([]string, 0, len(b.commands))
+	for name := range b.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{"Here's what I understand:"}
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("/%s - %s", name, b.commands[name].description))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// send delivers a message from the bot to username
+func (b *Bot) send(username, content string) {
+	log.Printf("Bot replying to %s", username)
+	b.hub.deliverMessage(&models.Message{
+		ID:        uuid.New().String(),
+		From:      BotUsername,
+		To:        username,
+		Content:   content,
+		Timestamp: time.Now(),
+		Status:    "sent",
+	}, "message")
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+// Broker carries events between server instances, so a user connected to one
+// instance gets messages, typing and presence raised on another. Topics are
+// "user.<username>" for events addressed to one user and "presence" for
+// status changes.
+type Broker interface {
+	// Publish sends data to every instance subscribed to topic. It must not
+	// block; a message that can't be sent is dropped and logged.
+	Publish(topic string, data []byte)
+
+	// Subscribe calls handler with every message published on any topic,
+	// including this instance's own, until the broker is closed. A
+	// TopicWatcher only delivers user topics once they are watched.
+	Subscribe(handler func(topic string, data []byte)) error
+
+	Close() error
+}
+
+// TopicWatcher is implemented by brokers that deliver a user's topic only to
+// the instances watching it, rather than to every instance
+type TopicWatcher interface {
+	// Watch and Unwatch start and stop delivering topic to the handler
+	// passed to Subscribe. They must not block.
+	Watch(topic string)
+	Unwatch(topic string)
+}
+
+const (
+	userTopicPrefix = "user."
+	presenceTopic   = "presence"
+)
+
+// relayEvent is what instances publish to each other. Origin lets an
+// instance skip the events it published itself.
+type relayEvent struct {
+	Origin  string          `json:"origin"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// relayStatus is the payload of a presence event
+type relayStatus struct {
+	Username string     `json:"username"`
+	Online   bool       `json:"online"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+// UseBroker relays events through broker from now on, and delivers the ones
+// other instances relay to this instance's connections
+func (h *Hub) UseBroker(broker Broker) error {
+	h.Broker = broker
+	return broker.Subscribe(h.handleRelayed)
+}
+
+func (h *Hub) publish(topic, msgType string, payload interface{}) {
+	if h.Broker == nil {
+		return
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling %s for the broker: %v", msgType, err)
+		return
+	}
+	event, err := json.Marshal(&relayEvent{Origin: h.instanceID, Type: msgType, Payload: data})
+	if err != nil {
+		log.Printf("Error marshaling %s for the broker: %v", msgType, err)
+		return
+	}
+	h.Broker.Publish(topic, event)
+}
+
+// watchUser starts or stops taking username's events from other instances,
+// as their first device connects here or their last disconnects. Callers
+// must hold h.mu.
+func (h *Hub) watchUser(username string, watch bool) {
+	watcher, ok := h.Broker.(TopicWatcher)
+	if !ok {
+		return
+	}
+	if watch {
+		watcher.Watch(userTopicPrefix + username)
+	} else {
+		watcher.Unwatch(userTopicPrefix + username)
+	}
+}
+
+// relayToUser sends an event to username's connections on other instances.
+// They only get it live; offline queueing and push stay with this instance.
+func (h *Hub) relayToUser(username, msgType string, payload interface{}) {
+	h.publish(userTopicPrefix+username, msgType, payload)
+}
+
+// relayStatus tells other instances that username came online or went
+// offline here. Callers must hold h.mu.
+func (h *Hub) relayStatus(username string, online bool) {
+	if h.Broker == nil {
+		return
+	}
+	status := &relayStatus{Username: username, Online: online}
+	if user, exists := h.Users[username]; exists && !online {
+		status.LastSeen = lastSeenAt(user)
+	}
+	h.publish(presenceTopic, "status", status)
+}
+
+// handleRelayed delivers an event another instance published
+func (h *Hub) handleRelayed(topic string, data []byte) {
+	var event relayEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		log.Printf("Ignoring malformed broker event on %s: %v", topic, err)
+		return
+	}
+	if event.Origin == h.instanceID {
+		return
+	}
+
+	if topic == presenceTopic {
+		var status relayStatus
+		if err := json.Unmarshal(event.Payload, &status); err != nil {
+			log.Printf("Ignoring malformed broker status: %v", err)
+			return
+		}
+		h.applyRelayedStatus(&status)
+		return
+	}
+
+	username, ok := strings.CutPrefix(topic, userTopicPrefix)
+	if !ok {
+		return
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, client := range h.clientsOf(username) {
+		h.sendToClient(client, event.Type, event.Payload)
+	}
+}
+
+// applyRelayedStatus records a user's presence on another instance and tells
+// the connections here that can see it. Going offline elsewhere doesn't
+// count while the user is still connected here.
+func (h *Hub) applyRelayedStatus(status *relayStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Users who have only connected elsewhere become known here, so they
+	// can be messaged through this instance
+	user, exists := h.Users[status.Username]
+	if !exists {
+		user = &models.User{Username: status.Username}
+		h.Users[status.Username] = user
+	}
+	if user.Online == status.Online {
+		return
+	}
+	if !status.Online && h.isConnected(status.Username) {
+		return
+	}
+	user.Online = status.Online
+	if status.LastSeen != nil {
+		user.LastSeen = *status.LastSeen
+	}
+	h.sendStatus(status.Username, status.Online)
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+)
+
+// Buffers grown past this aren't pooled, so one huge frame doesn't keep its
+// memory around for every encode after it
+const maxPooledBuffer = 64 << 10
+
+// writeBufferPool lends connections a write buffer only while a frame is
+// being written, instead of each idle connection holding its own
+var writeBufferPool = &sync.Pool{}
+
+// encodeBuffer is scratch space for encoding a frame, with a JSON encoder
+// bound to it. Encoded frames outlive the call (streams keep them for replay,
+// outboxes until there's room), so what's kept is copied out at its exact
+// size and the buffer goes back to the pool.
+type encodeBuffer struct {
+	buf     bytes.Buffer
+	encoder *json.Encoder
+
+	// For encodings built by appending, reused across encodes
+	scratch []byte
+}
+
+var encodeBuffers = sync.Pool{
+	New: func() interface{} {
+		b := &encodeBuffer{}
+		b.encoder = json.NewEncoder(&b.buf)
+		return b
+	},
+}
+
+func getEncodeBuffer() *encodeBuffer {
+	return encodeBuffers.Get().(*encodeBuffer)
+}
+
+func putEncodeBuffer(b *encodeBuffer) {
+	if b.buf.Cap() > maxPooledBuffer || cap(b.scratch) > maxPooledBuffer {
+		return
+	}
+	b.buf.Reset()
+	b.scratch = b.scratch[:0]
+	encodeBuffers.Put(b)
+}
+
+// encodeJSON encodes v as json.Marshal would. The result is only valid until
+// the buffer is encoded into again or put back.
+func (b *encodeBuffer) encodeJSON(v interface{}) ([]byte, error) {
+	b.buf.Reset()
+	if err := b.encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	// Encode terminates each value with a newline
+	return bytes.TrimSuffix(b.buf.Bytes(), []byte("\n")), nil
+}
+
+// marshalJSON is json.Marshal on a pooled buffer
+func marshalJSON(v interface{}) ([]byte, error) {
+	b := getEncodeBuffer()
+	defer putEncodeBuffer(b)
+	data, err := b.encodeJSON(v)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(data), nil
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"whatsdown/internal/models"
+)
+
+// Reasons a WebSocket upgrade is refused for capacity
+var (
+	errConnectionLimit = errors.New("server is at its connection limit")
+	errIPLimit         = errors.New("too many connections from this address")
+)
+
+// connectionSlots counts WebSocket connections in total and by client IP, so
+// new ones can be refused at MaxConnections or MaxConnectionsPerIP
+type connectionSlots struct {
+	mu    sync.Mutex
+	total int
+	byIP  map[string]int
+
+	// Upgrades and logins refused since startup, by the limit hit
+	refusedTotal atomic.Int64
+	refusedIP    atomic.Int64
+	refusedUsers atomic.Int64
+}
+
+func newConnectionSlots() *connectionSlots {
+	return &connectionSlots{byIP: make(map[string]int)}
+}
+
+// reserveConnection takes a slot for a connection from ip, returning the
+// function that gives it back once the connection ends, or the limit hit
+func (h *Hub) reserveConnection(ip string) (release func(), err error) {
+	slots := h.slots
+	slots.mu.Lock()
+	defer slots.mu.Unlock()
+
+	if h.MaxConnections > 0 && slots.total >= h.MaxConnections {
+		slots.refusedTotal.Add(1)
+		return nil, errConnectionLimit
+	}
+	if h.MaxConnectionsPerIP > 0 && slots.byIP[ip] >= h.MaxConnectionsPerIP {
+		slots.refusedIP.Add(1)
+		return nil, errIPLimit
+	}
+	slots.total++
+	slots.byIP[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			slots.mu.Lock()
+			defer slots.mu.Unlock()
+			slots.total--
+			if slots.byIP[ip]--; slots.byIP[ip] <= 0 {
+				delete(slots.byIP, ip)
+			}
+		})
+	}, nil
+}
+
+// refuseConnection answers an upgrade refused by reserveConnection: 503 when
+// the server is full, 429 when the address has too many connections. Either
+// way the client is told when to try again.
+func (h *Hub) refuseConnection(w http.ResponseWriter, ip string, err error) {
+	log.Printf("Refusing WebSocket from %s: %v", ip, err)
+	w.Header().Set("Retry-After", strconv.Itoa(int(h.reconnectHint().Seconds())))
+	status := http.StatusServiceUnavailable
+	if errors.Is(err, errIPLimit) {
+		status = http.StatusTooManyRequests
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// admitUser reports whether username may log in or connect: they're already
+// known here, or there's room for another user under MaxUsers
+func (h *Hub) admitUser(username string) bool {
+	if h.MaxUsers <= 0 {
+		return true
+	}
+	h.mu.RLock()
+	_, known := h.Users[username]
+	users := len(h.Users) - 1 // Not counting the bot
+	h.mu.RUnlock()
+
+	if known || users < h.MaxUsers {
+		return true
+	}
+	h.slots.refusedUsers.Add(1)
+	return false
+}
+
+// Metrics returns connection and user counts against their limits
+func (h *Hub) Metrics() *models.ServerMetrics {
+	h.mu.RLock()
+	users := len(h.Users) - 1
+	h.mu.RUnlock()
+
+	slots := h.slots
+	slots.mu.Lock()
+	connections, addresses := slots.total, len(slots.byIP)
+	slots.mu.Unlock()
+
+	return &models.ServerMetrics{
+		Connections:         connections,
+		ConnectionAddresses: addresses,
+		MaxConnections:      h.MaxConnections,
+		MaxConnectionsPerIP: h.MaxConnectionsPerIP,
+		Users:               users,
+		MaxUsers:            h.MaxUsers,
+		RefusedConnections:  slots.refusedTotal.Load(),
+		RefusedPerIP:        slots.refusedIP.Load(),
+		RefusedUsers:        slots.refusedUsers.Load(),
+	}
+}
+
+// HandleMetrics handles GET /api/admin/metrics
+func (h *HTTPHandlers) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := h.requireAdmin(w, r); !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Hub.Metrics())
+}
@@ -0,0 +1,366 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"whatsdown/internal/models"
+
+	"github.com/google/uuid"
+)
+
+var (
+	errChannelNotFound = errors.New("channel not found")
+	errNotChannelOwner = errors.New("only the channel owner can do that")
+)
+
+// CreateChannelRequest represents a request to create a broadcast channel
+type CreateChannelRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// ChannelPublisherRequest represents a request to grant publish rights
+type ChannelPublisherRequest struct {
+	Username string `json:"username"`
+}
+
+// ChannelResponse represents a channel along with the caller's relationship to it
+type ChannelResponse struct {
+	*models.Channel
+	SubscriberCount int  `json:"subscriberCount"`
+	Subscribed      bool `json:"subscribed"`
+	CanPublish      bool `json:"canPublish"`
+}
+
+// CreateChannel creates a channel owned by owner, who is subscribed automatically
+func (h *Hub) CreateChannel(owner, name, description string) *ChannelResponse {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	channel := &models.Channel{
+		ID:          uuid.New().String(),
+		Name:        name,
+		Description: description,
+		Owner:       owner,
+		Publishers:  []string{},
+		CreatedAt:   time.Now(),
+	}
+	h.Channels[channel.ID] = channel
+	h.Subscriptions[channel.ID] = map[string]bool{owner: true}
+
+	return h.channelResponse(channel, owner)
+}
+
+// ListChannels returns channels whose name matches query, most subscribed first
+func (h *Hub) ListChannels(query, username string) []*ChannelResponse {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	results := []*ChannelResponse{}
+	for _, channel := range h.Channels {
+		if contains(channel.Name, query) {
+			results = append(results, h.channelResponse(channel, username))
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].SubscriberCount != results[j].SubscriberCount {
+			return results[i].SubscriberCount > results[j].SubscriberCount
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results
+}
+
+// GetChannel returns a channel as seen by username
+func (h *Hub) GetChannel(channelID, username string) (*ChannelResponse, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	channel, exists := h.Channels[channelID]
+	if !exists {
+		return nil, errChannelNotFound
+	}
+	return h.channelResponse(channel, username), nil
+}
+
+// Subscribe adds username to a channel's subscribers
+func (h *Hub) Subscribe(channelID, username string) (*ChannelResponse, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	channel, exists := h.Channels[channelID]
+	if !exists {
+		return nil, errChannelNotFound
+	}
+	h.Subscriptions[channelID][username] = true
+	return h.channelResponse(channel, username), nil
+}
+
+// Unsubscribe removes username from a channel's subscribers
+func (h *Hub) Unsubscribe(channelID, username string) (*ChannelResponse, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	channel, exists := h.Channels[channelID]
+	if !exists {
+		return nil, errChannelNotFound
+	}
+	delete(h.Subscriptions[channelID], username)
+	return h.channelResponse(channel, username), nil
+}
+
+// SetChannelPublisher grants or revokes publish rights; only the owner may do so
+func (h *Hub) SetChannelPublisher(channelID, owner, username string, publisher bool) (*ChannelResponse, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	channel, exists := h.Channels[channelID]
+	if !exists {
+		return nil, errChannelNotFound
+	}
+	if channel.Owner != owner {
+		return nil, errNotChannelOwner
+	}
+
+	channel.Publishers = removeString(channel.Publishers, username)
+	if publisher && username != owner {
+		if _, exists := h.Users[username]; !exists {
+			return nil, errUnknownUser
+		}
+		channel.Publishers = append(channel.Publishers, username)
+	}
+	return h.channelResponse(channel, owner), nil
+}
+
+// GetChannelMessages returns a channel's posts. Channels are public, so any
+// user may read them.
+func (h *Hub) GetChannelMessages(channelID, username string) ([]*models.Message, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if _, exists := h.Channels[channelID]; !exists {
+		return nil, errChannelNotFound
+	}
+	return visibleMessages(h.conversation(models.ChannelConvKey(channelID)), username), nil
+}
+
+// deliverChannelPost stores a channel post and fans it out to online
+// subscribers, reporting whether it was stored
+func (h *Hub) deliverChannelPost(message *models.Message, msgType string) bool {
+	unlock := h.lockConversation(message.ConvKey())
+	defer unlock()
+	h.mu.RLock()
+
+	channel, exists := h.Channels[message.ChannelID]
+	if !exists || !channel.CanPublish(message.From) {
+		h.mu.RUnlock()
+		log.Printf("Dropping channel post from %s: cannot publish to %s", message.From, message.ChannelID)
+		h.sendError(message.From, &models.ErrorEvent{
+			Code:    ErrorInvalidRecipient,
+			Message: "not allowed to post in the channel",
+			TempID:  message.TempID,
+		})
+		return false
+	}
+
+	// Posts count as delivered once published
+	message.Status = "delivered"
+	h.storeMessage(message, nil)
+
+	// The publisher's devices get the post back as confirmation even if not subscribed
+	publishers := h.clientsOf(message.From)
+	recipients := []*Client{}
+	for username := range h.Subscriptions[channel.ID] {
+		if username == message.From {
+			continue
+		}
+		recipients = append(recipients, h.clientsOf(username)...)
+	}
+	h.mu.RUnlock()
+
+	if len(publishers) > 0 {
+		confirmation := senderOutboundMessage(message, message.Status)
+		for _, client := range publishers {
+			h.sendToClient(client, msgType, confirmation)
+		}
+	}
+
+	outbound := newOutboundMessage(message, message.Status)
+	for _, client := range recipients {
+		h.sendToClient(client, msgType, outbound)
+	}
+	return true
+}
+
+// channelResponse builds the caller's view of a channel. Callers must hold h.mu.
+func (h *Hub) channelResponse(channel *models.Channel, username string) *ChannelResponse {
+	subscribers := h.Subscriptions[channel.ID]
+	return &ChannelResponse{
+		Channel:         channel.Snapshot(),
+		SubscriberCount: len(subscribers),
+		Subscribed:      subscribers[username],
+		CanPublish:      channel.CanPublish(username),
+	}
+}
+
+// channelErrorStatus maps channel errors to HTTP status codes
+func channelErrorStatus(err error) int {
+	switch err {
+	case errChannelNotFound:
+		return http.StatusNotFound
+	case errNotChannelOwner:
+		return http.StatusForbidden
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// HandleChannels handles GET /api/channels?search=<query> and POST /api/channels
+func (h *HTTPHandlers) HandleChannels(w http.ResponseWriter, r *http.Request) {
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		channels := h.Hub.ListChannels(r.URL.Query().Get("search"), session.Username)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(channels)
+
+	case http.MethodPost:
+		var req CreateChannelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		name := strings.TrimSpace(req.Name)
+		if len(name) == 0 || len(name) > 100 {
+			http.Error(w, "Channel name must be between 1 and 100 characters", http.StatusBadRequest)
+			return
+		}
+		description := strings.TrimSpace(req.Description)
+		if len(description) > 500 {
+			http.Error(w, "Channel description must be at most 500 characters", http.StatusBadRequest)
+			return
+		}
+
+		channel := h.Hub.CreateChannel(session.Username, name, description)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(channel)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleChannel handles the /api/channels/{id} subtree:
+//
+//	GET    /api/channels/{id}
+//	GET    /api/channels/{id}/messages?sinceSeq=<n>
+//	GET    /api/channels/{id}/pins
+//	POST   /api/channels/{id}/subscribe
+//	POST   /api/channels/{id}/unsubscribe
+//	POST   /api/channels/{id}/publishers
+//	DELETE /api/channels/{id}/publishers/{username}
+func (h *HTTPHandlers) HandleChannel(w http.ResponseWriter, r *http.Request) {
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/channels/"), "/"), "/")
+	channelID := parts[0]
+	if channelID == "" {
+		http.Error(w, "Channel ID required", http.StatusBadRequest)
+		return
+	}
+
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	var result interface{}
+	var err error
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		result, err = h.Hub.GetChannel(channelID, session.Username)
+
+	case action == "messages" && r.Method == http.MethodGet:
+		since, ok := parseSinceSeq(w, r)
+		if !ok {
+			return
+		}
+		var messages []*models.Message
+		if messages, err = h.Hub.GetChannelMessages(channelID, session.Username); err == nil {
+			result = messagesAfter(messages, since)
+		}
+
+	case action == "pins" && r.Method == http.MethodGet:
+		if _, err = h.Hub.GetChannel(channelID, session.Username); err == nil {
+			result = h.Hub.GetPinnedMessages(models.ChannelConvKey(channelID), session.Username)
+		}
+
+	case action == "media" && r.Method == http.MethodGet:
+		section, beforeSeq, limit, ok := parseGalleryQuery(w, r)
+		if !ok {
+			return
+		}
+		if _, err = h.Hub.GetChannel(channelID, session.Username); err == nil {
+			result = h.Hub.ConversationMedia(models.ChannelConvKey(channelID), session.Username, section, beforeSeq, limit)
+		}
+
+	case action == "mute":
+		if _, err = h.Hub.GetChannel(channelID, session.Username); err == nil {
+			h.handleMute(w, r, session.Username, models.ChannelConvKey(channelID), &models.Mute{ChannelID: channelID})
+			return
+		}
+
+	case action == "archive" || action == "unarchive":
+		if _, err = h.Hub.GetChannel(channelID, session.Username); err == nil {
+			h.handleArchive(w, r, session.Username, models.ChannelConvKey(channelID), action, &models.Archive{ChannelID: channelID})
+			return
+		}
+
+	case action == "subscribe" && r.Method == http.MethodPost:
+		result, err = h.Hub.Subscribe(channelID, session.Username)
+
+	case action == "unsubscribe" && r.Method == http.MethodPost:
+		result, err = h.Hub.Unsubscribe(channelID, session.Username)
+
+	case action == "publishers" && len(parts) == 2 && r.Method == http.MethodPost:
+		var req ChannelPublisherRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		result, err = h.Hub.SetChannelPublisher(channelID, session.Username, strings.TrimSpace(req.Username), true)
+
+	case action == "publishers" && len(parts) == 3 && r.Method == http.MethodDelete:
+		result, err = h.Hub.SetChannelPublisher(channelID, session.Username, parts[2], false)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), channelErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
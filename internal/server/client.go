@@ -2,8 +2,10 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"whatsdown/internal/models"
@@ -11,20 +13,6 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-const (
-	// Time allowed to write a message to the peer
-	writeWait = 10 * time.Second
-
-	// Time allowed to read the next pong message from the peer
-	pongWait = 60 * time.Second
-
-	// Send pings to peer with this period (must be less than pongWait)
-	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from peer
-	maxMessageSize = 512 * 1024
-)
-
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -35,10 +23,71 @@ var upgrader = websocket.Upgrader{
 
 // Client represents a WebSocket client connection
 type Client struct {
-	Username string
-	Conn     *websocket.Conn
-	Send     chan []byte
-	Hub      *Hub
+	Username  string
+	SessionID string
+	DeviceID  string // Chosen by the client with ?deviceId=; receipts are tracked per device
+	Conn      *websocket.Conn // nil for long-poll clients
+	Send      chan []byte
+	Hub       *Hub
+
+	// Subprotocol negotiated in the upgrade, empty if the client offered none
+	Subprotocol string
+
+	// Frame encoding and protocol version negotiated through the WebSocket
+	// subprotocol, and the smallest frame to compress (-1 for none)
+	codec            wireCodec
+	protocolVersion  int
+	compressMinBytes int
+
+	// Frames being joined into a batch, reused by writePump
+	coalesced [][]byte
+
+	// Limits the frames the client may send; nil for no limit
+	limiter *frameLimiter
+
+	// Keepalive timings, fixed when the client connects
+	heartbeat heartbeat
+
+	// Set for long-poll clients
+	poll *poller
+
+	// Shown in the device list
+	DeviceName string
+	UserAgent  string
+	Platform   string
+	lastActive time.Time
+	idle       bool
+
+	// Presence subscriptions; once subscribing, the client only receives
+	// status events for users it watches. Guarded by Hub.mu.
+	subscribesPresence bool
+	presenceSubs       map[string]bool
+
+	// Sequenced events for resuming after a reconnect; nil when disabled.
+	// Detached clients only record into the stream of a disconnected device.
+	stream       *eventStream
+	detached     bool
+	resumeStream string
+	resumeSeq    int64
+
+	// Events dispatched to the client, waiting for a delivery worker
+	deliveries clientDeliveries
+
+	// Gives back the connection's slot under the hub's connection limits
+	releaseSlot func()
+
+	// Close frame sent when Send is closed; an empty frame if closeCode is 0
+	closeCode   int
+	closeReason string
+
+	// Frames waiting for room in Send, retried with backoff, and under the
+	// "spill" policy those that didn't fit in the outbox
+	spill      *spillQueue
+	outbox     []outboxFrame
+	retries    int
+	retryTimer *time.Timer
+	closed     bool
+	mu         sync.Mutex
 }
 
 // readPump pumps messages from the WebSocket connection to the hub
@@ -46,61 +95,96 @@ func (c *Client) readPump() {
 	defer func() {
 		c.Hub.Unregister <- c
 		c.Conn.Close()
+		c.releaseSlot()
 	}()
 
-	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.Conn.SetReadLimit(maxMessageSize)
+	c.Conn.SetReadDeadline(time.Now().Add(c.heartbeat.pongTimeout))
 	c.Conn.SetPongHandler(func(string) error {
-		c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.Conn.SetReadDeadline(time.Now().Add(c.heartbeat.pongTimeout))
 		return nil
 	})
 
 	for {
-		_, messageBytes, err := c.Conn.ReadMessage()
+		messageBytes, tooLarge, err := readFrame(c.Conn, c.Hub.MaxFrameBytes)
+		if err == errFrameTooLarge {
+			log.Printf("Closing connection of %s: frame far over the maximum size", c.Username)
+			c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseMessageTooBig, err.Error()), time.Now().Add(c.heartbeat.writeTimeout))
+			break
+		}
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket read error for %s: %v", c.Username, err)
 			}
 			break
 		}
+		if !c.limiter.allow() {
+			log.Printf("Discarding frame from %s: rate limited", c.Username)
+			c.rateLimited()
+			continue
+		}
+		if tooLarge {
+			log.Printf("Discarding oversized frame from %s", c.Username)
+			c.sendError(&models.ErrorEvent{
+				Code:    ErrorPayloadTooLarge,
+				Message: "frame exceeds the maximum size",
+				Limit:   c.Hub.MaxFrameBytes,
+			})
+			continue
+		}
+
+		// Any client traffic counts as session and device activity, and
+		// brings an away user back. Once the session has expired the
+		// connection is closed; reading goes on until the close is answered.
+		if !sessionStore.Touch(c.SessionID) {
+			c.closeWith(CloseSessionExpired, "session expired")
+			continue
+		}
+		if c.touch() {
+			c.Hub.markActive(c.Username)
+		}
 
 		// Parse WebSocket message
 		var wsMsg models.WSMessage
-		if err := json.Unmarshal(messageBytes, &wsMsg); err != nil {
+		if err := c.codec.Unmarshal(messageBytes, &wsMsg); err != nil {
 			log.Printf("Error unmarshaling WebSocket message: %v", err)
+			c.invalidPayload("", err)
 			continue
 		}
 
-		// Handle different message types
-		switch wsMsg.Type {
-		case "message":
-			var inboundMsg models.InboundMessage
-			payloadBytes, _ := json.Marshal(wsMsg.Payload)
-			if err := json.Unmarshal(payloadBytes, &inboundMsg); err != nil {
-				log.Printf("Error unmarshaling message payload: %v", err)
-				continue
-			}
-			c.Hub.handleInboundMessageWithSender(c.Username, &inboundMsg)
+		c.handleFrame(&wsMsg)
+	}
+}
 
-		case "typing":
-			var typingEvent models.TypingEvent
-			payloadBytes, _ := json.Marshal(wsMsg.Payload)
-			if err := json.Unmarshal(payloadBytes, &typingEvent); err != nil {
-				log.Printf("Error unmarshaling typing payload: %v", err)
-				continue
-			}
-			c.Hub.TypingEvents <- &TypingEventWrapper{
-				From:     c.Username,
-				To:       typingEvent.To,
-				IsTyping: typingEvent.IsTyping,
-			}
+// handleFrame dispatches a frame the client sent to the handler registered
+// for its type
+func (c *Client) handleFrame(wsMsg *models.WSMessage) {
+	handler, ok := wsHandlerFor(wsMsg.Type)
+	if !ok {
+		// Version 1 clients may send types this server doesn't know;
+		// later versions are told
+		if c.protocolVersion >= 2 {
+			c.sendError(&models.ErrorEvent{
+				Code:    ErrorUnknownType,
+				Message: fmt.Sprintf("unknown message type %q", wsMsg.Type),
+			})
 		}
+		return
+	}
+
+	// Handlers decode the payload from JSON whatever the frame encoding
+	payload, err := json.Marshal(wsMsg.Payload)
+	if err == nil {
+		err = handler(c, payload)
+	}
+	if err != nil {
+		log.Printf("Error handling %s payload from %s: %v", wsMsg.Type, c.Username, err)
+		c.invalidPayload(wsMsg.Type, err)
 	}
 }
 
 // writePump pumps messages from the hub to the WebSocket connection
 func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.heartbeat.pingInterval)
 	defer func() {
 		ticker.Stop()
 		c.Conn.Close()
@@ -109,15 +193,24 @@ func (c *Client) writePump() {
 	for {
 		select {
 		case message, ok := <-c.Send:
-			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.Conn.SetWriteDeadline(time.Now().Add(c.heartbeat.writeTimeout))
 			if !ok {
 				// Hub closed the channel
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.Conn.WriteMessage(websocket.CloseMessage, c.closeMessage())
 				return
 			}
 
+			// Join it with any queued messages if coalescing
+			if c.coalesces() && len(c.Send) > 0 {
+				if err := c.writeCoalesced(message, len(c.Send)); err != nil {
+					log.Printf("WebSocket write coalesced messages error for %s: %v", c.Username, err)
+					return
+				}
+				continue
+			}
+
 			// Write the message as a separate WebSocket frame
-			if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
+			if err := c.writeFrame(message); err != nil {
 				log.Printf("WebSocket write error for %s: %v", c.Username, err)
 				return
 			}
@@ -126,14 +219,19 @@ func (c *Client) writePump() {
 			n := len(c.Send)
 			for i := 0; i < n; i++ {
 				queuedMsg := <-c.Send
-				if err := c.Conn.WriteMessage(websocket.TextMessage, queuedMsg); err != nil {
+				if err := c.writeFrame(queuedMsg); err != nil {
 					log.Printf("WebSocket write queued message error for %s: %v", c.Username, err)
 					return
 				}
 			}
 
 		case <-ticker.C:
-			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			// An idle connection outliving its session is closed here
+			if !sessionStore.Valid(c.SessionID) {
+				c.closeWith(CloseSessionExpired, "session expired")
+				continue
+			}
+			c.Conn.SetWriteDeadline(time.Now().Add(c.heartbeat.writeTimeout))
 			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				log.Printf("WebSocket ping error for %s: %v", c.Username, err)
 				return
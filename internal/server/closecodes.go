@@ -0,0 +1,54 @@
+package server
+
+import "whatsdown/internal/models"
+
+// Close codes the server ends a WebSocket with, from the private-use range,
+// so a client can tell whether reconnecting is worth it. A server shutdown
+// uses the standard 1001 (going away) and a client that stops answering
+// pings is dropped without a close frame.
+const (
+	// No subprotocol the client offered is supported; don't retry without
+	// changing what's offered
+	CloseUnsupportedProtocol = 4001
+
+	// The session expired; log in again before reconnecting
+	CloseSessionExpired = 4002
+
+	// The session was ended by logging out or revoking it or its device;
+	// log in again before reconnecting
+	CloseSessionRevoked = 4003
+
+	// A newer connection from the same device took over; don't reconnect
+	CloseReplaced = 4004
+
+	// The client fell too far behind reading its events; reconnect and
+	// resume
+	CloseTooSlow = 4005
+
+	// The account was suspended; don't reconnect
+	CloseSuspended = 4006
+
+	// The client kept sending over its rate limit; reconnect after backing
+	// off
+	CloseRateLimited = 4008
+)
+
+// disconnect ends client's connection with code and reason and unregisters it
+func (h *Hub) disconnect(client *Client, code int, reason string) {
+	client.closeWith(code, reason)
+	h.Unregister <- client
+}
+
+// closeStatus returns the close code and reason the client's connection was
+// ended with, or 0 if it wasn't given one
+func (c *Client) closeStatus() (int, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeCode, c.closeReason
+}
+
+// pollClosed fills in why a long-poll client was disconnected
+func (c *Client) pollClosed(response *models.PollResponse) {
+	response.Closed = true
+	response.CloseCode, response.CloseReason = c.closeStatus()
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"whatsdown/internal/models"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket subprotocols select the frame encoding and protocol version, as
+// "whatsdown.<encoding>.v<version>" or the short "<alias>.v<version>" (e.g.
+// "json.v1", "proto.v2"). The unversioned names are version 1. A client that
+// asks for none gets JSON version 1, which is what the embedded SPA uses.
+const (
+	SubprotocolJSON     = "whatsdown.json"
+	SubprotocolProtobuf = "whatsdown.protobuf"
+	SubprotocolMsgpack  = "whatsdown.msgpack"
+)
+
+// Protocol versions served side by side. Version 2 clients are told about
+// frames of types the server doesn't handle instead of having them ignored.
+const (
+	MinProtocolVersion = 1
+	ProtocolVersion    = 2
+)
+
+// wireCodec encodes the WSMessage envelope for one negotiated subprotocol
+type wireCodec interface {
+	Marshal(msg *models.WSMessage) ([]byte, error)
+	Unmarshal(data []byte, msg *models.WSMessage) error
+
+	// MarshalPayload encodes a payload on its own and MarshalEnvelope wraps
+	// it, together giving what Marshal does; an event going to many
+	// connections has its payload encoded once this way
+	MarshalPayload(payload interface{}) ([]byte, error)
+	MarshalEnvelope(msgType string, seq int64, payload []byte) []byte
+
+	// MarshalBatch wraps already encoded envelopes in one "batch" envelope
+	MarshalBatch(frames [][]byte) []byte
+
+	// IsBatch reports whether data is a "batch" envelope, which can't be
+	// nested in another
+	IsBatch(data []byte) bool
+
+	// websocket.TextMessage or websocket.BinaryMessage
+	FrameType() int
+}
+
+// Codecs by unversioned subprotocol, in order of preference
+var (
+	wireCodecs = map[string]wireCodec{
+		SubprotocolJSON:     jsonCodec{},
+		SubprotocolProtobuf: protobufCodec{},
+		SubprotocolMsgpack:  msgpackCodec{},
+	}
+	wireEncodings = []string{SubprotocolProtobuf, SubprotocolMsgpack, SubprotocolJSON}
+
+	// Short names of wireEncodings, in the same order; only accepted with a
+	// version
+	wireAliases = []string{"proto", "msgpack", "json"}
+)
+
+// wireSubprotocols lists every subprotocol offered to clients, newest
+// version first, then the unversioned names. The upgrader picks the first
+// of the client's offers that is listed, so the client's order wins.
+var wireSubprotocols = func() []string {
+	var names []string
+	for version := ProtocolVersion; version >= MinProtocolVersion; version-- {
+		for _, encoding := range wireEncodings {
+			names = append(names, fmt.Sprintf("%s.v%d", encoding, version))
+		}
+		for _, alias := range wireAliases {
+			names = append(names, fmt.Sprintf("%s.v%d", alias, version))
+		}
+	}
+	return append(names, wireEncodings...)
+}()
+
+// parseSubprotocol returns the codec and protocol version of a negotiated
+// subprotocol; none negotiated is JSON version 1
+func parseSubprotocol(subprotocol string) (wireCodec, int) {
+	if subprotocol == "" {
+		return jsonCodec{}, MinProtocolVersion
+	}
+	version := MinProtocolVersion
+	if i := strings.LastIndex(subprotocol, ".v"); i >= 0 {
+		if n, err := strconv.Atoi(subprotocol[i+2:]); err == nil {
+			version = n
+		}
+		subprotocol = subprotocol[:i]
+		for j, alias := range wireAliases {
+			if subprotocol == alias {
+				subprotocol = wireEncodings[j]
+			}
+		}
+	}
+	if codec, ok := wireCodecs[subprotocol]; ok {
+		return codec, version
+	}
+	return jsonCodec{}, MinProtocolVersion
+}
+
+// rejectUnsupportedProtocol closes conn if the client asked for subprotocols
+// but none of them was one the server speaks, reporting whether it did
+func rejectUnsupportedProtocol(conn *websocket.Conn, r *http.Request, writeTimeout time.Duration) bool {
+	if conn.Subprotocol() != "" || len(websocket.Subprotocols(r)) == 0 {
+		return false
+	}
+	reason := fmt.Sprintf("unsupported protocol; versions %d-%d of %s", MinProtocolVersion, ProtocolVersion, strings.Join(wireEncodings, ", "))
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(CloseUnsupportedProtocol, reason), time.Now().Add(writeTimeout))
+	conn.Close()
+	return true
+}
+
+// jsonCodec sends envelopes as JSON text frames
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(msg *models.WSMessage) ([]byte, error) {
+	return marshalJSON(msg)
+}
+
+func (jsonCodec) MarshalPayload(payload interface{}) ([]byte, error) {
+	return marshalJSON(payload)
+}
+
+func (jsonCodec) MarshalEnvelope(msgType string, seq int64, payload []byte) []byte {
+	b := getEncodeBuffer()
+	defer putEncodeBuffer(b)
+	// Encoding a string can't fail
+	quotedType, _ := b.encodeJSON(msgType)
+
+	data := make([]byte, 0, len(quotedType)+len(payload)+48)
+	data = append(data, `{"type":`...)
+	data = append(data, quotedType...)
+	if seq != 0 {
+		data = append(data, `,"seq":`...)
+		data = strconv.AppendInt(data, seq, 10)
+	}
+	data = append(data, `,"payload":`...)
+	data = append(data, payload...)
+	return append(data, '}')
+}
+
+func (jsonCodec) Unmarshal(data []byte, msg *models.WSMessage) error {
+	return json.Unmarshal(data, msg)
+}
+
+func (jsonCodec) MarshalBatch(frames [][]byte) []byte {
+	const head, tail = `{"type":"batch","payload":[`, "]}"
+	size := len(head) + len(tail) + len(frames)
+	for _, frame := range frames {
+		size += len(frame)
+	}
+	data := append(make([]byte, 0, size), head...)
+	for i, frame := range frames {
+		if i > 0 {
+			data = append(data, ',')
+		}
+		data = append(data, frame...)
+	}
+	return append(data, tail...)
+}
+
+func (jsonCodec) IsBatch(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(`{"type":"batch",`))
+}
+
+func (jsonCodec) FrameType() int {
+	return websocket.TextMessage
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"whatsdown/internal/models"
+)
+
+// nested returns depth lists, each holding the next, around a string
+func nested(depth int) interface{} {
+	var value interface{} = "core"
+	for i := 0; i < depth; i++ {
+		value = []interface{}{value}
+	}
+	return value
+}
+
+// protoFrame encodes an envelope carrying payload, which must already be in
+// the form encoding/json decodes to
+func protoFrame(msgType string, payload interface{}) []byte {
+	return protobufCodec{}.MarshalEnvelope(msgType, 0, appendProtoValue(nil, payload))
+}
+
+// msgpackFrame encodes an envelope carrying payload as msgpackCodec does
+func msgpackFrame(msgType string, payload interface{}) []byte {
+	data := appendMsgpackLength(nil, 2, 0x80, 0xde)
+	data = appendMsgpack(data, "type")
+	data = appendMsgpack(data, msgType)
+	data = appendMsgpack(data, "payload")
+	return appendMsgpack(data, payload)
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	payload := &models.ErrorEvent{Code: ErrorRateLimited, Message: "slow down", Limit: 20, TempID: "t1"}
+	want := map[string]interface{}{"code": ErrorRateLimited, "message": "slow down", "limit": float64(20), "tempId": "t1"}
+
+	for name, codec := range wireCodecs {
+		t.Run(name, func(t *testing.T) {
+			data, err := codec.Marshal(&models.WSMessage{Type: "error", Seq: 7, Payload: payload})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg models.WSMessage
+			if err := codec.Unmarshal(data, &msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type != "error" || msg.Seq != 7 {
+				t.Errorf("envelope = %s %d, want error 7", msg.Type, msg.Seq)
+			}
+			got, ok := msg.Payload.(map[string]interface{})
+			if !ok {
+				t.Fatalf("payload = %#v", msg.Payload)
+			}
+			// MessagePack keeps whole numbers as integers
+			if limit, ok := got["limit"].(int64); ok {
+				got["limit"] = float64(limit)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("payload = %#v, want %#v", got, want)
+			}
+		})
+	}
+}
+
+func TestCodecsLimitNesting(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec wireCodec
+		frame func(string, interface{}) []byte
+		err   error
+	}{
+		{"protobuf", protobufCodec{}, protoFrame, errProtobufMalformed},
+		{"msgpack", msgpackCodec{}, msgpackFrame, errMsgpackMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var msg models.WSMessage
+			if err := tt.codec.Unmarshal(tt.frame("x", nested(32)), &msg); err != nil {
+				t.Errorf("32 levels: %v", err)
+			}
+			if err := tt.codec.Unmarshal(tt.frame("x", nested(10000)), &msg); !errors.Is(err, tt.err) {
+				t.Errorf("10000 levels: error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func FuzzProtobufUnmarshal(f *testing.F) {
+	f.Add(protoFrame("message", map[string]interface{}{"to": "bob", "content": "hi", "n": 1.5, "ok": true, "tags": []interface{}{"a", nil}}))
+	f.Add(protoFrame("x", nested(70)))
+	f.Add([]byte{0x12, 0xff, 0xff, 0xff, 0xff, 0x0f})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var msg models.WSMessage
+		if err := (protobufCodec{}).Unmarshal(data, &msg); err != nil {
+			return
+		}
+		// Payloads are re-encoded when relayed; NaN can't be, but mustn't panic
+		(protobufCodec{}).Marshal(&msg)
+	})
+}
+
+func FuzzMsgpackUnmarshal(f *testing.F) {
+	f.Add(msgpackFrame("message", map[string]interface{}{"to": "bob", "content": "hi", "n": int64(-3), "f": 1.5, "tags": []interface{}{"a", nil, true}}))
+	f.Add(msgpackFrame("x", nested(70)))
+	f.Add([]byte{0xdf, 0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var msg models.WSMessage
+		if err := (msgpackCodec{}).Unmarshal(data, &msg); err != nil {
+			return
+		}
+		// Payloads are re-encoded when relayed; NaN can't be, but mustn't panic
+		(msgpackCodec{}).Marshal(&msg)
+	})
+}
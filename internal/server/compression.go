@@ -0,0 +1,59 @@
+package server
+
+import "compress/flate"
+
+// permessage-deflate modes: off, on for every frame, or only for frames of at
+// least the configured threshold. Compression is negotiated per connection,
+// so clients that don't offer it get uncompressed frames in any mode.
+//
+// Context takeover is always disabled in both directions: each frame is
+// compressed on its own with a pooled compressor, so connections hold no
+// deflate state between frames.
+const (
+	CompressionOff       = "off"
+	CompressionOn        = "on"
+	CompressionThreshold = "threshold"
+)
+
+// ValidCompression reports whether the compression settings are usable
+func ValidCompression(mode string, threshold, level int) bool {
+	switch mode {
+	case CompressionOff, CompressionOn, CompressionThreshold:
+	default:
+		return false
+	}
+	return threshold >= 0 && level >= flate.BestSpeed && level <= flate.BestCompression
+}
+
+// compressionMinBytes returns the smallest frame h compresses, or -1 if it
+// doesn't compress
+func (h *Hub) compressionMinBytes() int {
+	switch h.Compression {
+	case CompressionOn:
+		return 0
+	case CompressionThreshold:
+		return h.CompressionThreshold
+	}
+	return -1
+}
+
+// writeFrame writes data as one frame in the client's encoding, compressing
+// it if compression was negotiated and the frame is large enough
+func (c *Client) writeFrame(data []byte) error {
+	if c.compressMinBytes >= 0 {
+		c.Conn.EnableWriteCompression(len(data) >= c.compressMinBytes)
+	}
+	return c.Conn.WriteMessage(c.codec.FrameType(), data)
+}
+
+// setupCompression applies h's compression settings to a new connection
+func (h *Hub) setupCompression(client *Client) {
+	client.compressMinBytes = h.compressionMinBytes()
+	if client.compressMinBytes < 0 {
+		return
+	}
+	if err := client.Conn.SetCompressionLevel(h.CompressionLevel); err != nil {
+		client.compressMinBytes = -1
+		client.Conn.EnableWriteCompression(false)
+	}
+}
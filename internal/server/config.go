@@ -0,0 +1,515 @@
+package server
+
+import (
+	"crypto/subtle"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds deployment-specific server settings
+type Config struct {
+	// Sessions expire after this long without activity
+	SessionIdleTimeout time.Duration
+
+	// Sessions expire this long after login regardless of activity
+	SessionAbsoluteTimeout time.Duration
+
+	// Usernames allowed to call /api/admin endpoints, and the token they must
+	// also send in the X-Admin-Token header; admin endpoints are disabled
+	// without one
+	Admins     []string
+	AdminToken string
+
+	// CIDRs allowed to reach /api and /ws; empty allows all
+	IPAllowlist []string
+
+	// CIDRs always rejected from /api and /ws
+	IPDenylist []string
+
+	// File the audit log is appended to; empty keeps it in memory only
+	AuditLogPath string
+
+	// Audit events kept in memory for querying before the oldest are
+	// dropped; the file keeps every event. 0 means unlimited.
+	AuditEventLimit int
+
+	// TLS certificate and key; the server listens over HTTPS when both are set
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// Security headers; an empty policy omits the header
+	ContentSecurityPolicy string
+	ReferrerPolicy        string
+
+	// Strict-Transport-Security max-age sent over TLS; zero ("off") disables HSTS
+	HSTSMaxAge time.Duration
+
+	// Sanitizers applied in order to message content before storage
+	MessageSanitizers []string
+
+	// Filters applied in order after sanitization; they may rewrite or reject a message
+	MessageFilters []string
+
+	// Words masked by the "profanity" filter
+	ProfanityWords []string
+
+	// Phrases that make the "keywords" filter reject a message
+	BlockedKeywords []string
+
+	// Score at which the "spam" filter rejects a message
+	SpamScoreThreshold int
+
+	// Maximum pinned messages per conversation
+	MaxPinnedMessages int
+
+	// Largest WebSocket frame accepted from a client, in bytes; larger frames
+	// are discarded with an "error" event
+	MaxFrameBytes int
+
+	// Longest message content accepted, in characters; 0 means unlimited
+	MaxMessageLength int
+
+	// Messages held in memory per conversation, and the estimated memory
+	// all conversations' messages may take, before the oldest are evicted
+	// (from the conversations least recently written to, for the latter).
+	// There's no persistent store, so evicted messages are gone. 0 means
+	// unlimited.
+	MaxConversationMessages int
+	MaxHistoryBytes         int64
+
+	// Frames per second each WebSocket connection may send, with bursts of up
+	// to FrameRateBurst; frames over the limit are discarded with an "error"
+	// event. 0 means unlimited.
+	FrameRateLimit int
+	FrameRateBurst int
+
+	// WebSocket keepalive: the server pings every PingInterval and drops
+	// connections that don't answer within PongTimeout. Clients may ask for
+	// ping intervals up to MaxPingInterval to save battery.
+	PingInterval    time.Duration
+	MaxPingInterval time.Duration
+	PongTimeout     time.Duration
+	WriteTimeout    time.Duration
+
+	// Slow clients: frames held per client beyond its send buffer, what to do
+	// once that many are held ("disconnect", "grow", "drop_oldest" or
+	// "spill"), and where "spill" writes the overflow
+	SlowClientBuffer int
+	SlowClientPolicy string
+	SpillDir         string
+
+	// Goroutines encoding events and queueing them to connections, so a
+	// slow connection doesn't hold up the hub; 0 queues them inline
+	DeliveryWorkers int
+
+	// WebSocket connections allowed at once in total and from one client IP,
+	// and distinct users allowed to log in; 0 means unlimited. Upgrades over
+	// the total or user limit get 503, over the per-IP limit 429.
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	MaxUsers            int
+
+	// On SIGTERM, how long to spend draining connections and requests, and
+	// the base delay clients are told to wait before reconnecting
+	ShutdownTimeout time.Duration
+	ReconnectAfter  time.Duration
+
+	// How long a user stays online to peers after their last device
+	// disconnects, so a reconnect after a network change doesn't flap their
+	// status; 0 marks them offline at once
+	ReconnectGrace time.Duration
+
+	// Events (receipts, group messages and changes, contact requests) held
+	// per user while none of their devices is connected; 0 holds none
+	OfflineEventLimit int
+
+	// Directory held offline events are saved to so they survive restarts;
+	// empty keeps them in memory only
+	OfflineQueueDir string
+
+	// Longest a long-poll request waits for events before answering with
+	// none. A long-poll device that hasn't polled for PongTimeout is dropped.
+	PollTimeout time.Duration
+
+	// Greeting the built-in bot sends new accounts; "{username}" is replaced
+	// with their name and empty disables it
+	BotWelcome string
+
+	// Identical content may go to at most this many other conversations per
+	// DuplicateWindow; 0 disables the check
+	DuplicateRecipientLimit int
+	DuplicateWindow         time.Duration
+
+	// Urgent messages each user may send per hour; 0 disables urgent messages
+	UrgentPerHour int
+
+	// File pending scheduled messages are saved to; empty keeps them in memory only
+	ScheduledMessagesPath string
+
+	// Directory uploaded media is stored in
+	MediaDir string
+
+	// Largest file accepted by /api/uploads, in bytes
+	MaxUploadBytes int64
+
+	// Background workers generating image thumbnails
+	ThumbnailWorkers int
+
+	// Largest video accepted by /api/uploads, in bytes, and its longest
+	// duration; 0 duration allows any length
+	MaxVideoBytes    int64
+	MaxVideoDuration time.Duration
+
+	// ffmpeg binary for video poster frames; empty disables them
+	FFmpegPath string
+
+	// MIME types ("type/subtype" or "type/*") uploads may have; empty allows
+	// any type not denied
+	UploadAllowedTypes []string
+	UploadDeniedTypes  []string
+
+	// Remove EXIF (including GPS), XMP and similar metadata from uploaded images
+	StripImageMetadata bool
+
+	// HMAC key and lifetime for signed media URLs; an empty key is random per
+	// run. With a base URL (a CDN in front of /media/) downloads redirect there.
+	MediaURLSecret  string
+	MediaURLTTL     time.Duration
+	MediaURLBaseURL string
+
+	// HMAC key and lifetime for WebSocket tickets; an empty key is random per
+	// run, so set one when several instances share a load balancer
+	WSTicketSecret string
+	WSTicketTTL    time.Duration
+
+	// Only allow direct messages between users who are contacts
+	ContactsOnly bool
+
+	// How long a disconnected device may resume its event stream (0 disables
+	// resuming) and how many recent events each stream keeps for replay
+	ResumeWindow time.Duration
+	ResumeBuffer int
+
+	// permessage-deflate for WebSocket frames: "off", "on", or "threshold" to
+	// compress only frames of at least CompressionThreshold bytes. The level
+	// runs from 1 (fastest) to 9 (smallest).
+	Compression          string
+	CompressionThreshold int
+	CompressionLevel     int
+
+	// Join events queued for a protocol version 2 client into "batch" frames
+	// when writing them, instead of writing one frame each
+	CoalesceWrites bool
+
+	// Mark users away after this long without activity on any device; 0 disables
+	IdleTimeout time.Duration
+
+	// Send presence changes to every connection that hasn't subscribed to
+	// specific users; turn off in large deployments
+	PresenceBroadcast bool
+
+	// Firebase service account key file; empty disables FCM push
+	FCMCredentialsFile string
+
+	// APNs token auth: .p8 key, its key ID, the team ID and the app's bundle ID.
+	// APNs push is enabled when all four are set.
+	APNsKeyFile string
+	APNsKeyID   string
+	APNsTeamID  string
+	APNsTopic   string
+	APNsSandbox bool
+
+	// VAPID contact (mailto: or https:) and base64url private key for Web Push.
+	// Web Push is enabled when the subject is set; without a key one is
+	// generated at startup.
+	VAPIDSubject    string
+	VAPIDPrivateKey string
+
+	// Push services browser subscriptions may point at; a host also covers
+	// its subdomains
+	WebPushHosts []string
+
+	// Base URL of a LibreTranslate-compatible API and its key; empty URL
+	// disables translation
+	TranslationURL    string
+	TranslationAPIKey string
+
+	// Redis server relaying events between instances, redis:// or rediss://,
+	// and sharing presence between them every PresenceHeartbeat; empty runs
+	// a single instance. Channels and keys are named with the prefix.
+	RedisURL          string
+	RedisPrefix       string
+	PresenceHeartbeat time.Duration
+
+	// NATS server relaying events between instances instead of Redis,
+	// nats:// or tls://. Subjects are named with the prefix.
+	NATSURL    string
+	NATSPrefix string
+
+	// Kafka brokers (host:port) and the topic every message, delivery and
+	// presence change is published to; no brokers disables the firehose
+	KafkaBrokers []string
+	KafkaTopic   string
+}
+
+// DefaultConfig returns the settings used when nothing is overridden
+func DefaultConfig() *Config {
+	return &Config{
+		SessionIdleTimeout:      24 * time.Hour,
+		SessionAbsoluteTimeout:  7 * 24 * time.Hour,
+		ContentSecurityPolicy:   "default-src 'self'; connect-src 'self' ws: wss:; img-src 'self' data: blob:; style-src 'self' 'unsafe-inline'; object-src 'none'; frame-ancestors 'none'; base-uri 'self'",
+		ReferrerPolicy:          "strict-origin-when-cross-origin",
+		HSTSMaxAge:              180 * 24 * time.Hour,
+		MessageSanitizers:       []string{"normalize", "strip_tags", "emoji"},
+		WebPushHosts:            []string{"fcm.googleapis.com", "push.services.mozilla.com", "push.apple.com", "notify.windows.com"},
+		SpamScoreThreshold:      5,
+		MaxPinnedMessages:       3,
+		UrgentPerHour:           5,
+		DuplicateRecipientLimit: 5,
+		DuplicateWindow:         10 * time.Minute,
+		MaxFrameBytes:           512 * 1024,
+		MaxMessageLength:        4096,
+		MaxConversationMessages: 10000,
+		AuditEventLimit:         100000,
+		MaxHistoryBytes:         1 << 30,
+		FrameRateLimit:          20,
+		FrameRateBurst:          50,
+		PingInterval:            54 * time.Second,
+		MaxPingInterval:         5 * time.Minute,
+		PongTimeout:             60 * time.Second,
+		WriteTimeout:            10 * time.Second,
+		SlowClientBuffer:        1024,
+		SlowClientPolicy:        SlowClientDisconnect,
+		SpillDir:                filepath.Join(os.TempDir(), "whatsdown-spill"),
+		DeliveryWorkers:         runtime.NumCPU(),
+		ShutdownTimeout:         15 * time.Second,
+		ReconnectAfter:          5 * time.Second,
+		ReconnectGrace:          10 * time.Second,
+		OfflineEventLimit:       1000,
+		PollTimeout:             25 * time.Second,
+		MediaDir:                filepath.Join(os.TempDir(), "whatsdown-media"),
+		MaxUploadBytes:          25 << 20,
+		ThumbnailWorkers:        2,
+		MaxVideoBytes:           100 << 20,
+		MaxVideoDuration:        3 * time.Minute,
+		FFmpegPath:              "ffmpeg",
+		UploadDeniedTypes:       defaultDeniedUploadTypes,
+		StripImageMetadata:      true,
+		PresenceBroadcast:       true,
+		IdleTimeout:             5 * time.Minute,
+		ResumeWindow:            2 * time.Minute,
+		ResumeBuffer:            500,
+		Compression:             CompressionOff,
+		CompressionThreshold:    1024,
+		CompressionLevel:        1,
+		MediaURLTTL:             time.Hour,
+		WSTicketTTL:             30 * time.Second,
+		RedisPrefix:             "whatsdown:",
+		PresenceHeartbeat:       10 * time.Second,
+		NATSPrefix:              "whatsdown.",
+		KafkaTopic:              "whatsdown.events",
+		BotWelcome:              "Welcome to whatsdown, {username}! Send /help to see what I can do.",
+	}
+}
+
+// LoadConfig returns the default config overridden by WHATSDOWN_* environment variables
+func LoadConfig() *Config {
+	cfg := DefaultConfig()
+	cfg.SessionIdleTimeout = envDuration("WHATSDOWN_SESSION_IDLE_TIMEOUT", cfg.SessionIdleTimeout)
+	cfg.SessionAbsoluteTimeout = envDuration("WHATSDOWN_SESSION_ABSOLUTE_TIMEOUT", cfg.SessionAbsoluteTimeout)
+	cfg.Admins = envList("WHATSDOWN_ADMINS", cfg.Admins)
+	cfg.AdminToken = os.Getenv("WHATSDOWN_ADMIN_TOKEN")
+	cfg.IPAllowlist = envList("WHATSDOWN_IP_ALLOWLIST", cfg.IPAllowlist)
+	cfg.IPDenylist = envList("WHATSDOWN_IP_DENYLIST", cfg.IPDenylist)
+	cfg.AuditLogPath = os.Getenv("WHATSDOWN_AUDIT_LOG_PATH")
+	cfg.AuditEventLimit = envInt("WHATSDOWN_AUDIT_EVENT_LIMIT", cfg.AuditEventLimit)
+	cfg.TLSCertFile = os.Getenv("WHATSDOWN_TLS_CERT")
+	cfg.TLSKeyFile = os.Getenv("WHATSDOWN_TLS_KEY")
+	cfg.ContentSecurityPolicy = envString("WHATSDOWN_CSP", cfg.ContentSecurityPolicy)
+	cfg.ReferrerPolicy = envString("WHATSDOWN_REFERRER_POLICY", cfg.ReferrerPolicy)
+	if os.Getenv("WHATSDOWN_HSTS_MAX_AGE") == "off" {
+		cfg.HSTSMaxAge = 0
+	} else {
+		cfg.HSTSMaxAge = envDuration("WHATSDOWN_HSTS_MAX_AGE", cfg.HSTSMaxAge)
+	}
+	cfg.MessageSanitizers = envList("WHATSDOWN_SANITIZERS", cfg.MessageSanitizers)
+	cfg.MessageFilters = envList("WHATSDOWN_FILTERS", cfg.MessageFilters)
+	cfg.ProfanityWords = envList("WHATSDOWN_PROFANITY_WORDS", cfg.ProfanityWords)
+	cfg.BlockedKeywords = envList("WHATSDOWN_BLOCKED_KEYWORDS", cfg.BlockedKeywords)
+	cfg.SpamScoreThreshold = envInt("WHATSDOWN_SPAM_THRESHOLD", cfg.SpamScoreThreshold)
+	cfg.MaxPinnedMessages = envInt("WHATSDOWN_MAX_PINNED_MESSAGES", cfg.MaxPinnedMessages)
+	cfg.MaxFrameBytes = envInt("WHATSDOWN_MAX_FRAME_BYTES", cfg.MaxFrameBytes)
+	cfg.MaxMessageLength = envInt("WHATSDOWN_MAX_MESSAGE_LENGTH", cfg.MaxMessageLength)
+	cfg.MaxConversationMessages = envInt("WHATSDOWN_MAX_CONVERSATION_MESSAGES", cfg.MaxConversationMessages)
+	cfg.MaxHistoryBytes = int64(envInt("WHATSDOWN_MAX_HISTORY_BYTES", int(cfg.MaxHistoryBytes)))
+	cfg.FrameRateLimit = envInt("WHATSDOWN_WS_RATE_LIMIT", cfg.FrameRateLimit)
+	cfg.FrameRateBurst = envInt("WHATSDOWN_WS_RATE_BURST", cfg.FrameRateBurst)
+	cfg.PingInterval = envDuration("WHATSDOWN_WS_PING_INTERVAL", cfg.PingInterval)
+	cfg.MaxPingInterval = envDuration("WHATSDOWN_WS_MAX_PING_INTERVAL", cfg.MaxPingInterval)
+	cfg.PongTimeout = envDuration("WHATSDOWN_WS_PONG_TIMEOUT", cfg.PongTimeout)
+	cfg.WriteTimeout = envDuration("WHATSDOWN_WS_WRITE_TIMEOUT", cfg.WriteTimeout)
+	cfg.SlowClientBuffer = envInt("WHATSDOWN_SLOW_CLIENT_BUFFER", cfg.SlowClientBuffer)
+	cfg.SlowClientPolicy = envString("WHATSDOWN_SLOW_CLIENT_POLICY", cfg.SlowClientPolicy)
+	cfg.SpillDir = envString("WHATSDOWN_SPILL_DIR", cfg.SpillDir)
+	cfg.DeliveryWorkers = envInt("WHATSDOWN_DELIVERY_WORKERS", cfg.DeliveryWorkers)
+	cfg.MaxConnections = envInt("WHATSDOWN_MAX_CONNECTIONS", cfg.MaxConnections)
+	cfg.MaxConnectionsPerIP = envInt("WHATSDOWN_MAX_CONNECTIONS_PER_IP", cfg.MaxConnectionsPerIP)
+	cfg.MaxUsers = envInt("WHATSDOWN_MAX_USERS", cfg.MaxUsers)
+	cfg.ShutdownTimeout = envDuration("WHATSDOWN_SHUTDOWN_TIMEOUT", cfg.ShutdownTimeout)
+	cfg.ReconnectAfter = envDuration("WHATSDOWN_RECONNECT_AFTER", cfg.ReconnectAfter)
+	cfg.ReconnectGrace = envDurationAllowZero("WHATSDOWN_RECONNECT_GRACE", cfg.ReconnectGrace)
+	cfg.OfflineEventLimit = envInt("WHATSDOWN_OFFLINE_EVENT_LIMIT", cfg.OfflineEventLimit)
+	cfg.OfflineQueueDir = os.Getenv("WHATSDOWN_OFFLINE_QUEUE_DIR")
+	cfg.PollTimeout = envDuration("WHATSDOWN_POLL_TIMEOUT", cfg.PollTimeout)
+	if welcome, set := os.LookupEnv("WHATSDOWN_BOT_WELCOME"); set {
+		cfg.BotWelcome = welcome
+	}
+	cfg.DuplicateRecipientLimit = envInt("WHATSDOWN_DUPLICATE_LIMIT", cfg.DuplicateRecipientLimit)
+	cfg.DuplicateWindow = envDuration("WHATSDOWN_DUPLICATE_WINDOW", cfg.DuplicateWindow)
+	cfg.UrgentPerHour = envInt("WHATSDOWN_URGENT_PER_HOUR", cfg.UrgentPerHour)
+	cfg.ScheduledMessagesPath = os.Getenv("WHATSDOWN_SCHEDULED_MESSAGES_PATH")
+	cfg.MediaDir = envString("WHATSDOWN_MEDIA_DIR", cfg.MediaDir)
+	cfg.MaxUploadBytes = int64(envInt("WHATSDOWN_MAX_UPLOAD_BYTES", int(cfg.MaxUploadBytes)))
+	cfg.ThumbnailWorkers = envInt("WHATSDOWN_THUMBNAIL_WORKERS", cfg.ThumbnailWorkers)
+	cfg.MaxVideoBytes = int64(envInt("WHATSDOWN_MAX_VIDEO_BYTES", int(cfg.MaxVideoBytes)))
+	cfg.MaxVideoDuration = envDuration("WHATSDOWN_MAX_VIDEO_DURATION", cfg.MaxVideoDuration)
+	if path, set := os.LookupEnv("WHATSDOWN_FFMPEG_PATH"); set {
+		cfg.FFmpegPath = path
+	}
+	cfg.UploadAllowedTypes = envList("WHATSDOWN_UPLOAD_ALLOWED_TYPES", cfg.UploadAllowedTypes)
+	cfg.UploadDeniedTypes = envList("WHATSDOWN_UPLOAD_DENIED_TYPES", cfg.UploadDeniedTypes)
+	cfg.StripImageMetadata = os.Getenv("WHATSDOWN_STRIP_IMAGE_METADATA") != "false"
+	cfg.MediaURLSecret = os.Getenv("WHATSDOWN_MEDIA_URL_SECRET")
+	cfg.MediaURLTTL = envDuration("WHATSDOWN_MEDIA_URL_TTL", cfg.MediaURLTTL)
+	cfg.MediaURLBaseURL = envString("WHATSDOWN_MEDIA_URL_BASE", cfg.MediaURLBaseURL)
+	cfg.WSTicketSecret = os.Getenv("WHATSDOWN_WS_TICKET_SECRET")
+	cfg.WSTicketTTL = envDuration("WHATSDOWN_WS_TICKET_TTL", cfg.WSTicketTTL)
+	cfg.ContactsOnly = os.Getenv("WHATSDOWN_CONTACTS_ONLY") == "true"
+	cfg.PresenceBroadcast = os.Getenv("WHATSDOWN_PRESENCE_BROADCAST") != "false"
+	cfg.IdleTimeout = envDurationAllowZero("WHATSDOWN_IDLE_TIMEOUT", cfg.IdleTimeout)
+	cfg.ResumeWindow = envDurationAllowZero("WHATSDOWN_RESUME_WINDOW", cfg.ResumeWindow)
+	cfg.ResumeBuffer = envInt("WHATSDOWN_RESUME_BUFFER", cfg.ResumeBuffer)
+	cfg.Compression = envString("WHATSDOWN_WS_COMPRESSION", cfg.Compression)
+	cfg.CompressionThreshold = envInt("WHATSDOWN_WS_COMPRESSION_THRESHOLD", cfg.CompressionThreshold)
+	cfg.CompressionLevel = envInt("WHATSDOWN_WS_COMPRESSION_LEVEL", cfg.CompressionLevel)
+	cfg.CoalesceWrites = os.Getenv("WHATSDOWN_WS_COALESCE") == "true"
+	cfg.FCMCredentialsFile = os.Getenv("WHATSDOWN_FCM_CREDENTIALS")
+	cfg.APNsKeyFile = os.Getenv("WHATSDOWN_APNS_KEY")
+	cfg.APNsKeyID = os.Getenv("WHATSDOWN_APNS_KEY_ID")
+	cfg.APNsTeamID = os.Getenv("WHATSDOWN_APNS_TEAM_ID")
+	cfg.APNsTopic = os.Getenv("WHATSDOWN_APNS_TOPIC")
+	cfg.APNsSandbox = os.Getenv("WHATSDOWN_APNS_SANDBOX") == "true"
+	cfg.VAPIDSubject = os.Getenv("WHATSDOWN_VAPID_SUBJECT")
+	cfg.VAPIDPrivateKey = os.Getenv("WHATSDOWN_VAPID_PRIVATE_KEY")
+	cfg.WebPushHosts = envList("WHATSDOWN_WEBPUSH_HOSTS", cfg.WebPushHosts)
+	cfg.TranslationURL = os.Getenv("WHATSDOWN_TRANSLATION_URL")
+	cfg.TranslationAPIKey = os.Getenv("WHATSDOWN_TRANSLATION_API_KEY")
+	cfg.RedisURL = os.Getenv("WHATSDOWN_REDIS_URL")
+	cfg.RedisPrefix = envString("WHATSDOWN_REDIS_PREFIX", cfg.RedisPrefix)
+	cfg.PresenceHeartbeat = envDuration("WHATSDOWN_PRESENCE_HEARTBEAT", cfg.PresenceHeartbeat)
+	cfg.NATSURL = os.Getenv("WHATSDOWN_NATS_URL")
+	cfg.NATSPrefix = envString("WHATSDOWN_NATS_PREFIX", cfg.NATSPrefix)
+	cfg.KafkaBrokers = envList("WHATSDOWN_KAFKA_BROKERS", cfg.KafkaBrokers)
+	cfg.KafkaTopic = envString("WHATSDOWN_KAFKA_TOPIC", cfg.KafkaTopic)
+	return cfg
+}
+
+// APNsEnabled reports whether APNs token auth is fully configured
+func (c *Config) APNsEnabled() bool {
+	return c.APNsKeyFile != "" && c.APNsKeyID != "" && c.APNsTeamID != "" && c.APNsTopic != ""
+}
+
+// IsAdminToken reports whether token is the configured admin token, in
+// constant time. It's always false if none is configured.
+func (c *Config) IsAdminToken(token string) bool {
+	return c.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(c.AdminToken)) == 1
+}
+
+// IsAdmin reports whether username is configured as an admin
+func (c *Config) IsAdmin(username string) bool {
+	for _, admin := range c.Admins {
+		if admin == username {
+			return true
+		}
+	}
+	return false
+}
+
+// TLSEnabled reports whether a certificate and key are configured
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// envString returns the variable's value, or fallback if unset. Setting it to
+// "off" yields an empty string so defaults can be disabled.
+func envString(key, fallback string) string {
+	value, set := os.LookupEnv(key)
+	if !set {
+		return fallback
+	}
+	if value == "off" {
+		return ""
+	}
+	return value
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid duration %q for %s, using %s", value, key, fallback)
+		return fallback
+	}
+	return d
+}
+
+// envDurationAllowZero is envDuration for settings where 0 turns the
+// feature off
+func envDurationAllowZero(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Printf("Invalid duration %q for %s, using %s", value, key, fallback)
+		return fallback
+	}
+	return d
+}
+
+func envInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("Invalid integer %q for %s, using %d", value, key, fallback)
+		return fallback
+	}
+	return n
+}
+
+// envList parses a comma-separated list, ignoring empty entries
+func envList(key string, fallback []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
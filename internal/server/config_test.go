@@ -0,0 +1,46 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnvDuration(t *testing.T) {
+	tests := []struct {
+		value     string
+		want      time.Duration
+		allowZero time.Duration
+	}{
+		{"", time.Minute, time.Minute},
+		{"30s", 30 * time.Second, 30 * time.Second},
+		{"0", time.Minute, 0},
+		{"0s", time.Minute, 0},
+		{"-1s", time.Minute, time.Minute},
+		{"soon", time.Minute, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Setenv("WHATSDOWN_TEST_DURATION", tt.value)
+		if got := envDuration("WHATSDOWN_TEST_DURATION", time.Minute); got != tt.want {
+			t.Errorf("envDuration(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+		if got := envDurationAllowZero("WHATSDOWN_TEST_DURATION", time.Minute); got != tt.allowZero {
+			t.Errorf("envDurationAllowZero(%q) = %v, want %v", tt.value, got, tt.allowZero)
+		}
+	}
+}
+
+func TestLoadConfigZeroDurations(t *testing.T) {
+	t.Setenv("WHATSDOWN_IDLE_TIMEOUT", "0")
+	t.Setenv("WHATSDOWN_RESUME_WINDOW", "0")
+	t.Setenv("WHATSDOWN_RECONNECT_GRACE", "0")
+	cfg := LoadConfig()
+	if cfg.IdleTimeout != 0 {
+		t.Errorf("IdleTimeout = %v, want 0", cfg.IdleTimeout)
+	}
+	if cfg.ResumeWindow != 0 {
+		t.Errorf("ResumeWindow = %v, want 0", cfg.ResumeWindow)
+	}
+	if cfg.ReconnectGrace != 0 {
+		t.Errorf("ReconnectGrace = %v, want 0", cfg.ReconnectGrace)
+	}
+}
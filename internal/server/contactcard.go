@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"whatsdown/internal/models"
+)
+
+const (
+	// Maximum length of a contact card's display name in runes
+	maxContactNameRunes = 64
+
+	// Maximum length of a contact card's avatar URL
+	maxAvatarURLLength = 2048
+)
+
+// newContactCard validates a shared contact: the user must exist, and the
+// display name and avatar URL are sanitized. Callers must not hold h.mu.
+func (h *Hub) newContactCard(req *models.ContactCard) (*models.ContactCard, bool) {
+	username := strings.TrimSpace(req.Username)
+
+	h.mu.RLock()
+	_, exists := h.Users[username]
+	h.mu.RUnlock()
+	if !exists {
+		return nil, false
+	}
+
+	displayName := strings.TrimSpace(h.Sanitizer.Sanitize(req.DisplayName))
+	if utf8.RuneCountInString(displayName) > maxContactNameRunes {
+		return nil, false
+	}
+
+	avatarURL := strings.TrimSpace(req.AvatarURL)
+	if avatarURL != "" && !validAvatarURL(avatarURL) {
+		return nil, false
+	}
+
+	return &models.ContactCard{
+		Username:    username,
+		DisplayName: displayName,
+		AvatarURL:   avatarURL,
+	}, true
+}
+
+// validAvatarURL accepts absolute http(s) URLs only, so cards can't carry
+// javascript: or data: payloads
+func validAvatarURL(raw string) bool {
+	if len(raw) > maxAvatarURLLength {
+		return false
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Host == "" {
+		return false
+	}
+	return parsed.Scheme == "https" || parsed.Scheme == "http"
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+// Contact request outcomes, as sent in contact events
+const (
+	ContactRequested = "requested"
+	ContactAccepted  = "accepted"
+)
+
+// maxPendingContactRequests bounds the unanswered requests one user may have out
+const maxPendingContactRequests = 100
+
+var (
+	errContactSelf         = errors.New("cannot add yourself as a contact")
+	errContactUnknownUser  = errors.New("user not found")
+	errAlreadyContacts     = errors.New("already contacts")
+	errContactRequestSent  = errors.New("contact request already sent")
+	errTooManyContactReqs  = errors.New("too many pending contact requests")
+	errNoContactRequest    = errors.New("contact request not found")
+	errNotContacts         = errors.New("not a contact")
+	errContactsOnlyMessage = &FilterRejection{Filter: "contacts", Reason: "you can only message your contacts"}
+)
+
+// contactsOnlyRejection refuses a direct message when the hub only allows
+// messaging contacts and to isn't one of from's. The bot is always reachable.
+// Callers must not hold h.mu.
+func (h *Hub) contactsOnlyRejection(from, to string) error {
+	if !h.ContactsOnly || to == BotUsername {
+		return nil
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if _, exists := h.Contacts[from][to]; !exists {
+		return errContactsOnlyMessage
+	}
+	return nil
+}
+
+// addContact records username and other as each other's contacts.
+// Callers must hold h.mu.
+func (h *Hub) addContact(username, other string, since time.Time) {
+	for _, pair := range [][2]string{{username, other}, {other, username}} {
+		contacts, exists := h.Contacts[pair[0]]
+		if !exists {
+			contacts = make(map[string]time.Time)
+			h.Contacts[pair[0]] = contacts
+		}
+		contacts[pair[1]] = since
+	}
+}
+
+// pendingRequestsFrom counts username's unanswered outgoing requests.
+// Callers must hold h.mu.
+func (h *Hub) pendingRequestsFrom(username string) int {
+	count := 0
+	for _, requests := range h.ContactRequests {
+		if _, exists := requests[username]; exists {
+			count++
+		}
+	}
+	return count
+}
+
+// RequestContact asks to to become from's contact. If to already asked from,
+// the two become contacts straight away and the result is true.
+func (h *Hub) RequestContact(from, to string) (bool, error) {
+	if from == to {
+		return false, errContactSelf
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, exists := h.Users[to]; !exists || to == BotUsername {
+		return false, errContactUnknownUser
+	}
+	if _, exists := h.Contacts[from][to]; exists {
+		return false, errAlreadyContacts
+	}
+	if _, exists := h.ContactRequests[from][to]; exists {
+		h.acceptContactRequest(from, to)
+		return true, nil
+	}
+	if _, exists := h.ContactRequests[to][from]; exists {
+		return false, errContactRequestSent
+	}
+	if h.pendingRequestsFrom(from) >= maxPendingContactRequests {
+		return false, errTooManyContactReqs
+	}
+
+	request := &models.ContactRequest{From: from, To: to, CreatedAt: time.Now()}
+	requests, exists := h.ContactRequests[to]
+	if !exists {
+		requests = make(map[string]*models.ContactRequest)
+		h.ContactRequests[to] = requests
+	}
+	requests[from] = request
+
+	log.Printf("Contact request: %s -> %s", from, to)
+	h.sendToUser(to, "contact_request", request)
+	h.sendToUser(from, "contact_request", request)
+	return false, nil
+}
+
+// acceptContactRequest turns from's pending request to username into a
+// contact and tells both. Callers must hold h.mu.
+func (h *Hub) acceptContactRequest(username, from string) {
+	delete(h.ContactRequests[username], from)
+	h.addContact(username, from, time.Now())
+
+	log.Printf("Contact request accepted: %s -> %s", from, username)
+	h.sendToUser(username, "contact", &models.ContactEvent{Username: from, Status: ContactAccepted})
+	h.sendToUser(from, "contact", &models.ContactEvent{Username: username, Status: ContactAccepted})
+}
+
+// AnswerContactRequest accepts or declines from's pending request to
+// username. Declining is silent: from isn't told.
+func (h *Hub) AnswerContactRequest(username, from string, accept bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, exists := h.ContactRequests[username][from]; !exists {
+		return errNoContactRequest
+	}
+	if accept {
+		h.acceptContactRequest(username, from)
+	} else {
+		delete(h.ContactRequests[username], from)
+	}
+	return nil
+}
+
+// CancelContactRequest withdraws username's pending request to other
+func (h *Hub) CancelContactRequest(username, other string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, exists := h.ContactRequests[other][username]; !exists {
+		return errNoContactRequest
+	}
+	delete(h.ContactRequests[other], username)
+	return nil
+}
+
+// RemoveContact ends the contact between username and other on both sides
+func (h *Hub) RemoveContact(username, other string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, exists := h.Contacts[username][other]; !exists {
+		return errNotContacts
+	}
+	delete(h.Contacts[username], other)
+	delete(h.Contacts[other], username)
+	return nil
+}
+
+// ListContacts returns username's contacts as username may see them, sorted
+// by username
+func (h *Hub) ListContacts(username string) []*models.User {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	contacts := make([]*models.User, 0, len(h.Contacts[username]))
+	for contact := range h.Contacts[username] {
+		if user, exists := h.Users[contact]; exists {
+			contacts = append(contacts, h.visibleUser(username, user))
+		}
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i].Username < contacts[j].Username
+	})
+	return contacts
+}
+
+// ListContactRequests returns username's pending incoming and outgoing requests,
+// newest first
+func (h *Hub) ListContactRequests(username string) *models.ContactRequests {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	result := &models.ContactRequests{
+		Incoming: []*models.ContactRequest{},
+		Outgoing: []*models.ContactRequest{},
+	}
+	for _, request := range h.ContactRequests[username] {
+		result.Incoming = append(result.Incoming, request)
+	}
+	for _, requests := range h.ContactRequests {
+		if request, exists := requests[username]; exists {
+			result.Outgoing = append(result.Outgoing, request)
+		}
+	}
+	for _, list := range [][]*models.ContactRequest{result.Incoming, result.Outgoing} {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].CreatedAt.After(list[j].CreatedAt)
+		})
+	}
+	return result
+}
+
+// contactErrorStatus maps contact errors to HTTP status codes
+func contactErrorStatus(err error) int {
+	switch err {
+	case errContactUnknownUser, errNoContactRequest, errNotContacts:
+		return http.StatusNotFound
+	case errAlreadyContacts, errContactRequestSent:
+		return http.StatusConflict
+	case errTooManyContactReqs:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// ContactRequestBody is the body of POST /api/contacts/requests
+type ContactRequestBody struct {
+	Username string `json:"username"`
+}
+
+// HandleContacts handles GET /api/contacts
+func (h *HTTPHandlers) HandleContacts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	contacts := h.Hub.ListContacts(session.Username)
+	resp := make([]UserResponse, len(contacts))
+	for i, user := range contacts {
+		resp[i] = newUserResponse(user)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HandleContact routes the /api/contacts subtree:
+//
+//	DELETE /api/contacts/{username}
+//	GET    /api/contacts/requests
+//	POST   /api/contacts/requests
+//	DELETE /api/contacts/requests/{username}
+//	POST   /api/contacts/requests/{username}/accept
+//	POST   /api/contacts/requests/{username}/decline
+func (h *HTTPHandlers) HandleContact(w http.ResponseWriter, r *http.Request) {
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/contacts/"), "/"), "/")
+	if parts[0] == "" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	var err error
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		err = h.Hub.RemoveContact(session.Username, parts[0])
+
+	case parts[0] != "requests":
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.Hub.ListContactRequests(session.Username))
+		return
+
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		var req ContactRequestBody
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		accepted, err := h.Hub.RequestContact(session.Username, strings.TrimSpace(req.Username))
+		if err != nil {
+			http.Error(w, err.Error(), contactErrorStatus(err))
+			return
+		}
+		status := ContactRequested
+		if accepted {
+			status = ContactAccepted
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&models.ContactEvent{Username: strings.TrimSpace(req.Username), Status: status})
+		return
+
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		err = h.Hub.CancelContactRequest(session.Username, parts[1])
+
+	case len(parts) == 3 && parts[2] == "accept" && r.Method == http.MethodPost:
+		err = h.Hub.AnswerContactRequest(session.Username, parts[1], true)
+
+	case len(parts) == 3 && parts[2] == "decline" && r.Method == http.MethodPost:
+		err = h.Hub.AnswerContactRequest(session.Username, parts[1], false)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), contactErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
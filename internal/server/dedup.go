@@ -0,0 +1,95 @@
+package server
+
+import (
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+const (
+	// How long a client's tempId is remembered for deduplicating retries
+	tempIDRetention = 24 * time.Hour
+
+	// Tracked tempIds above which expired entries are swept
+	tempIDSweepThreshold = 10000
+)
+
+// sentTempID records which message a client-generated tempId produced
+type sentTempID struct {
+	messageID string
+	sentAt    time.Time
+}
+
+func tempIDKey(from, tempID string) string {
+	return from + "|" + tempID
+}
+
+// resendDuplicate handles a retried send: if from already sent tempID, the
+// stored message is echoed back to the sender with an ack instead of being
+// delivered again. It reports whether the send was a duplicate.
+func (h *Hub) resendDuplicate(from, tempID string) bool {
+	if tempID == "" {
+		return false
+	}
+
+	h.mu.RLock()
+	key := tempIDKey(from, tempID)
+	s := h.shard(from)
+	s.mu.RLock()
+	sent, exists := s.tempIDs[key]
+	s.mu.RUnlock()
+	var message *models.Message
+	if exists && time.Since(sent.sentAt) < tempIDRetention {
+		message, _ = h.message(sent.messageID)
+	}
+	if message == nil {
+		h.mu.RUnlock()
+		return false
+	}
+
+	outbound := newOutboundMessage(message, message.Status)
+	outbound.TempID = tempID
+	ack := &models.AckEvent{
+		MessageID: message.ID,
+		TempID:    tempID,
+		Status:    message.Status,
+	}
+	clients := h.clientsOf(from)
+	h.mu.RUnlock()
+
+	for _, client := range clients {
+		h.sendToClient(client, messageEventType(message), outbound)
+		h.sendToClient(client, "ack", ack)
+	}
+	return true
+}
+
+// rememberTempID records the tempId a message was sent with, in its sender's
+// shard
+func (h *Hub) rememberTempID(message *models.Message) {
+	if message.TempID == "" {
+		return
+	}
+
+	s := h.shard(message.From)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.tempIDs) >= tempIDSweepThreshold/hubShards {
+		for key, sent := range s.tempIDs {
+			if time.Since(sent.sentAt) >= tempIDRetention {
+				delete(s.tempIDs, key)
+			}
+		}
+	}
+	s.tempIDs[tempIDKey(message.From, message.TempID)] = &sentTempID{
+		messageID: message.ID,
+		sentAt:    message.Timestamp,
+	}
+}
+
+// senderOutboundMessage is newOutboundMessage plus the sender's tempId
+func senderOutboundMessage(message *models.Message, status string) *models.OutboundMessage {
+	outbound := newOutboundMessage(message, status)
+	outbound.TempID = message.TempID
+	return outbound
+}
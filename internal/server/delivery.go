@@ -0,0 +1,123 @@
+package server
+
+import (
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+// Device ID used by connections that don't name one
+const defaultDeviceID = "default"
+
+// Longest device ID a client may choose
+const maxDeviceIDLength = 64
+
+// recordDelivery notes that client's device received message and marks the
+// message "delivered" once any device has it. It reports whether this was the
+// first delivery of the message. Callers must hold h.mu, for writing once the
+// message is stored.
+func (h *Hub) recordDelivery(message *models.Message, client *Client) bool {
+	if client.detached {
+		return false
+	}
+	for _, delivery := range message.Deliveries {
+		if delivery.Username == client.Username && delivery.DeviceID == client.DeviceID {
+			return false
+		}
+	}
+
+	first := len(message.Deliveries) == 0
+	message.Deliveries = append(message.Deliveries, &models.Delivery{
+		Username:    client.Username,
+		DeviceID:    client.DeviceID,
+		DeliveredAt: time.Now(),
+	})
+	h.emitDelivery(message, client.Username, client.DeviceID, "delivered")
+	if message.Status == "sent" {
+		message.Status = "delivered"
+		h.scheduleExpiry(message)
+	}
+	return first
+}
+
+// forgetDelivery removes client's device from message's deliveries after it
+// failed to receive it. A direct message no device has is marked "sent" again
+// so it is flushed when the user reconnects. Callers must hold h.mu.
+func (h *Hub) forgetDelivery(message *models.Message, client *Client) {
+	kept := message.Deliveries[:0]
+	for _, delivery := range message.Deliveries {
+		if delivery.Username != client.Username || delivery.DeviceID != client.DeviceID {
+			kept = append(kept, delivery)
+		}
+	}
+	message.Deliveries = kept
+
+	if message.To == client.Username && message.Status == "delivered" && !h.deliveredTo(message, client.Username) {
+		message.Status = "sent"
+	}
+}
+
+// deliveredTo reports whether any of username's devices received message.
+// Callers must hold h.mu.
+func (h *Hub) deliveredTo(message *models.Message, username string) bool {
+	for _, delivery := range message.Deliveries {
+		if delivery.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+// GetDeliveryInfo returns per-recipient, per-device delivery details for a
+// message. Only its sender may see them.
+func (h *Hub) GetDeliveryInfo(messageID, username string) (*models.DeliveryInfo, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	message, exists := h.message(messageID)
+	if !exists || !h.canAccessMessage(message, username) {
+		return nil, errMessageNotFound
+	}
+	if message.From != username {
+		return nil, errNotAllowed
+	}
+
+	var recipients []string
+	switch {
+	case message.GroupID != "":
+		if group, exists := h.Groups[message.GroupID]; exists {
+			recipients = group.Members
+		}
+	case message.ChannelID != "":
+		// Channels have no receipts
+	default:
+		recipients = []string{message.To}
+	}
+
+	info := &models.DeliveryInfo{
+		MessageID:  message.ID,
+		Status:     message.Status,
+		Recipients: []*models.RecipientDelivery{},
+	}
+	for _, recipient := range recipients {
+		if recipient == message.From {
+			continue
+		}
+		entry := &models.RecipientDelivery{
+			Username: recipient,
+			Devices:  []*models.DeviceDelivery{},
+			Read:     containsString(message.ReadBy, recipient) || (message.GroupID == "" && message.Status == "read"),
+		}
+		for _, delivery := range message.Deliveries {
+			if delivery.Username == recipient {
+				entry.Devices = append(entry.Devices, &models.DeviceDelivery{
+					DeviceID:    delivery.DeviceID,
+					DeliveredAt: delivery.DeliveredAt,
+					ReceivedAt:  delivery.ReceivedAt,
+				})
+			}
+		}
+		info.Recipients = append(info.Recipients, entry)
+	}
+	return info, nil
+}
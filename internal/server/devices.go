@@ -0,0 +1,286 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"whatsdown/internal/models"
+)
+
+// maxDeviceNameLength bounds the ?deviceName= a client may choose
+const maxDeviceNameLength = 64
+
+// devicePlatforms maps user agent substrings to platform names, checked in
+// order since e.g. Android user agents also mention Linux
+var devicePlatforms = []struct{ token, platform string }{
+	{"iPhone", "iOS"},
+	{"iPad", "iOS"},
+	{"Android", "Android"},
+	{"Windows", "Windows"},
+	{"Macintosh", "macOS"},
+	{"CrOS", "ChromeOS"},
+	{"Linux", "Linux"},
+}
+
+// devicePlatform guesses the platform a user agent runs on
+func devicePlatform(userAgent string) string {
+	for _, p := range devicePlatforms {
+		if strings.Contains(userAgent, p.token) {
+			return p.platform
+		}
+	}
+	return "unknown"
+}
+
+// deviceInfo reads how a WebSocket client describes itself: ?deviceName= and
+// ?platform=, falling back to the user agent for the platform
+func deviceInfo(r *http.Request) (name, userAgent, platform string, ok bool) {
+	name = strings.TrimSpace(r.URL.Query().Get("deviceName"))
+	if utf8.RuneCountInString(name) > maxDeviceNameLength {
+		return "", "", "", false
+	}
+	userAgent = r.UserAgent()
+	platform = strings.TrimSpace(r.URL.Query().Get("platform"))
+	if platform == "" || utf8.RuneCountInString(platform) > maxDeviceNameLength {
+		platform = devicePlatform(userAgent)
+	}
+	return name, userAgent, platform, true
+}
+
+// touch records activity on the connection, reporting whether it had been
+// marked idle
+func (c *Client) touch() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wasIdle := c.idle
+	c.idle = false
+	c.lastActive = time.Now()
+	return wasIdle
+}
+
+// setIdle marks the connection idle until its next activity
+func (c *Client) setIdle() {
+	c.mu.Lock()
+	c.idle = true
+	c.mu.Unlock()
+}
+
+// lastActivity returns when the connection last saw traffic
+func (c *Client) lastActivity() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastActive
+}
+
+// clientsOf returns every connected device of username, plus recorders for
+// disconnected devices that may still resume their event stream.
+// Callers must hold h.mu.
+func (h *Hub) clientsOf(username string) []*Client {
+	return append(h.connectedClients(username), h.detachedClients(username)...)
+}
+
+// isConnected reports whether any of username's devices is connected
+func (h *Hub) isConnected(username string) bool {
+	s := h.shard(username)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.clients[username]) > 0
+}
+
+// sendToUser sends an event to every device of username, here and on other
+// instances, holding it in their offline queue if none is connected here. Callers must hold h.mu, for writing
+// unless the event is a typing indicator, which is never held.
+func (h *Hub) sendToUser(username, msgType string, payload interface{}) {
+	for _, client := range h.clientsOf(username) {
+		h.sendToClient(client, msgType, payload)
+	}
+	h.relayToUser(username, msgType, payload)
+	if msgType != "typing" {
+		h.queueOffline(username, offlineEvent{msgType: msgType, payload: payload})
+	}
+}
+
+// addClient registers a device, replacing an older connection that used the
+// same device ID. It reports whether this is the user's first device.
+// Callers must hold h.mu.
+func (h *Hub) addClient(client *Client) bool {
+	s := h.shard(client.Username)
+	s.mu.Lock()
+	devices, exists := s.clients[client.Username]
+	if !exists {
+		devices = make(map[*Client]bool)
+		s.clients[client.Username] = devices
+	}
+	var replaced []*Client
+	for existing := range devices {
+		if existing.DeviceID == client.DeviceID {
+			// A reconnect whose old connection hasn't been noticed as closed yet
+			replaced = append(replaced, existing)
+			delete(devices, existing)
+		}
+	}
+	devices[client] = true
+	first := len(devices) == 1
+	s.mu.Unlock()
+
+	for _, existing := range replaced {
+		existing.closeWith(CloseReplaced, "replaced by a newer connection")
+		h.dropPresenceSubscriptions(existing)
+	}
+	h.recordDevice(client)
+	return first
+}
+
+// recordDevice adds or refreshes client's entry in the device registry.
+// Callers must hold h.mu.
+func (h *Hub) recordDevice(client *Client) {
+	now := time.Now()
+	client.touch()
+	registry, exists := h.Devices[client.Username]
+	if !exists {
+		registry = make(map[string]*models.Device)
+		h.Devices[client.Username] = registry
+	}
+	device, exists := registry[client.DeviceID]
+	if !exists {
+		device = &models.Device{ID: client.DeviceID}
+		registry[client.DeviceID] = device
+	}
+	if client.DeviceName != "" {
+		device.Name = client.DeviceName
+	}
+	device.UserAgent = client.UserAgent
+	device.Platform = client.Platform
+	device.Subprotocol = client.Subprotocol
+	device.ConnectedAt = now
+	device.LastActive = now
+	device.Online = true
+	device.SessionID = client.SessionID
+}
+
+// removeClient unregisters a device, reporting whether it was registered and
+// whether it was the user's last one. Callers must hold h.mu.
+func (h *Hub) removeClient(client *Client) (removed, last bool) {
+	s := h.shard(client.Username)
+	s.mu.Lock()
+	devices := s.clients[client.Username]
+	if !devices[client] {
+		s.mu.Unlock()
+		return false, false
+	}
+	delete(devices, client)
+	last = len(devices) == 0
+	if last {
+		delete(s.clients, client.Username)
+	}
+	s.mu.Unlock()
+
+	h.dropPresenceSubscriptions(client)
+	h.detachStream(client)
+	if device, exists := h.Devices[client.Username][client.DeviceID]; exists {
+		device.Online = false
+		device.LastActive = client.lastActivity()
+	}
+	return true, last
+}
+
+// ListDevices returns the devices username has connected from, most recently
+// active first
+func (h *Hub) ListDevices(username string) []models.Device {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	devices := make([]models.Device, 0, len(h.Devices[username]))
+	for _, device := range h.Devices[username] {
+		devices = append(devices, *device)
+	}
+	for _, client := range h.connectedClients(username) {
+		for i := range devices {
+			if devices[i].ID == client.DeviceID {
+				devices[i].LastActive = client.lastActivity()
+			}
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].LastActive.After(devices[j].LastActive)
+	})
+	return devices
+}
+
+// RevokeDevice forgets one of username's devices, ends the session it
+// connected with and force-closes its connection. It returns that session's
+// ID, and false if the device is unknown.
+func (h *Hub) RevokeDevice(username, deviceID string) (string, bool) {
+	h.mu.Lock()
+	device, exists := h.Devices[username][deviceID]
+	if !exists {
+		h.mu.Unlock()
+		return "", false
+	}
+	delete(h.Devices[username], deviceID)
+	h.dropStream(username, deviceID)
+	var clients []*Client
+	for _, client := range h.connectedClients(username) {
+		if client.DeviceID == deviceID {
+			clients = append(clients, client)
+		}
+	}
+	h.mu.Unlock()
+
+	sessionStore.DeleteSession(device.SessionID)
+	for _, client := range clients {
+		h.disconnect(client, CloseSessionRevoked, "device revoked")
+	}
+	return device.SessionID, true
+}
+
+// HandleDevices handles GET /api/me/devices
+func (h *HTTPHandlers) HandleDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Hub.ListDevices(session.Username))
+}
+
+// HandleDevice handles DELETE /api/me/devices/{id}
+func (h *HTTPHandlers) HandleDevice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	deviceID := strings.TrimSpace(strings.TrimPrefix(r.URL.Path, "/api/me/devices/"))
+	if deviceID == "" {
+		http.Error(w, "Device ID required", http.StatusBadRequest)
+		return
+	}
+
+	revokedSession, revoked := h.Hub.RevokeDevice(session.Username, deviceID)
+	if !revoked {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	// Other connections made with the revoked session can no longer authenticate
+	h.Hub.DisconnectSession(session.Username, revokedSession)
+	h.Audit.Record(AuditDeviceRevoked, session.Username, clientIP(r), deviceID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+// Bounds on disappearing message timers
+const (
+	minDisappearingTimer = time.Minute
+	maxDisappearingTimer = 90 * 24 * time.Hour
+)
+
+// DisappearingRequest sets or clears a conversation's disappearing timer
+type DisappearingRequest struct {
+	Duration string `json:"duration"` // Go duration such as "24h"; empty disables
+}
+
+// SetDisappearingTimer sets the disappearing timer for a direct conversation.
+// A zero duration disables it. Messages already sent keep their timers.
+func (h *Hub) SetDisappearingTimer(username, peer string, duration time.Duration) *models.DisappearingEvent {
+	h.mu.Lock()
+	h.setDisappearing(models.ConvKey(username, peer), duration)
+
+	event := &models.DisappearingEvent{
+		Peer:     peer,
+		Duration: formatTimer(duration),
+		By:       username,
+	}
+	recipients := h.clientsFor([]string{username, peer})
+	h.mu.Unlock()
+
+	for _, client := range recipients {
+		h.sendToClient(client, "disappearing", event)
+	}
+	return event
+}
+
+// SetGroupDisappearingTimer sets a group's disappearing timer; admins only
+func (h *Hub) SetGroupDisappearingTimer(groupID, admin string, duration time.Duration) (*models.DisappearingEvent, error) {
+	h.mu.Lock()
+
+	group, exists := h.Groups[groupID]
+	if !exists {
+		h.mu.Unlock()
+		return nil, errGroupNotFound
+	}
+	if !group.IsAdmin(admin) {
+		h.mu.Unlock()
+		return nil, errNotGroupAdmin
+	}
+	h.setDisappearing(models.GroupConvKey(groupID), duration)
+
+	event := &models.DisappearingEvent{
+		GroupID:  groupID,
+		Duration: formatTimer(duration),
+		By:       admin,
+	}
+	recipients := h.clientsFor(group.Members)
+	h.mu.Unlock()
+
+	for _, client := range recipients {
+		h.sendToClient(client, "disappearing", event)
+	}
+	return event, nil
+}
+
+// setDisappearing stores a conversation's timer. Callers must hold h.mu.
+func (h *Hub) setDisappearing(convKey string, duration time.Duration) {
+	if duration <= 0 {
+		delete(h.DisappearingTimers, convKey)
+		return
+	}
+	h.DisappearingTimers[convKey] = duration
+}
+
+// scheduleExpiry starts a delivered message's disappearing timer if its
+// conversation has one. Callers must hold h.mu.
+func (h *Hub) scheduleExpiry(message *models.Message) {
+	duration, enabled := h.DisappearingTimers[message.ConvKey()]
+	if !enabled || message.ExpiresAt != nil {
+		return
+	}
+
+	expiresAt := time.Now().Add(duration)
+	message.ExpiresAt = &expiresAt
+	time.AfterFunc(duration, func() {
+		h.expireMessage(message.ID)
+	})
+}
+
+// expireMessage removes a disappeared message's content and tells
+// participants to drop it with an "expired" event
+func (h *Hub) expireMessage(messageID string) {
+	h.mu.Lock()
+
+	message, exists := h.message(messageID)
+	if !exists || message.Expired {
+		h.mu.Unlock()
+		return
+	}
+	message.Expired = true
+	h.clearContent(message)
+
+	recipients := h.participantClients(message)
+	h.mu.Unlock()
+
+	event := &models.ExpiredEvent{MessageID: messageID}
+	for _, client := range recipients {
+		h.sendToClient(client, "expired", event)
+	}
+}
+
+// clientsFor returns the connected clients among usernames. Callers must hold h.mu.
+func (h *Hub) clientsFor(usernames []string) []*Client {
+	clients := []*Client{}
+	for _, username := range usernames {
+		clients = append(clients, h.clientsOf(username)...)
+	}
+	return clients
+}
+
+func formatTimer(duration time.Duration) string {
+	if duration <= 0 {
+		return ""
+	}
+	return duration.String()
+}
+
+// parseDisappearingRequest decodes and validates a timer update
+func parseDisappearingRequest(w http.ResponseWriter, r *http.Request) (time.Duration, bool) {
+	var req DisappearingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return 0, false
+	}
+	if req.Duration == "" {
+		return 0, true
+	}
+
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil || duration < minDisappearingTimer || duration > maxDisappearingTimer {
+		http.Error(w, "Duration must be between 1m and 2160h", http.StatusBadRequest)
+		return 0, false
+	}
+	return duration, true
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"whatsdown/internal/models"
+)
+
+// Maximum length of a draft in runes
+const maxDraftRunes = 10000
+
+// DraftRequest represents a draft update from a client
+type DraftRequest struct {
+	Content string `json:"content"`
+}
+
+// SaveDraft stores username's draft for a direct conversation with peer and
+// syncs it to their connected client. Empty content clears the draft.
+func (h *Hub) SaveDraft(username, peer, content string) *models.Draft {
+	h.mu.Lock()
+
+	draft := &models.Draft{
+		Peer:      peer,
+		Content:   content,
+		UpdatedAt: time.Now(),
+	}
+	h.setDraft(username, models.ConvKey(username, peer), draft)
+
+	clients := h.clientsOf(username)
+	h.mu.Unlock()
+
+	for _, client := range clients {
+		h.sendToClient(client, "draft", draft)
+	}
+	return draft
+}
+
+// GetDraft returns username's draft for a direct conversation with peer
+func (h *Hub) GetDraft(username, peer string) *models.Draft {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if draft, exists := h.Drafts[username][models.ConvKey(username, peer)]; exists {
+		return draft
+	}
+	return &models.Draft{Peer: peer}
+}
+
+// clearDraftAfterSend drops the sender's draft once they send a message in
+// the conversation, letting their other clients clear the input box
+func (h *Hub) clearDraftAfterSend(message *models.Message) {
+	if message.To == "" {
+		return
+	}
+
+	// Most sends have no draft to clear, so check without blocking other sends
+	convKey := message.ConvKey()
+	h.mu.RLock()
+	_, exists := h.Drafts[message.From][convKey]
+	h.mu.RUnlock()
+	if !exists {
+		return
+	}
+
+	h.mu.Lock()
+	if _, exists := h.Drafts[message.From][convKey]; !exists {
+		h.mu.Unlock()
+		return
+	}
+
+	draft := &models.Draft{Peer: message.To, UpdatedAt: time.Now()}
+	h.setDraft(message.From, convKey, draft)
+	clients := h.clientsOf(message.From)
+	h.mu.Unlock()
+
+	for _, client := range clients {
+		h.sendToClient(client, "draft", draft)
+	}
+}
+
+// setDraft stores or, for empty content, removes a draft. Callers must hold h.mu.
+func (h *Hub) setDraft(username, convKey string, draft *models.Draft) {
+	drafts, exists := h.Drafts[username]
+	if !exists {
+		drafts = make(map[string]*models.Draft)
+		h.Drafts[username] = drafts
+	}
+	if draft.Content == "" {
+		delete(drafts, convKey)
+	} else {
+		drafts[convKey] = draft
+	}
+}
+
+// handleDraft serves GET and PUT /api/conversations/{peerUsername}/draft
+func (h *HTTPHandlers) handleDraft(w http.ResponseWriter, r *http.Request, username, peer string) {
+	var draft *models.Draft
+
+	switch r.Method {
+	case http.MethodGet:
+		draft = h.Hub.GetDraft(username, peer)
+
+	case http.MethodPut:
+		var req DraftRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if utf8.RuneCountInString(req.Content) > maxDraftRunes {
+			http.Error(w, "Draft too long", http.StatusBadRequest)
+			return
+		}
+		draft = h.Hub.SaveDraft(username, peer, req.Content)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(draft)
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"testing"
+
+	"whatsdown/internal/models"
+)
+
+func TestDraftClearedOnlyAfterStoredSend(t *testing.T) {
+	hub := newTestHub(t, "alice", "bob")
+	hub.SaveDraft("alice", "carol", "hello carol")
+	hub.SaveDraft("alice", "bob", "hello bob")
+
+	// carol doesn't exist, so the send is rejected and the draft kept
+	hub.handleInboundMessageWithSender("alice", &models.InboundMessage{To: "carol", Content: "hello carol"})
+	if draft := hub.GetDraft("alice", "carol"); draft.Content != "hello carol" {
+		t.Errorf("draft after rejected send = %q, want it kept", draft.Content)
+	}
+
+	hub.handleInboundMessageWithSender("alice", &models.InboundMessage{To: "bob", Content: "hello bob"})
+	if draft := hub.GetDraft("alice", "bob"); draft.Content != "" {
+		t.Errorf("draft after send = %q, want it cleared", draft.Content)
+	}
+}
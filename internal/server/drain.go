@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"whatsdown/internal/models"
+
+	"github.com/gorilla/websocket"
+)
+
+// How often Shutdown checks on connections it is draining
+const drainPollInterval = 50 * time.Millisecond
+
+// Shutdown drains WebSocket connections so the server can exit without
+// dropping sockets mid-write. New upgrades are refused, every client is sent
+// a "server_shutdown" event with a hint of when to reconnect, and each
+// connection is closed with a close frame once what's queued for it has been
+// written. It returns when all connections are closed or ctx ends, whichever
+// comes first; connections still open then are closed without flushing.
+// Offline queues not yet saved are saved before it returns.
+func (h *Hub) Shutdown(ctx context.Context) {
+	defer h.saveOfflineQueues()
+	h.mu.Lock()
+	h.draining = true
+	var clients []*Client
+	for _, devices := range h.everyClient() {
+		clients = append(clients, devices...)
+	}
+	h.mu.Unlock()
+
+	log.Printf("Draining %d WebSocket connections", len(clients))
+	for _, client := range clients {
+		h.sendToClient(client, "server_shutdown", &models.ShutdownEvent{
+			ReconnectAfter: h.reconnectHint().Seconds(),
+		})
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	waiting := clients
+	for len(waiting) > 0 {
+		remaining := waiting[:0]
+		for _, client := range waiting {
+			if client.pending() == 0 {
+				client.closeWith(websocket.CloseGoingAway, "server shutting down")
+				h.endPoll(client)
+			} else {
+				remaining = append(remaining, client)
+			}
+		}
+		waiting = remaining
+		if len(waiting) == 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Drain timed out with %d connections still flushing", len(waiting))
+			for _, client := range waiting {
+				client.closeWith(websocket.CloseGoingAway, "server shutting down")
+				h.endPoll(client)
+			}
+			waiting = nil
+		case <-ticker.C:
+		}
+	}
+
+	// Connections unregister once their close handshake ends
+	for h.connectionCount() > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+	log.Printf("All WebSocket connections drained")
+}
+
+// Draining reports whether Shutdown has started
+func (h *Hub) Draining() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.draining
+}
+
+// refuseWhileDraining answers an upgrade request with 503 once Shutdown has
+// started, reporting whether it did
+func (h *Hub) refuseWhileDraining(w http.ResponseWriter) bool {
+	if !h.Draining() {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(h.reconnectHint().Seconds())))
+	http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+	return true
+}
+
+// reconnectHint returns how long a client should wait before reconnecting:
+// ReconnectAfter plus up to as much again of jitter, so clients don't all
+// come back at once
+func (h *Hub) reconnectHint() time.Duration {
+	if h.ReconnectAfter <= 0 {
+		return 0
+	}
+	return h.ReconnectAfter + time.Duration(rand.Int63n(int64(h.ReconnectAfter)))
+}
+
+// connectionCount returns the number of connected clients
+func (h *Hub) connectionCount() int {
+	count := 0
+	for _, s := range h.shards {
+		s.mu.RLock()
+		for _, devices := range s.clients {
+			count += len(devices)
+		}
+		s.mu.RUnlock()
+	}
+	return count
+}
+
+// pending returns how many frames are waiting to be written to the client,
+// counting deliveries not yet encoded
+func (c *Client) pending() int {
+	queued := c.deliveries.pending()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return queued + len(c.Send) + len(c.outbox) + c.spill.len()
+}
+
+// closeWith ends the client's connection with a close frame carrying code
+// and reason once the write pump has written what's already in Send
+func (c *Client) closeWith(code int, reason string) {
+	c.mu.Lock()
+	if !c.closed {
+		c.closeCode = code
+		c.closeReason = reason
+	}
+	c.mu.Unlock()
+	c.closeSend()
+}
+
+// closeMessage returns the body of the close frame the write pump sends when
+// Send is closed
+func (c *Client) closeMessage() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeCode == 0 {
+		return []byte{}
+	}
+	return websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+)
+
+var shortcodeTokenPattern = regexp.MustCompile(`:[a-z0-9_+\-]+:`)
+
+// emojiShortcodes maps the common GitHub/Slack-style shortcodes to Unicode.
+// Unknown shortcodes, including custom emoji from sticker packs, are left as
+// typed for clients to render.
+var emojiShortcodes = map[string]string{
+	"smile":                        "😄",
+	"smiley":                       "😃",
+	"grinning":                     "😀",
+	"grin":                         "😁",
+	"laughing":                     "😆",
+	"sweat_smile":                  "😅",
+	"joy":                          "😂",
+	"rofl":                         "🤣",
+	"slightly_smiling_face":        "🙂",
+	"upside_down_face":             "🙃",
+	"wink":                         "😉",
+	"blush":                        "😊",
+	"innocent":                     "😇",
+	"heart_eyes":                   "😍",
+	"star_struck":                  "🤩",
+	"kissing_heart":                "😘",
+	"yum":                          "😋",
+	"stuck_out_tongue":             "😛",
+	"stuck_out_tongue_winking_eye": "😜",
+	"zany_face":                    "🤪",
+	"hugs":                         "🤗",
+	"thinking":                     "🤔",
+	"shushing_face":                "🤫",
+	"neutral_face":                 "😐",
+	"expressionless":               "😑",
+	"no_mouth":                     "😶",
+	"smirk":                        "😏",
+	"unamused":                     "😒",
+	"roll_eyes":                    "🙄",
+	"grimacing":                    "😬",
+	"relieved":                     "😌",
+	"pensive":                      "😔",
+	"sleepy":                       "😪",
+	"sleeping":                     "😴",
+	"mask":                         "😷",
+	"nerd_face":                    "🤓",
+	"sunglasses":                   "😎",
+	"confused":                     "😕",
+	"worried":                      "😟",
+	"slightly_frowning_face":       "🙁",
+	"open_mouth":                   "😮",
+	"astonished":                   "😲",
+	"flushed":                      "😳",
+	"pleading_face":                "🥺",
+	"cry":                          "😢",
+	"sob":                          "😭",
+	"scream":                       "😱",
+	"confounded":                   "😖",
+	"disappointed":                 "😞",
+	"sweat":                        "😓",
+	"weary":                        "😩",
+	"tired_face":                   "😫",
+	"yawning_face":                 "🥱",
+	"triumph":                      "😤",
+	"rage":                         "😡",
+	"angry":                        "😠",
+	"skull":                        "💀",
+	"poop":                         "💩",
+	"clown_face":                   "🤡",
+	"ghost":                        "👻",
+	"alien":                        "👽",
+	"robot":                        "🤖",
+	"see_no_evil":                  "🙈",
+	"hear_no_evil":                 "🙉",
+	"speak_no_evil":                "🙊",
+	"heart":                        "❤️",
+	"orange_heart":                 "🧡",
+	"yellow_heart":                 "💛",
+	"green_heart":                  "💚",
+	"blue_heart":                   "💙",
+	"purple_heart":                 "💜",
+	"black_heart":                  "🖤",
+	"broken_heart":                 "💔",
+	"two_hearts":                   "💕",
+	"sparkling_heart":              "💖",
+	"100":                          "💯",
+	"boom":                         "💥",
+	"zzz":                          "💤",
+	"wave":                         "👋",
+	"ok_hand":                      "👌",
+	"v":                            "✌️",
+	"crossed_fingers":              "🤞",
+	"point_up":                     "☝️",
+	"point_down":                   "👇",
+	"point_left":                   "👈",
+	"point_right":                  "👉",
+	"+1":                           "👍",
+	"thumbsup":                     "👍",
+	"-1":                           "👎",
+	"thumbsdown":                   "👎",
+	"fist":                         "✊",
+	"clap":                         "👏",
+	"raised_hands":                 "🙌",
+	"open_hands":                   "👐",
+	"pray":                         "🙏",
+	"handshake":                    "🤝",
+	"muscle":                       "💪",
+	"eyes":                         "👀",
+	"brain":                        "🧠",
+	"dog":                          "🐶",
+	"cat":                          "🐱",
+	"unicorn":                      "🦄",
+	"sun":                          "☀️",
+	"cloud":                        "☁️",
+	"rainbow":                      "🌈",
+	"zap":                          "⚡",
+	"snowflake":                    "❄️",
+	"fire":                         "🔥",
+	"star":                         "⭐",
+	"sparkles":                     "✨",
+	"tada":                         "🎉",
+	"confetti_ball":                "🎊",
+	"balloon":                      "🎈",
+	"gift":                         "🎁",
+	"birthday":                     "🎂",
+	"trophy":                       "🏆",
+	"coffee":                       "☕",
+	"beer":                         "🍺",
+	"beers":                        "🍻",
+	"wine_glass":                   "🍷",
+	"pizza":                        "🍕",
+	"hamburger":                    "🍔",
+	"cake":                         "🍰",
+	"rocket":                       "🚀",
+	"car":                          "🚗",
+	"airplane":                     "✈️",
+	"house":                        "🏠",
+	"phone":                        "📱",
+	"computer":                     "💻",
+	"bulb":                         "💡",
+	"memo":                         "📝",
+	"calendar":                     "📅",
+	"lock":                         "🔒",
+	"key":                          "🔑",
+	"bell":                         "🔔",
+	"warning":                      "⚠️",
+	"no_entry":                     "⛔",
+	"x":                            "❌",
+	"white_check_mark":             "✅",
+	"heavy_check_mark":             "✔️",
+	"question":                     "❓",
+	"exclamation":                  "❗",
+	"hourglass":                    "⌛",
+	"watch":                        "⌚",
+	"money_with_wings":             "💸",
+	"moneybag":                     "💰",
+	"shrug":                        "🤷",
+	"facepalm":                     "🤦",
+}
+
+// expandEmojiShortcodes replaces known :shortcode: tokens with Unicode emoji,
+// leaving `code` spans untouched
+func expandEmojiShortcodes(content string) string {
+	if !strings.Contains(content, ":") {
+		return content
+	}
+
+	// Odd segments sit between backticks, except a trailing unclosed one
+	segments := strings.Split(content, "`")
+	for i := range segments {
+		inCode := i%2 == 1 && i < len(segments)-1
+		if !inCode {
+			segments[i] = shortcodeTokenPattern.ReplaceAllStringFunc(segments[i], replaceShortcode)
+		}
+	}
+	return strings.Join(segments, "`")
+}
+
+func replaceShortcode(token string) string {
+	if emoji, known := emojiShortcodes[strings.Trim(token, ":")]; known {
+		return emoji
+	}
+	return token
+}
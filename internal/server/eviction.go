@@ -0,0 +1,196 @@
+package server
+
+import (
+	"container/list"
+	"log"
+	"sync"
+
+	"whatsdown/internal/models"
+)
+
+// Rough memory a stored message takes besides its content: the struct, its
+// deliveries and its entries in the conversation and the ID index
+const messageOverhead = 512
+
+// historyUsage tracks how much memory conversations' messages take, so that
+// once MaxHistoryBytes is reached the oldest messages of the conversations
+// least recently written to can be evicted. Its lock is taken after h.mu and
+// before any shard's.
+type historyUsage struct {
+	mu    sync.Mutex
+	bytes int64
+
+	// *conversationUsage, most recently written to first
+	order *list.List
+	byKey map[string]*list.Element
+}
+
+// conversationUsage is the estimated size of each message held for a
+// conversation, oldest first
+type conversationUsage struct {
+	convKey string
+	sizes   []int64
+	bytes   int64
+}
+
+func newHistoryUsage() *historyUsage {
+	return &historyUsage{
+		order: list.New(),
+		byKey: make(map[string]*list.Element),
+	}
+}
+
+// messageFootprint estimates the memory message takes
+func messageFootprint(message *models.Message) int64 {
+	size := int64(messageOverhead + len(message.Content))
+	if message.Encrypted != nil {
+		size += int64(len(message.Encrypted.Ciphertext))
+	}
+	return size
+}
+
+// trimConversation drops the oldest messages of convKey beyond
+// MaxConversationMessages, returning them. Callers must hold s.mu.
+func (h *Hub) trimConversation(s *hubShard, convKey string) []*models.Message {
+	messages := s.conversations[convKey]
+	if h.MaxConversationMessages <= 0 || len(messages) <= h.MaxConversationMessages {
+		return nil
+	}
+	// Readers may still hold the old slice, so it's resliced rather than
+	// shifted; the next append copies what's kept into a new array
+	n := len(messages) - h.MaxConversationMessages
+	s.conversations[convKey] = messages[n:]
+	return messages[:n]
+}
+
+// recordHistory accounts for message being stored and evicted messages being
+// dropped from its conversation, then evicts from the conversations least
+// recently written to until history fits in MaxHistoryBytes. The message just
+// stored is never evicted. Callers must hold h.mu.
+func (h *Hub) recordHistory(message *models.Message, evicted []*models.Message) {
+	h.forgetMessages(evicted)
+
+	convKey := message.ConvKey()
+	u := h.history
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	element, exists := u.byKey[convKey]
+	if exists {
+		u.order.MoveToFront(element)
+	} else {
+		element = u.order.PushFront(&conversationUsage{convKey: convKey})
+		u.byKey[convKey] = element
+	}
+	usage := element.Value.(*conversationUsage)
+	u.release(usage, len(evicted))
+	size := messageFootprint(message)
+	usage.sizes = append(usage.sizes, size)
+	usage.bytes += size
+	u.bytes += size
+
+	if h.MaxHistoryBytes <= 0 {
+		return
+	}
+	for u.bytes > h.MaxHistoryBytes {
+		victim := u.order.Back().Value.(*conversationUsage)
+		if victim == usage && len(usage.sizes) <= 1 {
+			break
+		}
+		h.evictOldest(victim)
+	}
+}
+
+// evictOldest drops the oldest messages of a conversation until history fits
+// in MaxHistoryBytes, or all of them, in which case the conversation is no
+// longer held in memory though its sequence numbers carry on. Callers must
+// hold h.history.mu.
+func (h *Hub) evictOldest(usage *conversationUsage) {
+	u := h.history
+	n := 0
+	for excess := u.bytes - h.MaxHistoryBytes; n < len(usage.sizes) && excess > 0; n++ {
+		excess -= usage.sizes[n]
+	}
+
+	s := h.shard(usage.convKey)
+	s.mu.Lock()
+	messages := s.conversations[usage.convKey]
+	n = min(n, len(messages))
+	evicted := messages[:n]
+	if n == len(messages) {
+		delete(s.conversations, usage.convKey)
+	} else {
+		s.conversations[usage.convKey] = messages[n:]
+	}
+	s.mu.Unlock()
+
+	if n == len(messages) {
+		// Whatever was accounted for is gone, including sizes of messages
+		// dropped by a trim not yet recorded
+		n = len(usage.sizes)
+	}
+	u.release(usage, n)
+	if len(usage.sizes) == 0 {
+		u.order.Remove(u.byKey[usage.convKey])
+		delete(u.byKey, usage.convKey)
+	}
+	h.forgetMessages(evicted)
+	log.Printf("Evicted %d messages from %s: history over %d bytes", len(evicted), usage.convKey, h.MaxHistoryBytes)
+}
+
+// release stops accounting for the n oldest messages of a conversation.
+// Callers must hold u.mu.
+func (u *historyUsage) release(usage *conversationUsage, n int) {
+	n = min(n, len(usage.sizes))
+	for _, size := range usage.sizes[:n] {
+		usage.bytes -= size
+		u.bytes -= size
+	}
+	usage.sizes = usage.sizes[n:]
+}
+
+// forgetHistory stops accounting for convKey once it has been deleted
+func (h *Hub) forgetHistory(convKey string) {
+	u := h.history
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if element, exists := u.byKey[convKey]; exists {
+		usage := element.Value.(*conversationUsage)
+		u.release(usage, len(usage.sizes))
+		u.order.Remove(element)
+		delete(u.byKey, convKey)
+	}
+}
+
+// forgetMessages removes evicted messages from the ID index and the messages
+// held for offline recipients, and then from pins and stars. There's no
+// persistent store, so they're gone, as after a restart.
+func (h *Hub) forgetMessages(messages []*models.Message) {
+	for _, message := range messages {
+		s := h.shard(message.ID)
+		s.mu.Lock()
+		delete(s.messages, message.ID)
+		s.mu.Unlock()
+		h.releasePending(message)
+	}
+	if len(messages) > 0 {
+		// Messages are evicted with h.mu only read-locked
+		go h.unmarkEvicted(messages)
+	}
+}
+
+// unmarkEvicted drops evicted messages from their conversations' pins and
+// from the starred lists of whoever starred them, so they neither count
+// against MaxPinnedMessages nor stay referenced forever
+func (h *Hub) unmarkEvicted(messages []*models.Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, message := range messages {
+		h.unpinDeleted(message)
+		for _, username := range h.starredBy[message.ID] {
+			h.Starred[username] = removeString(h.Starred[username], message.ID)
+		}
+		delete(h.starredBy, message.ID)
+	}
+}
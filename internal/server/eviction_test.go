@@ -0,0 +1,44 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+func TestEvictionUnpinsAndUnstars(t *testing.T) {
+	hub := newTestHub(t, "alice", "bob")
+	hub.MaxConversationMessages = 1
+	dm := &models.Message{From: "alice", To: "bob"}
+
+	hub.handleInboundMessageWithSender("alice", &models.InboundMessage{To: "bob", Content: "pin me"})
+	first := lastMessage(t, hub, dm)
+	if err := hub.PinMessage(first.ID, "alice", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, username := range []string{"alice", "bob"} {
+		if err := hub.StarMessage(first.ID, username, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hub.handleInboundMessageWithSender("alice", &models.InboundMessage{To: "bob", Content: "evicts the first"})
+	if _, exists := hub.message(first.ID); exists {
+		t.Fatal("first message wasn't evicted")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		hub.mu.RLock()
+		pins, aliceStars, bobStars, starrers := len(hub.Pins[dm.ConvKey()]), len(hub.Starred["alice"]), len(hub.Starred["bob"]), len(hub.starredBy)
+		hub.mu.RUnlock()
+		if pins+aliceStars+bobStars+starrers == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("after eviction: %d pins, stars %d and %d, %d starred messages", pins, aliceStars, bobStars, starrers)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// stripImageMetadata removes EXIF (including GPS), XMP, IPTC and text
+// metadata from JPEG, PNG and WebP images without re-encoding them. Other
+// types, and files it can't parse, are returned unchanged.
+func stripImageMetadata(contentType string, data []byte) []byte {
+	var stripped []byte
+	var ok bool
+	switch contentType {
+	case "image/jpeg":
+		stripped, ok = stripJPEGMetadata(data)
+	case "image/png":
+		stripped, ok = stripPNGMetadata(data)
+	case "image/webp":
+		stripped, ok = stripWebPMetadata(data)
+	}
+	if !ok {
+		return data
+	}
+	return stripped
+}
+
+// stripJPEGMetadata drops APP1 (EXIF, XMP), APP13 (IPTC) and comment
+// segments. The EXIF orientation is kept in a minimal APP1 so photos still
+// display upright.
+func stripJPEGMetadata(data []byte) ([]byte, bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, false
+	}
+	var kept [][]byte
+	orientation := 0
+
+	offset := 2
+	for offset+4 <= len(data) {
+		if data[offset] != 0xFF {
+			return nil, false
+		}
+		marker := data[offset+1]
+		if marker == 0xFF {
+			// Fill byte
+			offset++
+			continue
+		}
+		if marker == 0xDA {
+			// Start of scan: the rest is image data. EXIF goes right after
+			// SOI, or after JFIF's APP0 when there is one.
+			out := bytes.NewBuffer(make([]byte, 0, len(data)))
+			out.Write(data[:2])
+			if len(kept) > 0 && kept[0][1] == 0xE0 {
+				out.Write(kept[0])
+				kept = kept[1:]
+			}
+			if orientation > 1 {
+				out.Write(jpegOrientationSegment(orientation))
+			}
+			for _, segment := range kept {
+				out.Write(segment)
+			}
+			out.Write(data[offset:])
+			return out.Bytes(), true
+		}
+		length := int(binary.BigEndian.Uint16(data[offset+2 : offset+4]))
+		end := offset + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, false
+		}
+		segment := data[offset+4 : end]
+
+		switch {
+		case marker == 0xE1:
+			if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				orientation = exifOrientation(segment[6:])
+			}
+		case marker == 0xED || marker == 0xFE:
+		default:
+			kept = append(kept, data[offset:end])
+		}
+		offset = end
+	}
+	return nil, false
+}
+
+// exifOrientation reads tag 0x0112 from IFD0 of a TIFF structure
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd+2 > len(tiff) || ifd < 8 {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[ifd : ifd+2]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:entry+2]) == 0x0112 {
+			value := int(order.Uint16(tiff[entry+8 : entry+10]))
+			if value >= 1 && value <= 8 {
+				return value
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// jpegOrientationSegment builds an APP1 segment whose EXIF holds only the
+// orientation tag
+func jpegOrientationSegment(orientation int) []byte {
+	tiff := []byte{
+		'M', 'M', 0, 42, 0, 0, 0, 8, // big-endian header, IFD0 at offset 8
+		0, 1, // one entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0, // Orientation, SHORT, count 1
+		0, 0, 0, 0, // no next IFD
+	}
+	body := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(body)+2))
+	return append(segment, body...)
+}
+
+// PNG chunks that carry metadata rather than pixels or color information
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// stripPNGMetadata drops metadata chunks; each chunk has its own CRC so the
+// rest stay valid
+func stripPNGMetadata(data []byte) ([]byte, bool) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, false
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.WriteString(signature)
+
+	for offset := len(signature); offset < len(data); {
+		if offset+12 > len(data) {
+			return nil, false
+		}
+		length := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		end := offset + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, false
+		}
+		if !pngMetadataChunks[string(data[offset+4:offset+8])] {
+			out.Write(data[offset:end])
+		}
+		offset = end
+	}
+	return out.Bytes(), true
+}
+
+// stripWebPMetadata drops the EXIF and XMP chunks of an extended WebP and
+// clears their flags in the VP8X header
+func stripWebPMetadata(data []byte) ([]byte, bool) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, false
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+
+	for offset := 12; offset < len(data); {
+		if offset+8 > len(data) {
+			return nil, false
+		}
+		kind := string(data[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		end := offset + 8 + size + size%2 // chunks are padded to an even size
+		if size < 0 || end > len(data) {
+			return nil, false
+		}
+		switch kind {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := append([]byte(nil), data[offset:end]...)
+			if len(chunk) > 8 {
+				chunk[8] &^= 0x08 | 0x04 // EXIF and XMP present flags
+			}
+			out.Write(chunk)
+		default:
+			out.Write(data[offset:end])
+		}
+		offset = end
+	}
+
+	stripped := out.Bytes()
+	binary.LittleEndian.PutUint32(stripped[4:8], uint32(len(stripped)-8))
+	return stripped, true
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+// jpegSegment builds a marker segment with body
+func jpegSegment(marker byte, body []byte) []byte {
+	segment := []byte{0xFF, marker}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(body)+2))
+	return append(segment, body...)
+}
+
+// exifWithOrientation builds an APP1 EXIF body holding an orientation and a
+// GPS IFD pointer, little-endian to differ from what the stripper writes
+func exifWithOrientation(orientation uint16) []byte {
+	tiff := []byte("II\x2a\x00\x08\x00\x00\x00")
+	tiff = binary.LittleEndian.AppendUint16(tiff, 2)
+	tiff = append(tiff, 0x12, 0x01, 3, 0, 1, 0, 0, 0)
+	tiff = binary.LittleEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0)
+	tiff = append(tiff, 0x25, 0x88, 4, 0, 1, 0, 0, 0, 0x40, 0, 0, 0) // GPS IFD
+	tiff = append(tiff, 0, 0, 0, 0)
+	return append([]byte("Exif\x00\x00"), tiff...)
+}
+
+func jpegFile(segments ...[]byte) []byte {
+	file := []byte{0xFF, 0xD8}
+	for _, segment := range segments {
+		file = append(file, segment...)
+	}
+	file = append(file, jpegSegment(0xDA, []byte{1, 2, 3})...)
+	return append(file, 0x55, 0xAA, 0xFF, 0xD9)
+}
+
+func pngChunk(kind string, body []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	chunk = append(chunk, kind...)
+	chunk = append(chunk, body...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+func webpChunk(kind string, body []byte) []byte {
+	chunk := append([]byte(kind), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...)
+	chunk = append(chunk, body...)
+	if len(body)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func webpFile(chunks ...[]byte) []byte {
+	body := []byte("WEBP")
+	for _, chunk := range chunks {
+		body = append(body, chunk...)
+	}
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+func TestStripImageMetadata(t *testing.T) {
+	jfif := jpegSegment(0xE0, []byte("JFIF\x00\x01\x02"))
+	quant := jpegSegment(0xDB, make([]byte, 65))
+	vp8x := append([]byte{0x0C}, make([]byte, 9)...) // EXIF and XMP flags set
+
+	tests := []struct {
+		name        string
+		contentType string
+		data        []byte
+		want        []byte
+	}{
+		{
+			name:        "jpeg keeps orientation",
+			contentType: "image/jpeg",
+			data:        jpegFile(jfif, jpegSegment(0xE1, exifWithOrientation(6)), jpegSegment(0xFE, []byte("comment")), quant),
+			want:        jpegFile(jfif, jpegOrientationSegment(6), quant),
+		},
+		{
+			name:        "jpeg upright",
+			contentType: "image/jpeg",
+			data:        jpegFile(jpegSegment(0xE1, exifWithOrientation(1)), jpegSegment(0xED, []byte("Photoshop 3.0\x00")), quant),
+			want:        jpegFile(quant),
+		},
+		{
+			name:        "jpeg xmp",
+			contentType: "image/jpeg",
+			data:        jpegFile(jpegSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<x/>")), quant),
+			want:        jpegFile(quant),
+		},
+		{
+			name:        "truncated jpeg unchanged",
+			contentType: "image/jpeg",
+			data:        []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x10, 0x00, 'E'},
+			want:        []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x10, 0x00, 'E'},
+		},
+		{
+			name:        "png",
+			contentType: "image/png",
+			data:        append([]byte("\x89PNG\r\n\x1a\n"), bytes.Join([][]byte{pngChunk("IHDR", make([]byte, 13)), pngChunk("eXIf", exifWithOrientation(1)[6:]), pngChunk("tEXt", []byte("Author\x00me")), pngChunk("IDAT", []byte{1}), pngChunk("IEND", nil)}, nil)...),
+			want:        append([]byte("\x89PNG\r\n\x1a\n"), bytes.Join([][]byte{pngChunk("IHDR", make([]byte, 13)), pngChunk("IDAT", []byte{1}), pngChunk("IEND", nil)}, nil)...),
+		},
+		{
+			name:        "webp",
+			contentType: "image/webp",
+			data:        webpFile(webpChunk("VP8X", vp8x), webpChunk("VP8 ", []byte{1, 2, 3}), webpChunk("EXIF", exifWithOrientation(1)[6:]), webpChunk("XMP ", []byte("<x/>"))),
+			want:        webpFile(webpChunk("VP8X", make([]byte, 10)), webpChunk("VP8 ", []byte{1, 2, 3})),
+		},
+		{
+			name:        "gif unchanged",
+			contentType: "image/gif",
+			data:        []byte("GIF89a..."),
+			want:        []byte("GIF89a..."),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripImageMetadata(tt.contentType, tt.data); !bytes.Equal(got, tt.want) {
+				t.Errorf("stripImageMetadata =\n%x\nwant\n%x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExifOrientation(t *testing.T) {
+	tests := []struct {
+		name string
+		tiff []byte
+		want int
+	}{
+		{"little-endian", exifWithOrientation(8)[6:], 8},
+		{"big-endian", jpegOrientationSegment(3)[10:], 3},
+		{"out of range", exifWithOrientation(9)[6:], 0},
+		{"IFD past end", []byte("MM\x00\x2a\xff\xff\xff\xff"), 0},
+		{"entries past end", []byte("MM\x00\x2a\x00\x00\x00\x08\xff\xff"), 0},
+		{"bad byte order", []byte("XX\x00\x2a\x00\x00\x00\x08"), 0},
+	}
+	for _, tt := range tests {
+		if got := exifOrientation(tt.tiff); got != tt.want {
+			t.Errorf("%s: exifOrientation = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func FuzzStripImageMetadata(f *testing.F) {
+	f.Add(uint8(0), jpegFile(jpegSegment(0xE1, exifWithOrientation(6))))
+	f.Add(uint8(1), append([]byte("\x89PNG\r\n\x1a\n"), pngChunk("tEXt", []byte("a\x00b"))...))
+	f.Add(uint8(2), webpFile(webpChunk("EXIF", []byte{1})))
+	f.Fuzz(func(t *testing.T, kind uint8, data []byte) {
+		contentType := []string{"image/jpeg", "image/png", "image/webp"}[kind%3]
+		stripped := stripImageMetadata(contentType, data)
+		if again := stripImageMetadata(contentType, stripped); !bytes.Equal(again, stripped) {
+			t.Errorf("stripping %s twice changed it again", contentType)
+		}
+	})
+}
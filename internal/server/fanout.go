@@ -0,0 +1,124 @@
+package server
+
+import (
+	"sync"
+)
+
+// deliveryPool encodes events and hands them to clients' write pumps on a
+// fixed set of workers, so the hub's locks are only held while deciding who
+// gets what. A client's deliveries run one at a time in the order they were
+// dispatched, so its events keep their order, while a client whose outbox is
+// slow to take them (spilling to disk, say) only holds up the worker serving
+// it, not registration or everyone else's broadcasts.
+type deliveryPool struct {
+	mu    sync.Mutex
+	ready *sync.Cond
+
+	// Clients with deliveries waiting and no worker serving them, oldest
+	// first; each appears at most once
+	clients []*Client
+}
+
+// clientDeliveries are a client's deliveries waiting for a worker. Its lock
+// is never held while delivering, or while taking any other lock.
+type clientDeliveries struct {
+	mu      sync.Mutex
+	queue   []func()
+	running bool // Waiting for, or being served by, a worker
+}
+
+// StartDelivery moves fan-out to workers delivery goroutines. Without it, or
+// with 0 workers, events are delivered inline by whoever sends them.
+func (h *Hub) StartDelivery(workers int) {
+	if workers <= 0 {
+		return
+	}
+	pool := &deliveryPool{}
+	pool.ready = sync.NewCond(&pool.mu)
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+	h.delivery = pool
+}
+
+// dispatch runs deliver on a delivery worker after any earlier deliveries to
+// client. Detached clients only record into a stream, which is cheap and
+// must be seen by a device resuming it, so they're served inline.
+func (h *Hub) dispatch(client *Client, deliver func()) {
+	if h.delivery == nil || client.detached {
+		deliver()
+		return
+	}
+	h.delivery.submit(client, deliver)
+}
+
+// submit queues deliver for client, scheduling the client unless a worker is
+// already due to serve it
+func (p *deliveryPool) submit(client *Client, deliver func()) {
+	d := &client.deliveries
+	d.mu.Lock()
+	d.queue = append(d.queue, deliver)
+	idle := !d.running
+	d.running = true
+	d.mu.Unlock()
+
+	if idle {
+		p.schedule(client)
+	}
+}
+
+func (p *deliveryPool) schedule(client *Client) {
+	p.mu.Lock()
+	p.clients = append(p.clients, client)
+	p.mu.Unlock()
+	p.ready.Signal()
+}
+
+func (p *deliveryPool) work() {
+	for {
+		p.mu.Lock()
+		for len(p.clients) == 0 {
+			p.ready.Wait()
+		}
+		client := p.clients[0]
+		p.clients[0] = nil
+		p.clients = p.clients[1:]
+		p.mu.Unlock()
+
+		p.serve(client)
+	}
+}
+
+// serve runs the deliveries waiting for client. If more arrive meanwhile the
+// client goes to the back of the line, so a busy one can't keep a worker
+// from everyone else.
+func (p *deliveryPool) serve(client *Client) {
+	d := &client.deliveries
+	d.mu.Lock()
+	batch := d.queue
+	d.queue = nil
+	d.mu.Unlock()
+
+	for _, deliver := range batch {
+		deliver()
+	}
+
+	d.mu.Lock()
+	more := len(d.queue) > 0
+	d.running = more
+	d.mu.Unlock()
+	if more {
+		p.schedule(client)
+	}
+}
+
+// pending returns how many deliveries are waiting, plus one while the client
+// is scheduled or being served
+func (d *clientDeliveries) pending() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.running {
+		return len(d.queue) + 1
+	}
+	return len(d.queue)
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"whatsdown/internal/models"
+)
+
+// MessageFilter inspects message content before it is stored and fanned out.
+// It returns the content to deliver, possibly rewritten, or a *FilterRejection
+// to refuse the message.
+type MessageFilter interface {
+	Filter(from, content string) (string, error)
+}
+
+// FilterPipeline applies filters in order; the first rejection stops it
+type FilterPipeline []MessageFilter
+
+// FilterRejection explains why a filter refused a message
+type FilterRejection struct {
+	Filter string
+	Reason string
+}
+
+func (r *FilterRejection) Error() string {
+	return r.Filter + ": " + r.Reason
+}
+
+// NewFilterPipeline builds the filters named in cfg.MessageFilters
+func NewFilterPipeline(cfg *Config) (FilterPipeline, error) {
+	pipeline := FilterPipeline{}
+	for _, name := range cfg.MessageFilters {
+		switch name {
+		case "profanity":
+			pipeline = append(pipeline, newProfanityFilter(cfg.ProfanityWords))
+		case "spam":
+			pipeline = append(pipeline, newSpamFilter(cfg.SpamScoreThreshold))
+		case "keywords":
+			pipeline = append(pipeline, &keywordFilter{keywords: lowerAll(cfg.BlockedKeywords)})
+		default:
+			return nil, fmt.Errorf("unknown message filter: %q", name)
+		}
+	}
+	return pipeline, nil
+}
+
+// Apply runs content through every filter in the pipeline
+func (p FilterPipeline) Apply(from, content string) (string, error) {
+	for _, filter := range p {
+		var err error
+		if content, err = filter.Filter(from, content); err != nil {
+			return "", err
+		}
+	}
+	return content, nil
+}
+
+// profanityFilter masks listed words with asterisks, keeping the first letter
+type profanityFilter struct {
+	pattern *regexp.Regexp
+}
+
+func newProfanityFilter(words []string) *profanityFilter {
+	if len(words) == 0 {
+		return &profanityFilter{}
+	}
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = regexp.QuoteMeta(word)
+	}
+	return &profanityFilter{
+		pattern: regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`),
+	}
+}
+
+func (f *profanityFilter) Filter(from, content string) (string, error) {
+	if f.pattern == nil {
+		return content, nil
+	}
+	return f.pattern.ReplaceAllStringFunc(content, func(word string) string {
+		runes := []rune(word)
+		return string(runes[0]) + strings.Repeat("*", len(runes)-1)
+	}), nil
+}
+
+// keywordFilter rejects messages containing any blocked keyword
+type keywordFilter struct {
+	keywords []string
+}
+
+func (f *keywordFilter) Filter(from, content string) (string, error) {
+	lower := strings.ToLower(content)
+	for _, keyword := range f.keywords {
+		if strings.Contains(lower, keyword) {
+			return "", &FilterRejection{Filter: "keywords", Reason: "message contains blocked content"}
+		}
+	}
+	return content, nil
+}
+
+// Window in which resending the same content counts towards the spam score
+const spamRepeatWindow = time.Minute
+
+// Length of a run of one character that counts as spammy
+const spamRepeatRun = 10
+
+var spamLinkPattern = regexp.MustCompile(`(?i)https?://`)
+
+// spamFilter scores messages on simple heuristics and rejects those at or
+// above the threshold
+type spamFilter struct {
+	threshold int
+	last      map[string]spamLastMessage
+	mu        sync.Mutex
+}
+
+type spamLastMessage struct {
+	content string
+	at      time.Time
+}
+
+func newSpamFilter(threshold int) *spamFilter {
+	return &spamFilter{
+		threshold: threshold,
+		last:      make(map[string]spamLastMessage),
+	}
+}
+
+func (f *spamFilter) Filter(from, content string) (string, error) {
+	score := spamScore(content)
+
+	f.mu.Lock()
+	previous, exists := f.last[from]
+	if exists && previous.content == content && time.Since(previous.at) < spamRepeatWindow {
+		score += 3
+	}
+	f.last[from] = spamLastMessage{content: content, at: time.Now()}
+	f.mu.Unlock()
+
+	if score >= f.threshold {
+		return "", &FilterRejection{Filter: "spam", Reason: "message looks like spam"}
+	}
+	return content, nil
+}
+
+// spamScore rates content on links, long character runs and shouting
+func spamScore(content string) int {
+	score := 0
+	if links := len(spamLinkPattern.FindAllStringIndex(content, -1)); links > 1 {
+		score += 2 * (links - 1)
+	}
+	if hasRepeatedRun(content, spamRepeatRun) {
+		score += 2
+	}
+
+	letters, upper := 0, 0
+	for _, r := range content {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	if letters >= 20 && upper*10 >= letters*8 {
+		score += 2
+	}
+	return score
+}
+
+// hasRepeatedRun reports whether content repeats one character at least n
+// times in a row. RE2 has no backreferences, so this can't be a regexp.
+func hasRepeatedRun(content string, n int) bool {
+	var previous rune
+	run := 0
+	for _, r := range content {
+		if r == previous {
+			run++
+		} else {
+			previous, run = r, 1
+		}
+		if run >= n {
+			return true
+		}
+	}
+	return false
+}
+
+func lowerAll(words []string) []string {
+	lowered := make([]string, len(words))
+	for i, word := range words {
+		lowered[i] = strings.ToLower(word)
+	}
+	return lowered
+}
+
+// rejectMessage tells the sender a filter refused their message
+func (h *Hub) rejectMessage(from, tempID string, err error) {
+	reason := "message rejected"
+	if rejection, ok := err.(*FilterRejection); ok {
+		reason = rejection.Reason
+	}
+	h.sendError(from, &models.ErrorEvent{
+		Code:    ErrorMessageRejected,
+		Message: reason,
+		TempID:  tempID,
+	})
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+// EventSink receives a copy of every chat event, for analytics, search
+// indexing or compliance systems that shouldn't touch the hub. Each event is
+// a JSON models.FirehoseEvent keyed so that a conversation's events, or a
+// user's presence changes, stay in order.
+type EventSink interface {
+	// Emit must not block; an event that can't be sent is dropped and logged
+	Emit(key string, value []byte)
+	Close() error
+}
+
+func (h *Hub) emit(key string, event *models.FirehoseEvent) {
+	if h.Firehose == nil {
+		return
+	}
+	event.Timestamp = time.Now().UTC()
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error marshaling %s for the firehose: %v", event.Type, err)
+		return
+	}
+	h.Firehose.Emit(key, data)
+}
+
+// emitMessage records a newly stored message. Callers must hold h.mu.
+func (h *Hub) emitMessage(message *models.Message) {
+	if h.Firehose == nil {
+		return
+	}
+	h.emit(message.ConvKey(), &models.FirehoseEvent{
+		Type:    "message",
+		Message: newOutboundMessage(message, message.Status),
+	})
+}
+
+// emitDelivery records message reaching username's device, or being read by
+// username if deviceID is empty. Callers must hold h.mu.
+func (h *Hub) emitDelivery(message *models.Message, username, deviceID, status string) {
+	if h.Firehose == nil {
+		return
+	}
+	h.emit(message.ConvKey(), &models.FirehoseEvent{
+		Type: "delivery",
+		Delivery: &models.FirehoseDelivery{
+			MessageID:       message.ID,
+			ConversationKey: message.ConvKey(),
+			Username:        username,
+			DeviceID:        deviceID,
+			Status:          status,
+		},
+	})
+}
+
+// emitPresence records username's presence after it changed. Callers must
+// hold h.mu.
+func (h *Hub) emitPresence(username string) {
+	if h.Firehose == nil {
+		return
+	}
+	user, exists := h.Users[username]
+	if !exists {
+		return
+	}
+	h.emit(username, &models.FirehoseEvent{
+		Type: "presence",
+		Presence: &models.FirehosePresence{
+			Username: username,
+			Online:   user.Online,
+			Away:     user.Away,
+			LastSeen: lastSeenAt(user),
+		},
+	})
+}
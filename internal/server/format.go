@@ -0,0 +1,111 @@
+package server
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"whatsdown/internal/models"
+)
+
+// Formatting markers, WhatsApp-style
+var formatMarkers = map[rune]string{
+	'*': models.EntityBold,
+	'_': models.EntityItalic,
+	'`': models.EntityCode,
+}
+
+var linkPattern = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// parseFormatting strips formatting markers from content and returns the
+// plain text along with entities describing the formatted ranges. Markers
+// only count at word boundaries and can't span lines, so text like
+// snake_case or "2 * 3 * 4" is left alone. Formatting doesn't nest; links are
+// detected anywhere outside code spans.
+func parseFormatting(content string) (string, []models.MessageEntity) {
+	runes := []rune(content)
+	out := make([]rune, 0, len(runes))
+	entities := []models.MessageEntity{}
+
+	for i := 0; i < len(runes); i++ {
+		entityType, isMarker := formatMarkers[runes[i]]
+		if isMarker && canOpenFormat(runes, i) {
+			if end := findFormatClose(runes, i); end > 0 {
+				entities = append(entities, models.MessageEntity{
+					Type:   entityType,
+					Offset: len(out),
+					Length: end - i - 1,
+				})
+				out = append(out, runes[i+1:end]...)
+				i = end
+				continue
+			}
+		}
+		out = append(out, runes[i])
+	}
+
+	text := string(out)
+	for _, loc := range linkPattern.FindAllStringIndex(text, -1) {
+		link := strings.TrimRight(text[loc[0]:loc[1]], ".,;:!?)]}'")
+		if parsed, err := url.Parse(link); err != nil || parsed.Host == "" {
+			continue
+		}
+		entity := models.MessageEntity{
+			Type:   models.EntityLink,
+			Offset: utf8.RuneCountInString(text[:loc[0]]),
+			Length: utf8.RuneCountInString(link),
+			URL:    link,
+		}
+		if !insideCode(entities, entity) {
+			entities = append(entities, entity)
+		}
+	}
+
+	sort.SliceStable(entities, func(i, j int) bool {
+		return entities[i].Offset < entities[j].Offset
+	})
+	return text, entities
+}
+
+// canOpenFormat reports whether the marker at i can start a formatted span
+func canOpenFormat(runes []rune, i int) bool {
+	if i > 0 && !isFormatBoundary(runes[i-1]) {
+		return false
+	}
+	return i+1 < len(runes) && !unicode.IsSpace(runes[i+1]) && runes[i+1] != runes[i]
+}
+
+// findFormatClose returns the index of the marker closing the span opened at
+// start, or -1 if there isn't one on the same line
+func findFormatClose(runes []rune, start int) int {
+	marker := runes[start]
+	for k := start + 2; k < len(runes); k++ {
+		if runes[k] == '\n' {
+			return -1
+		}
+		if runes[k] != marker || unicode.IsSpace(runes[k-1]) {
+			continue
+		}
+		if k+1 == len(runes) || isFormatBoundary(runes[k+1]) {
+			return k
+		}
+	}
+	return -1
+}
+
+func isFormatBoundary(r rune) bool {
+	return unicode.IsSpace(r) || unicode.IsPunct(r)
+}
+
+// insideCode reports whether entity overlaps a code span
+func insideCode(entities []models.MessageEntity, entity models.MessageEntity) bool {
+	for _, e := range entities {
+		if e.Type == models.EntityCode && entity.Offset < e.Offset+e.Length && e.Offset < entity.Offset+entity.Length {
+			return true
+		}
+	}
+	return false
+}
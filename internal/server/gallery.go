@@ -0,0 +1,114 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"whatsdown/internal/models"
+)
+
+// Gallery sections, like a chat's "Media, Links, Docs" view
+const (
+	GalleryMedia = "media" // images and videos
+	GalleryAudio = "audio" // audio attachments and voice notes
+	GalleryDocs  = "docs"  // other files
+	GalleryLinks = "links"
+)
+
+const (
+	defaultGalleryLimit = 50
+	maxGalleryLimit     = 200
+)
+
+// gallerySection files an item type under its section
+func gallerySection(itemType string) string {
+	switch itemType {
+	case AttachmentImage, AttachmentVideo:
+		return GalleryMedia
+	case AttachmentAudio:
+		return GalleryAudio
+	case models.EntityLink:
+		return GalleryLinks
+	default:
+		return GalleryDocs
+	}
+}
+
+// galleryItems lists the attachments, voice note and links in message
+func galleryItems(message *models.Message) []*models.GalleryItem {
+	var items []*models.GalleryItem
+	add := func(item *models.GalleryItem) {
+		item.MessageID = message.ID
+		item.Seq = message.Seq
+		item.From = message.From
+		item.Timestamp = message.Timestamp
+		items = append(items, item)
+	}
+
+	for _, attachment := range message.Attachments {
+		add(&models.GalleryItem{Type: attachment.Type, Attachment: attachment})
+	}
+	if message.Voice != nil {
+		add(&models.GalleryItem{Type: AttachmentAudio, Voice: message.Voice})
+	}
+	for _, entity := range message.Entities {
+		if entity.Type == models.EntityLink {
+			add(&models.GalleryItem{Type: models.EntityLink, URL: entity.URL})
+		}
+	}
+	return items
+}
+
+// ConversationMedia pages through a conversation's shared media, newest
+// first, starting below beforeSeq (0 for the latest). Pages end on a message
+// boundary, so one may hold a few more than limit items.
+func (h *Hub) ConversationMedia(convKey, username, section string, beforeSeq int64, limit int) *models.MediaGallery {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	gallery := &models.MediaGallery{Items: []*models.GalleryItem{}}
+	messages := h.conversation(convKey)
+	for i := len(messages) - 1; i >= 0; i-- {
+		message := messages[i]
+		if (beforeSeq > 0 && message.Seq >= beforeSeq) || message.HiddenFrom(username) || message.Deleted {
+			continue
+		}
+		if len(gallery.Items) >= limit {
+			gallery.NextBeforeSeq = messages[i+1].Seq
+			break
+		}
+		for _, item := range galleryItems(message) {
+			if section == "" || gallerySection(item.Type) == section {
+				gallery.Items = append(gallery.Items, item)
+			}
+		}
+	}
+	return gallery
+}
+
+// parseGalleryQuery reads ?type=, ?beforeSeq= and ?limit=
+func parseGalleryQuery(w http.ResponseWriter, r *http.Request) (section string, beforeSeq int64, limit int, ok bool) {
+	query := r.URL.Query()
+	section = query.Get("type")
+	switch section {
+	case "", GalleryMedia, GalleryAudio, GalleryDocs, GalleryLinks:
+	default:
+		http.Error(w, "type must be media, audio, docs or links", http.StatusBadRequest)
+		return "", 0, 0, false
+	}
+
+	if value := query.Get("beforeSeq"); value != "" {
+		seq, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || seq < 0 {
+			http.Error(w, "beforeSeq must be a non-negative integer", http.StatusBadRequest)
+			return "", 0, 0, false
+		}
+		beforeSeq = seq
+	}
+
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultGalleryLimit
+	}
+	return section, beforeSeq, min(limit, maxGalleryLimit), true
+}
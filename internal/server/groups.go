@@ -0,0 +1,487 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"whatsdown/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// Maximum number of members in a group
+const maxGroupMembers = 256
+
+var (
+	errGroupNotFound  = errors.New("group not found")
+	errNotGroupMember = errors.New("not a member of this group")
+	errNotGroupAdmin  = errors.New("only group admins can do that")
+	errUnknownUser    = errors.New("unknown user")
+	errGroupFull      = errors.New("group is full")
+)
+
+// CreateGroupRequest represents a request to create a group
+type CreateGroupRequest struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+// GroupMemberRequest represents a request to add a member to a group
+type GroupMemberRequest struct {
+	Username string `json:"username"`
+}
+
+// CreateGroup creates a group with creator as its first admin
+func (h *Hub) CreateGroup(creator, name string, members []string) (*models.Group, error) {
+	h.mu.Lock()
+
+	group := &models.Group{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Members:   []string{creator},
+		Admins:    []string{creator},
+		CreatedBy: creator,
+		CreatedAt: time.Now(),
+	}
+	for _, member := range members {
+		if member == creator || group.IsMember(member) {
+			continue
+		}
+		if _, exists := h.Users[member]; !exists {
+			h.mu.Unlock()
+			return nil, errUnknownUser
+		}
+		group.Members = append(group.Members, member)
+	}
+	if len(group.Members) > maxGroupMembers {
+		h.mu.Unlock()
+		return nil, errGroupFull
+	}
+
+	h.Groups[group.ID] = group
+	snapshot := group.Snapshot()
+	h.mu.Unlock()
+
+	h.notifyGroup(snapshot, snapshot.Members)
+	return snapshot, nil
+}
+
+// GetGroup returns a group if username is a member
+func (h *Hub) GetGroup(groupID, username string) (*models.Group, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	group, exists := h.Groups[groupID]
+	if !exists {
+		return nil, errGroupNotFound
+	}
+	if !group.IsMember(username) {
+		return nil, errNotGroupMember
+	}
+	return group.Snapshot(), nil
+}
+
+// JoinGroup adds username to a group
+func (h *Hub) JoinGroup(groupID, username string) (*models.Group, error) {
+	return h.addGroupMember(groupID, "", username)
+}
+
+// AddGroupMember lets an admin add another user to a group
+func (h *Hub) AddGroupMember(groupID, admin, username string) (*models.Group, error) {
+	return h.addGroupMember(groupID, admin, username)
+}
+
+// addGroupMember adds username to a group, requiring admin rights unless
+// admin is empty (a user joining themselves)
+func (h *Hub) addGroupMember(groupID, admin, username string) (*models.Group, error) {
+	h.mu.Lock()
+
+	group, exists := h.Groups[groupID]
+	if !exists {
+		h.mu.Unlock()
+		return nil, errGroupNotFound
+	}
+	if admin != "" && !group.IsAdmin(admin) {
+		h.mu.Unlock()
+		return nil, errNotGroupAdmin
+	}
+	if _, exists := h.Users[username]; !exists && admin != "" {
+		h.mu.Unlock()
+		return nil, errUnknownUser
+	}
+	if group.IsMember(username) {
+		snapshot := group.Snapshot()
+		h.mu.Unlock()
+		return snapshot, nil
+	}
+	if len(group.Members) >= maxGroupMembers {
+		h.mu.Unlock()
+		return nil, errGroupFull
+	}
+
+	group.Members = append(group.Members, username)
+	snapshot := group.Snapshot()
+	h.mu.Unlock()
+
+	h.notifyGroup(snapshot, snapshot.Members)
+	return snapshot, nil
+}
+
+// LeaveGroup removes username from a group
+func (h *Hub) LeaveGroup(groupID, username string) error {
+	return h.removeGroupMember(groupID, "", username)
+}
+
+// RemoveGroupMember lets an admin remove another member from a group
+func (h *Hub) RemoveGroupMember(groupID, admin, username string) error {
+	return h.removeGroupMember(groupID, admin, username)
+}
+
+// removeGroupMember removes username from a group, requiring admin rights
+// unless admin is empty. If the last admin leaves, the longest-standing
+// remaining member is promoted; an empty group is deleted.
+func (h *Hub) removeGroupMember(groupID, admin, username string) error {
+	h.mu.Lock()
+
+	group, exists := h.Groups[groupID]
+	if !exists {
+		h.mu.Unlock()
+		return errGroupNotFound
+	}
+	if admin != "" && !group.IsAdmin(admin) {
+		h.mu.Unlock()
+		return errNotGroupAdmin
+	}
+	if !group.IsMember(username) {
+		h.mu.Unlock()
+		return errNotGroupMember
+	}
+
+	// Notify the departing member too, so their client drops the group
+	recipients := append([]string(nil), group.Members...)
+
+	group.Members = removeString(group.Members, username)
+	group.Admins = removeString(group.Admins, username)
+	if len(group.Members) == 0 {
+		delete(h.Groups, groupID)
+		h.deleteConversation(models.GroupConvKey(groupID))
+		h.mu.Unlock()
+		return nil
+	}
+	if len(group.Admins) == 0 {
+		group.Admins = []string{group.Members[0]}
+	}
+
+	snapshot := group.Snapshot()
+	h.mu.Unlock()
+
+	h.notifyGroup(snapshot, recipients)
+	return nil
+}
+
+// GetGroupMessages returns a group's messages if username is a member
+func (h *Hub) GetGroupMessages(groupID, username string) ([]*models.Message, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	group, exists := h.Groups[groupID]
+	if !exists {
+		return nil, errGroupNotFound
+	}
+	if !group.IsMember(username) {
+		return nil, errNotGroupMember
+	}
+	return visibleMessages(h.conversation(models.GroupConvKey(groupID)), username), nil
+}
+
+// deliverGroupMessage stores a group message and sends it to every online
+// member, reporting whether it was stored
+func (h *Hub) deliverGroupMessage(message *models.Message, msgType string) bool {
+	unlock := h.lockConversation(message.ConvKey())
+	h.mu.RLock()
+
+	group, exists := h.Groups[message.GroupID]
+	if !exists || !group.IsMember(message.From) {
+		h.mu.RUnlock()
+		unlock()
+		log.Printf("Dropping group message from %s: not a member of %s", message.From, message.GroupID)
+		h.sendError(message.From, &models.ErrorEvent{
+			Code:    ErrorInvalidRecipient,
+			Message: "not a member of the group",
+			TempID:  message.TempID,
+		})
+		return false
+	}
+
+	message.Mentions = parseMentions(message.Content, group, message.From)
+
+	var senderClients []*Client
+	recipients := []*Client{}
+	offline := []string{}
+	delivered := false
+	for _, member := range group.Members {
+		if member == message.From {
+			senderClients = h.clientsOf(member)
+			continue
+		}
+		if h.isConnected(member) {
+			delivered = true
+		} else {
+			offline = append(offline, member)
+			h.queueOffline(member, offlineEvent{msgType: msgType, message: message})
+		}
+		// Includes devices that may still resume their event stream
+		recipients = append(recipients, h.clientsOf(member)...)
+	}
+	h.storeMessage(message, recipients)
+
+	silent := make(map[*Client]bool, len(recipients))
+	for _, client := range recipients {
+		silent[client] = !h.shouldAlert(client.Username, message)
+	}
+	mentioned := h.mentionRecipients(message)
+	title := message.From + " in " + group.Name
+	members := append([]string(nil), group.Members...)
+	h.mu.RUnlock()
+
+	h.notifyOffline(message, title, offline)
+
+	senderOutbound := senderOutboundMessage(message, "sent")
+	for _, client := range senderClients {
+		h.sendToClient(client, msgType, senderOutbound)
+	}
+
+	// Members' devices on other instances get the message as it stands here
+	h.relayToUser(message.From, msgType, senderOutbound)
+	for _, member := range members {
+		if member != message.From {
+			h.relayToUser(member, msgType, newOutboundMessage(message, "sent"))
+		}
+	}
+
+	for _, client := range recipients {
+		outbound := newOutboundMessage(message, "delivered")
+		outbound.Silent = silent[client]
+		h.sendToClient(client, msgType, outbound)
+	}
+
+	// Mentions get a separate event so clients can badge them apart from regular unreads
+	if len(mentioned) > 0 {
+		mention := &models.MentionEvent{
+			MessageID: message.ID,
+			GroupID:   message.GroupID,
+			From:      message.From,
+			Preview:   message.Quote().Snippet,
+		}
+		for _, client := range mentioned {
+			h.sendToClient(client, "mention", mention)
+		}
+	}
+
+	// A group message counts as delivered once any other member has it
+	if delivered {
+		ack := &models.AckEvent{
+			MessageID: message.ID,
+			TempID:    message.TempID,
+			Status:    "delivered",
+		}
+		for _, client := range senderClients {
+			h.sendToClient(client, "ack", ack)
+		}
+	}
+	unlock()
+
+	h.translateLater(message, recipients)
+	return true
+}
+
+// notifyGroup pushes the group's current state to the given usernames
+func (h *Hub) notifyGroup(group *models.Group, usernames []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, username := range usernames {
+		h.sendToUser(username, "group", group)
+	}
+}
+
+func removeString(items []string, item string) []string {
+	result := items[:0]
+	for _, i := range items {
+		if i != item {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+// groupErrorStatus maps group errors to HTTP status codes
+func groupErrorStatus(err error) int {
+	switch err {
+	case errGroupNotFound:
+		return http.StatusNotFound
+	case errNotGroupMember, errNotGroupAdmin:
+		return http.StatusForbidden
+	case errGroupFull:
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// HandleCreateGroup handles POST /api/groups
+func (h *HTTPHandlers) HandleCreateGroup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	var req CreateGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if len(name) == 0 || len(name) > 100 {
+		http.Error(w, "Group name must be between 1 and 100 characters", http.StatusBadRequest)
+		return
+	}
+
+	group, err := h.Hub.CreateGroup(session.Username, name, req.Members)
+	if err != nil {
+		http.Error(w, err.Error(), groupErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(group)
+}
+
+// HandleGroup handles the /api/groups/{id} subtree:
+//
+//	GET    /api/groups/{id}
+//	GET    /api/groups/{id}/messages?sinceSeq=<n>
+//	GET    /api/groups/{id}/pins
+//	PUT    /api/groups/{id}/disappearing
+//	GET, PUT, DELETE /api/groups/{id}/mute
+//	POST   /api/groups/{id}/archive
+//	POST   /api/groups/{id}/unarchive
+//	POST   /api/groups/{id}/join
+//	POST   /api/groups/{id}/leave
+//	POST   /api/groups/{id}/members
+//	DELETE /api/groups/{id}/members/{username}
+func (h *HTTPHandlers) HandleGroup(w http.ResponseWriter, r *http.Request) {
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/groups/"), "/"), "/")
+	groupID := parts[0]
+	if groupID == "" {
+		http.Error(w, "Group ID required", http.StatusBadRequest)
+		return
+	}
+
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	var result interface{}
+	var err error
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		result, err = h.Hub.GetGroup(groupID, session.Username)
+
+	case action == "messages" && r.Method == http.MethodGet:
+		since, ok := parseSinceSeq(w, r)
+		if !ok {
+			return
+		}
+		var messages []*models.Message
+		if messages, err = h.Hub.GetGroupMessages(groupID, session.Username); err == nil {
+			result = messagesAfter(messages, since)
+		}
+
+	case action == "pins" && r.Method == http.MethodGet:
+		if _, err = h.Hub.GetGroup(groupID, session.Username); err == nil {
+			result = h.Hub.GetPinnedMessages(models.GroupConvKey(groupID), session.Username)
+		}
+
+	case action == "media" && r.Method == http.MethodGet:
+		section, beforeSeq, limit, ok := parseGalleryQuery(w, r)
+		if !ok {
+			return
+		}
+		if _, err = h.Hub.GetGroup(groupID, session.Username); err == nil {
+			result = h.Hub.ConversationMedia(models.GroupConvKey(groupID), session.Username, section, beforeSeq, limit)
+		}
+
+	case action == "disappearing" && r.Method == http.MethodPut:
+		duration, ok := parseDisappearingRequest(w, r)
+		if !ok {
+			return
+		}
+		result, err = h.Hub.SetGroupDisappearingTimer(groupID, session.Username, duration)
+
+	case action == "mute":
+		if _, err = h.Hub.GetGroup(groupID, session.Username); err == nil {
+			h.handleMute(w, r, session.Username, models.GroupConvKey(groupID), &models.Mute{GroupID: groupID})
+			return
+		}
+
+	case action == "archive" || action == "unarchive":
+		if _, err = h.Hub.GetGroup(groupID, session.Username); err == nil {
+			h.handleArchive(w, r, session.Username, models.GroupConvKey(groupID), action, &models.Archive{GroupID: groupID})
+			return
+		}
+
+	case action == "join" && r.Method == http.MethodPost:
+		result, err = h.Hub.JoinGroup(groupID, session.Username)
+
+	case action == "leave" && r.Method == http.MethodPost:
+		if err = h.Hub.LeaveGroup(groupID, session.Username); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+	case action == "members" && len(parts) == 2 && r.Method == http.MethodPost:
+		var req GroupMemberRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		result, err = h.Hub.AddGroupMember(groupID, session.Username, strings.TrimSpace(req.Username))
+
+	case action == "members" && len(parts) == 3 && r.Method == http.MethodDelete:
+		if err = h.Hub.RemoveGroupMember(groupID, session.Username, parts[2]); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), groupErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// SecurityHeaders wraps next so every response carries the configured
+// security headers. HSTS is only sent over TLS, since browsers ignore it on
+// plain HTTP and sending it there would be misleading.
+func SecurityHeaders(cfg *Config, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		if cfg.ContentSecurityPolicy != "" {
+			header.Set("Content-Security-Policy", cfg.ContentSecurityPolicy)
+		}
+		if cfg.ReferrerPolicy != "" {
+			header.Set("Referrer-Policy", cfg.ReferrerPolicy)
+		}
+		header.Set("X-Content-Type-Options", "nosniff")
+
+		if r.TLS != nil && cfg.HSTSMaxAge > 0 {
+			header.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", int(cfg.HSTSMaxAge.Seconds())))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+// heartbeat holds one connection's keepalive timings
+type heartbeat struct {
+	pingInterval time.Duration // Ping the client this often
+	pongTimeout  time.Duration // Drop the client after this long without a pong
+	writeTimeout time.Duration // Time allowed to write a frame
+}
+
+// heartbeatFor returns the timings for a connection. A client may ask for a
+// longer ping interval with ?pingInterval=<duration> (e.g. "2m"), up to
+// h.MaxPingInterval; its pong timeout grows by as much. ok is false if the
+// value is malformed.
+func (h *Hub) heartbeatFor(r *http.Request) (beat heartbeat, ok bool) {
+	beat = heartbeat{
+		pingInterval: h.PingInterval,
+		pongTimeout:  h.PongTimeout,
+		writeTimeout: h.WriteTimeout,
+	}
+	value := r.URL.Query().Get("pingInterval")
+	if value == "" {
+		return beat, true
+	}
+	requested, err := time.ParseDuration(value)
+	if err != nil {
+		return beat, false
+	}
+	if requested > h.MaxPingInterval {
+		requested = h.MaxPingInterval
+	}
+	if requested > beat.pingInterval {
+		beat.pongTimeout += requested - beat.pingInterval
+		beat.pingInterval = requested
+	}
+	return beat, true
+}
+
+// sendHello tells a newly registered client the protocol version and
+// heartbeat timings it got. It is the first frame on every connection and,
+// like "stream", isn't numbered. Long-poll clients have no heartbeat and
+// aren't sent one.
+func (h *Hub) sendHello(client *Client) {
+	if client.poll != nil {
+		return
+	}
+	data, err := client.codec.Marshal(&models.WSMessage{Type: "hello", Payload: &models.HelloEvent{
+		ProtocolVersion: client.protocolVersion,
+		PingInterval:    client.heartbeat.pingInterval.Seconds(),
+		PongTimeout:     client.heartbeat.pongTimeout.Seconds(),
+		WriteTimeout:    client.heartbeat.writeTimeout.Seconds(),
+		MaxPingInterval: h.MaxPingInterval.Seconds(),
+		ResumeWindow:    h.ResumeWindow.Seconds(),
+		ReconnectGrace:  h.ReconnectGrace.Seconds(),
+	}})
+	if err != nil {
+		log.Printf("Error marshaling hello event: %v", err)
+		return
+	}
+	client.enqueue(outboxFrame{data: data})
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"whatsdown/internal/models"
+)
+
+// ClearConversation hides every message between username and peer from
+// username, or with DeleteForEveryone from both of them, and sends a
+// "cleared" event to each affected user so open clients refresh. It returns
+// the number of messages newly hidden from username.
+func (h *Hub) ClearConversation(username, peer, scope string) int {
+	h.mu.Lock()
+
+	users := []string{username}
+	if scope == DeleteForEveryone && peer != username {
+		users = append(users, peer)
+	}
+
+	cleared := 0
+	for _, message := range h.conversation(models.ConvKey(username, peer)) {
+		for _, user := range users {
+			if message.HiddenFrom(user) {
+				continue
+			}
+			message.HiddenFor = append(message.HiddenFor, user)
+			if user == username {
+				cleared++
+			}
+		}
+	}
+
+	type notification struct {
+		client *Client
+		event  *models.ClearEvent
+	}
+	var notifications []notification
+	for _, user := range users {
+		other := peer
+		if user != username {
+			other = username
+		}
+		event := &models.ClearEvent{
+			Peer:      other,
+			Scope:     scope,
+			ClearedBy: username,
+		}
+		for _, client := range h.clientsOf(user) {
+			notifications = append(notifications, notification{client, event})
+		}
+	}
+	h.mu.Unlock()
+
+	for _, n := range notifications {
+		h.sendToClient(n.client, "cleared", n.event)
+	}
+	return cleared
+}
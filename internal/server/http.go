@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"strings"
 	"sync"
@@ -11,37 +12,57 @@ import (
 
 	"whatsdown/internal/models"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
 // SessionStore manages HTTP sessions
 type SessionStore struct {
-	sessions map[string]*models.Session
-	mu       sync.RWMutex
+	sessions        map[string]*models.Session
+	idleTimeout     time.Duration
+	absoluteTimeout time.Duration
+	mu              sync.RWMutex
 }
 
 var sessionStore = &SessionStore{
-	sessions: make(map[string]*models.Session),
+	sessions:        make(map[string]*models.Session),
+	idleTimeout:     DefaultConfig().SessionIdleTimeout,
+	absoluteTimeout: DefaultConfig().SessionAbsoluteTimeout,
+}
+
+// ConfigureSessions applies the session timeouts from cfg
+func ConfigureSessions(cfg *Config) {
+	sessionStore.mu.Lock()
+	defer sessionStore.mu.Unlock()
+	sessionStore.idleTimeout = cfg.SessionIdleTimeout
+	sessionStore.absoluteTimeout = cfg.SessionAbsoluteTimeout
 }
 
 // CreateSession creates a new session for a username
-func (s *SessionStore) CreateSession(username string) string {
+func (s *SessionStore) CreateSession(username, ip, userAgent string) string {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	now := time.Now()
 	sessionID := generateSessionID()
-	s.sessions[sessionID] = &models.Session{
-		Username:  username,
-		ExpiresAt: time.Now().Add(24 * time.Hour),
+	session := &models.Session{
+		ID:           uuid.New().String(),
+		Username:     username,
+		CreatedAt:    now,
+		LastActivity: now,
+		IP:           ip,
+		UserAgent:    userAgent,
 	}
+	session.ExpiresAt = s.expiry(session)
+	s.sessions[sessionID] = session
 
 	return sessionID
 }
 
-// GetSession retrieves a session by ID
+// GetSession retrieves a session by ID, sliding its idle expiry forward
 func (s *SessionStore) GetSession(sessionID string) (*models.Session, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	session, exists := s.sessions[sessionID]
 	if !exists {
@@ -53,9 +74,67 @@ func (s *SessionStore) GetSession(sessionID string) (*models.Session, bool) {
 		return nil, false
 	}
 
+	s.touch(session)
 	return session, true
 }
 
+// Touch records activity on a session without returning it, reporting
+// whether the session is still valid
+func (s *SessionStore) Touch(sessionID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session, exists := s.sessions[sessionID]; exists && time.Now().Before(session.ExpiresAt) {
+		s.touch(session)
+		return true
+	}
+	return false
+}
+
+// Valid reports whether a session exists and hasn't expired, without
+// counting as activity on it
+func (s *SessionStore) Valid(sessionID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, exists := s.sessions[sessionID]
+	return exists && time.Now().Before(session.ExpiresAt)
+}
+
+// RefreshSession resets a session's idle timer and returns a snapshot of it
+func (s *SessionStore) RefreshSession(sessionID string) (*models.Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, exists := s.sessions[sessionID]
+	if !exists {
+		return nil, false
+	}
+	if time.Now().After(session.ExpiresAt) {
+		delete(s.sessions, sessionID)
+		return nil, false
+	}
+
+	s.touch(session)
+	snapshot := *session
+	return &snapshot, true
+}
+
+func (s *SessionStore) touch(session *models.Session) {
+	session.LastActivity = time.Now()
+	session.ExpiresAt = s.expiry(session)
+}
+
+// expiry is the earlier of the idle and absolute deadlines
+func (s *SessionStore) expiry(session *models.Session) time.Time {
+	idle := session.LastActivity.Add(s.idleTimeout)
+	absolute := session.CreatedAt.Add(s.absoluteTimeout)
+	if idle.Before(absolute) {
+		return idle
+	}
+	return absolute
+}
+
 // DeleteSession removes a session
 func (s *SessionStore) DeleteSession(sessionID string) {
 	s.mu.Lock()
@@ -74,13 +153,72 @@ func (s *SessionStore) DeleteSessionByUsername(username string) {
 	}
 }
 
+// ListSessions returns the active sessions for a username keyed by session ID
+func (s *SessionStore) ListSessions(username string) map[string]*models.Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	sessions := make(map[string]*models.Session)
+	for sessionID, session := range s.sessions {
+		if session.Username == username && now.Before(session.ExpiresAt) {
+			snapshot := *session
+			sessions[sessionID] = &snapshot
+		}
+	}
+	return sessions
+}
+
+// RevokeSession removes the session with the given public ID if it belongs
+// to username, returning the revoked session ID
+func (s *SessionStore) RevokeSession(username, publicID string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sessionID, session := range s.sessions {
+		if session.ID == publicID && session.Username == username {
+			delete(s.sessions, sessionID)
+			return sessionID, true
+		}
+	}
+	return "", false
+}
+
+// remaining returns the number of seconds until the session's absolute deadline
+func (s *SessionStore) remaining(sessionID string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	session, exists := s.sessions[sessionID]
+	if !exists {
+		return -1
+	}
+	return int(time.Until(session.CreatedAt.Add(s.absoluteTimeout)).Seconds())
+}
+
 func generateSessionID() string {
 	return fmt.Sprintf("%d-%d", time.Now().UnixNano(), time.Now().Unix())
 }
 
 // HTTPHandlers contains HTTP route handlers
 type HTTPHandlers struct {
-	Hub *Hub
+	Hub      *Hub
+	Config   *Config
+	IPFilter *IPFilter
+	Audit    *AuditLog
+	Keys     *KeyStore
+
+	// Reported messages and user suspensions
+	Moderation *ModerationQueue
+
+	// Nil unless Web Push is configured
+	WebPush *WebPushProvider
+
+	// Signs media URLs that work without a session
+	MediaURLs *MediaSigner
+
+	// Issues tickets that authenticate a WebSocket upgrade without a cookie
+	WSTickets *TicketSigner
 }
 
 // LoginRequest represents a login request
@@ -90,14 +228,36 @@ type LoginRequest struct {
 
 // LoginResponse represents a login response
 type LoginResponse struct {
-	Username string `json:"username"`
-	Online   bool   `json:"online"`
+	Username   string `json:"username"`
+	Online     bool   `json:"online"`
+	StatusText string `json:"statusText,omitempty"`
 }
 
 // UserResponse represents a user in search results
 type UserResponse struct {
 	Username string `json:"username"`
 	Online   bool   `json:"online"`
+	Away     bool   `json:"away,omitempty"`
+
+	// When the user was last online; omitted while they are
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+
+	StatusText string `json:"statusText,omitempty"`
+
+	// The caller's private nickname for the user
+	Nickname string `json:"nickname,omitempty"`
+}
+
+// newUserResponse describes user, already filtered by visibleUser
+func newUserResponse(user *models.User) UserResponse {
+	return UserResponse{
+		Username:   user.Username,
+		Online:     user.Online,
+		Away:       user.Away,
+		LastSeen:   lastSeenAt(user),
+		StatusText: user.StatusText,
+		Nickname:   user.Nickname,
+	}
 }
 
 // HandleLogin handles POST /api/login
@@ -116,6 +276,7 @@ func (h *HTTPHandlers) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	// Validate username
 	username := strings.TrimSpace(req.Username)
 	if len(username) == 0 || len(username) > 50 {
+		h.Audit.Record(AuditLoginFailed, username, clientIP(r), "invalid username length")
 		http.Error(w, "Username must be between 1 and 50 characters", http.StatusBadRequest)
 		return
 	}
@@ -124,34 +285,36 @@ func (h *HTTPHandlers) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	for _, char := range username {
 		if !((char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || 
 			(char >= '0' && char <= '9') || char == '_') {
+			h.Audit.Record(AuditLoginFailed, username, clientIP(r), "invalid username characters")
 			http.Error(w, "Username can only contain letters, numbers, and underscores", http.StatusBadRequest)
 			return
 		}
 	}
 
-	// Check if user already has an active connection
-	h.Hub.mu.RLock()
-	if user, exists := h.Hub.Users[username]; exists && user.CurrentConn != nil {
-		h.Hub.mu.RUnlock()
-		http.Error(w, "User already logged in from another device", http.StatusConflict)
+	if strings.EqualFold(username, BotUsername) {
+		h.Audit.Record(AuditLoginFailed, username, clientIP(r), "reserved username")
+		http.Error(w, "Username is reserved", http.StatusForbidden)
+		return
+	}
+
+	if until, suspended := h.Moderation.Suspended(username); suspended {
+		h.Audit.Record(AuditLoginFailed, username, clientIP(r), "suspended")
+		http.Error(w, "Account suspended until "+until.Format(time.RFC3339), http.StatusForbidden)
+		return
+	}
+
+	if !h.Hub.admitUser(username) {
+		h.Audit.Record(AuditLoginFailed, username, clientIP(r), "user limit reached")
+		http.Error(w, "Server is at its user limit", http.StatusServiceUnavailable)
 		return
 	}
-	h.Hub.mu.RUnlock()
 
 	// Create session
-	sessionID := sessionStore.CreateSession(username)
+	sessionID := sessionStore.CreateSession(username, clientIP(r), r.UserAgent())
 
 	// Set cookie
-	cookie := &http.Cookie{
-		Name:     "session_id",
-		Value:    sessionID,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   false, // Set to true in production with HTTPS
-		SameSite: http.SameSiteStrictMode,
-		MaxAge:   86400, // 24 hours
-	}
-	http.SetCookie(w, cookie)
+	setSessionCookie(w, sessionID)
+	h.Audit.Record(AuditLogin, username, clientIP(r), r.UserAgent())
 
 	// Return response
 	resp := LoginResponse{
@@ -181,17 +344,13 @@ func (h *HTTPHandlers) HandleLogout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Close WebSocket connection if exists
-	h.Hub.mu.Lock()
-	if client, exists := h.Hub.Clients[session.Username]; exists {
-		h.Hub.mu.Unlock()
-		h.Hub.Unregister <- client
-	} else {
-		h.Hub.mu.Unlock()
-	}
+	// Close the WebSocket connections opened with this session; the user's
+	// other devices stay connected
+	h.Hub.DisconnectSession(session.Username, sessionID)
 
 	// Delete session
 	sessionStore.DeleteSession(sessionID)
+	h.Audit.Record(AuditLogout, session.Username, clientIP(r), "")
 
 	// Clear cookie
 	cookie := &http.Cookie{
@@ -227,14 +386,17 @@ func (h *HTTPHandlers) HandleMe(w http.ResponseWriter, r *http.Request) {
 
 	h.Hub.mu.RLock()
 	online := false
+	statusText := ""
 	if user, exists := h.Hub.Users[session.Username]; exists {
 		online = user.Online
+		statusText = user.StatusText
 	}
 	h.Hub.mu.RUnlock()
 
 	resp := LoginResponse{
-		Username: session.Username,
-		Online:   online,
+		Username:   session.Username,
+		Online:     online,
+		StatusText: statusText,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
@@ -261,21 +423,19 @@ func (h *HTTPHandlers) HandleSearchUsers(w http.ResponseWriter, r *http.Request)
 	}
 
 	query := r.URL.Query().Get("search")
-	users := h.Hub.SearchUsers(query, session.Username)
+	contactsOnly := r.URL.Query().Get("contacts") == "true"
+	users := h.Hub.SearchUsers(query, session.Username, contactsOnly)
 
 	userResponses := make([]UserResponse, len(users))
 	for i, user := range users {
-		userResponses[i] = UserResponse{
-			Username: user.Username,
-			Online:   user.Online,
-		}
+		userResponses[i] = newUserResponse(user)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(userResponses)
 }
 
-// HandleGetConversations handles GET /api/conversations
+// HandleGetConversations handles GET /api/conversations?filter=archived|all
 func (h *HTTPHandlers) HandleGetConversations(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -294,19 +454,31 @@ func (h *HTTPHandlers) HandleGetConversations(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	conversations := h.Hub.GetConversations(session.Username)
+	filter := r.URL.Query().Get("filter")
+	if filter != ConversationFilterActive && filter != ConversationFilterArchived && filter != ConversationFilterAll {
+		http.Error(w, "filter must be archived or all", http.StatusBadRequest)
+		return
+	}
+
+	conversations := filterConversations(h.Hub.GetConversations(session.Username), filter)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(conversations)
 }
 
-// HandleGetConversation handles GET /api/conversations/{peerUsername}
+// HandleGetConversation handles the /api/conversations/{peerUsername} subtree:
+//
+//	GET /api/conversations/{peerUsername}
+//	GET /api/conversations/{peerUsername}?sinceSeq=<n>
+//	DELETE /api/conversations/{peerUsername}?scope=me|everyone
+//	GET /api/conversations/{peerUsername}/pins
+//	GET, PUT /api/conversations/{peerUsername}/draft
+//	GET /api/conversations/{peerUsername}/search?q=<query>&limit=<n>
+//	PUT /api/conversations/{peerUsername}/disappearing
+//	GET, PUT, DELETE /api/conversations/{peerUsername}/mute
+//	POST /api/conversations/{peerUsername}/archive
+//	POST /api/conversations/{peerUsername}/unarchive
 func (h *HTTPHandlers) HandleGetConversation(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
 	sessionID := getSessionIDFromRequest(r)
 	if sessionID == "" {
 		http.Error(w, "Not authenticated", http.StatusUnauthorized)
@@ -319,19 +491,113 @@ func (h *HTTPHandlers) HandleGetConversation(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	// Extract peer username from path
-	path := strings.TrimPrefix(r.URL.Path, "/api/conversations/")
-	peerUsername := strings.TrimSpace(path)
+	// Extract peer username and optional action from path
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/conversations/"), "/"), "/")
+	peerUsername := strings.TrimSpace(parts[0])
 
 	if peerUsername == "" {
 		http.Error(w, "Peer username required", http.StatusBadRequest)
 		return
 	}
 
-	messages := h.Hub.GetConversationMessages(session.Username, peerUsername)
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	var result interface{}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		since, ok := parseSinceSeq(w, r)
+		if !ok {
+			return
+		}
+		result = messagesAfter(h.Hub.GetConversationMessages(session.Username, peerUsername), since)
+
+	case action == "" && r.Method == http.MethodDelete:
+		scope := r.URL.Query().Get("scope")
+		if scope == "" {
+			scope = DeleteForMe
+		}
+		if scope != DeleteForMe && scope != DeleteForEveryone {
+			http.Error(w, "scope must be \"me\" or \"everyone\"", http.StatusBadRequest)
+			return
+		}
+		h.Hub.ClearConversation(session.Username, peerUsername, scope)
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	case action == "pins" && r.Method == http.MethodGet:
+		result = h.Hub.GetPinnedMessages(models.ConvKey(session.Username, peerUsername), session.Username)
+
+	case action == "media" && r.Method == http.MethodGet:
+		section, beforeSeq, limit, ok := parseGalleryQuery(w, r)
+		if !ok {
+			return
+		}
+		result = h.Hub.ConversationMedia(models.ConvKey(session.Username, peerUsername), session.Username, section, beforeSeq, limit)
+
+	case action == "search" && r.Method == http.MethodGet:
+		query := r.URL.Query()
+		convKey := models.ConvKey(session.Username, peerUsername)
+		result = h.Hub.SearchConversation(convKey, session.Username, query.Get("q"), searchLimit(query.Get("limit")))
+
+	case action == "disappearing" && r.Method == http.MethodPut:
+		duration, ok := parseDisappearingRequest(w, r)
+		if !ok {
+			return
+		}
+		result = h.Hub.SetDisappearingTimer(session.Username, peerUsername, duration)
+
+	case action == "mute":
+		mute := &models.Mute{Peer: peerUsername}
+		h.handleMute(w, r, session.Username, models.ConvKey(session.Username, peerUsername), mute)
+		return
+
+	case action == "archive" || action == "unarchive":
+		archive := &models.Archive{Peer: peerUsername}
+		h.handleArchive(w, r, session.Username, models.ConvKey(session.Username, peerUsername), action, archive)
+		return
+
+	case action == "draft":
+		h.handleDraft(w, r, session.Username, peerUsername)
+		return
+
+	case action == "":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(messages)
+	json.NewEncoder(w).Encode(result)
+}
+
+// clientIP returns the remote IP address of the request without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// setSessionCookie sets the session cookie to live until the session's absolute deadline.
+// Idle expiry is enforced server side so the cookie doesn't need refreshing on activity.
+func setSessionCookie(w http.ResponseWriter, sessionID string) {
+	cookie := &http.Cookie{
+		Name:     "session_id",
+		Value:    sessionID,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   false, // Set to true in production with HTTPS
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   sessionStore.remaining(sessionID),
+	}
+	http.SetCookie(w, cookie)
 }
 
 // getSessionIDFromRequest extracts session ID from cookie
@@ -364,8 +630,16 @@ func requireAuth(next http.HandlerFunc) http.HandlerFunc {
 
 // HandleWebSocket handles WebSocket connections
 func (h *HTTPHandlers) HandleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	// Get session
-	sessionID := getSessionIDFromRequest(r)
+	if hub.refuseWhileDraining(w) {
+		return
+	}
+
+	// Get session, from a ticket, bearer token or cookie
+	sessionID, ok := h.wsSessionID(r)
+	if !ok {
+		http.Error(w, "Invalid ticket", http.StatusUnauthorized)
+		return
+	}
 	if sessionID == "" {
 		http.Error(w, "Not authenticated", http.StatusUnauthorized)
 		return
@@ -378,15 +652,40 @@ func (h *HTTPHandlers) HandleWebSocket(hub *Hub, w http.ResponseWriter, r *http.
 	}
 
 	username := session.Username
+	if !hub.admitUser(username) {
+		http.Error(w, "Server is at its user limit", http.StatusServiceUnavailable)
+		return
+	}
 
-	// Check if user already has an active connection
-	hub.mu.RLock()
-	if user, exists := hub.Users[username]; exists && user.CurrentConn != nil {
-		hub.mu.RUnlock()
-		http.Error(w, "User already has an active connection", http.StatusConflict)
+	deviceID := strings.TrimSpace(r.URL.Query().Get("deviceId"))
+	if deviceID == "" {
+		deviceID = defaultDeviceID
+	}
+	if len(deviceID) > maxDeviceIDLength {
+		http.Error(w, "deviceId too long", http.StatusBadRequest)
+		return
+	}
+	deviceName, userAgent, platform, ok := deviceInfo(r)
+	if !ok {
+		http.Error(w, "deviceName too long", http.StatusBadRequest)
+		return
+	}
+	resumeStream, resumeSeq, ok := resumeRequest(r)
+	if !ok {
+		http.Error(w, "Invalid lastSeq", http.StatusBadRequest)
+		return
+	}
+	heartbeat, ok := hub.heartbeatFor(r)
+	if !ok {
+		http.Error(w, "Invalid pingInterval", http.StatusBadRequest)
+		return
+	}
+	ip := clientIP(r)
+	releaseSlot, err := hub.reserveConnection(ip)
+	if err != nil {
+		hub.refuseConnection(w, ip, err)
 		return
 	}
-	hub.mu.RUnlock()
 
 	// Upgrade connection
 	upgrader := websocket.Upgrader{
@@ -395,24 +694,52 @@ func (h *HTTPHandlers) HandleWebSocket(hub *Hub, w http.ResponseWriter, r *http.
 		CheckOrigin: func(r *http.Request) bool {
 			return true // Allow all origins for demo
 		},
-		EnableCompression: false, // Disable compression to avoid issues
+		WriteBufferPool:   writeBufferPool,
+		EnableCompression: hub.Compression != CompressionOff,
+		Subprotocols:      wireSubprotocols,
 	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("WebSocket upgrade error: %v", err)
+		releaseSlot()
+		return
+	}
+	if rejectUnsupportedProtocol(conn, r, hub.WriteTimeout) {
+		log.Printf("Rejected WebSocket for %s: no supported subprotocol in %v", username, websocket.Subprotocols(r))
+		releaseSlot()
 		return
 	}
+	subprotocol := conn.Subprotocol()
+	codec, protocolVersion := parseSubprotocol(subprotocol)
 	
 	log.Printf("WebSocket upgraded successfully for user: %s", username)
 
 	// Create client
 	client := &Client{
-		Username: username,
-		Conn:     conn,
-		Send:     make(chan []byte, 256),
-		Hub:      hub,
+		Username:  username,
+		SessionID: sessionID,
+		DeviceID:  deviceID,
+		Conn:      conn,
+		Send:      make(chan []byte, 256),
+		Hub:       hub,
+
+		Subprotocol:     subprotocol,
+		codec:           codec,
+		protocolVersion: protocolVersion,
+
+		DeviceName: deviceName,
+		UserAgent:  userAgent,
+		Platform:   platform,
+
+		subscribesPresence: r.URL.Query().Get("presence") == "subscribe",
+		resumeStream:       resumeStream,
+		resumeSeq:          resumeSeq,
+		limiter:            newFrameLimiter(hub.FrameRateLimit, hub.FrameRateBurst),
+		heartbeat:          heartbeat,
+		releaseSlot:        releaseSlot,
 	}
+	hub.setupCompression(client)
 
 	// Register client (non-blocking)
 	select {
@@ -426,6 +753,7 @@ func (h *HTTPHandlers) HandleWebSocket(hub *Hub, w http.ResponseWriter, r *http.
 		// Hub is busy, close connection
 		log.Printf("Failed to register client: hub register channel full")
 		conn.Close()
+		releaseSlot()
 	}
 }
 
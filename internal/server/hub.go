@@ -1,7 +1,6 @@
 package server
 
 import (
-	"encoding/json"
 	"log"
 	"sort"
 	"strings"
@@ -15,14 +14,119 @@ import (
 
 // Hub maintains the set of active clients and broadcasts messages
 type Hub struct {
-	// Registered clients
-	Clients map[string]*Client
-
 	// Registered users
 	Users map[string]*models.User
 
-	// Conversations: key is conversation key (e.g., "user1|user2"), value is messages
-	Conversations map[string][]*models.Message
+	// Connected devices, conversations (keyed e.g. "user1|user2" or
+	// "group:<id>") and stored messages by ID, spread across shards
+	shards [hubShards]*hubShard
+
+	// Read positions: username -> conversation key -> seq of the latest
+	// message read
+	ReadPositions map[string]map[string]int64
+
+	// Messages held per conversation, and the estimated memory all
+	// conversations' messages may take, before the oldest are evicted; 0
+	// means unlimited
+	MaxConversationMessages int
+	MaxHistoryBytes         int64
+	history                 *historyUsage
+
+	// Pinned message IDs per conversation key, in pin order
+	Pins map[string][]string
+
+	// Maximum pinned messages per conversation
+	MaxPinnedMessages int
+
+	// Same content may go to at most DuplicateRecipientLimit other
+	// conversations per DuplicateWindow; 0 disables the check
+	DuplicateRecipientLimit int
+	DuplicateWindow         time.Duration
+
+	// Built-in system user that greets new accounts and answers commands
+	Bot *Bot
+
+	// Translates incoming messages into recipients' preferred languages; nil disables translation
+	Translator Translator
+
+	// Preferred languages: username -> BCP 47 tag
+	Languages map[string]string
+
+	// Largest WebSocket frame read from a client, in bytes
+	MaxFrameBytes int
+
+	// Longest message content accepted, in characters; 0 means unlimited
+	MaxMessageLength int
+
+	// Frames per second, and burst, each connection may send; 0 means unlimited
+	FrameRateLimit int
+	FrameRateBurst int
+
+	// What to do with clients that fall SlowClientBuffer frames behind, and
+	// where the "spill" policy keeps their overflow
+	SlowClientPolicy string
+	SlowClientBuffer int
+	SpillDir         string
+
+	// Set by Shutdown; no new connections are accepted while draining
+	draining bool
+
+	// WebSocket connections allowed in total and from one IP, and users
+	// allowed to log in; 0 means unlimited
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	MaxUsers            int
+	slots               *connectionSlots
+
+	// Base delay clients are told to wait before reconnecting after a
+	// shutdown; each gets up to as much again of jitter
+	ReconnectAfter time.Duration
+
+	// How long a user whose last device disconnected stays online to peers,
+	// so a quick reconnect doesn't show as offline and back, and the timers
+	// marking users offline once it passes
+	ReconnectGrace time.Duration
+	pendingOffline map[string]*time.Timer
+
+	// How many events may be held for a user with no connected device, and
+	// where they are saved; nil keeps them in memory only
+	OfflineEventLimit int
+	offlineStore      *offlineStore
+
+	// Long-poll clients by session and device, and the longest a poll waits
+	PollTimeout time.Duration
+	Pollers     map[string]*Client
+
+	// WebSocket keepalive: ping interval (which clients may raise up to
+	// MaxPingInterval), how long to wait for a pong, and the write timeout
+	PingInterval    time.Duration
+	MaxPingInterval time.Duration
+	PongTimeout     time.Duration
+	WriteTimeout    time.Duration
+
+	// Urgent messages each user may send per hour, and when they sent them
+	UrgentPerHour int
+	UrgentSent    map[string][]time.Time
+
+	// Starred message IDs per username, in the order they were starred, and
+	// who starred each message, to unstar it everywhere once it's evicted
+	Starred   map[string][]string
+	starredBy map[string][]string
+
+	// Unsent drafts: username -> conversation key -> draft
+	Drafts map[string]map[string]*models.Draft
+
+	// Disappearing message timers per conversation key
+	DisappearingTimers map[string]time.Duration
+
+	// Groups by ID
+	Groups map[string]*models.Group
+
+	// Broadcast channels by ID
+	Channels map[string]*models.Channel
+
+	// Channel subscriptions: channel ID -> set of subscribed usernames
+	Subscriptions map[string]map[string]bool
 
 	// Register requests from clients
 	Register chan *Client
@@ -36,6 +140,92 @@ type Hub struct {
 	// Typing events
 	TypingEvents chan *TypingEventWrapper
 
+	// Applied to message content before storage and fan-out
+	Sanitizer SanitizerPipeline
+
+	// Content filters run after sanitization
+	Filters FilterPipeline
+
+	// Messages held back until their sendAt time
+	Scheduler *Scheduler
+
+	// Mobile push notifications for users without a WebSocket connection
+	Push *PushService
+
+	// Relays events to users connected to other instances; nil when this is
+	// the only one
+	Broker     Broker
+	instanceID string
+
+	// Shares who is connected to which instance; nil when this is the only one
+	PresenceStore   PresenceStore
+	presenceDone    chan struct{}
+	presenceStopped chan struct{}
+
+	// Receives every message, delivery and presence change; nil disables
+	// the firehose
+	Firehose EventSink
+
+	// Workers fanning events out to clients; nil delivers inline
+	delivery *deliveryPool
+
+	// Uploaded files referenced by messages
+	Media *MediaStore
+
+	// Admin-managed sticker and custom emoji packs
+	Stickers *StickerStore
+
+	// Muted conversations: username -> conversation key -> muted until (zero = indefinitely)
+	Mutes map[string]map[string]time.Time
+
+	// Mutual contacts: username -> contact -> when they became contacts
+	Contacts map[string]map[string]time.Time
+
+	// Pending contact requests: recipient -> sender -> request
+	ContactRequests map[string]map[string]*models.ContactRequest
+
+	// Only allow direct messages between contacts
+	ContactsOnly bool
+
+	// Private nicknames: owner -> username -> nickname
+	Nicknames map[string]map[string]string
+
+	// Profiles by username; users without one have only a username
+	Profiles map[string]*models.Profile
+
+	// Devices each user has connected from: username -> device ID -> device
+	Devices map[string]map[string]*models.Device
+
+	// Connections watching each user's presence: username -> clients
+	PresenceSubscribers map[string]map[*Client]bool
+
+	// Resumable event streams: username -> device ID -> stream. Streams of
+	// disconnected devices are kept for ResumeWindow (0 disables resuming),
+	// each buffering the last ResumeBuffer events.
+	Streams      map[string]map[string]*eventStream
+	ResumeWindow time.Duration
+	ResumeBuffer int
+
+	// permessage-deflate mode, the smallest frame compressed in threshold
+	// mode, and the deflate level
+	Compression          string
+	CompressionThreshold int
+	CompressionLevel     int
+
+	// Write events queued for a connection as "batch" frames where the client
+	// supports them
+	CoalesceWrites bool
+
+	// Users with no activity on any device for this long are away; 0 disables
+	IdleTimeout time.Duration
+
+	// Send presence to every connection that hasn't subscribed to specific
+	// users; large deployments turn this off to avoid O(N²) status events
+	PresenceBroadcast bool
+
+	// Who may see each user's online status and last seen; unset means everyone
+	PresencePrivacy map[string]*models.PresencePrivacy
+
 	// Mutex for thread-safe access
 	mu sync.RWMutex
 }
@@ -49,15 +239,84 @@ type TypingEventWrapper struct {
 
 // NewHub creates a new Hub
 func NewHub() *Hub {
-	return &Hub{
-		Clients:         make(map[string]*Client),
+	hub := &Hub{
 		Users:           make(map[string]*models.User),
-		Conversations:   make(map[string][]*models.Message),
+		ReadPositions:   make(map[string]map[string]int64),
+		Pins:            make(map[string][]string),
+		Starred:         make(map[string][]string),
+		starredBy:       make(map[string][]string),
+		Drafts:          make(map[string]map[string]*models.Draft),
+		Groups:          make(map[string]*models.Group),
+		Channels:        make(map[string]*models.Channel),
+		Subscriptions:   make(map[string]map[string]bool),
 		Register:        make(chan *Client),
 		Unregister:      make(chan *Client),
 		InboundMessages: make(chan *models.InboundMessage, 256),
 		TypingEvents:    make(chan *TypingEventWrapper, 256),
+
+		DisappearingTimers: make(map[string]time.Duration),
+		Mutes:              make(map[string]map[string]time.Time),
+		MaxPinnedMessages:  DefaultConfig().MaxPinnedMessages,
+		UrgentPerHour:      DefaultConfig().UrgentPerHour,
+		MaxFrameBytes:      DefaultConfig().MaxFrameBytes,
+		MaxMessageLength:   DefaultConfig().MaxMessageLength,
+		FrameRateLimit:     DefaultConfig().FrameRateLimit,
+		FrameRateBurst:     DefaultConfig().FrameRateBurst,
+		PingInterval:       DefaultConfig().PingInterval,
+		MaxPingInterval:    DefaultConfig().MaxPingInterval,
+		PongTimeout:        DefaultConfig().PongTimeout,
+		WriteTimeout:       DefaultConfig().WriteTimeout,
+		ReconnectAfter:     DefaultConfig().ReconnectAfter,
+		ReconnectGrace:     DefaultConfig().ReconnectGrace,
+		pendingOffline:     make(map[string]*time.Timer),
+		instanceID:         uuid.New().String(),
+		presenceDone:       make(chan struct{}),
+		presenceStopped:    make(chan struct{}),
+		OfflineEventLimit:  DefaultConfig().OfflineEventLimit,
+		PollTimeout:        DefaultConfig().PollTimeout,
+		Pollers:            make(map[string]*Client),
+		SlowClientPolicy:   DefaultConfig().SlowClientPolicy,
+		SlowClientBuffer:   DefaultConfig().SlowClientBuffer,
+		SpillDir:           DefaultConfig().SpillDir,
+		UrgentSent:         make(map[string][]time.Time),
+		Languages:          make(map[string]string),
+		PresencePrivacy:    make(map[string]*models.PresencePrivacy),
+		Devices:            make(map[string]map[string]*models.Device),
+		Profiles:           make(map[string]*models.Profile),
+		Nicknames:          make(map[string]map[string]string),
+		Contacts:           make(map[string]map[string]time.Time),
+		PresenceBroadcast:  DefaultConfig().PresenceBroadcast,
+		IdleTimeout:        DefaultConfig().IdleTimeout,
+		Streams:            make(map[string]map[string]*eventStream),
+		history:            newHistoryUsage(),
+		slots:              newConnectionSlots(),
+		ResumeWindow:       DefaultConfig().ResumeWindow,
+		ResumeBuffer:       DefaultConfig().ResumeBuffer,
+
+		Compression:          DefaultConfig().Compression,
+		CompressionThreshold: DefaultConfig().CompressionThreshold,
+		CompressionLevel:     DefaultConfig().CompressionLevel,
+		ContactRequests:    make(map[string]map[string]*models.ContactRequest),
+
+		MaxConversationMessages: DefaultConfig().MaxConversationMessages,
+		MaxHistoryBytes:         DefaultConfig().MaxHistoryBytes,
+		DuplicateRecipientLimit: DefaultConfig().DuplicateRecipientLimit,
+		DuplicateWindow:         DefaultConfig().DuplicateWindow,
+		PresenceSubscribers:     make(map[string]map[*Client]bool),
 	}
+	for i := range hub.shards {
+		hub.shards[i] = newHubShard()
+	}
+	hub.Scheduler, _ = NewScheduler("")
+	hub.Bot = NewBot(hub)
+	hub.Users[BotUsername] = &models.User{
+		Username: BotUsername,
+		Online:   true,
+		LastSeen: time.Now(),
+	}
+	hub.Push = NewPushService()
+	hub.Stickers = NewStickerStore()
+	return hub
 }
 
 // Run starts the hub's main loop
@@ -89,51 +348,56 @@ func (h *Hub) registerClient(client *Client) bool {
 
 	username := client.Username
 
-	// Check if user already has an active connection
-	if user, exists := h.Users[username]; exists && user.CurrentConn != nil {
-		// Reject new connection - user already connected
-		log.Printf("User %s already has an active connection, closing old connection", username)
-		// Close the old connection's Send channel to trigger cleanup
-		if oldClient, exists := h.Clients[username]; exists {
-			close(oldClient.Send)
-			delete(h.Clients, username)
-		}
-		// Continue with new registration
+	// Register the device alongside any others the user has connected, greet
+	// it, and resume or start its event stream before anything else is sent
+	firstDevice := h.addClient(client)
+	if firstDevice {
+		h.watchUser(client.Username, true)
 	}
-
-	// Register client
-	h.Clients[username] = client
+	h.sendHello(client)
+	resumed := h.attachStream(client)
 
 	// Create or update user
 	if user, exists := h.Users[username]; exists {
 		user.Online = true
-		user.CurrentConn = client
 		user.LastSeen = time.Now()
 	} else {
 		h.Users[username] = &models.User{
-			Username:    username,
-			Online:      true,
-			CurrentConn: client,
-			LastSeen:    time.Now(),
+			Username: username,
+			Online:   true,
+			LastSeen: time.Now(),
 		}
+
+		// Greet once the client is registered and h.mu released
+		go h.Bot.Welcome(username)
 	}
 
-	// Broadcast online status to all other users
-	h.broadcastStatus(username, true)
+	// Broadcast online status to all other users when the first device
+	// connects, unless peers never saw the user go offline
+	if firstDevice && !h.cancelOffline(username) {
+		h.broadcastStatus(username, true)
+	}
+	// Connecting another device counts as activity
+	h.clearAway(username)
 
 	// Send online status of all existing users to the newly connected client
-	// This ensures the new client knows who's online
-	for uname, user := range h.Users {
-		if uname != username && user.Online {
-			statusEvent := &models.StatusEvent{
-				Username: uname,
-				Online:   true,
+	// This ensures the new client knows who's online; subscribing clients
+	// get presence for the users they subscribe to instead
+	if !client.subscribesPresence && h.PresenceBroadcast {
+		var statuses []*models.WSMessage
+		for uname, user := range h.Users {
+			if uname != username && user.Online && h.canSeeOnline(username, uname) {
+				statuses = append(statuses, &models.WSMessage{Type: "status", Payload: h.statusEventFor(username, uname)})
 			}
-			h.sendToClient(client, "status", statusEvent)
 		}
+		h.sendBatch(client, statuses)
 	}
 
-	log.Printf("Client registered: %s", username)
+	// Deliver anything that arrived while the user was offline
+	h.flushOfflineMessages(client)
+	h.flushOfflineEvents(client, resumed)
+
+	log.Printf("Client registered: %s (device %s)", username, client.DeviceID)
 	return true
 }
 
@@ -143,165 +407,478 @@ func (h *Hub) unregisterClient(client *Client) {
 
 	username := client.Username
 
-	// Only unregister if this is still the active client
-	if existingClient, exists := h.Clients[username]; exists && existingClient == client {
-		delete(h.Clients, username)
+	// Only unregister if this device is still registered
+	removed, lastDevice := h.removeClient(client)
+	if !removed {
+		log.Printf("Client %s (device %s) already replaced, skipping unregister", username, client.DeviceID)
+		return
+	}
+	client.closeSend()
+
+	// The user is offline once their last device disconnects and doesn't
+	// come back within the reconnect grace period
+	if lastDevice {
+		h.watchUser(username, false)
+		h.holdOffline(username, time.Now())
+	}
+
+	log.Printf("Client unregistered: %s (device %s)", username, client.DeviceID)
+}
 
-		if user, exists := h.Users[username]; exists {
-			user.Online = false
-			user.CurrentConn = nil
-			user.LastSeen = time.Now()
+func (h *Hub) handleInboundMessageWithSender(from string, msg *models.InboundMessage) {
+	if !h.checkMessageLength(from, msg.TempID, msg.Content) {
+		return
+	}
+	if msg.SendAt != nil && msg.SendAt.After(time.Now()) {
+		h.scheduleMessage(from, msg)
+		return
+	}
+	if h.resendDuplicate(from, msg.TempID) {
+		return
+	}
+
+	content := h.Sanitizer.Sanitize(msg.Content)
+	if content == "" && msg.Content != "" {
+		log.Printf("Dropping message from %s to %s: empty after sanitization", from, msg.To)
+		return
+	}
+	content, err := h.Filters.Apply(from, content)
+	if err != nil {
+		log.Printf("Rejecting message from %s: %v", from, err)
+		h.rejectMessage(from, msg.TempID, err)
+		return
+	}
+	if !h.allowDuplicate(from, inboundConvKey(from, msg), content) {
+		log.Printf("Throttling duplicate message from %s", from)
+		h.throttleDuplicate(from, msg.TempID)
+		return
+	}
+	var stored bool
+	if msg.Urgent {
+		if !h.allowUrgent(from) {
+			log.Printf("Rejecting urgent message from %s: limit reached", from)
+			h.rejectMessage(from, msg.TempID, urgentRejection(h.UrgentPerHour))
+			return
 		}
+		defer func() {
+			if !stored {
+				h.refundUrgent(from)
+			}
+		}()
+	}
+	content, entities := parseFormatting(content)
 
-		// Close Send channel safely (check if already closed)
-		select {
-		case <-client.Send:
-			// Channel already closed or has messages, don't close again
-		default:
-			close(client.Send)
+	// Create message
+	message := &models.Message{
+		ID:        uuid.New().String(),
+		From:      from,
+		Content:   content,
+		Timestamp: time.Now(),
+		Status:    "sent",
+		TempID:    msg.TempID,
+		Urgent:    msg.Urgent,
+	}
+	if len(entities) > 0 {
+		message.Entities = entities
+	}
+	if msg.Poll != nil {
+		poll, ok := h.newPoll(content, msg.Poll)
+		if !ok {
+			log.Printf("Dropping poll from %s: invalid question or options", from)
+			return
+		}
+		message.Poll = poll
+	}
+	if msg.Location != nil {
+		location, ok := h.newLocation(msg.Location)
+		if !ok {
+			log.Printf("Dropping location from %s: invalid coordinates, label or duration", from)
+			return
 		}
+		message.Location = location
+	}
+	if msg.Contact != nil {
+		contact, ok := h.newContactCard(msg.Contact)
+		if !ok {
+			log.Printf("Dropping contact card from %s: unknown user or invalid details", from)
+			return
+		}
+		message.Contact = contact
+	}
+	if msg.Voice != nil {
+		voice, ok := h.newVoiceNote(from, msg.Voice.MediaID)
+		if !ok {
+			log.Printf("Dropping voice note from %s: media %s not found", from, msg.Voice.MediaID)
+			return
+		}
+		message.Voice = voice
+	}
+	if msg.Sticker != nil {
+		sticker, err := h.Stickers.Get(msg.Sticker.PackID, msg.Sticker.StickerID)
+		if err != nil {
+			log.Printf("Dropping sticker from %s: %v", from, err)
+			return
+		}
+		message.Sticker = sticker
+	}
+	if len(msg.AttachmentIDs) > 0 {
+		attachments, err := h.newAttachments(from, msg.AttachmentIDs)
+		if err != nil {
+			log.Printf("Dropping message from %s: %v", from, err)
+			return
+		}
+		message.Attachments = attachments
+	}
 
-		// Broadcast offline status
-		h.broadcastStatus(username, false)
+	switch {
+	case msg.GroupID != "":
+		message.GroupID = msg.GroupID
+	case msg.ChannelID != "":
+		message.ChannelID = msg.ChannelID
+	default:
+		message.To = msg.To
+	}
 
-		log.Printf("Client unregistered: %s", username)
-	} else {
-		log.Printf("Client %s already replaced, skipping unregister", username)
+	if msg.ReplyToID != "" {
+		quote, ok := h.quoteForReply(message, msg.ReplyToID)
+		if !ok {
+			log.Printf("Dropping reply from %s: message %s not found in conversation", from, msg.ReplyToID)
+			return
+		}
+		message.ReplyTo = quote
+	}
+
+	// Thread replies get their own event type so clients can keep them out of the main timeline
+	msgType := "message"
+	if msg.ThreadID != "" {
+		if !h.canReplyInThread(message, msg.ThreadID) {
+			log.Printf("Dropping thread reply from %s: thread %s not found in conversation", from, msg.ThreadID)
+			return
+		}
+		message.ThreadID = msg.ThreadID
+		msgType = "thread_message"
 	}
+
+	switch {
+	case message.GroupID != "":
+		stored = h.deliverGroupMessage(message, msgType)
+	case message.ChannelID != "":
+		stored = h.deliverChannelPost(message, msgType)
+	default:
+		stored = h.deliverMessage(message, msgType)
+	}
+
+	// A rejected send doesn't count towards its thread, isn't recorded against
+	// its media, has no live share to end, and leaves the draft for the user
+	// to retry
+	if !stored {
+		return
+	}
+	h.attachMedia(message)
+	if message.ThreadID != "" {
+		h.updateThread(message)
+	}
+	h.startLiveLocation(message)
+	h.clearDraftAfterSend(message)
 }
 
-func (h *Hub) handleInboundMessageWithSender(from string, msg *models.InboundMessage) {
-	h.mu.Lock()
+// quoteForReply returns a quote of replyToID if it belongs to the same
+// conversation as message and is visible to its sender
+func (h *Hub) quoteForReply(message *models.Message, replyToID string) (*models.QuotedMessage, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	quoted, exists := h.message(replyToID)
+	if !exists || quoted.ConvKey() != message.ConvKey() || quoted.Deleted || quoted.HiddenFrom(message.From) {
+		return nil, false
+	}
+	return quoted.Quote(), true
+}
+
+// handleEncryptedMessage relays an end-to-end encrypted message. The
+// ciphertext is stored and forwarded as-is; content sanitization doesn't apply.
+func (h *Hub) handleEncryptedMessage(from string, msg *models.InboundEncryptedMessage) {
+	if msg.Ciphertext == "" {
+		log.Printf("Dropping encrypted message from %s to %s: empty ciphertext", from, msg.To)
+		return
+	}
+	if h.resendDuplicate(from, msg.TempID) {
+		return
+	}
 
-	// Create message
 	message := &models.Message{
 		ID:        uuid.New().String(),
 		From:      from,
 		To:        msg.To,
-		Content:   msg.Content,
 		Timestamp: time.Now(),
 		Status:    "sent",
+		TempID:    msg.TempID,
+		Encrypted: &models.EncryptedPayload{
+			Type:       msg.Type,
+			Ciphertext: msg.Ciphertext,
+		},
 	}
 
-	// Store in conversation
-	convKey := models.ConvKey(from, msg.To)
-	h.Conversations[convKey] = append(h.Conversations[convKey], message)
+	h.deliverMessage(message, "encrypted")
+}
 
-	// Create outbound message for sender
-	senderOutboundMsg := &models.OutboundMessage{
-		ID:        message.ID,
-		From:      message.From,
-		To:        message.To,
-		Content:   message.Content,
-		Timestamp: message.Timestamp.Format(time.RFC3339),
-		Status:    message.Status,
+// deliverMessage stores a direct message and sends it to both participants,
+// reporting whether it was stored
+func (h *Hub) deliverMessage(message *models.Message, msgType string) bool {
+	from := message.From
+	to := message.To
+
+	h.mu.RLock()
+	_, recipientExists := h.Users[to]
+	h.mu.RUnlock()
+	if !recipientExists {
+		log.Printf("Rejecting message from %s: unknown recipient %q", from, to)
+		h.sendError(from, &models.ErrorEvent{
+			Code:    ErrorInvalidRecipient,
+			Message: "recipient does not exist",
+			TempID:  message.TempID,
+		})
+		return false
 	}
+	if err := h.contactsOnlyRejection(from, to); err != nil {
+		log.Printf("Rejecting message from %s to %s: not contacts", from, to)
+		h.rejectMessage(from, message.TempID, err)
+		return false
+	}
+
+	// Sends in unrelated conversations only share h.mu for reading
+	unlock := h.lockConversation(message.ConvKey())
+	h.mu.RLock()
 
 	// Get clients while holding lock
-	var senderClient *Client
-	var recipientClient *Client
-	var senderExists bool
-	var recipientExists bool
-	
-	if client, exists := h.Clients[from]; exists {
-		senderClient = client
-		senderExists = true
-	}
-	if client, exists := h.Clients[msg.To]; exists {
-		recipientClient = client
-		recipientExists = true
-	}
-
-	h.mu.Unlock()
-
-	// Send to sender (confirmation) - without lock
-	if senderExists && senderClient != nil {
-		log.Printf("Sending message to sender %s: %s -> %s", from, message.Content, msg.To)
-		h.sendToClient(senderClient, "message", senderOutboundMsg)
+	senderClients := h.clientsOf(from)
+	recipientClients := h.clientsOf(to)
+	recipientOnline := h.isConnected(to)
+	recipientSilent := !h.shouldAlert(to, message)
+
+	// Store in conversation, as delivered to the recipient's devices if any
+	// are connected
+	var delivered []*Client
+	if recipientOnline {
+		delivered = recipientClients
+	}
+	h.storeMessage(message, delivered)
+
+	// Create outbound message for sender
+	senderOutboundMsg := senderOutboundMessage(message, "sent")
+
+	h.mu.RUnlock()
+
+	// Send to every sender device (confirmation, and sync for the others) - without lock
+	if len(senderClients) > 0 {
+		log.Printf("Sending %s to sender %s: %s -> %s", msgType, from, message.Content, to)
 	} else {
 		log.Printf("Sender %s not found or not connected", from)
 	}
+	for _, client := range senderClients {
+		h.sendToClient(client, msgType, senderOutboundMsg)
+	}
 
-	// Send to recipient if online - without lock
-	if recipientExists && recipientClient != nil {
+	// Devices on other instances get the message as it stands here
+	h.relayToUser(from, msgType, senderOutboundMsg)
+	h.relayToUser(to, msgType, newOutboundMessage(message, "sent"))
+
+	// Send to every recipient device if online - without lock
+	if recipientOnline {
 		// Create separate outbound message for recipient
-		recipientOutboundMsg := &models.OutboundMessage{
-			ID:        message.ID,
-			From:      message.From,
-			To:        message.To,
-			Content:   message.Content,
-			Timestamp: message.Timestamp.Format(time.RFC3339),
-			Status:    "delivered",
+		recipientOutboundMsg := newOutboundMessage(message, "delivered")
+		recipientOutboundMsg.Silent = recipientSilent
+		log.Printf("Sending %s to recipient %s (%d devices): %s -> %s", msgType, to, len(recipientClients), message.Content, from)
+		for _, client := range recipientClients {
+			h.sendToClient(client, msgType, recipientOutboundMsg)
 		}
-		log.Printf("Sending message to recipient %s: %s -> %s", msg.To, message.Content, from)
-		h.sendToClient(recipientClient, "message", recipientOutboundMsg)
-		
-		// Mark as delivered in storage
-		h.mu.Lock()
-		message.Status = "delivered"
-		h.mu.Unlock()
 
 		// Send ack to sender
-		if senderExists && senderClient != nil {
-			ack := &models.AckEvent{
-				MessageID: message.ID,
-				Status:    "delivered",
-			}
-			h.sendToClient(senderClient, "ack", ack)
+		ack := &models.AckEvent{
+			MessageID: message.ID,
+			TempID:    message.TempID,
+			Status:    "delivered",
 		}
+		for _, client := range senderClients {
+			h.sendToClient(client, "ack", ack)
+		}
+	}
+	unlock()
+
+	// The bot replies in this conversation, so only once it's unlocked
+	if recipientOnline {
+		h.translateLater(message, recipientClients)
+		return true
+	}
+	if to == BotUsername {
+		h.Bot.receive(message)
+	} else {
+		h.notifyOffline(message, from, []string{to})
+	}
+	return true
+}
+
+// newOutboundMessage builds the wire representation of a stored message
+func newOutboundMessage(message *models.Message, status string) *models.OutboundMessage {
+	outbound := &models.OutboundMessage{
+		ID:        message.ID,
+		From:      message.From,
+		FromName:  message.FromName,
+		To:        message.To,
+		Content:   message.Content,
+		Encrypted: message.Encrypted,
+		GroupID:   message.GroupID,
+		ChannelID: message.ChannelID,
+		Timestamp: message.Timestamp.Format(time.RFC3339),
+		Status:    status,
+		Seq:       message.Seq,
+		Deleted:   message.Deleted,
+		ReplyTo:   message.ReplyTo,
+		ThreadID:  message.ThreadID,
+		Mentions:  message.Mentions,
+		Entities:  message.Entities,
+		Contact:   message.Contact,
+		Voice:     message.Voice,
+		Sticker:   message.Sticker,
+		Kind:      message.Kind(),
+		Urgent:    message.Urgent,
+	}
+	if len(message.Attachments) > 0 {
+		outbound.Attachments = append([]*models.Attachment(nil), message.Attachments...)
 	}
+	if message.Poll != nil {
+		outbound.Poll = message.Poll.Snapshot()
+	}
+	if message.Location != nil {
+		location := *message.Location
+		outbound.Location = &location
+	}
+	return outbound
+}
+
+// storeMessage appends a message to its conversation and indexes it by ID,
+// recording it as delivered to recipients' devices and evicting old messages
+// once history is over its limits. A stored message's fields are guarded by
+// h.mu, so it is only stored once they are settled, and callers holding h.mu
+// just for reading can store messages in unrelated conversations side by
+// side. Callers must hold h.mu.
+func (h *Hub) storeMessage(message *models.Message, recipients []*Client) {
+	convKey := message.ConvKey()
+	message.FromName = h.displayName(message.From)
+
+	s := h.shard(convKey)
+	s.mu.Lock()
+	s.nextSeq(message)
+	h.emitMessage(message)
+	for _, client := range recipients {
+		h.recordDelivery(message, client)
+	}
+	s.conversations[convKey] = append(s.conversations[convKey], message)
+	evicted := h.trimConversation(s, convKey)
+	s.unarchive(convKey)
+	s.mu.Unlock()
+
+	index := h.shard(message.ID)
+	index.mu.Lock()
+	index.messages[message.ID] = message
+	index.mu.Unlock()
+	if message.To != "" && message.To != BotUsername && len(recipients) == 0 {
+		h.holdPending(message)
+	}
+	h.rememberTempID(message)
+	h.recordHistory(message, evicted)
 }
 
 func (h *Hub) handleTypingEvent(event *TypingEventWrapper) {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
-	// Send typing event to recipient
-	if recipientClient, exists := h.Clients[event.To]; exists {
+	// Send typing event to every recipient device, here or on other instances
+	if h.isConnected(event.To) || h.Broker != nil {
 		typingEvent := &models.TypingEvent{
 			From:     event.From,
 			IsTyping: event.IsTyping,
 		}
 		log.Printf("Sending typing event: %s -> %s (typing: %v)", event.From, event.To, event.IsTyping)
-		h.sendToClient(recipientClient, "typing", typingEvent)
+		h.sendToUser(event.To, "typing", typingEvent)
 	} else {
 		log.Printf("Recipient %s not found for typing event from %s", event.To, event.From)
 	}
 }
 
 func (h *Hub) broadcastStatus(username string, online bool) {
-	statusEvent := &models.StatusEvent{
-		Username: username,
-		Online:   online,
-	}
+	h.sendStatus(username, online)
+	h.relayStatus(username, online)
+	h.emitPresence(username)
+}
 
-	// Broadcast to all connected clients except the user themselves
-	for uname, client := range h.Clients {
-		if uname != username {
-			h.sendToClient(client, "status", statusEvent)
+// sendStatus tells this instance's connections about a change in username's
+// online status. Callers must hold h.mu.
+func (h *Hub) sendStatus(username string, online bool) {
+	// Tell the user's presence audience, skipping connections whose view of
+	// the user this doesn't change
+	views := make(statusViews)
+	for _, client := range h.presenceAudience(username) {
+		viewer := client.Username
+		if h.canSeeOnline(viewer, username) || (!online && h.canSeeLastSeen(viewer, username)) {
+			h.sendPrepared(client, views.event(h.statusEventFor(viewer, username)))
 		}
 	}
 }
 
+// sendToClient queues an event for client behind any already dispatched to
+// it. The payload is encoded later, so it must not be changed once sent.
 func (h *Hub) sendToClient(client *Client, msgType string, payload interface{}) {
+	h.dispatch(client, func() {
+		h.deliver(client, msgType, payload)
+	})
+}
+
+// deliver encodes an event and hands it to client's write pump, numbering it
+// first if the client has a stream
+func (h *Hub) deliver(client *Client, msgType string, payload interface{}) {
+	if client.stream != nil {
+		if client.stream.send(msgType, payload) {
+			log.Printf("Message queued for client %s, type: %s", client.Username, msgType)
+		}
+		return
+	}
+
 	wsMsg := &models.WSMessage{
 		Type:    msgType,
 		Payload: payload,
 	}
 
-	data, err := json.Marshal(wsMsg)
+	data, err := client.codec.Marshal(wsMsg)
 	if err != nil {
 		log.Printf("Error marshaling message: %v", err)
 		return
 	}
 
-	select {
-	case client.Send <- data:
+	if client.enqueue(newOutboxFrame(data, payload)) {
 		log.Printf("Message queued for client %s, type: %s", client.Username, msgType)
-	default:
-		log.Printf("Client %s send channel full, closing connection", client.Username)
-		close(client.Send)
-		delete(h.Clients, client.Username)
+	}
+}
+
+// DisconnectSession tears down the WebSocket clients bound to a session, if any
+func (h *Hub) DisconnectSession(username, sessionID string) {
+	var clients []*Client
+	for _, client := range h.connectedClients(username) {
+		if client.SessionID == sessionID {
+			clients = append(clients, client)
+		}
+	}
+
+	for _, client := range clients {
+		h.disconnect(client, CloseSessionRevoked, "session ended")
+	}
+}
+
+// DisconnectUser tears down all of username's WebSocket clients, closing
+// them with code and reason
+func (h *Hub) DisconnectUser(username string, code int, reason string) {
+	for _, client := range h.connectedClients(username) {
+		h.disconnect(client, code, reason)
 	}
 }
 
@@ -313,13 +890,21 @@ func (h *Hub) GetConversations(username string) []*models.Conversation {
 	conversations := []*models.Conversation{}
 	seenPeers := make(map[string]bool)
 
-	for _, messages := range h.Conversations {
+	for _, messages := range h.conversations() {
 		if len(messages) == 0 {
 			continue
 		}
 
 		// Check if this conversation involves the user
 		lastMsg := messages[len(messages)-1]
+		if lastMsg.GroupID != "" || lastMsg.ChannelID != "" {
+			// Group and channel conversations are collected separately below
+			continue
+		}
+		if visible := lastVisibleMessage(messages, username); visible != nil {
+			lastMsg = visible
+		}
+
 		var peer string
 		if lastMsg.From == username {
 			peer = lastMsg.To
@@ -335,18 +920,83 @@ func (h *Hub) GetConversations(username string) []*models.Conversation {
 		seenPeers[peer] = true
 
 		peerOnline := false
+		peerAway := false
+		var peerLastSeen *time.Time
+		peerStatusText := ""
+		peerNickname := ""
 		if user, exists := h.Users[peer]; exists {
-			peerOnline = user.Online
+			visible := h.visibleUser(username, user)
+			peerOnline = visible.Online
+			peerAway = visible.Away
+			peerLastSeen = lastSeenAt(visible)
+			peerStatusText = visible.StatusText
+			peerNickname = visible.Nickname
+		}
+
+		preview := lastMsg.Preview()
+		if lastMsg.HiddenFrom(username) {
+			preview = ""
 		}
 
 		conversations = append(conversations, &models.Conversation{
 			PeerUsername:      peer,
-			LastMessagePreview: lastMsg.Content,
+			LastMessagePreview: preview,
 			LastMessageTime:   lastMsg.Timestamp,
 			PeerOnline:        peerOnline,
+			UnreadCount:       h.unreadCount(username, models.ConvKey(username, peer)),
+			LastSeq:           h.lastSeq(models.ConvKey(username, peer)),
+			Muted:             h.isMuted(username, models.ConvKey(username, peer)),
+			Archived:          h.isArchived(username, models.ConvKey(username, peer)),
+			PeerLastSeen:      peerLastSeen,
+			PeerAway:          peerAway,
+			PeerStatusText:    peerStatusText,
+			PeerNickname:      peerNickname,
 		})
 	}
 
+	for _, group := range h.Groups {
+		if !group.IsMember(username) {
+			continue
+		}
+
+		conversation := &models.Conversation{
+			GroupID:         group.ID,
+			GroupName:       group.Name,
+			LastMessageTime: group.CreatedAt,
+			UnreadCount:     h.unreadCount(username, models.GroupConvKey(group.ID)),
+			LastSeq:         h.lastSeq(models.GroupConvKey(group.ID)),
+			Muted:           h.isMuted(username, models.GroupConvKey(group.ID)),
+			Archived:        h.isArchived(username, models.GroupConvKey(group.ID)),
+		}
+		if lastMsg := lastVisibleMessage(h.conversation(models.GroupConvKey(group.ID)), username); lastMsg != nil {
+			conversation.LastMessagePreview = lastMsg.From + ": " + lastMsg.Preview()
+			conversation.LastMessageTime = lastMsg.Timestamp
+		}
+		conversations = append(conversations, conversation)
+	}
+
+	for channelID, subscribers := range h.Subscriptions {
+		channel, exists := h.Channels[channelID]
+		if !exists || !subscribers[username] {
+			continue
+		}
+
+		conversation := &models.Conversation{
+			ChannelID:       channel.ID,
+			ChannelName:     channel.Name,
+			LastMessageTime: channel.CreatedAt,
+			UnreadCount:     h.unreadCount(username, models.ChannelConvKey(channel.ID)),
+			LastSeq:         h.lastSeq(models.ChannelConvKey(channel.ID)),
+			Muted:           h.isMuted(username, models.ChannelConvKey(channel.ID)),
+			Archived:        h.isArchived(username, models.ChannelConvKey(channel.ID)),
+		}
+		if lastMsg := lastVisibleMessage(h.conversation(models.ChannelConvKey(channel.ID)), username); lastMsg != nil {
+			conversation.LastMessagePreview = lastMsg.Preview()
+			conversation.LastMessageTime = lastMsg.Timestamp
+		}
+		conversations = append(conversations, conversation)
+	}
+
 	// Sort conversations by last message time (most recent first)
 	sort.Slice(conversations, func(i, j int) bool {
 		return conversations[i].LastMessageTime.After(conversations[j].LastMessageTime)
@@ -355,17 +1005,17 @@ func (h *Hub) GetConversations(username string) []*models.Conversation {
 	return conversations
 }
 
-// GetConversationMessages returns all messages for a conversation between two users
+// GetConversationMessages returns the messages between two users that username1 hasn't deleted for themselves
 func (h *Hub) GetConversationMessages(username1, username2 string) []*models.Message {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
 	convKey := models.ConvKey(username1, username2)
-	return h.Conversations[convKey]
+	return visibleMessages(h.conversation(convKey), username1)
 }
 
 // SearchUsers returns users matching the search query
-func (h *Hub) SearchUsers(query string, excludeUsername string) []*models.User {
+func (h *Hub) SearchUsers(query string, excludeUsername string, contactsOnly bool) []*models.User {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
@@ -376,12 +1026,12 @@ func (h *Hub) SearchUsers(query string, excludeUsername string) []*models.User {
 		if user.Username == excludeUsername {
 			continue
 		}
+		if _, isContact := h.Contacts[excludeUsername][user.Username]; contactsOnly && !isContact {
+			continue
+		}
 		// Simple substring search (case-insensitive)
 		if len(queryLower) == 0 || contains(user.Username, queryLower) {
-			results = append(results, &models.User{
-				Username: user.Username,
-				Online:   user.Online,
-			})
+			results = append(results, h.visibleUser(excludeUsername, user))
 		}
 	}
 
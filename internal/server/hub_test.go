@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+// newTestHub returns a hub with the given users registered but offline
+func newTestHub(t *testing.T, usernames ...string) *Hub {
+	t.Helper()
+	hub := NewHub()
+	hub.FrameRateLimit = 0
+	for _, username := range usernames {
+		hub.Users[username] = &models.User{Username: username}
+	}
+	return hub
+}
+
+// lastMessage returns the newest message stored in the conversation probe
+// belongs to
+func lastMessage(t *testing.T, hub *Hub, probe *models.Message) *models.Message {
+	t.Helper()
+	messages := hub.conversation(probe.ConvKey())
+	if len(messages) == 0 {
+		t.Fatalf("no messages in %s", probe.ConvKey())
+	}
+	return messages[len(messages)-1]
+}
+
+// newTestClient connects a JSON client for username
+func newTestClient(t *testing.T, hub *Hub, username string) *Client {
+	t.Helper()
+	client := &Client{
+		Username:        username,
+		DeviceID:        username + "-device",
+		Send:            make(chan []byte, 256),
+		Hub:             hub,
+		codec:           jsonCodec{},
+		protocolVersion: MinProtocolVersion,
+	}
+	hub.mu.Lock()
+	hub.addClient(client)
+	hub.mu.Unlock()
+	return client
+}
+
+// nextEvent returns the next event of type msgType sent to client, skipping
+// others, or fails after a second
+func nextEvent(t *testing.T, client *Client, msgType string) json.RawMessage {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case data := <-client.Send:
+			var event struct {
+				Type    string          `json:"type"`
+				Payload json.RawMessage `json:"payload"`
+			}
+			if err := json.Unmarshal(data, &event); err != nil {
+				t.Fatal(err)
+			}
+			if event.Type == msgType {
+				return event.Payload
+			}
+		case <-timeout:
+			t.Fatalf("%s got no %s event", client.Username, msgType)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"log"
+	"time"
+)
+
+// minIdleCheckInterval bounds how often connections are checked for idleness
+const minIdleCheckInterval = time.Second
+
+// StartIdleDetector flips users to away once none of their devices has seen
+// activity for h.IdleTimeout, checking a few times per timeout. A zero
+// timeout disables it.
+func (h *Hub) StartIdleDetector() {
+	if h.IdleTimeout <= 0 {
+		return
+	}
+	interval := h.IdleTimeout / 4
+	if interval < minIdleCheckInterval {
+		interval = minIdleCheckInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			h.markIdleUsers(time.Now().Add(-h.IdleTimeout))
+		}
+	}()
+}
+
+// markIdleUsers flips connected users whose devices have all been inactive
+// since cutoff to away and tells their presence audience
+func (h *Hub) markIdleUsers(cutoff time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for username, devices := range h.everyClient() {
+		user, exists := h.Users[username]
+		if !exists || user.Away {
+			continue
+		}
+		idle := true
+		for _, client := range devices {
+			if client.lastActivity().After(cutoff) {
+				idle = false
+				break
+			}
+		}
+		if !idle {
+			continue
+		}
+
+		for _, client := range devices {
+			client.setIdle()
+		}
+		user.Away = true
+		log.Printf("User %s is away", username)
+		h.broadcastPresence(username)
+		h.emitPresence(username)
+	}
+}
+
+// markActive returns username from away after activity on an idle device
+func (h *Hub) markActive(username string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clearAway(username)
+}
+
+// clearAway returns a connected username from away to online and tells their
+// presence audience. Callers must hold h.mu.
+func (h *Hub) clearAway(username string) {
+	user, exists := h.Users[username]
+	if !exists || !user.Away || !user.Online {
+		return
+	}
+	user.Away = false
+	log.Printf("User %s is back", username)
+	h.broadcastPresence(username)
+	h.emitPresence(username)
+}
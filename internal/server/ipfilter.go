@@ -0,0 +1,182 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// IPFilter applies CIDR allow/deny rules and temporary bans to incoming requests
+type IPFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+
+	// Temporary bans keyed by normalized CIDR
+	bans map[string]*ipBan
+
+	mu sync.RWMutex
+}
+
+type ipBan struct {
+	network   *net.IPNet
+	expiresAt time.Time
+}
+
+// BanResponse represents a temporary ban in the admin API
+type BanResponse struct {
+	CIDR      string `json:"cidr"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+// NewIPFilter creates a filter from allow and deny lists of CIDRs or bare IPs.
+// An empty allow list admits every address not otherwise denied.
+func NewIPFilter(allow, deny []string) (*IPFilter, error) {
+	f := &IPFilter{
+		bans: make(map[string]*ipBan),
+	}
+
+	for _, rule := range allow {
+		network, err := parseCIDR(rule)
+		if err != nil {
+			return nil, err
+		}
+		f.allow = append(f.allow, network)
+	}
+	for _, rule := range deny {
+		network, err := parseCIDR(rule)
+		if err != nil {
+			return nil, err
+		}
+		f.deny = append(f.deny, network)
+	}
+
+	return f, nil
+}
+
+// Allowed reports whether requests from ip may proceed
+func (f *IPFilter) Allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range f.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	f.mu.RLock()
+	now := time.Now()
+	for _, ban := range f.bans {
+		if now.Before(ban.expiresAt) && ban.network.Contains(ip) {
+			f.mu.RUnlock()
+			return false
+		}
+	}
+	f.mu.RUnlock()
+
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, network := range f.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ban blocks a CIDR or IP for the given duration, replacing any existing ban on it
+func (f *IPFilter) Ban(rule string, duration time.Duration) (*BanResponse, error) {
+	network, err := parseCIDR(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	expiresAt := time.Now().Add(duration)
+	f.bans[network.String()] = &ipBan{network: network, expiresAt: expiresAt}
+
+	return &BanResponse{
+		CIDR:      network.String(),
+		ExpiresAt: expiresAt.Format(time.RFC3339),
+	}, nil
+}
+
+// Unban lifts a temporary ban, reporting whether one existed
+func (f *IPFilter) Unban(rule string) bool {
+	network, err := parseCIDR(rule)
+	if err != nil {
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, exists := f.bans[network.String()]; !exists {
+		return false
+	}
+	delete(f.bans, network.String())
+	return true
+}
+
+// Bans returns the active temporary bans, pruning expired ones
+func (f *IPFilter) Bans() []BanResponse {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	bans := []BanResponse{}
+	for key, ban := range f.bans {
+		if now.After(ban.expiresAt) {
+			delete(f.bans, key)
+			continue
+		}
+		bans = append(bans, BanResponse{
+			CIDR:      key,
+			ExpiresAt: ban.expiresAt.Format(time.RFC3339),
+		})
+	}
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].ExpiresAt < bans[j].ExpiresAt
+	})
+	return bans
+}
+
+// Middleware rejects requests from filtered addresses before they reach next
+func (f *IPFilter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if !f.Allowed(net.ParseIP(ip)) {
+			log.Printf("Rejected request from %s to %s", ip, r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseCIDR accepts either CIDR notation or a bare IP address
+func parseCIDR(rule string) (*net.IPNet, error) {
+	if _, network, err := net.ParseCIDR(rule); err == nil {
+		return network, nil
+	}
+
+	ip := net.ParseIP(rule)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP or CIDR: %q", rule)
+	}
+	bits := 128
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
@@ -0,0 +1,545 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	kafkaQueueSize      = 8192
+	kafkaMaxBatch       = 500
+	kafkaLinger         = 100 * time.Millisecond
+	kafkaTimeout        = 10 * time.Second
+	kafkaMetadataMaxAge = 5 * time.Minute
+	kafkaMaxResponse    = 64 << 20
+	kafkaClientID       = "whatsdown"
+)
+
+// Kafka API keys and the versions used: Metadata v1 and Produce v3, the first
+// Produce version that carries v2 record batches
+const (
+	kafkaProduce          = 0
+	kafkaProduceVersion   = 3
+	kafkaMetadata         = 3
+	kafkaMetadataVersion  = 1
+	kafkaRecordBatchMagic = 2
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// KafkaProducer is an EventSink writing to one Kafka topic. Events are
+// batched for up to kafkaLinger and sent to each partition's leader with
+// acks from the leader only. The partition is chosen by hashing the key, so
+// a key's events keep their order. A batch that fails is retried once after
+// refreshing the cluster metadata, then dropped.
+type KafkaProducer struct {
+	seeds []string
+	topic string
+
+	queue   chan kafkaRecord
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+
+	// Cluster metadata and connections, used only by the run goroutine
+	brokers     map[int32]string // Node ID -> host:port
+	leaders     []int32          // Partition -> leader node ID
+	refreshed   time.Time
+	conns       map[int32]*kafkaConn
+	correlation int32
+	next        uint32 // Partition for the next keyless record
+}
+
+type kafkaRecord struct {
+	key       []byte
+	value     []byte
+	timestamp time.Time
+}
+
+type kafkaConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// kafkaError is an error code a broker returned
+type kafkaError int16
+
+// Returned while a topic's partitions have no leader, as when the brokers
+// have just created it
+const kafkaLeaderNotAvailable kafkaError = 5
+
+func (e kafkaError) Error() string { return "kafka: error code " + strconv.Itoa(int(e)) }
+
+// NewKafkaProducer connects to the cluster through seeds (host:port) and
+// checks that topic exists, or is created by the brokers on first use
+func NewKafkaProducer(seeds []string, topic string) (*KafkaProducer, error) {
+	if len(seeds) == 0 {
+		return nil, errors.New("no brokers")
+	}
+	if topic == "" {
+		return nil, errors.New("no topic")
+	}
+	p := &KafkaProducer{
+		seeds:   seeds,
+		topic:   topic,
+		queue:   make(chan kafkaRecord, kafkaQueueSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		conns:   make(map[int32]*kafkaConn),
+	}
+	// A topic created on first use has no leaders for a moment
+	err := p.refreshMetadata()
+	for attempt := 1; errors.Is(err, kafkaLeaderNotAvailable) && attempt < 5; attempt++ {
+		time.Sleep(time.Second)
+		err = p.refreshMetadata()
+	}
+	if err != nil {
+		return nil, err
+	}
+	go p.run()
+	return p, nil
+}
+
+// Emit queues an event, dropping it if the queue is full
+func (p *KafkaProducer) Emit(key string, value []byte) {
+	select {
+	case p.queue <- kafkaRecord{key: []byte(key), value: value, timestamp: time.Now()}:
+	default:
+		log.Printf("Kafka queue full; dropping event for %s", key)
+	}
+}
+
+// Close sends what's queued and closes the connections
+func (p *KafkaProducer) Close() error {
+	p.once.Do(func() {
+		close(p.done)
+		<-p.stopped
+	})
+	return nil
+}
+
+func (p *KafkaProducer) run() {
+	defer close(p.stopped)
+	defer func() {
+		for id := range p.conns {
+			p.dropConn(id)
+		}
+	}()
+
+	for {
+		var batch []kafkaRecord
+		select {
+		case record := <-p.queue:
+			batch = append(batch, record)
+		case <-p.done:
+			p.flush()
+			return
+		}
+
+		linger := time.NewTimer(kafkaLinger)
+	collecting:
+		for len(batch) < kafkaMaxBatch {
+			select {
+			case record := <-p.queue:
+				batch = append(batch, record)
+			case <-linger.C:
+				break collecting
+			case <-p.done:
+				break collecting
+			}
+		}
+		linger.Stop()
+		p.produce(batch, true)
+	}
+}
+
+// flush sends everything still queued
+func (p *KafkaProducer) flush() {
+	for {
+		var batch []kafkaRecord
+	draining:
+		for len(batch) < kafkaMaxBatch {
+			select {
+			case record := <-p.queue:
+				batch = append(batch, record)
+			default:
+				break draining
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+		p.produce(batch, false)
+	}
+}
+
+// produce sends records to their partitions' leaders, retrying the ones
+// that fail once after refreshing metadata if retry is set
+func (p *KafkaProducer) produce(records []kafkaRecord, retry bool) {
+	if len(p.leaders) == 0 || time.Since(p.refreshed) > kafkaMetadataMaxAge {
+		if err := p.refreshMetadata(); err != nil && len(p.leaders) == 0 {
+			log.Printf("Kafka metadata unavailable, dropping %d events: %v", len(records), err)
+			return
+		}
+	}
+
+	byLeader := make(map[int32]map[int32][]kafkaRecord)
+	for _, record := range records {
+		partition := p.partition(record.key)
+		leader := p.leaders[partition]
+		if byLeader[leader] == nil {
+			byLeader[leader] = make(map[int32][]kafkaRecord)
+		}
+		byLeader[leader][partition] = append(byLeader[leader][partition], record)
+	}
+
+	var failed []kafkaRecord
+	for leader, partitions := range byLeader {
+		if err := p.send(leader, partitions); err != nil {
+			log.Printf("Kafka produce to broker %d failed: %v", leader, err)
+			p.dropConn(leader)
+			for _, records := range partitions {
+				failed = append(failed, records...)
+			}
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+	if !retry {
+		log.Printf("Dropping %d Kafka events", len(failed))
+		return
+	}
+	if err := p.refreshMetadata(); err != nil {
+		log.Printf("Kafka metadata refresh failed: %v", err)
+	}
+	p.produce(failed, false)
+}
+
+// partition picks the partition for a key, spreading keyless records
+func (p *KafkaProducer) partition(key []byte) int32 {
+	if len(key) == 0 {
+		p.next++
+		return int32(p.next % uint32(len(p.leaders)))
+	}
+	hash := fnv.New32a()
+	hash.Write(key)
+	return int32(hash.Sum32() % uint32(len(p.leaders)))
+}
+
+func (p *KafkaProducer) conn(id int32) (*kafkaConn, error) {
+	if c, exists := p.conns[id]; exists {
+		return c, nil
+	}
+	addr, known := p.brokers[id]
+	if !known {
+		return nil, fmt.Errorf("unknown broker %d", id)
+	}
+	conn, err := net.DialTimeout("tcp", addr, kafkaTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &kafkaConn{conn: conn, r: bufio.NewReader(conn)}
+	p.conns[id] = c
+	return c, nil
+}
+
+func (p *KafkaProducer) dropConn(id int32) {
+	if c, exists := p.conns[id]; exists {
+		c.conn.Close()
+		delete(p.conns, id)
+	}
+}
+
+// request sends one request and returns the body of its response
+func (p *KafkaProducer) request(c *kafkaConn, apiKey, apiVersion int16, body []byte) ([]byte, error) {
+	p.correlation++
+	correlation := p.correlation
+
+	message := make([]byte, 4, 4+10+len(kafkaClientID)+len(body))
+	message = binary.BigEndian.AppendUint16(message, uint16(apiKey))
+	message = binary.BigEndian.AppendUint16(message, uint16(apiVersion))
+	message = binary.BigEndian.AppendUint32(message, uint32(correlation))
+	message = appendKafkaString(message, kafkaClientID)
+	message = append(message, body...)
+	binary.BigEndian.PutUint32(message, uint32(len(message)-4))
+
+	c.conn.SetDeadline(time.Now().Add(kafkaTimeout))
+	if _, err := c.conn.Write(message); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c.r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > kafkaMaxResponse {
+		return nil, fmt.Errorf("kafka: bad response size %d", n)
+	}
+	response := make([]byte, n)
+	if _, err := io.ReadFull(c.r, response); err != nil {
+		return nil, err
+	}
+	if got := int32(binary.BigEndian.Uint32(response)); got != correlation {
+		return nil, fmt.Errorf("kafka: response %d to request %d", got, correlation)
+	}
+	return response[4:], nil
+}
+
+// refreshMetadata asks the seed brokers, in turn, for the brokers and the
+// topic's partition leaders
+func (p *KafkaProducer) refreshMetadata() error {
+	body := binary.BigEndian.AppendUint32(nil, 1)
+	body = appendKafkaString(body, p.topic)
+
+	var lastErr error
+	for _, seed := range p.seeds {
+		conn, err := net.DialTimeout("tcp", seed, kafkaTimeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		response, err := p.request(&kafkaConn{conn: conn, r: bufio.NewReader(conn)}, kafkaMetadata, kafkaMetadataVersion, body)
+		conn.Close()
+		if err == nil {
+			err = p.parseMetadata(response)
+		}
+		if err == nil {
+			p.refreshed = time.Now()
+			return nil
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+func (p *KafkaProducer) parseMetadata(response []byte) error {
+	r := &kafkaReader{data: response}
+	brokers := make(map[int32]string)
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		id := r.int32()
+		host := r.string()
+		port := r.int32()
+		r.string() // Rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	r.int32() // Controller
+
+	var leaders []int32
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		code := r.int16()
+		name := r.string()
+		r.bool() // Internal
+		var partitions []int32
+		for m := r.int32(); m > 0 && r.err == nil; m-- {
+			r.int16() // Partition error; a missing leader shows as -1
+			index := r.int32()
+			leader := r.int32()
+			r.skipInt32Array() // Replicas
+			r.skipInt32Array() // In-sync replicas
+			if index < 0 || index > 1<<16 {
+				return fmt.Errorf("kafka: bad partition %d", index)
+			}
+			for int32(len(partitions)) <= index {
+				partitions = append(partitions, -1)
+			}
+			partitions[index] = leader
+		}
+		if name != p.topic {
+			continue
+		}
+		if code != 0 {
+			return fmt.Errorf("kafka: topic %s: %w", name, kafkaError(code))
+		}
+		leaders = partitions
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if len(leaders) == 0 {
+		return fmt.Errorf("kafka: topic %s has no partitions", p.topic)
+	}
+	for partition, leader := range leaders {
+		if _, known := brokers[leader]; !known {
+			return fmt.Errorf("kafka: topic %s partition %d: %w", p.topic, partition, kafkaLeaderNotAvailable)
+		}
+	}
+
+	// Connections to brokers that moved or left are reopened on next use
+	for id, c := range p.conns {
+		if addr, known := brokers[id]; !known || addr != c.conn.RemoteAddr().String() {
+			p.dropConn(id)
+		}
+	}
+	p.brokers = brokers
+	p.leaders = leaders
+	return nil
+}
+
+// send produces records to partitions led by broker id
+func (p *KafkaProducer) send(id int32, partitions map[int32][]kafkaRecord) error {
+	c, err := p.conn(id)
+	if err != nil {
+		return err
+	}
+
+	body := binary.BigEndian.AppendUint16(nil, 0xffff) // No transactional ID
+	body = binary.BigEndian.AppendUint16(body, 1)      // Acks from the leader
+	body = binary.BigEndian.AppendUint32(body, uint32(kafkaTimeout.Milliseconds()))
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = appendKafkaString(body, p.topic)
+	body = binary.BigEndian.AppendUint32(body, uint32(len(partitions)))
+	for partition, records := range partitions {
+		batch := kafkaRecordBatch(records)
+		body = binary.BigEndian.AppendUint32(body, uint32(partition))
+		body = binary.BigEndian.AppendUint32(body, uint32(len(batch)))
+		body = append(body, batch...)
+	}
+
+	response, err := p.request(c, kafkaProduce, kafkaProduceVersion, body)
+	if err != nil {
+		return err
+	}
+	return parseProduceResponse(response)
+}
+
+// parseProduceResponse returns the first partition error in a Produce
+// response
+func parseProduceResponse(response []byte) error {
+	r := &kafkaReader{data: response}
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		r.string() // Topic
+		for m := r.int32(); m > 0 && r.err == nil; m-- {
+			partition := r.int32()
+			code := r.int16()
+			r.int64() // Base offset
+			r.int64() // Log append time
+			if code != 0 && r.err == nil {
+				return fmt.Errorf("partition %d: %w", partition, kafkaError(code))
+			}
+		}
+	}
+	return r.err
+}
+
+// kafkaRecordBatch encodes records as a v2 record batch, uncompressed and
+// without a producer ID
+func kafkaRecordBatch(records []kafkaRecord) []byte {
+	base := records[0].timestamp.UnixMilli()
+	latest := base
+	var encoded []byte
+	for i, record := range records {
+		timestamp := record.timestamp.UnixMilli()
+		latest = max(latest, timestamp)
+
+		fields := []byte{0} // Attributes
+		fields = binary.AppendVarint(fields, timestamp-base)
+		fields = binary.AppendVarint(fields, int64(i))
+		if record.key == nil {
+			fields = binary.AppendVarint(fields, -1)
+		} else {
+			fields = binary.AppendVarint(fields, int64(len(record.key)))
+			fields = append(fields, record.key...)
+		}
+		fields = binary.AppendVarint(fields, int64(len(record.value)))
+		fields = append(fields, record.value...)
+		fields = binary.AppendVarint(fields, 0) // Headers
+
+		encoded = binary.AppendVarint(encoded, int64(len(fields)))
+		encoded = append(encoded, fields...)
+	}
+
+	// The part of the batch after the CRC, which the CRC covers
+	checked := binary.BigEndian.AppendUint16(nil, 0) // Attributes
+	checked = binary.BigEndian.AppendUint32(checked, uint32(len(records)-1))
+	checked = binary.BigEndian.AppendUint64(checked, uint64(base))
+	checked = binary.BigEndian.AppendUint64(checked, uint64(latest))
+	checked = binary.BigEndian.AppendUint64(checked, 0xffffffffffffffff) // Producer ID
+	checked = binary.BigEndian.AppendUint16(checked, 0xffff)             // Producer epoch
+	checked = binary.BigEndian.AppendUint32(checked, 0xffffffff)         // Base sequence
+	checked = binary.BigEndian.AppendUint32(checked, uint32(len(records)))
+	checked = append(checked, encoded...)
+
+	batch := binary.BigEndian.AppendUint64(nil, 0) // Base offset
+	batch = binary.BigEndian.AppendUint32(batch, uint32(4+1+4+len(checked)))
+	batch = binary.BigEndian.AppendUint32(batch, 0xffffffff) // Partition leader epoch
+	batch = append(batch, kafkaRecordBatchMagic)
+	batch = binary.BigEndian.AppendUint32(batch, crc32.Checksum(checked, castagnoli))
+	return append(batch, checked...)
+}
+
+func appendKafkaString(data []byte, s string) []byte {
+	data = binary.BigEndian.AppendUint16(data, uint16(len(s)))
+	return append(data, s...)
+}
+
+// kafkaReader decodes a response, remembering the first error so callers can
+// check once at the end
+type kafkaReader struct {
+	data []byte
+	err  error
+}
+
+func (r *kafkaReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data) {
+		r.err = errors.New("kafka: truncated response")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *kafkaReader) bool() bool {
+	b := r.take(1)
+	return b != nil && b[0] != 0
+}
+
+func (r *kafkaReader) int16() int16 {
+	if b := r.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if b := r.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int64() int64 {
+	if b := r.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string reads a nullable string; null reads as ""
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.take(int(n)))
+}
+
+func (r *kafkaReader) skipInt32Array() {
+	if n := r.int32(); n > 0 {
+		r.take(int(n) * 4)
+	}
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCastagnoli(t *testing.T) {
+	// The CRC-32C check value
+	if got := crc32.Checksum([]byte("123456789"), castagnoli); got != 0xe3069283 {
+		t.Errorf("CRC-32C = %#x, want 0xe3069283", got)
+	}
+}
+
+func TestKafkaRecordBatch(t *testing.T) {
+	base := time.UnixMilli(1700000000000)
+	batch := kafkaRecordBatch([]kafkaRecord{
+		{key: []byte("alice"), value: []byte("hi"), timestamp: base},
+		{value: []byte("x"), timestamp: base.Add(5 * time.Millisecond)},
+	})
+
+	// Encoded by hand from the v2 record batch format
+	want, _ := hex.DecodeString("" +
+		"0000000000000000" + // Base offset
+		"00000047" + // Batch length
+		"ffffffff" + // Partition leader epoch
+		"02" + // Magic
+		"e26df69b" + // CRC-32C
+		"0000" + // Attributes
+		"00000001" + // Last offset delta
+		"0000018bcfe56800" + // First timestamp
+		"0000018bcfe56805" + // Max timestamp
+		"ffffffffffffffff" + // Producer ID
+		"ffff" + // Producer epoch
+		"ffffffff" + // Base sequence
+		"00000002" + // Records
+		"1a" + "00" + "00" + "00" + "0a" + "616c696365" + "04" + "6869" + "00" +
+		"0e" + "00" + "0a" + "02" + "01" + "02" + "78" + "00")
+	if !bytes.Equal(batch, want) {
+		t.Errorf("kafkaRecordBatch =\n%x\nwant\n%x", batch, want)
+	}
+}
+
+// kafkaMetadataResponse encodes a Metadata v1 response with one broker and
+// the given topic's partition leaders
+func kafkaMetadataResponse(addr, topic string, code int16, leaders ...int32) []byte {
+	host, portString, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portString)
+
+	b := binary.BigEndian.AppendUint32(nil, 1)
+	b = binary.BigEndian.AppendUint32(b, 0) // Node ID
+	b = appendKafkaString(b, host)
+	b = binary.BigEndian.AppendUint32(b, uint32(port))
+	b = binary.BigEndian.AppendUint16(b, 0xffff) // Rack
+	b = binary.BigEndian.AppendUint32(b, 0)      // Controller
+	b = binary.BigEndian.AppendUint32(b, 1)
+	b = binary.BigEndian.AppendUint16(b, uint16(code))
+	b = appendKafkaString(b, topic)
+	b = append(b, 0) // Internal
+	b = binary.BigEndian.AppendUint32(b, uint32(len(leaders)))
+	for partition, leader := range leaders {
+		b = binary.BigEndian.AppendUint16(b, 0)
+		b = binary.BigEndian.AppendUint32(b, uint32(partition))
+		b = binary.BigEndian.AppendUint32(b, uint32(leader))
+		b = binary.BigEndian.AppendUint32(b, 1) // Replicas
+		b = binary.BigEndian.AppendUint32(b, uint32(leader))
+		b = binary.BigEndian.AppendUint32(b, 0) // In-sync replicas
+	}
+	return b
+}
+
+// kafkaProduceResponse encodes a Produce v3 response for one partition
+func kafkaProduceResponse(topic string, partition int32, code int16) []byte {
+	b := binary.BigEndian.AppendUint32(nil, 1)
+	b = appendKafkaString(b, topic)
+	b = binary.BigEndian.AppendUint32(b, 1)
+	b = binary.BigEndian.AppendUint32(b, uint32(partition))
+	b = binary.BigEndian.AppendUint16(b, uint16(code))
+	b = binary.BigEndian.AppendUint64(b, 42)                 // Base offset
+	b = binary.BigEndian.AppendUint64(b, 0xffffffffffffffff) // Log append time
+	return binary.BigEndian.AppendUint32(b, 0)               // Throttle time
+}
+
+func TestKafkaParseMetadata(t *testing.T) {
+	p := &KafkaProducer{topic: "events", conns: make(map[int32]*kafkaConn)}
+	if err := p.parseMetadata(kafkaMetadataResponse("kafka:9092", "events", 0, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if p.brokers[0] != "kafka:9092" || len(p.leaders) != 2 || p.leaders[1] != 0 {
+		t.Errorf("brokers %v, leaders %v", p.brokers, p.leaders)
+	}
+
+	tests := []struct {
+		name     string
+		response []byte
+		want     error
+	}{
+		{"topic error", kafkaMetadataResponse("kafka:9092", "events", 5), kafkaLeaderNotAvailable},
+		{"partition without a leader", kafkaMetadataResponse("kafka:9092", "events", 0, 0, -1), kafkaLeaderNotAvailable},
+		{"other topic", kafkaMetadataResponse("kafka:9092", "other", 0, 0), nil},
+		{"truncated", kafkaMetadataResponse("kafka:9092", "events", 0, 0)[:20], nil},
+	}
+	for _, tt := range tests {
+		p := &KafkaProducer{topic: "events", conns: make(map[int32]*kafkaConn)}
+		err := p.parseMetadata(tt.response)
+		if err == nil || (tt.want != nil && !errors.Is(err, tt.want)) {
+			t.Errorf("%s: parseMetadata = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestKafkaParseProduceResponse(t *testing.T) {
+	if err := parseProduceResponse(kafkaProduceResponse("events", 0, 0)); err != nil {
+		t.Errorf("parseProduceResponse = %v", err)
+	}
+	// Not the leader for the partition
+	if err := parseProduceResponse(kafkaProduceResponse("events", 3, 6)); !errors.Is(err, kafkaError(6)) {
+		t.Errorf("parseProduceResponse = %v, want error code 6", err)
+	}
+	if err := parseProduceResponse(kafkaProduceResponse("events", 0, 0)[:12]); err == nil {
+		t.Error("parseProduceResponse accepted a truncated response")
+	}
+}
+
+// fakeKafka is a single broker leading every partition of one topic. The
+// first Produce request fails with failFirst if it's set; the batches of the
+// others are sent on batches.
+type fakeKafka struct {
+	listener net.Listener
+	topic    string
+	batches  chan []byte
+
+	mu        sync.Mutex
+	failFirst int16
+}
+
+func newFakeKafka(t *testing.T, topic string, failFirst int16) *fakeKafka {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeKafka{listener: listener, topic: topic, failFirst: failFirst, batches: make(chan []byte, 16)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go f.serve(t, conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeKafka) serve(t *testing.T, conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return
+		}
+		request := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(r, request); err != nil {
+			return
+		}
+		req := &kafkaReader{data: request}
+		apiKey, apiVersion, correlation := req.int16(), req.int16(), req.int32()
+		if clientID := req.string(); clientID != kafkaClientID {
+			t.Errorf("client ID %q", clientID)
+		}
+
+		var response []byte
+		switch {
+		case apiKey == kafkaMetadata && apiVersion == kafkaMetadataVersion:
+			response = kafkaMetadataResponse(f.listener.Addr().String(), f.topic, 0, 0)
+		case apiKey == kafkaProduce && apiVersion == kafkaProduceVersion:
+			req.string() // Transactional ID
+			if acks := req.int16(); acks != 1 {
+				t.Errorf("acks %d", acks)
+			}
+			req.int32() // Timeout
+			req.int32() // Topics
+			req.string()
+			req.int32() // Partitions
+			partition := req.int32()
+			batch := req.take(int(req.int32()))
+			if req.err != nil {
+				t.Errorf("bad produce request: %v", req.err)
+				return
+			}
+			f.mu.Lock()
+			code := f.failFirst
+			f.failFirst = 0
+			f.mu.Unlock()
+			if code == 0 {
+				f.batches <- batch
+			}
+			response = kafkaProduceResponse(f.topic, partition, code)
+		default:
+			t.Errorf("unexpected request %d v%d", apiKey, apiVersion)
+			return
+		}
+
+		message := binary.BigEndian.AppendUint32(nil, uint32(4+len(response)))
+		message = binary.BigEndian.AppendUint32(message, uint32(correlation))
+		conn.Write(append(message, response...))
+	}
+}
+
+func TestKafkaProducer(t *testing.T) {
+	// The first batch is refused as if leadership moved, and is retried
+	broker := newFakeKafka(t, "events", 6)
+	p, err := NewKafkaProducer([]string{broker.listener.Addr().String()}, "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	p.Emit("alice", []byte(`{"type":"message"}`))
+	select {
+	case batch := <-broker.batches:
+		if len(batch) < 21 || batch[16] != kafkaRecordBatchMagic {
+			t.Fatalf("bad batch %x", batch)
+		}
+		if crc := binary.BigEndian.Uint32(batch[17:]); crc != crc32.Checksum(batch[21:], castagnoli) {
+			t.Errorf("batch CRC %#x doesn't match its contents", crc)
+		}
+		if !bytes.Contains(batch, []byte(`alice`)) || !bytes.Contains(batch, []byte(`{"type":"message"}`)) {
+			t.Errorf("batch %x is missing the record", batch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no batch produced")
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"whatsdown/internal/models"
+)
+
+const (
+	// Maximum one-time prekeys accepted in a single upload
+	maxPreKeysPerUpload = 100
+
+	// Maximum one-time prekeys stored per user
+	maxStoredPreKeys = 500
+)
+
+// KeyStore holds users' public end-to-end encryption keys. The server only
+// ever sees public key material; private keys never leave the client.
+type KeyStore struct {
+	identities map[string]*keyRecord
+	mu         sync.Mutex
+}
+
+type keyRecord struct {
+	identityKey  string
+	signedPreKey *models.SignedPreKey
+	preKeys      []*models.PreKey
+}
+
+// PublishKeysRequest represents a key upload from a client
+type PublishKeysRequest struct {
+	IdentityKey    string               `json:"identityKey"`
+	SignedPreKey   *models.SignedPreKey `json:"signedPreKey"`
+	OneTimePreKeys []*models.PreKey     `json:"oneTimePreKeys"`
+}
+
+// KeyStatusResponse tells a client what the server holds for it
+type KeyStatusResponse struct {
+	IdentityKey        string `json:"identityKey"`
+	SignedPreKeyID     int    `json:"signedPreKeyId"`
+	OneTimePreKeyCount int    `json:"oneTimePreKeyCount"`
+}
+
+// NewKeyStore creates an empty key store
+func NewKeyStore() *KeyStore {
+	return &KeyStore{
+		identities: make(map[string]*keyRecord),
+	}
+}
+
+// Publish stores a user's keys. A changed identity key discards any one-time
+// prekeys generated under the old identity.
+func (k *KeyStore) Publish(username string, req *PublishKeysRequest) *KeyStatusResponse {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	record, exists := k.identities[username]
+	if !exists || record.identityKey != req.IdentityKey {
+		record = &keyRecord{identityKey: req.IdentityKey}
+		k.identities[username] = record
+	}
+	if req.SignedPreKey != nil {
+		record.signedPreKey = req.SignedPreKey
+	}
+
+	known := make(map[int]bool, len(record.preKeys))
+	for _, preKey := range record.preKeys {
+		known[preKey.KeyID] = true
+	}
+	for _, preKey := range req.OneTimePreKeys {
+		if known[preKey.KeyID] || len(record.preKeys) >= maxStoredPreKeys {
+			continue
+		}
+		known[preKey.KeyID] = true
+		record.preKeys = append(record.preKeys, preKey)
+	}
+
+	return record.status()
+}
+
+// Status returns what the server holds for username
+func (k *KeyStore) Status(username string) (*KeyStatusResponse, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	record, exists := k.identities[username]
+	if !exists {
+		return nil, false
+	}
+	return record.status(), true
+}
+
+// FetchBundle returns a key bundle for username, consuming one one-time
+// prekey if any remain
+func (k *KeyStore) FetchBundle(username string) (*models.KeyBundle, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	record, exists := k.identities[username]
+	if !exists || record.signedPreKey == nil {
+		return nil, false
+	}
+
+	bundle := &models.KeyBundle{
+		Username:     username,
+		IdentityKey:  record.identityKey,
+		SignedPreKey: record.signedPreKey,
+	}
+	if len(record.preKeys) > 0 {
+		bundle.OneTimePreKey = record.preKeys[0]
+		record.preKeys = record.preKeys[1:]
+	}
+	return bundle, true
+}
+
+func (r *keyRecord) status() *KeyStatusResponse {
+	status := &KeyStatusResponse{
+		IdentityKey:        r.identityKey,
+		OneTimePreKeyCount: len(r.preKeys),
+	}
+	if r.signedPreKey != nil {
+		status.SignedPreKeyID = r.signedPreKey.KeyID
+	}
+	return status
+}
+
+// isBase64Key reports whether s is non-empty, reasonably sized base64
+func isBase64Key(s string) bool {
+	if s == "" || len(s) > 1024 {
+		return false
+	}
+	_, err := base64.StdEncoding.DecodeString(s)
+	return err == nil
+}
+
+// HandleKeys handles GET and PUT /api/keys for the caller's own keys
+func (h *HTTPHandlers) HandleKeys(w http.ResponseWriter, r *http.Request) {
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		status, exists := h.Keys.Status(session.Username)
+		if !exists {
+			http.Error(w, "No keys published", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+
+	case http.MethodPut:
+		var req PublishKeysRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if !isBase64Key(req.IdentityKey) {
+			http.Error(w, "identityKey must be base64", http.StatusBadRequest)
+			return
+		}
+		if req.SignedPreKey != nil && (!isBase64Key(req.SignedPreKey.PublicKey) || !isBase64Key(req.SignedPreKey.Signature)) {
+			http.Error(w, "signedPreKey must have base64 publicKey and signature", http.StatusBadRequest)
+			return
+		}
+		if len(req.OneTimePreKeys) > maxPreKeysPerUpload {
+			http.Error(w, "Too many one-time prekeys", http.StatusBadRequest)
+			return
+		}
+		for _, preKey := range req.OneTimePreKeys {
+			if preKey == nil || !isBase64Key(preKey.PublicKey) {
+				http.Error(w, "oneTimePreKeys must have base64 publicKey", http.StatusBadRequest)
+				return
+			}
+		}
+
+		status := h.Keys.Publish(session.Username, &req)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleKeyBundle handles GET /api/keys/{username}
+func (h *HTTPHandlers) HandleKeyBundle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, _, ok := currentSession(w, r); !ok {
+		return
+	}
+
+	username := strings.TrimSpace(strings.TrimPrefix(r.URL.Path, "/api/keys/"))
+	if username == "" {
+		http.Error(w, "Username required", http.StatusBadRequest)
+		return
+	}
+
+	bundle, exists := h.Keys.FetchBundle(username)
+	if !exists {
+		http.Error(w, "No keys published for user", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bundle)
+}
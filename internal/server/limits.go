@@ -0,0 +1,98 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"unicode/utf8"
+
+	"whatsdown/internal/models"
+
+	"github.com/gorilla/websocket"
+)
+
+// Error codes sent in "error" events
+const (
+	ErrorPayloadTooLarge  = "PAYLOAD_TOO_LARGE"
+	ErrorMessageTooLong   = "MESSAGE_TOO_LONG"
+	ErrorUnknownType      = "UNKNOWN_TYPE"
+	ErrorInvalidPayload   = "INVALID_PAYLOAD"
+	ErrorInvalidRecipient = "INVALID_RECIPIENT"
+	ErrorRateLimited      = "RATE_LIMITED"
+	ErrorMessageRejected  = "MESSAGE_REJECTED"
+)
+
+// A frame over the size limit is drained so the connection survives, unless
+// it is more than this many times the limit, when draining it would only let
+// a client make the server read without bound
+const maxOversizedFrameFactor = 16
+
+var errFrameTooLarge = errors.New("frame exceeds the maximum size")
+
+// readFrame reads the next WebSocket frame, up to limit bytes. A larger frame
+// is drained and discarded and reported with tooLarge rather than failing
+// the connection, up to maxOversizedFrameFactor times limit; beyond that
+// readFrame gives up with errFrameTooLarge and the connection must be closed.
+func readFrame(conn *websocket.Conn, limit int) (data []byte, tooLarge bool, err error) {
+	_, reader, err := conn.NextReader()
+	if err != nil {
+		return nil, false, err
+	}
+
+	data, err = io.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(data) > limit {
+		drainLimit := int64(limit)*maxOversizedFrameFactor - int64(len(data))
+		drained, err := io.Copy(io.Discard, io.LimitReader(reader, drainLimit+1))
+		if err != nil {
+			return nil, false, err
+		}
+		if drained > drainLimit {
+			return nil, false, errFrameTooLarge
+		}
+		return nil, true, nil
+	}
+	return data, false, nil
+}
+
+// sendError sends the client an "error" event
+func (c *Client) sendError(event *models.ErrorEvent) {
+	c.Hub.sendToClient(c, "error", event)
+}
+
+// invalidPayload tells the client a frame of msgType couldn't be parsed
+func (c *Client) invalidPayload(msgType string, err error) {
+	c.sendError(&models.ErrorEvent{
+		Code:    ErrorInvalidPayload,
+		Message: err.Error(),
+		Type:    msgType,
+	})
+}
+
+// sendError sends username an "error" event if they are connected
+func (h *Hub) sendError(username string, event *models.ErrorEvent) {
+	h.mu.RLock()
+	clients := h.clientsOf(username)
+	h.mu.RUnlock()
+
+	for _, client := range clients {
+		h.sendToClient(client, "error", event)
+	}
+}
+
+// checkMessageLength reports whether content fits the configured message
+// length, telling from why not otherwise
+func (h *Hub) checkMessageLength(from, tempID, content string) bool {
+	if h.MaxMessageLength <= 0 || utf8.RuneCountInString(content) <= h.MaxMessageLength {
+		return true
+	}
+
+	h.sendError(from, &models.ErrorEvent{
+		Code:    ErrorMessageTooLong,
+		Message: "message content exceeds the maximum length",
+		Limit:   h.MaxMessageLength,
+		TempID:  tempID,
+	})
+	return false
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"whatsdown/internal/models"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestReadFrame(t *testing.T) {
+	const limit = 1024
+	type result struct {
+		size     int
+		tooLarge bool
+		err      error
+	}
+	results := make(chan result)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			data, tooLarge, err := readFrame(conn, limit)
+			results <- result{len(data), tooLarge, err}
+			if err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		size     int
+		tooLarge bool
+		err      error
+	}{
+		{size: limit},
+		{size: limit + 1, tooLarge: true},
+		{size: limit * maxOversizedFrameFactor, tooLarge: true},
+		{size: 10},
+		{size: limit*maxOversizedFrameFactor + 1, err: errFrameTooLarge},
+	}
+	for _, tt := range tests {
+		if err := conn.WriteMessage(websocket.TextMessage, bytes.Repeat([]byte("x"), tt.size)); err != nil {
+			t.Fatal(err)
+		}
+		got := <-results
+		if got.tooLarge != tt.tooLarge || got.err != tt.err {
+			t.Errorf("%d-byte frame: tooLarge %v, err %v; want %v, %v", tt.size, got.tooLarge, got.err, tt.tooLarge, tt.err)
+		}
+		if !tt.tooLarge && tt.err == nil && got.size != tt.size {
+			t.Errorf("%d-byte frame read as %d bytes", tt.size, got.size)
+		}
+	}
+}
+
+func TestRefusedSendsGetErrorEvents(t *testing.T) {
+	hub := newTestHub(t, "alice", "bob")
+	hub.UrgentPerHour = 0
+	alice := newTestClient(t, hub, "alice")
+	group, err := hub.CreateGroup("bob", "team", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel := hub.CreateChannel("bob", "news", "")
+
+	tests := []struct {
+		name string
+		msg  *models.InboundMessage
+		code string
+	}{
+		{"unknown recipient", &models.InboundMessage{To: "nobody", Content: "hi"}, ErrorInvalidRecipient},
+		{"group non-member", &models.InboundMessage{GroupID: group.ID, Content: "hi"}, ErrorInvalidRecipient},
+		{"channel non-publisher", &models.InboundMessage{ChannelID: channel.ID, Content: "hi"}, ErrorInvalidRecipient},
+		{"urgent disabled", &models.InboundMessage{To: "bob", Content: "hi", Urgent: true}, ErrorMessageRejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.msg.TempID = tt.name
+			hub.handleInboundMessageWithSender("alice", tt.msg)
+			var event models.ErrorEvent
+			if err := json.Unmarshal(nextEvent(t, alice, "error"), &event); err != nil {
+				t.Fatal(err)
+			}
+			if event.Code != tt.code || event.TempID != tt.name {
+				t.Errorf("error event %+v, want code %s for %q", event, tt.code, tt.name)
+			}
+		})
+	}
+}
+
+func TestGroupAckCarriesTempID(t *testing.T) {
+	hub := newTestHub(t, "alice", "bob")
+	alice := newTestClient(t, hub, "alice")
+	newTestClient(t, hub, "bob")
+	group, err := hub.CreateGroup("alice", "team", []string{"bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub.handleInboundMessageWithSender("alice", &models.InboundMessage{GroupID: group.ID, Content: "hi", TempID: "t1"})
+	var ack models.AckEvent
+	if err := json.Unmarshal(nextEvent(t, alice, "ack"), &ack); err != nil {
+		t.Fatal(err)
+	}
+	if ack.TempID != "t1" || ack.Status != "delivered" {
+		t.Errorf("ack = %+v, want delivered with tempId t1", ack)
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"log"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"whatsdown/internal/models"
+)
+
+const (
+	// Maximum length of a location label in runes
+	maxLocationLabelRunes = 100
+
+	// Bounds on how long live location can be shared
+	minLiveLocation = 15 * time.Minute
+	maxLiveLocation = 8 * time.Hour
+)
+
+// validCoordinates reports whether lat/lng are finite and on the globe
+func validCoordinates(latitude, longitude float64) bool {
+	if math.IsNaN(latitude) || math.IsNaN(longitude) {
+		return false
+	}
+	return latitude >= -90 && latitude <= 90 && longitude >= -180 && longitude <= 180
+}
+
+// newLocation validates a location request, sanitizing its label
+func (h *Hub) newLocation(req *models.LocationRequest) (*models.Location, bool) {
+	if !validCoordinates(req.Latitude, req.Longitude) {
+		return nil, false
+	}
+
+	label := strings.TrimSpace(h.Sanitizer.Sanitize(req.Label))
+	if utf8.RuneCountInString(label) > maxLocationLabelRunes {
+		return nil, false
+	}
+
+	location := &models.Location{
+		Latitude:  req.Latitude,
+		Longitude: req.Longitude,
+		Label:     label,
+	}
+	if req.LiveFor != "" {
+		duration, err := time.ParseDuration(req.LiveFor)
+		if err != nil || duration < minLiveLocation || duration > maxLiveLocation {
+			return nil, false
+		}
+		until := time.Now().Add(duration)
+		location.Live = true
+		location.LiveUntil = &until
+	}
+	return location, true
+}
+
+// startLiveLocation ends a live location share when its time runs out
+func (h *Hub) startLiveLocation(message *models.Message) {
+	if message.Location == nil || !message.Location.Live {
+		return
+	}
+	time.AfterFunc(time.Until(*message.Location.LiveUntil), func() {
+		h.stopLiveLocation(message.ID)
+	})
+}
+
+// stopLiveLocation marks a live share as ended and tells participants
+func (h *Hub) stopLiveLocation(messageID string) {
+	h.mu.Lock()
+	message, exists := h.message(messageID)
+	if !exists || message.Location == nil || !message.Location.Live {
+		h.mu.Unlock()
+		return
+	}
+
+	message.Location.Live = false
+	update := &models.LocationEvent{
+		MessageID: message.ID,
+		Location:  *message.Location,
+	}
+	recipients := h.participantClients(message)
+	h.mu.Unlock()
+
+	for _, client := range recipients {
+		h.sendToClient(client, "location", update)
+	}
+}
+
+// handleLocationUpdate moves a live location the sender is sharing, or stops
+// sharing it early, and pushes the change to everyone in the conversation
+func (h *Hub) handleLocationUpdate(from string, event *models.LocationUpdate) {
+	if event.Stop {
+		h.mu.RLock()
+		message, exists := h.message(event.MessageID)
+		owned := exists && message.From == from
+		h.mu.RUnlock()
+
+		if owned {
+			h.stopLiveLocation(event.MessageID)
+		}
+		return
+	}
+
+	if !validCoordinates(event.Latitude, event.Longitude) {
+		log.Printf("Dropping location update from %s: invalid coordinates", from)
+		return
+	}
+
+	h.mu.Lock()
+	message, exists := h.message(event.MessageID)
+	if !exists || message.From != from || message.Deleted || message.Location == nil || !message.Location.Live {
+		h.mu.Unlock()
+		log.Printf("Dropping location update from %s: no live location %s", from, event.MessageID)
+		return
+	}
+
+	message.Location.Latitude = event.Latitude
+	message.Location.Longitude = event.Longitude
+	update := &models.LocationEvent{
+		MessageID: message.ID,
+		Location:  *message.Location,
+	}
+	recipients := h.participantClients(message)
+	h.mu.Unlock()
+
+	for _, client := range recipients {
+		h.sendToClient(client, "location", update)
+	}
+}
@@ -0,0 +1,354 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+// poller is the state of a long-poll client, one that has no WebSocket and
+// instead fetches its events with GET /api/poll and sends frames with
+// POST /api/poll/send. Its events still go through Send; a poll drains it.
+type poller struct {
+	key string // In Hub.Pollers
+
+	// A poll holds waitMu while it waits, a send holds sendMu while the
+	// frame is handled, so each runs one at a time like a read or write pump
+	waitMu sync.Mutex
+	sendMu sync.Mutex
+
+	// Drops the client once it stops polling
+	expiry *time.Timer
+}
+
+func pollerKey(sessionID, deviceID string) string {
+	return sessionID + "|" + deviceID
+}
+
+// poller returns the long-poll client for a session's device, or nil if it
+// has none or it was disconnected
+func (h *Hub) poller(sessionID, deviceID string) *Client {
+	h.mu.RLock()
+	client := h.Pollers[pollerKey(sessionID, deviceID)]
+	h.mu.RUnlock()
+
+	if client == nil {
+		return nil
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.closed {
+		return nil
+	}
+	return client
+}
+
+// startPolling registers a long-poll client. Unlike a WebSocket client it is
+// registered before this returns, so its stream is attached by the first
+// poll. The client is dropped if it goes h.PongTimeout without polling.
+func (h *Hub) startPolling(client *Client) {
+	client.poll = &poller{key: pollerKey(client.SessionID, client.DeviceID)}
+	client.poll.expiry = time.AfterFunc(h.PongTimeout, func() {
+		log.Printf("Long-poll client %s (device %s) stopped polling", client.Username, client.DeviceID)
+		h.endPoll(client)
+	})
+
+	h.mu.Lock()
+	if previous := h.Pollers[client.poll.key]; previous != nil {
+		previous.poll.expiry.Stop()
+	}
+	h.Pollers[client.poll.key] = client
+	h.mu.Unlock()
+
+	h.registerClient(client)
+}
+
+// endPoll forgets a long-poll client and unregisters it. There is no read
+// pump to notice it has gone, so this takes its place. It does nothing for
+// WebSocket clients.
+func (h *Hub) endPoll(client *Client) {
+	if client.poll == nil {
+		return
+	}
+	client.poll.expiry.Stop()
+
+	h.mu.Lock()
+	if h.Pollers[client.poll.key] == client {
+		delete(h.Pollers, client.poll.key)
+	}
+	h.mu.Unlock()
+
+	h.Unregister <- client
+}
+
+// poll waits up to wait for events after cursor on client's stream and
+// returns them, at most maxBatchEvents at a time. streamID is the stream the
+// cursor belongs to; if it isn't the client's current stream every event on
+// the current one is returned with Reset set. Reaching cursor acknowledges
+// the events up to it, as a "received" frame would.
+//
+// Without a stream (resuming disabled) events can't be replayed, so the
+// ones queued are returned as they are and are lost if the response is.
+func (h *Hub) poll(ctx context.Context, client *Client, streamID string, cursor int64, wait time.Duration) *models.PollResponse {
+	client.poll.waitMu.Lock()
+	defer client.poll.waitMu.Unlock()
+	client.poll.expiry.Stop()
+	defer client.poll.expiry.Reset(h.PongTimeout)
+
+	h.mu.RLock()
+	stream := client.stream
+	h.mu.RUnlock()
+
+	response := &models.PollResponse{Events: []json.RawMessage{}}
+	if stream != nil {
+		response.StreamID = stream.ID
+		if streamID == stream.ID {
+			h.handleReceived(client, &models.ReceivedEvent{Seq: cursor})
+		} else {
+			response.Reset = streamID != ""
+			cursor = 0
+		}
+	}
+
+	// Everything sequenced is replayed from the stream below, so on a
+	// stream the frames in Send only signal that there are events
+	var queued [][]byte
+	ready := func() bool {
+		if stream != nil {
+			return stream.lastSeq() != cursor
+		}
+		return len(queued) > 0
+	}
+	closed := false
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+waiting:
+	for !ready() {
+		select {
+		case data, ok := <-client.Send:
+			if !ok {
+				closed = true
+				break waiting
+			}
+			queued = append(queued, data)
+		case <-timer.C:
+			break waiting
+		case <-ctx.Done():
+			break waiting
+		}
+	}
+draining:
+	for !closed {
+		select {
+		case data, ok := <-client.Send:
+			if !ok {
+				closed = true
+				break draining
+			}
+			queued = append(queued, data)
+		default:
+			break draining
+		}
+	}
+
+	if stream != nil {
+		frames, last, ok := stream.after(cursor, maxBatchEvents)
+		if !ok {
+			response.Reset = true
+		}
+		queued = frames
+		cursor = last
+	}
+	response.Cursor = cursor
+	for _, data := range queued {
+		response.Events = append(response.Events, json.RawMessage(data))
+	}
+
+	if closed {
+		client.pollClosed(response)
+		h.endPoll(client)
+	}
+	return response
+}
+
+// after returns up to limit frames after seq, and the seq of the last one
+// returned (seq itself if none are). ok is false if some of the frames have
+// already been dropped from the buffer; last is then the stream's latest
+// seq, so the caller can carry on from there.
+func (s *eventStream) after(seq int64, limit int) (frames [][]byte, last int64, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Everything acknowledged was received, whatever the client now says
+	if seq < s.acked {
+		seq = s.acked
+	}
+	if seq > s.seq || (seq < s.seq && (len(s.frames) == 0 || s.frames[0].seq > seq+1)) {
+		return nil, s.seq, false
+	}
+	last = seq
+	for _, frame := range s.frames {
+		if frame.seq <= seq {
+			continue
+		}
+		if len(frames) == limit {
+			break
+		}
+		frames = append(frames, frame.data)
+		last = frame.seq
+	}
+	return frames, last, true
+}
+
+// pollClient returns the long-poll client for the request's session and
+// device, registering one that resumes the stream cursor is on if needed. It
+// answers the request itself and returns nil if it can't.
+func (h *HTTPHandlers) pollClient(w http.ResponseWriter, r *http.Request, sessionID, username string, cursor int64) *Client {
+	deviceID := strings.TrimSpace(r.URL.Query().Get("deviceId"))
+	if deviceID == "" {
+		deviceID = defaultDeviceID
+	}
+	if len(deviceID) > maxDeviceIDLength {
+		http.Error(w, "deviceId too long", http.StatusBadRequest)
+		return nil
+	}
+	if client := h.Hub.poller(sessionID, deviceID); client != nil {
+		return client
+	}
+
+	if h.Hub.refuseWhileDraining(w) {
+		return nil
+	}
+	deviceName, userAgent, platform, ok := deviceInfo(r)
+	if !ok {
+		http.Error(w, "deviceName too long", http.StatusBadRequest)
+		return nil
+	}
+
+	client := &Client{
+		Username:  username,
+		SessionID: sessionID,
+		DeviceID:  deviceID,
+		Send:      make(chan []byte, 256),
+		Hub:       h.Hub,
+
+		codec:            jsonCodec{},
+		protocolVersion:  ProtocolVersion,
+		compressMinBytes: -1,
+
+		DeviceName: deviceName,
+		UserAgent:  userAgent,
+		Platform:   platform,
+
+		subscribesPresence: r.URL.Query().Get("presence") == "subscribe",
+		resumeStream:       r.URL.Query().Get("stream"),
+		resumeSeq:          cursor,
+		limiter:            newFrameLimiter(h.Hub.FrameRateLimit, h.Hub.FrameRateBurst),
+	}
+	h.Hub.startPolling(client)
+	log.Printf("Long polling started for user: %s (device %s)", username, deviceID)
+	return client
+}
+
+// HandlePoll handles GET /api/poll?deviceId=&stream=&cursor=&timeout=
+func (h *HTTPHandlers) HandlePoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	var cursor int64
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		cursor = parsed
+	}
+	wait := h.Hub.PollTimeout
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		requested, err := time.ParseDuration(value)
+		if err != nil || requested < 0 {
+			http.Error(w, "Invalid timeout", http.StatusBadRequest)
+			return
+		}
+		wait = min(requested, h.Hub.PollTimeout)
+	}
+
+	client := h.pollClient(w, r, sessionID, session.Username, cursor)
+	if client == nil {
+		return
+	}
+	response := h.Hub.poll(r.Context(), client, r.URL.Query().Get("stream"), cursor, wait)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandlePollSend handles POST /api/poll/send?deviceId=. The body is one frame
+// as it would be sent on a WebSocket; errors about its payload arrive as
+// "error" events on the next poll.
+func (h *HTTPHandlers) HandlePollSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID, _, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	deviceID := strings.TrimSpace(r.URL.Query().Get("deviceId"))
+	if deviceID == "" {
+		deviceID = defaultDeviceID
+	}
+	client := h.Hub.poller(sessionID, deviceID)
+	if client == nil {
+		http.Error(w, "Not polling; GET /api/poll first", http.StatusConflict)
+		return
+	}
+
+	client.poll.sendMu.Lock()
+	defer client.poll.sendMu.Unlock()
+
+	if !client.limiter.allow() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Rate limited", http.StatusTooManyRequests)
+		return
+	}
+	var wsMsg models.WSMessage
+	body := http.MaxBytesReader(w, r.Body, int64(h.Hub.MaxFrameBytes))
+	if err := json.NewDecoder(body).Decode(&wsMsg); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Frame too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid frame", http.StatusBadRequest)
+		return
+	}
+
+	// Sending counts as session and device activity, as on a WebSocket
+	sessionStore.Touch(client.SessionID)
+	if client.touch() {
+		h.Hub.markActive(client.Username)
+	}
+	client.handleFrame(&wsMsg)
+	w.WriteHeader(http.StatusNoContent)
+}
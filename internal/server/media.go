@@ -0,0 +1,302 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"whatsdown/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// Media kinds
+const (
+	MediaVoice      = "voice"
+	MediaSticker    = "sticker" // public to every signed-in user
+	MediaAttachment = "attachment"
+)
+
+const (
+	// Largest voice note accepted
+	maxVoiceBytes = 16 << 20
+
+	// Longest voice note accepted
+	maxVoiceDuration = 15 * time.Minute
+)
+
+var (
+	errMediaNotFound = errors.New("media not found")
+	errMediaTooLarge = errors.New("media too large")
+)
+
+// MediaStore keeps uploaded media on disk with its metadata in memory
+type MediaStore struct {
+	dir   string
+	items map[string]*models.Media
+	mu    sync.RWMutex
+
+	// Images waiting for thumbnails; nil until StartThumbnailer
+	thumbnailQueue chan string
+
+	// ffmpeg binary used for video poster frames; empty disables them
+	FFmpegPath string
+}
+
+// NewMediaStore stores files under dir, creating it if needed
+func NewMediaStore(dir string) (*MediaStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &MediaStore{
+		dir:   dir,
+		items: make(map[string]*models.Media),
+	}, nil
+}
+
+// Save writes data to disk and records media, assigning its ID
+func (m *MediaStore) Save(media *models.Media, data []byte) (*models.Media, error) {
+	media.ID = uuid.New().String()
+	media.Size = int64(len(data))
+	media.CreatedAt = time.Now()
+
+	if err := os.WriteFile(m.path(media.ID), data, 0600); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.items[media.ID] = media
+	return media.Snapshot(), nil
+}
+
+// Get returns media metadata by ID
+func (m *MediaStore) Get(id string) (*models.Media, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	media, exists := m.items[id]
+	if !exists {
+		return nil, false
+	}
+	return media.Snapshot(), true
+}
+
+// Attach records that a message references media, granting its
+// conversation's participants access
+func (m *MediaStore) Attach(id, messageID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if media, exists := m.items[id]; exists {
+		media.MessageIDs = append(media.MessageIDs, messageID)
+	}
+}
+
+// Open opens media's file for reading
+func (m *MediaStore) Open(id string) (*os.File, error) {
+	return os.Open(m.path(id))
+}
+
+func (m *MediaStore) path(id string) string {
+	return filepath.Join(m.dir, filepath.Base(id))
+}
+
+// attachMedia records a stored message against the media it carries, so its
+// participants may fetch it
+func (h *Hub) attachMedia(message *models.Message) {
+	if message.Voice != nil {
+		h.Media.Attach(message.Voice.MediaID, message.ID)
+	}
+	for _, attachment := range message.Attachments {
+		h.Media.Attach(attachment.ID, message.ID)
+	}
+}
+
+// canAccessMedia reports whether username uploaded media or can see a
+// message that references it
+func (h *Hub) canAccessMedia(media *models.Media, username string) bool {
+	if media.Owner == username || media.Kind == MediaSticker {
+		return true
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, messageID := range media.MessageIDs {
+		message, exists := h.message(messageID)
+		if exists && !message.Deleted && h.canAccessMessage(message, username) && !message.HiddenFrom(username) {
+			return true
+		}
+	}
+	return false
+}
+
+// newVoiceNote validates that from uploaded mediaID as a voice note
+func (h *Hub) newVoiceNote(from, mediaID string) (*models.VoiceNote, bool) {
+	if h.Media == nil {
+		return nil, false
+	}
+	media, exists := h.Media.Get(mediaID)
+	if !exists || media.Owner != from || media.Kind != MediaVoice {
+		return nil, false
+	}
+	return &models.VoiceNote{
+		MediaID:  media.ID,
+		URL:      "/api/media/" + media.ID,
+		Duration: media.Duration,
+		Peaks:    media.Peaks,
+	}, true
+}
+
+// HandleUploadMedia handles POST /api/media?kind=voice. The body is the raw
+// file with its Content-Type.
+func (h *HTTPHandlers) HandleUploadMedia(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	if r.URL.Query().Get("kind") != MediaVoice {
+		http.Error(w, "kind must be voice", http.StatusBadRequest)
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if !strings.HasPrefix(contentType, "audio/") {
+		http.Error(w, "Voice notes must have an audio/* Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxVoiceBytes))
+	if err != nil {
+		http.Error(w, errMediaTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	info, err := probeAudio(data)
+	if err != nil {
+		http.Error(w, "Voice notes must be WAV (PCM) or Ogg (Opus or Vorbis)", http.StatusUnsupportedMediaType)
+		return
+	}
+	if info.Duration > maxVoiceDuration {
+		http.Error(w, "Voice note too long", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	media, err := h.Hub.Media.Save(&models.Media{
+		Owner:       session.Username,
+		Kind:        MediaVoice,
+		ContentType: contentType,
+		Codec:       info.Codec,
+		Duration:    info.Duration.Seconds(),
+		Peaks:       info.Peaks,
+	}, data)
+	if err != nil {
+		log.Printf("Error saving media: %v", err)
+		http.Error(w, "Failed to store media", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(media)
+}
+
+// HandleMedia handles GET /api/media/{id}, GET /api/media/{id}/thumbnail/{size},
+// GET /api/media/{id}/poster and GET /api/media/{id}/signed
+func (h *HTTPHandlers) HandleMedia(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/media/")
+	signedURLs := false
+	if trimmed, found := strings.CutSuffix(strings.TrimRight(path, "/"), "/signed"); found {
+		path, signedURLs = trimmed, true
+	}
+	id, variant, ok := parseMediaPath(path)
+	if !ok || (signedURLs && variant != "") {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	media, exists := h.Hub.Media.Get(id)
+	if !exists || !h.Hub.canAccessMedia(media, session.Username) {
+		http.Error(w, errMediaNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case signedURLs:
+		h.handleSignedMediaURLs(w, media)
+	case h.MediaURLs.baseURL != "":
+		// Send the download to the CDN instead of serving it here
+		url, _ := h.MediaURLs.Sign(signedMediaPath(media.ID, variant))
+		http.Redirect(w, r, url, http.StatusFound)
+	default:
+		w.Header().Set("Cache-Control", "private")
+		h.serveMedia(w, r, media, variant)
+	}
+}
+
+// serveMedia writes media, or its thumbnail or poster, supporting range requests
+func (h *HTTPHandlers) serveMedia(w http.ResponseWriter, r *http.Request, media *models.Media, thumbnail string) {
+	if thumbnail != "" {
+		file, ok := h.Hub.Media.OpenThumbnail(media.ID, thumbnail)
+		if !ok && attachmentType(media.ContentType) == AttachmentVideo {
+			// Small videos use their poster as every thumbnail
+			file, ok = h.Hub.Media.OpenThumbnail(media.ID, posterSize)
+		}
+		if ok {
+			defer file.Close()
+			w.Header().Set("Content-Type", "image/jpeg")
+			http.ServeContent(w, r, "", media.CreatedAt, file)
+			return
+		}
+		if attachmentType(media.ContentType) != AttachmentImage {
+			http.Error(w, "Thumbnail not available", http.StatusNotFound)
+			return
+		}
+		// Not generated yet, or the image is already that small
+	}
+
+	file, err := h.Hub.Media.Open(media.ID)
+	if err != nil {
+		http.Error(w, errMediaNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", media.ContentType)
+	// Never let an upload run script in the app's origin, even if rendered
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	if media.Name != "" {
+		disposition := "attachment"
+		if attachmentType(media.ContentType) != AttachmentFile {
+			disposition = "inline"
+		}
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": media.Name}))
+	}
+	http.ServeContent(w, r, "", media.CreatedAt, file)
+}
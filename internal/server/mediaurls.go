@@ -0,0 +1,140 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+// MediaSigner issues and checks expiring HMAC-signed media URLs. Holding a
+// valid URL is enough to download, so they are only issued to users who may
+// access the media; this lets a CDN cache media without session cookies.
+type MediaSigner struct {
+	secret  []byte
+	ttl     time.Duration
+	baseURL string
+}
+
+// NewMediaSigner signs with secret, or a random per-process key if it's
+// empty. baseURL (for example a CDN origin) prefixes issued URLs.
+func NewMediaSigner(secret string, ttl time.Duration, baseURL string) *MediaSigner {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+	}
+	return &MediaSigner{secret: key, ttl: ttl, baseURL: strings.TrimRight(baseURL, "/")}
+}
+
+func (s *MediaSigner) signature(path string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(path + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns a URL for path (under /media/) valid until the returned time
+func (s *MediaSigner) Sign(path string) (string, time.Time) {
+	expires := time.Now().Add(s.ttl).Truncate(time.Second)
+	sig := s.signature(path, expires.Unix())
+	return s.baseURL + path + "?expires=" + strconv.FormatInt(expires.Unix(), 10) + "&sig=" + sig, expires
+}
+
+// Verify checks a signed request's signature and expiry
+func (s *MediaSigner) Verify(r *http.Request) bool {
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	expected := s.signature(r.URL.Path, expires)
+	return hmac.Equal([]byte(expected), []byte(r.URL.Query().Get("sig")))
+}
+
+// signedMediaPath maps a media path under /api/media to its signed form
+func signedMediaPath(id, variant string) string {
+	path := "/media/" + id
+	switch {
+	case variant == posterSize:
+		path += "/" + posterSize
+	case variant != "":
+		path += "/thumbnail/" + variant
+	}
+	return path
+}
+
+// parseMediaPath splits "{id}", "{id}/thumbnail/{size}" or "{id}/poster"
+func parseMediaPath(path string) (id, variant string, ok bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) == 1:
+		return parts[0], "", parts[0] != ""
+	case len(parts) == 3 && parts[1] == "thumbnail" && thumbnailSizes[parts[2]] > 0:
+		return parts[0], parts[2], true
+	case len(parts) == 2 && parts[1] == posterSize:
+		return parts[0], posterSize, true
+	default:
+		return "", "", false
+	}
+}
+
+// signedMedia issues signed URLs for every variant of media
+func (s *MediaSigner) signedMedia(media *models.Media) *models.SignedMedia {
+	url, expires := s.Sign(signedMediaPath(media.ID, ""))
+	signed := &models.SignedMedia{URL: url, ExpiresAt: expires}
+
+	kind := attachmentType(media.ContentType)
+	if kind == AttachmentVideo {
+		signed.Poster, _ = s.Sign(signedMediaPath(media.ID, posterSize))
+	}
+	if thumbnailSourceTypes[media.ContentType] || kind == AttachmentVideo {
+		signed.Thumbnails = map[string]string{}
+		for size := range thumbnailSizes {
+			signed.Thumbnails[size], _ = s.Sign(signedMediaPath(media.ID, size))
+		}
+	}
+	return signed
+}
+
+// handleSignedMediaURLs handles GET /api/media/{id}/signed
+func (h *HTTPHandlers) handleSignedMediaURLs(w http.ResponseWriter, media *models.Media) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.MediaURLs.signedMedia(media))
+}
+
+// HandleSignedMedia handles GET /media/{id}, /media/{id}/thumbnail/{size} and
+// /media/{id}/poster, authorized by signature instead of a session
+func (h *HTTPHandlers) HandleSignedMedia(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.MediaURLs.Verify(r) {
+		http.Error(w, "Invalid or expired link", http.StatusForbidden)
+		return
+	}
+
+	id, variant, ok := parseMediaPath(strings.TrimPrefix(r.URL.Path, "/media/"))
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	media, exists := h.Hub.Media.Get(id)
+	if !exists {
+		http.Error(w, errMediaNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	// The URL changes when it expires, so shared caches may keep it until then
+	expires, _ := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.FormatInt(max(0, expires-time.Now().Unix()), 10))
+	h.serveMedia(w, r, media, variant)
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"regexp"
+
+	"whatsdown/internal/models"
+)
+
+// Matches @username using the same character set allowed at login
+var mentionPattern = regexp.MustCompile(`(?:^|[^A-Za-z0-9_@])@([A-Za-z0-9_]{1,50})`)
+
+// parseMentions returns the distinct group members mentioned in content,
+// excluding the sender, in order of first mention
+func parseMentions(content string, group *models.Group, sender string) []string {
+	var mentions []string
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		username := match[1]
+		if username == sender || !group.IsMember(username) || containsString(mentions, username) {
+			continue
+		}
+		mentions = append(mentions, username)
+	}
+	return mentions
+}
+
+// mentionRecipients returns the connected clients of everyone mentioned in
+// message. Callers must hold h.mu.
+func (h *Hub) mentionRecipients(message *models.Message) []*Client {
+	clients := []*Client{}
+	for _, username := range message.Mentions {
+		clients = append(clients, h.clientsOf(username)...)
+	}
+	return clients
+}
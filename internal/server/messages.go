@@ -0,0 +1,280 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"whatsdown/internal/models"
+)
+
+// Message deletion scopes
+const (
+	DeleteForMe       = "me"
+	DeleteForEveryone = "everyone"
+)
+
+var (
+	errMessageNotFound = errors.New("message not found")
+	errNotAllowed      = errors.New("not allowed")
+)
+
+// visibleMessages returns snapshots of the messages username hasn't deleted
+// for themselves. Callers must hold h.mu.
+func visibleMessages(messages []*models.Message, username string) []*models.Message {
+	visible := make([]*models.Message, 0, len(messages))
+	for _, message := range messages {
+		if !message.HiddenFrom(username) {
+			visible = append(visible, message.Snapshot())
+		}
+	}
+	return visible
+}
+
+// lastVisibleMessage returns the most recent message username hasn't hidden
+func lastVisibleMessage(messages []*models.Message, username string) *models.Message {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if !messages[i].HiddenFrom(username) {
+			return messages[i]
+		}
+	}
+	return nil
+}
+
+// canAccessMessage reports whether username can see message. Callers must hold h.mu.
+func (h *Hub) canAccessMessage(message *models.Message, username string) bool {
+	switch {
+	case message.GroupID != "":
+		group, exists := h.Groups[message.GroupID]
+		return exists && group.IsMember(username)
+	case message.ChannelID != "":
+		_, exists := h.Channels[message.ChannelID]
+		return exists
+	default:
+		return message.From == username || message.To == username
+	}
+}
+
+// canModerateMessage reports whether username may act on message for everyone:
+// its sender, a group admin, or the channel owner. Callers must hold h.mu.
+func (h *Hub) canModerateMessage(message *models.Message, username string) bool {
+	if message.From == username {
+		return true
+	}
+	switch {
+	case message.GroupID != "":
+		group, exists := h.Groups[message.GroupID]
+		return exists && group.IsAdmin(username)
+	case message.ChannelID != "":
+		channel, exists := h.Channels[message.ChannelID]
+		return exists && channel.Owner == username
+	}
+	return false
+}
+
+// participantClients returns the connected clients of everyone in message's
+// conversation. Callers must hold h.mu.
+func (h *Hub) participantClients(message *models.Message) []*Client {
+	var usernames []string
+	switch {
+	case message.GroupID != "":
+		if group, exists := h.Groups[message.GroupID]; exists {
+			usernames = group.Members
+		}
+	case message.ChannelID != "":
+		if channel, exists := h.Channels[message.ChannelID]; exists {
+			usernames = append(usernames, channel.Owner)
+			usernames = append(usernames, channel.Publishers...)
+			for username := range h.Subscriptions[channel.ID] {
+				if !channel.CanPublish(username) {
+					usernames = append(usernames, username)
+				}
+			}
+		}
+	default:
+		usernames = []string{message.From, message.To}
+	}
+
+	clients := []*Client{}
+	for _, username := range usernames {
+		clients = append(clients, h.clientsOf(username)...)
+	}
+	return clients
+}
+
+// DeleteMessage deletes a message for username only, or tombstones it for
+// everyone, notifying the affected clients with a "deleted" event
+func (h *Hub) DeleteMessage(messageID, username, scope string) error {
+	h.mu.Lock()
+
+	message, exists := h.message(messageID)
+	if !exists || !h.canAccessMessage(message, username) {
+		h.mu.Unlock()
+		return errMessageNotFound
+	}
+
+	var recipients []*Client
+	switch scope {
+	case DeleteForMe:
+		if !message.HiddenFrom(username) {
+			message.HiddenFor = append(message.HiddenFor, username)
+		}
+		recipients = h.clientsOf(username)
+
+	case DeleteForEveryone:
+		if !h.canModerateMessage(message, username) {
+			h.mu.Unlock()
+			return errNotAllowed
+		}
+		recipients = h.tombstone(message)
+	}
+	h.mu.Unlock()
+
+	event := &models.DeleteEvent{
+		MessageID: messageID,
+		Scope:     scope,
+		DeletedBy: username,
+	}
+	for _, client := range recipients {
+		h.sendToClient(client, "deleted", event)
+	}
+	return nil
+}
+
+// tombstone clears a message's content for everyone and returns the clients
+// to notify. Callers must hold h.mu.
+func (h *Hub) tombstone(message *models.Message) []*Client {
+	message.Deleted = true
+	h.clearContent(message)
+	return h.participantClients(message)
+}
+
+// clearContent drops everything a deleted or expired message said, keeping
+// only what's needed to show where it was. Callers must hold h.mu.
+func (h *Hub) clearContent(message *models.Message) {
+	message.Content = ""
+	message.Encrypted = nil
+	message.Entities = nil
+	message.Mentions = nil
+	message.Reactions = nil
+	message.Poll = nil
+	message.Location = nil
+	message.Contact = nil
+	message.Voice = nil
+	message.Sticker = nil
+	message.Attachments = nil
+	message.Translations = nil
+	h.unpinDeleted(message)
+	h.clearQuotes(message)
+}
+
+// clearQuotes blanks the snippet of message in replies that quote it, so its
+// text doesn't live on in them. Callers must hold h.mu.
+func (h *Hub) clearQuotes(message *models.Message) {
+	for _, reply := range h.conversation(message.ConvKey()) {
+		if reply.ReplyTo != nil && reply.ReplyTo.ID == message.ID {
+			// Replaced rather than changed, as snapshots share the quote
+			reply.ReplyTo = &models.QuotedMessage{ID: message.ID, From: message.From, Deleted: true}
+		}
+	}
+}
+
+// messageErrorStatus maps message errors to HTTP status codes
+func messageErrorStatus(err error) int {
+	switch err {
+	case errMessageNotFound:
+		return http.StatusNotFound
+	case errNotAllowed:
+		return http.StatusForbidden
+	case errTooManyPins:
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// HandleMessage handles the /api/messages/{id} subtree:
+//
+//	DELETE /api/messages/{id}?scope=me|everyone
+//	GET    /api/messages/{id}/thread
+//	GET    /api/messages/{id}/info
+//	POST   /api/messages/{id}/pin
+//	DELETE /api/messages/{id}/pin
+//	POST   /api/messages/{id}/star
+//	DELETE /api/messages/{id}/star
+//	POST   /api/messages/{id}/report
+func (h *HTTPHandlers) HandleMessage(w http.ResponseWriter, r *http.Request) {
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/messages/"), "/"), "/")
+	messageID := parts[0]
+	if messageID == "" {
+		http.Error(w, "Message ID required", http.StatusBadRequest)
+		return
+	}
+
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodDelete:
+		scope := r.URL.Query().Get("scope")
+		if scope == "" {
+			scope = DeleteForMe
+		}
+		if scope != DeleteForMe && scope != DeleteForEveryone {
+			http.Error(w, "scope must be \"me\" or \"everyone\"", http.StatusBadRequest)
+			return
+		}
+
+		if err := h.Hub.DeleteMessage(messageID, session.Username, scope); err != nil {
+			http.Error(w, err.Error(), messageErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case action == "thread" && r.Method == http.MethodGet:
+		thread, err := h.Hub.GetThread(messageID, session.Username)
+		if err != nil {
+			http.Error(w, err.Error(), messageErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(thread)
+
+	case action == "info" && r.Method == http.MethodGet:
+		info, err := h.Hub.GetDeliveryInfo(messageID, session.Username)
+		if err != nil {
+			http.Error(w, err.Error(), messageErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+
+	case action == "pin" && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		if err := h.Hub.PinMessage(messageID, session.Username, r.Method == http.MethodPost); err != nil {
+			http.Error(w, err.Error(), messageErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case action == "report" && r.Method == http.MethodPost:
+		h.handleReport(w, r, messageID, session.Username)
+
+	case action == "star" && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		if err := h.Hub.StarMessage(messageID, session.Username, r.Method == http.MethodPost); err != nil {
+			http.Error(w, err.Error(), messageErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
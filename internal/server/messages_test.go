@@ -0,0 +1,45 @@
+package server
+
+import (
+	"testing"
+
+	"whatsdown/internal/models"
+)
+
+func TestDeleteForEveryoneClearsFormatting(t *testing.T) {
+	hub := newTestHub(t, "alice", "bob")
+	hub.handleInboundMessageWithSender("alice", &models.InboundMessage{To: "bob", Content: "*hi* @bob see https://example.com"})
+	message := lastMessage(t, hub, &models.Message{From: "alice", To: "bob"})
+	if len(message.Entities) == 0 {
+		t.Fatal("message has no entities to clear")
+	}
+
+	if err := hub.DeleteMessage(message.ID, "alice", DeleteForEveryone); err != nil {
+		t.Fatal(err)
+	}
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	if message.Content != "" || message.Entities != nil || message.Mentions != nil {
+		t.Errorf("deleted message kept %q, entities %v, mentions %v", message.Content, message.Entities, message.Mentions)
+	}
+}
+
+func TestDeleteForEveryoneClearsQuotes(t *testing.T) {
+	hub := newTestHub(t, "alice", "bob")
+	hub.handleInboundMessageWithSender("alice", &models.InboundMessage{To: "bob", Content: "my secret"})
+	quoted := lastMessage(t, hub, &models.Message{From: "alice", To: "bob"})
+	hub.handleInboundMessageWithSender("bob", &models.InboundMessage{To: "alice", Content: "what?", ReplyToID: quoted.ID})
+	reply := lastMessage(t, hub, &models.Message{From: "bob", To: "alice"})
+	if reply.ReplyTo == nil || reply.ReplyTo.Snippet != "my secret" {
+		t.Fatalf("reply quotes %+v", reply.ReplyTo)
+	}
+
+	if err := hub.DeleteMessage(quoted.ID, "alice", DeleteForEveryone); err != nil {
+		t.Fatal(err)
+	}
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	if reply.ReplyTo.Snippet != "" || !reply.ReplyTo.Deleted || reply.ReplyTo.ID != quoted.ID {
+		t.Errorf("reply still quotes %+v", reply.ReplyTo)
+	}
+}
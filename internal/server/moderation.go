@@ -0,0 +1,355 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"whatsdown/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// Report statuses
+const (
+	ReportOpen       = "open"
+	ReportDismissed  = "dismissed"
+	ReportDeleted    = "deleted"    // message removed for everyone
+	ReportSanctioned = "sanctioned" // sender suspended
+)
+
+// Maximum length of a report reason in runes
+const maxReportReasonRunes = 500
+
+var (
+	errReportNotFound = errors.New("report not found")
+	errReportResolved = errors.New("report already resolved")
+)
+
+// ModerationQueue holds user reports awaiting review and the suspensions
+// moderators have imposed
+type ModerationQueue struct {
+	reports     []*models.Report
+	suspensions map[string]time.Time
+	mu          sync.RWMutex
+}
+
+// ReportRequest files a report against a message
+type ReportRequest struct {
+	Reason string `json:"reason"`
+}
+
+// SanctionRequest suspends a reported message's sender
+type SanctionRequest struct {
+	Duration string `json:"duration"` // Go duration, e.g. "24h"
+}
+
+// NewModerationQueue creates an empty moderation queue
+func NewModerationQueue() *ModerationQueue {
+	return &ModerationQueue{
+		suspensions: make(map[string]time.Time),
+	}
+}
+
+// File adds a report for a snapshot of the message as the reporter saw it.
+// Reporting the same message twice returns the existing open report.
+func (q *ModerationQueue) File(reporter, reason string, message *models.Message) *models.Report {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, report := range q.reports {
+		if report.MessageID == message.ID && report.Reporter == reporter && report.Status == ReportOpen {
+			return report.Snapshot()
+		}
+	}
+
+	report := &models.Report{
+		ID:        uuid.New().String(),
+		MessageID: message.ID,
+		Sender:    message.From,
+		Reporter:  reporter,
+		Reason:    reason,
+		Message:   message,
+		Status:    ReportOpen,
+		CreatedAt: time.Now(),
+	}
+	q.reports = append(q.reports, report)
+	return report.Snapshot()
+}
+
+// List returns reports with the given status (all if empty), oldest first
+func (q *ModerationQueue) List(status string) []*models.Report {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	reports := []*models.Report{}
+	for _, report := range q.reports {
+		if status == "" || report.Status == status {
+			reports = append(reports, report.Snapshot())
+		}
+	}
+	sort.SliceStable(reports, func(i, j int) bool {
+		return reports[i].CreatedAt.Before(reports[j].CreatedAt)
+	})
+	return reports
+}
+
+// Get returns a report by ID
+func (q *ModerationQueue) Get(id string) (*models.Report, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	report := q.find(id)
+	if report == nil {
+		return nil, errReportNotFound
+	}
+	return report.Snapshot(), nil
+}
+
+// Resolve closes an open report. Deleting a message also closes every other
+// open report against it.
+func (q *ModerationQueue) Resolve(id, moderator, status string) (*models.Report, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	report := q.find(id)
+	if report == nil {
+		return nil, errReportNotFound
+	}
+	if report.Status != ReportOpen {
+		return nil, errReportResolved
+	}
+
+	now := time.Now()
+	for _, other := range q.reports {
+		if other == report || (status == ReportDeleted && other.MessageID == report.MessageID && other.Status == ReportOpen) {
+			other.Status = status
+			other.ResolvedBy = moderator
+			other.ResolvedAt = &now
+		}
+	}
+	return report.Snapshot(), nil
+}
+
+// Suspend blocks username from logging in until the given time
+func (q *ModerationQueue) Suspend(username string, until time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.suspensions[username] = until
+}
+
+// Suspended reports whether username is suspended and until when
+func (q *ModerationQueue) Suspended(username string) (time.Time, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	until, exists := q.suspensions[username]
+	if !exists || time.Now().After(until) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// find returns the report with id. Callers must hold q.mu.
+func (q *ModerationQueue) find(id string) *models.Report {
+	for _, report := range q.reports {
+		if report.ID == id {
+			return report
+		}
+	}
+	return nil
+}
+
+// ReportableMessage returns a snapshot of a message username can see, for filing a report
+func (h *Hub) ReportableMessage(messageID, username string) (*models.Message, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	message, exists := h.message(messageID)
+	if !exists || !h.canAccessMessage(message, username) || message.Deleted || message.HiddenFrom(username) {
+		return nil, errMessageNotFound
+	}
+	if message.From == username {
+		return nil, errNotAllowed
+	}
+	return message.Snapshot(), nil
+}
+
+// RemoveMessage tombstones a message for everyone on a moderator's behalf
+func (h *Hub) RemoveMessage(messageID, moderator string) error {
+	h.mu.Lock()
+
+	message, exists := h.message(messageID)
+	if !exists {
+		h.mu.Unlock()
+		return errMessageNotFound
+	}
+	if message.Deleted {
+		h.mu.Unlock()
+		return nil
+	}
+	recipients := h.tombstone(message)
+	h.mu.Unlock()
+
+	event := &models.DeleteEvent{
+		MessageID: messageID,
+		Scope:     DeleteForEveryone,
+		DeletedBy: moderator,
+	}
+	for _, client := range recipients {
+		h.sendToClient(client, "deleted", event)
+	}
+	return nil
+}
+
+// reportErrorStatus maps moderation errors to HTTP status codes
+func reportErrorStatus(err error) int {
+	switch err {
+	case errReportNotFound, errMessageNotFound:
+		return http.StatusNotFound
+	case errReportResolved:
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// handleReport serves POST /api/messages/{id}/report
+func (h *HTTPHandlers) handleReport(w http.ResponseWriter, r *http.Request, messageID, username string) {
+	var req ReportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	reason := strings.TrimSpace(req.Reason)
+	if reason == "" || utf8.RuneCountInString(reason) > maxReportReasonRunes {
+		http.Error(w, "Reason must be between 1 and 500 characters", http.StatusBadRequest)
+		return
+	}
+
+	message, err := h.Hub.ReportableMessage(messageID, username)
+	if err != nil {
+		http.Error(w, err.Error(), messageErrorStatus(err))
+		return
+	}
+
+	report := h.Moderation.File(username, reason, message)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(report)
+}
+
+// HandleReports handles GET /api/admin/reports?status=open|dismissed|deleted|sanctioned
+func (h *HTTPHandlers) HandleReports(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, ok := h.requireAdmin(w, r); !ok {
+		return
+	}
+
+	reports := h.Moderation.List(r.URL.Query().Get("status"))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+// HandleReport handles the /api/admin/reports/{id} subtree:
+//
+//	GET  /api/admin/reports/{id}
+//	POST /api/admin/reports/{id}/dismiss
+//	POST /api/admin/reports/{id}/delete   - remove the message for everyone
+//	POST /api/admin/reports/{id}/sanction - suspend the sender
+func (h *HTTPHandlers) HandleReport(w http.ResponseWriter, r *http.Request) {
+	admin, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/reports/"), "/"), "/")
+	reportID := parts[0]
+	if reportID == "" {
+		http.Error(w, "Report ID required", http.StatusBadRequest)
+		return
+	}
+
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	var result *models.Report
+	var err error
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		result, err = h.Moderation.Get(reportID)
+
+	case action == "dismiss" && r.Method == http.MethodPost:
+		result, err = h.Moderation.Resolve(reportID, admin.Username, ReportDismissed)
+
+	case action == "delete" && r.Method == http.MethodPost:
+		if result, err = h.Moderation.Get(reportID); err != nil {
+			break
+		}
+		if result.Status != ReportOpen {
+			err = errReportResolved
+			break
+		}
+		if err = h.Hub.RemoveMessage(result.MessageID, admin.Username); err != nil {
+			break
+		}
+		result, err = h.Moderation.Resolve(reportID, admin.Username, ReportDeleted)
+
+	case action == "sanction" && r.Method == http.MethodPost:
+		var req SanctionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		duration, parseErr := time.ParseDuration(req.Duration)
+		if parseErr != nil || duration <= 0 {
+			http.Error(w, "Duration must be a positive Go duration such as \"24h\"", http.StatusBadRequest)
+			return
+		}
+
+		if result, err = h.Moderation.Resolve(reportID, admin.Username, ReportSanctioned); err != nil {
+			break
+		}
+		h.suspend(result.Sender, duration)
+		h.Audit.Record(AuditAdminAction, admin.Username, clientIP(r), fmt.Sprintf("suspend %s for %s (report %s)", result.Sender, duration, reportID))
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), reportErrorStatus(err))
+		return
+	}
+	if action == "dismiss" || action == "delete" {
+		h.Audit.Record(AuditAdminAction, admin.Username, clientIP(r), fmt.Sprintf("%s report %s", action, reportID))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// suspend blocks username from logging in for duration and ends their
+// current sessions and connection
+func (h *HTTPHandlers) suspend(username string, duration time.Duration) {
+	h.Moderation.Suspend(username, time.Now().Add(duration))
+	sessionStore.DeleteSessionByUsername(username)
+	h.Hub.DisconnectUser(username, CloseSuspended, "account suspended")
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// mp4Track describes one track of an MP4/QuickTime file
+type mp4Track struct {
+	Handler string // "soun" or "vide"
+	Codec   string
+	Width   int
+	Height  int
+}
+
+// mp4Info is what the server reads from an MP4's moov box
+type mp4Info struct {
+	Duration time.Duration
+	Tracks   []mp4Track
+}
+
+// Codec names for MP4 sample entry types
+var mp4Codecs = map[string]string{
+	"mp4a": "aac",
+	"alac": "alac",
+	"Opus": "opus",
+	"fLaC": "flac",
+	"ac-3": "ac3",
+	"ec-3": "eac3",
+	"avc1": "h264",
+	"avc3": "h264",
+	"hvc1": "hevc",
+	"hev1": "hevc",
+	"vp09": "vp9",
+	"av01": "av1",
+}
+
+// isMP4 reports whether data starts with an ftyp box
+func isMP4(data []byte) bool {
+	return len(data) >= 8 && string(data[4:8]) == "ftyp"
+}
+
+// walkMP4Boxes calls fn with the type and body of each box in data, stopping
+// early if fn returns false
+func walkMP4Boxes(data []byte, fn func(kind string, body []byte) bool) {
+	for offset := 0; offset+8 <= len(data); {
+		size := uint64(binary.BigEndian.Uint32(data[offset : offset+4]))
+		kind := string(data[offset+4 : offset+8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			// Box extends to the end of the file
+			size = uint64(len(data) - offset)
+		case 1:
+			if offset+16 > len(data) {
+				return
+			}
+			size = binary.BigEndian.Uint64(data[offset+8 : offset+16])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)-offset) {
+			return
+		}
+		if !fn(kind, data[offset+int(header):offset+int(size)]) {
+			return
+		}
+		offset += int(size)
+	}
+}
+
+// findMP4Box follows path through nested boxes and returns the body of the
+// first match
+func findMP4Box(data []byte, path ...string) []byte {
+	for _, kind := range path {
+		var found []byte
+		walkMP4Boxes(data, func(k string, body []byte) bool {
+			if k == kind {
+				found = body
+				return false
+			}
+			return true
+		})
+		if found == nil {
+			return nil
+		}
+		data = found
+	}
+	return data
+}
+
+// probeMP4 reads the duration and track codecs from the moov box
+func probeMP4(data []byte) (*mp4Info, error) {
+	if !isMP4(data) {
+		return nil, errUnsupportedAudio
+	}
+	moov := findMP4Box(data, "moov")
+	mvhd := findMP4Box(moov, "mvhd")
+	if len(mvhd) < 20 {
+		return nil, errUnsupportedAudio
+	}
+
+	info := &mp4Info{}
+	var timescale, duration uint64
+	if mvhd[0] == 1 {
+		if len(mvhd) < 32 {
+			return nil, errUnsupportedAudio
+		}
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[20:24]))
+		duration = binary.BigEndian.Uint64(mvhd[24:32])
+	} else {
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:20]))
+	}
+	var ok bool
+	if info.Duration, ok = mediaDuration(duration, timescale); !ok {
+		return nil, errUnsupportedAudio
+	}
+
+	walkMP4Boxes(moov, func(kind string, trak []byte) bool {
+		if kind != "trak" {
+			return true
+		}
+		track := mp4Track{}
+		if hdlr := findMP4Box(trak, "mdia", "hdlr"); len(hdlr) >= 12 {
+			track.Handler = string(hdlr[8:12])
+		}
+		// stsd: version/flags, entry count, then the first sample entry
+		if stsd := findMP4Box(trak, "mdia", "minf", "stbl", "stsd"); len(stsd) >= 16 {
+			format := string(stsd[12:16])
+			track.Codec = mp4Codecs[format]
+			if track.Codec == "" {
+				track.Codec = strings.ToLower(strings.TrimSpace(format))
+			}
+			// Visual sample entries store width and height 24 bytes into their fields
+			if track.Handler == "vide" && len(stsd) >= 16+36 {
+				track.Width = int(binary.BigEndian.Uint16(stsd[16+24 : 16+26]))
+				track.Height = int(binary.BigEndian.Uint16(stsd[16+26 : 16+28]))
+			}
+		}
+		info.Tracks = append(info.Tracks, track)
+		return true
+	})
+	return info, nil
+}
+
+// track returns the first track with the given handler
+func (i *mp4Info) track(handler string) (mp4Track, bool) {
+	for _, track := range i.Tracks {
+		if track.Handler == handler {
+			return track, true
+		}
+	}
+	return mp4Track{}, false
+}
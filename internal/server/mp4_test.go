@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// mp4Box wraps body in a box of the given type
+func mp4Box(kind string, body ...[]byte) []byte {
+	var content []byte
+	for _, b := range body {
+		content = append(content, b...)
+	}
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(content)))
+	box = append(box, kind...)
+	return append(box, content...)
+}
+
+// mp4Trak builds a track with a handler and a single sample entry
+func mp4Trak(handler, format string) []byte {
+	hdlr := make([]byte, 24)
+	copy(hdlr[8:], handler)
+	entry := make([]byte, 36)
+	binary.BigEndian.PutUint16(entry[24:], 1920)
+	binary.BigEndian.PutUint16(entry[26:], 1080)
+	stsd := append(make([]byte, 8), binary.BigEndian.AppendUint32(nil, uint32(8+len(entry)))...)
+	stsd = append(append(stsd, format...), entry...)
+	stbl := mp4Box("stbl", mp4Box("stsd", stsd))
+	return mp4Box("trak", mp4Box("mdia", mp4Box("hdlr", hdlr), mp4Box("minf", stbl)))
+}
+
+// mp4File builds an MP4 with a version 0 mvhd and the given tracks
+func mp4File(timescale, duration uint32, traks ...[]byte) []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], timescale)
+	binary.BigEndian.PutUint32(mvhd[16:], duration)
+	moov := append([][]byte{mp4Box("mvhd", mvhd)}, traks...)
+	return append(mp4Box("ftyp", []byte("isom\x00\x00\x02\x00")), mp4Box("moov", moov...)...)
+}
+
+func TestProbeMP4(t *testing.T) {
+	data := mp4File(90000, 900000, mp4Trak("vide", "avc1"), mp4Trak("soun", "mp4a"), mp4Trak("soun", "xyz "))
+	info, err := probeMP4(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Duration != 10*time.Second {
+		t.Errorf("Duration = %v, want 10s", info.Duration)
+	}
+	want := []mp4Track{
+		{Handler: "vide", Codec: "h264", Width: 1920, Height: 1080},
+		{Handler: "soun", Codec: "aac"},
+		{Handler: "soun", Codec: "xyz"},
+	}
+	if len(info.Tracks) != len(want) {
+		t.Fatalf("Tracks = %+v, want %+v", info.Tracks, want)
+	}
+	for i := range want {
+		if info.Tracks[i] != want[i] {
+			t.Errorf("track %d = %+v, want %+v", i, info.Tracks[i], want[i])
+		}
+	}
+
+	bad := map[string][]byte{
+		"no ftyp":        mp4Box("moov"),
+		"no moov":        mp4Box("ftyp", []byte("isom")),
+		"zero timescale": mp4File(0, 100),
+		"box past end":   append(mp4Box("ftyp", []byte("isom")), 0xFF, 0xFF, 0xFF, 0xFF, 'm', 'o', 'o', 'v'),
+		"huge duration":  mp4File(1, 1<<32-1),
+	}
+	for name, data := range bad {
+		if info, err := probeMP4(data); err == nil {
+			t.Errorf("%s: probeMP4 = %+v, want error", name, info)
+		}
+	}
+}
+
+func FuzzProbeMP4(f *testing.F) {
+	f.Add(mp4File(1000, 5000, mp4Trak("soun", "mp4a")))
+	f.Add(mp4File(600, 60, mp4Trak("vide", "hvc1")))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		info, err := probeMP4(data)
+		if err != nil {
+			return
+		}
+		if info.Duration < 0 {
+			t.Errorf("probeMP4 Duration = %v", info.Duration)
+		}
+	})
+}
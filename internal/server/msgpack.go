@@ -0,0 +1,342 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+
+	"whatsdown/internal/models"
+
+	"github.com/gorilla/websocket"
+)
+
+// msgpackCodec sends envelopes as binary MessagePack frames: a map with the
+// same keys as the JSON envelope ("type", "seq" when numbered, "payload"),
+// whose payload has the same shape as its JSON form. Whole numbers are sent
+// as integers.
+type msgpackCodec struct{}
+
+// Nesting limit when decoding, so a hostile frame can't exhaust the stack
+const msgpackMaxDepth = 64
+
+var errMsgpackMalformed = errors.New("malformed MessagePack")
+
+// Sizes of the argument following each format byte that has a fixed-size one
+var msgpackArgSizes = map[byte]int{
+	0xc4: 1, 0xc5: 2, 0xc6: 4, // bin
+	0xca: 4, 0xcb: 8, // float
+	0xcc: 1, 0xcd: 2, 0xce: 4, 0xcf: 8, // uint
+	0xd0: 1, 0xd1: 2, 0xd2: 4, 0xd3: 8, // int
+	0xd9: 1, 0xda: 2, 0xdb: 4, // str
+	0xdc: 2, 0xdd: 4, // array
+	0xde: 2, 0xdf: 4, // map
+}
+
+func (c msgpackCodec) Marshal(msg *models.WSMessage) ([]byte, error) {
+	b := getEncodeBuffer()
+	defer putEncodeBuffer(b)
+	if err := encodeMsgpackPayload(b, msg.Payload); err != nil {
+		return nil, err
+	}
+	return c.MarshalEnvelope(msg.Type, msg.Seq, b.scratch), nil
+}
+
+func (msgpackCodec) MarshalPayload(payload interface{}) ([]byte, error) {
+	b := getEncodeBuffer()
+	defer putEncodeBuffer(b)
+	if err := encodeMsgpackPayload(b, payload); err != nil {
+		return nil, err
+	}
+	return bytes.Clone(b.scratch), nil
+}
+
+// MarshalEnvelope writes the envelope map with its keys sorted, as
+// appendMsgpack would
+func (msgpackCodec) MarshalEnvelope(msgType string, seq int64, payload []byte) []byte {
+	fields := 2
+	if seq != 0 {
+		fields++
+	}
+	// The keys, a 9-byte seq and the type's header, besides the map's
+	data := make([]byte, 0, len(payload)+len(msgType)+32)
+	data = appendMsgpackLength(data, fields, 0x80, 0xde)
+	data = appendMsgpack(data, "payload")
+	data = append(data, payload...)
+	if seq != 0 {
+		data = appendMsgpack(data, "seq")
+		data = appendMsgpackInt(data, seq)
+	}
+	data = appendMsgpack(data, "type")
+	return appendMsgpack(data, msgType)
+}
+
+// encodeMsgpackPayload encodes payload into b.scratch. Payloads are structs
+// with JSON tags; going through JSON gives them the same field names in both
+// encodings.
+func encodeMsgpackPayload(b *encodeBuffer, payload interface{}) error {
+	payloadJSON, err := b.encodeJSON(payload)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(payloadJSON))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+	b.scratch = appendMsgpack(b.scratch[:0], value)
+	return nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, msg *models.WSMessage) error {
+	value, rest, err := parseMsgpack(data, 0)
+	if err != nil {
+		return err
+	}
+	envelope, ok := value.(map[string]interface{})
+	if !ok || len(rest) != 0 {
+		return errMsgpackMalformed
+	}
+
+	msg.Type, _ = envelope["type"].(string)
+	switch seq := envelope["seq"].(type) {
+	case int64:
+		msg.Seq = seq
+	case uint64:
+		msg.Seq = int64(seq)
+	}
+	msg.Payload = envelope["payload"]
+	return nil
+}
+
+func (msgpackCodec) MarshalBatch(frames [][]byte) []byte {
+	data := appendMsgpackLength(nil, 2, 0x80, 0xde)
+	data = appendMsgpack(data, "payload")
+	data = appendMsgpackLength(data, len(frames), 0x90, 0xdc)
+	for _, frame := range frames {
+		data = append(data, frame...)
+	}
+	data = appendMsgpack(data, "type")
+	return appendMsgpack(data, "batch")
+}
+
+// Envelope keys are sorted, so a batch is the only envelope ending in type
+// "batch"
+var msgpackBatchSuffix = appendMsgpack(appendMsgpack(nil, "type"), "batch")
+
+func (msgpackCodec) IsBatch(data []byte) bool {
+	return bytes.HasSuffix(data, msgpackBatchSuffix)
+}
+
+func (msgpackCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+// appendMsgpack encodes a value decoded from JSON, or an int64
+func appendMsgpack(data []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(data, 0xc0)
+	case bool:
+		if v {
+			return append(data, 0xc3)
+		}
+		return append(data, 0xc2)
+	case int64:
+		return appendMsgpackInt(data, v)
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return appendMsgpackInt(data, n)
+		}
+		f, _ := v.Float64()
+		data = append(data, 0xcb)
+		return binary.BigEndian.AppendUint64(data, math.Float64bits(f))
+	case string:
+		n := len(v)
+		switch {
+		case n < 32:
+			data = append(data, 0xa0|byte(n))
+		case n <= math.MaxUint8:
+			data = append(data, 0xd9, byte(n))
+		case n <= math.MaxUint16:
+			data = binary.BigEndian.AppendUint16(append(data, 0xda), uint16(n))
+		default:
+			data = binary.BigEndian.AppendUint32(append(data, 0xdb), uint32(n))
+		}
+		return append(data, v...)
+	case []interface{}:
+		data = appendMsgpackLength(data, len(v), 0x90, 0xdc)
+		for _, item := range v {
+			data = appendMsgpack(data, item)
+		}
+		return data
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		data = appendMsgpackLength(data, len(v), 0x80, 0xde)
+		for _, key := range keys {
+			data = appendMsgpack(data, key)
+			data = appendMsgpack(data, v[key])
+		}
+		return data
+	}
+	return append(data, 0xc0)
+}
+
+// appendMsgpackInt encodes n in the smallest integer format that holds it
+func appendMsgpackInt(data []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		return append(data, byte(n))
+	case n >= -32 && n < 0:
+		return append(data, byte(n))
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		return append(data, 0xd0, byte(n))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		return binary.BigEndian.AppendUint16(append(data, 0xd1), uint16(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(data, 0xd2), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(data, 0xd3), uint64(n))
+}
+
+// appendMsgpackLength writes an array or map header: the fix format for
+// short lengths, else the 16- or 32-bit one (wide + 1)
+func appendMsgpackLength(data []byte, n int, fix, wide byte) []byte {
+	switch {
+	case n < 16:
+		return append(data, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(data, wide), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(data, wide+1), uint32(n))
+}
+
+// parseMsgpack decodes one value from the front of data, returning what
+// follows it. Integers decode to int64 (uint64 above its range), floats to
+// float64, binary to []byte and maps, whose keys must be strings, to
+// map[string]interface{}. Extension types aren't supported.
+func parseMsgpack(data []byte, depth int) (interface{}, []byte, error) {
+	if len(data) == 0 || depth > msgpackMaxDepth {
+		return nil, nil, errMsgpackMalformed
+	}
+	b, data := data[0], data[1:]
+
+	switch {
+	case b <= 0x7f:
+		return int64(b), data, nil
+	case b >= 0xe0:
+		return int64(int8(b)), data, nil
+	case b&0xe0 == 0xa0:
+		return parseMsgpackString(data, int(b&0x1f))
+	case b&0xf0 == 0x90:
+		return parseMsgpackArray(data, int(b&0x0f), depth)
+	case b&0xf0 == 0x80:
+		return parseMsgpackMap(data, int(b&0x0f), depth)
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, data, nil
+	case 0xc2:
+		return false, data, nil
+	case 0xc3:
+		return true, data, nil
+	}
+	size, ok := msgpackArgSizes[b]
+	if !ok || len(data) < size {
+		return nil, nil, errMsgpackMalformed
+	}
+	var arg uint64
+	for _, c := range data[:size] {
+		arg = arg<<8 | uint64(c)
+	}
+	data = data[size:]
+
+	switch b {
+	case 0xc4, 0xc5, 0xc6:
+		if arg > uint64(len(data)) {
+			return nil, nil, errMsgpackMalformed
+		}
+		return append([]byte(nil), data[:arg]...), data[arg:], nil
+	case 0xca:
+		return float64(math.Float32frombits(uint32(arg))), data, nil
+	case 0xcb:
+		return math.Float64frombits(arg), data, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		if arg > math.MaxInt64 {
+			return arg, data, nil
+		}
+		return int64(arg), data, nil
+	case 0xd0:
+		return int64(int8(arg)), data, nil
+	case 0xd1:
+		return int64(int16(arg)), data, nil
+	case 0xd2:
+		return int64(int32(arg)), data, nil
+	case 0xd3:
+		return int64(arg), data, nil
+	case 0xd9, 0xda, 0xdb:
+		return parseMsgpackString(data, int(arg))
+	case 0xdc, 0xdd:
+		return parseMsgpackArray(data, int(arg), depth)
+	}
+	return parseMsgpackMap(data, int(arg), depth)
+}
+
+func parseMsgpackString(data []byte, n int) (interface{}, []byte, error) {
+	if n < 0 || n > len(data) {
+		return nil, nil, errMsgpackMalformed
+	}
+	return string(data[:n]), data[n:], nil
+}
+
+func parseMsgpackArray(data []byte, n int, depth int) (interface{}, []byte, error) {
+	// Every element takes at least a byte
+	if n < 0 || n > len(data) {
+		return nil, nil, errMsgpackMalformed
+	}
+	items := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		var item interface{}
+		var err error
+		item, data, err = parseMsgpack(data, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		items = append(items, item)
+	}
+	return items, data, nil
+}
+
+func parseMsgpackMap(data []byte, n int, depth int) (interface{}, []byte, error) {
+	if n < 0 || n > len(data) {
+		return nil, nil, errMsgpackMalformed
+	}
+	fields := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		var key, value interface{}
+		var err error
+		key, data, err = parseMsgpack(data, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, nil, errMsgpackMalformed
+		}
+		value, data, err = parseMsgpack(data, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		fields[name] = value
+	}
+	return fields, data, nil
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+// Mute lengths clients can choose; zero means until unmuted
+var muteDurations = map[string]time.Duration{
+	"1h":      time.Hour,
+	"8h":      8 * time.Hour,
+	"forever": 0,
+}
+
+// MuteRequest mutes a conversation for one of muteDurations
+type MuteRequest struct {
+	Duration string `json:"duration"`
+}
+
+// SetMute mutes (or, with muted false, unmutes) a conversation for username
+// and syncs the change to their client. mute identifies the conversation.
+func (h *Hub) SetMute(username, convKey string, mute *models.Mute, muted bool, duration time.Duration) *models.Mute {
+	h.mu.Lock()
+
+	mutes, exists := h.Mutes[username]
+	if !exists {
+		mutes = make(map[string]time.Time)
+		h.Mutes[username] = mutes
+	}
+
+	var until time.Time
+	if duration > 0 {
+		until = time.Now().Add(duration)
+	}
+	if muted {
+		mutes[convKey] = until
+	} else {
+		delete(mutes, convKey)
+	}
+	h.describeMute(username, convKey, mute)
+
+	clients := h.clientsOf(username)
+	h.mu.Unlock()
+
+	for _, client := range clients {
+		h.sendToClient(client, "mute", mute)
+	}
+	return mute
+}
+
+// GetMute fills in username's current mute state for a conversation
+func (h *Hub) GetMute(username, convKey string, mute *models.Mute) *models.Mute {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	h.describeMute(username, convKey, mute)
+	return mute
+}
+
+// describeMute sets mute's Muted and Until fields. Callers must hold h.mu.
+func (h *Hub) describeMute(username, convKey string, mute *models.Mute) {
+	until, muted := h.muteUntil(username, convKey)
+	mute.Muted = muted
+	mute.Until = nil
+	if muted && !until.IsZero() {
+		mute.Until = &until
+	}
+}
+
+// muteUntil reports whether username has muted a conversation and until when;
+// a zero time means indefinitely. Callers must hold h.mu.
+func (h *Hub) muteUntil(username, convKey string) (time.Time, bool) {
+	until, exists := h.Mutes[username][convKey]
+	if !exists || (!until.IsZero() && time.Now().After(until)) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// isMuted reports whether username currently has a conversation muted.
+// Callers must hold h.mu.
+func (h *Hub) isMuted(username, convKey string) bool {
+	_, muted := h.muteUntil(username, convKey)
+	return muted
+}
+
+// handleMute serves GET, PUT and DELETE on a conversation's /mute path. mute
+// identifies the conversation and is filled in with the resulting state.
+func (h *HTTPHandlers) handleMute(w http.ResponseWriter, r *http.Request, username, convKey string, mute *models.Mute) {
+	switch r.Method {
+	case http.MethodGet:
+		mute = h.Hub.GetMute(username, convKey, mute)
+
+	case http.MethodPut:
+		var req MuteRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		duration, valid := muteDurations[req.Duration]
+		if !valid {
+			http.Error(w, "Duration must be 1h, 8h or forever", http.StatusBadRequest)
+			return
+		}
+		mute = h.Hub.SetMute(username, convKey, mute, true, duration)
+
+	case http.MethodDelete:
+		mute = h.Hub.SetMute(username, convKey, mute, false, 0)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mute)
+}
@@ -0,0 +1,405 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	natsDialTimeout = 5 * time.Second
+	natsReadTimeout = 5 * time.Minute // Well past the server's ping interval
+	natsMaxBackoff  = 30 * time.Second
+	natsQueueSize   = 4096
+	natsMaxPayload  = 64 << 20 // Well past the server's max_payload
+)
+
+// NATSBroker relays events between instances over NATS, with a subject per
+// topic under the prefix. Each user's subject is only subscribed to while
+// the user is connected to this instance, so NATS routes their events to the
+// instances serving them instead of every instance. One connection carries
+// everything; writes go through a queue so Publish never blocks the hub, and
+// the connection is re-established with backoff, resubscribing as it was.
+// Events published while it's down are lost.
+type NATSBroker struct {
+	addr    string
+	host    string
+	tls     bool
+	user    string
+	pass    string
+	token   string
+	prefix  string
+	handler func(topic string, data []byte)
+
+	queue chan natsCommand
+	done  chan struct{}
+	once  sync.Once
+
+	// The current connection, bumped each reconnect, and the subjects
+	// subscribed to with their subscription IDs on it
+	mu      sync.Mutex
+	conn    net.Conn
+	gen     int
+	nextSID int
+	subs    map[string]int
+}
+
+// natsCommand is a line queued for the writer. Commands tied to one
+// connection carry its generation and are dropped if it has been replaced.
+type natsCommand struct {
+	gen  int // 0 for any connection
+	data []byte
+}
+
+// natsInfo is the part of the server's INFO line the client uses
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+}
+
+// NewNATSBroker connects to the server at rawURL, nats://[user:password@]host[:port]
+// or nats://token@host, or tls:// for TLS, using subjects named prefix + topic
+func NewNATSBroker(rawURL, prefix string) (*NATSBroker, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return nil, fmt.Errorf("unsupported scheme %q; use nats:// or tls://", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("missing host")
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	b := &NATSBroker{
+		addr:   addr,
+		host:   u.Hostname(),
+		tls:    u.Scheme == "tls",
+		prefix: prefix,
+		queue:  make(chan natsCommand, natsQueueSize),
+		done:   make(chan struct{}),
+		subs:   make(map[string]int),
+	}
+	if u.User != nil {
+		if pass, set := u.User.Password(); set {
+			b.user, b.pass = u.User.Username(), pass
+		} else {
+			b.token = u.User.Username()
+		}
+	}
+
+	// Fail at startup rather than on the first event if NATS can't be reached
+	conn, r, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	b.attach(conn)
+	go b.writeLoop()
+	go b.readLoop(conn, r)
+	return b, nil
+}
+
+// Publish queues data for the subject of topic, dropping it if the queue is
+// full
+func (b *NATSBroker) Publish(topic string, data []byte) {
+	subject := b.prefix + topic
+	command := make([]byte, 0, len(subject)+len(data)+24)
+	command = append(command, "PUB "+subject+" "...)
+	command = strconv.AppendInt(command, int64(len(data)), 10)
+	command = append(command, "\r\n"...)
+	command = append(command, data...)
+	command = append(command, "\r\n"...)
+	b.send(natsCommand{data: command}, topic)
+}
+
+// Subscribe calls handler with the messages on the presence subject and the
+// subjects of watched users, from a single goroutine
+func (b *NATSBroker) Subscribe(handler func(topic string, data []byte)) error {
+	b.mu.Lock()
+	b.handler = handler
+	b.mu.Unlock()
+	b.Watch(presenceTopic)
+	return nil
+}
+
+// Watch subscribes to the subject of topic
+func (b *NATSBroker) Watch(topic string) {
+	subject := b.prefix + topic
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, subscribed := b.subs[subject]; subscribed {
+		return
+	}
+	b.nextSID++
+	b.subs[subject] = b.nextSID
+	if b.conn != nil {
+		b.send(natsCommand{gen: b.gen, data: natsSub(subject, b.nextSID)}, topic)
+	}
+}
+
+// Unwatch unsubscribes from the subject of topic
+func (b *NATSBroker) Unwatch(topic string) {
+	subject := b.prefix + topic
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sid, subscribed := b.subs[subject]
+	if !subscribed {
+		return
+	}
+	delete(b.subs, subject)
+	if b.conn != nil {
+		b.send(natsCommand{gen: b.gen, data: []byte("UNSUB " + strconv.Itoa(sid) + "\r\n")}, topic)
+	}
+}
+
+// Close stops relaying and closes the connection
+func (b *NATSBroker) Close() error {
+	b.once.Do(func() {
+		close(b.done)
+		b.mu.Lock()
+		if b.conn != nil {
+			b.conn.Close()
+		}
+		b.mu.Unlock()
+	})
+	return nil
+}
+
+func (b *NATSBroker) closed() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *NATSBroker) send(command natsCommand, topic string) {
+	select {
+	case b.queue <- command:
+	default:
+		log.Printf("NATS write queue full; dropping command for %s", topic)
+	}
+}
+
+func natsSub(subject string, sid int) []byte {
+	return []byte("SUB " + subject + " " + strconv.Itoa(sid) + "\r\n")
+}
+
+// dial opens a connection and completes the handshake: the server's INFO,
+// TLS if either side wants it, then CONNECT answered by a PONG to our PING
+func (b *NATSBroker) dial() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", b.addr, natsDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(natsDialTimeout))
+	r := bufio.NewReader(conn)
+
+	line, err := readNATSLine(r)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	infoJSON, found := strings.CutPrefix(line, "INFO ")
+	if !found {
+		conn.Close()
+		return nil, nil, fmt.Errorf("nats: expected INFO, got %q", line)
+	}
+	var info natsInfo
+	json.Unmarshal([]byte(infoJSON), &info)
+
+	if b.tls || info.TLSRequired {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: b.host})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = tlsConn
+		r = bufio.NewReader(conn)
+	}
+
+	options := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "whatsdown",
+		"lang":     "go",
+		"version":  "1",
+		"protocol": 1,
+	}
+	if b.user != "" {
+		options["user"], options["pass"] = b.user, b.pass
+	}
+	if b.token != "" {
+		options["auth_token"] = b.token
+	}
+	connect, _ := json.Marshal(options)
+	if _, err := conn.Write([]byte("CONNECT " + string(connect) + "\r\nPING\r\n")); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	for {
+		line, err := readNATSLine(r)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		if line == "PONG" {
+			break
+		}
+		if message, isErr := strings.CutPrefix(line, "-ERR "); isErr {
+			conn.Close()
+			return nil, nil, fmt.Errorf("nats: %s", strings.Trim(message, "'"))
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, r, nil
+}
+
+// attach makes conn the current connection and queues its subscriptions
+func (b *NATSBroker) attach(conn net.Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conn = conn
+	b.gen++
+	for subject := range b.subs {
+		b.nextSID++
+		b.subs[subject] = b.nextSID
+		b.send(natsCommand{gen: b.gen, data: natsSub(subject, b.nextSID)}, subject)
+	}
+}
+
+// detach forgets conn if it's still the current connection
+func (b *NATSBroker) detach(conn net.Conn) {
+	b.mu.Lock()
+	if b.conn == conn {
+		b.conn = nil
+	}
+	b.mu.Unlock()
+	conn.Close()
+}
+
+// writeLoop writes queued commands to the current connection, flushing once
+// the queue is empty. Commands queued while disconnected are dropped.
+func (b *NATSBroker) writeLoop() {
+	var conn net.Conn
+	var w *bufio.Writer
+	for {
+		var command natsCommand
+		select {
+		case <-b.done:
+			return
+		case command = <-b.queue:
+		}
+
+		b.mu.Lock()
+		current, gen := b.conn, b.gen
+		b.mu.Unlock()
+		if current == nil || (command.gen != 0 && command.gen != gen) {
+			continue
+		}
+		if current != conn {
+			conn, w = current, bufio.NewWriter(current)
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(natsDialTimeout))
+		w.Write(command.data)
+		if len(b.queue) == 0 {
+			if err := w.Flush(); err != nil && !b.closed() {
+				log.Printf("NATS write failed: %v", err)
+				b.detach(conn)
+			}
+		}
+	}
+}
+
+// readLoop hands messages to the handler and answers the server's pings,
+// reconnecting when the connection fails
+func (b *NATSBroker) readLoop(conn net.Conn, r *bufio.Reader) {
+	backoff := time.Second
+	for {
+		err := b.receive(conn, r)
+		b.detach(conn)
+		if b.closed() {
+			return
+		}
+		log.Printf("NATS connection lost: %v", err)
+
+		for {
+			select {
+			case <-b.done:
+				return
+			case <-time.After(backoff):
+			}
+			if conn, r, err = b.dial(); err == nil {
+				backoff = time.Second
+				break
+			}
+			backoff = min(backoff*2, natsMaxBackoff)
+			log.Printf("NATS can't connect, retrying in %v: %v", backoff, err)
+		}
+		b.attach(conn)
+	}
+}
+
+func (b *NATSBroker) receive(conn net.Conn, r *bufio.Reader) error {
+	for {
+		conn.SetReadDeadline(time.Now().Add(natsReadTimeout))
+		line, err := readNATSLine(r)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case line == "PING":
+			b.send(natsCommand{data: []byte("PONG\r\n")}, "PONG")
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			fields := strings.Fields(line)
+			if len(fields) < 4 {
+				return fmt.Errorf("nats: malformed %q", line)
+			}
+			n, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || n < 0 || n > natsMaxPayload {
+				return fmt.Errorf("nats: malformed %q", line)
+			}
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			if data[n] != '\r' || data[n+1] != '\n' {
+				return errors.New("nats: message payload not terminated by CRLF")
+			}
+			b.mu.Lock()
+			handler := b.handler
+			b.mu.Unlock()
+			if topic, ok := strings.CutPrefix(fields[1], b.prefix); ok && handler != nil {
+				handler(topic, data[:n])
+			}
+		case strings.HasPrefix(line, "-ERR "):
+			log.Printf("NATS error: %s", strings.Trim(line[len("-ERR "):], "'"))
+		}
+	}
+}
+
+// readNATSLine reads one protocol line without its CRLF
+func readNATSLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
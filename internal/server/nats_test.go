@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNATS is one NATS server connection. It sends INFO, answers PING and
+// echoes each PUB back as a MSG if the subject is subscribed to. Every line
+// the client sends, and each PUB's payload, is passed on lines.
+type fakeNATS struct {
+	listener net.Listener
+	authErr  string
+	lines    chan string
+	conns    chan net.Conn
+}
+
+func newFakeNATS(t *testing.T, authErr string) *fakeNATS {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeNATS{listener: listener, authErr: authErr, lines: make(chan string, 64), conns: make(chan net.Conn, 4)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			f.conns <- conn
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeNATS) serve(conn net.Conn) {
+	conn.Write([]byte(`INFO {"server_id":"fake","version":"2.10.0","max_payload":1048576}` + "\r\n"))
+	r := bufio.NewReader(conn)
+	subs := make(map[string]string)
+	for {
+		line, err := readNATSLine(r)
+		if err != nil {
+			return
+		}
+		f.lines <- line
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "CONNECT":
+			if f.authErr != "" {
+				conn.Write([]byte("-ERR '" + f.authErr + "'\r\n"))
+				return
+			}
+		case "PING":
+			conn.Write([]byte("PONG\r\n"))
+		case "SUB":
+			subs[fields[1]] = fields[len(fields)-1]
+		case "PUB":
+			n, _ := strconv.Atoi(fields[len(fields)-1])
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			f.lines <- string(data)
+			if sid, subscribed := subs[fields[1]]; subscribed {
+				conn.Write([]byte("MSG " + fields[1] + " " + sid + " " + strconv.Itoa(n) + "\r\n" + string(data)))
+			}
+		}
+	}
+}
+
+// expect waits for the client to send want
+func (f *fakeNATS) expect(t *testing.T, want string) {
+	t.Helper()
+	select {
+	case line := <-f.lines:
+		if line != want {
+			t.Fatalf("client sent %q, want %q", line, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("client didn't send %q", want)
+	}
+}
+
+func (f *fakeNATS) expectConnect(t *testing.T) map[string]interface{} {
+	t.Helper()
+	select {
+	case line := <-f.lines:
+		options, found := strings.CutPrefix(line, "CONNECT ")
+		if !found {
+			t.Fatalf("client sent %q, want CONNECT", line)
+		}
+		var decoded map[string]interface{}
+		if err := json.Unmarshal([]byte(options), &decoded); err != nil {
+			t.Fatalf("CONNECT options %q: %v", options, err)
+		}
+		f.expect(t, "PING")
+		return decoded
+	case <-time.After(2 * time.Second):
+		t.Fatal("client didn't send CONNECT")
+		return nil
+	}
+}
+
+func TestNATSBroker(t *testing.T) {
+	server := newFakeNATS(t, "")
+	b, err := NewNATSBroker("nats://bob:secret@"+server.listener.Addr().String(), "wd.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	conn := <-server.conns
+
+	options := server.expectConnect(t)
+	if options["user"] != "bob" || options["pass"] != "secret" || options["verbose"] != false {
+		t.Errorf("CONNECT options %v", options)
+	}
+
+	type event struct{ topic, data string }
+	received := make(chan event, 4)
+	b.Subscribe(func(topic string, data []byte) {
+		received <- event{topic, string(data)}
+	})
+	server.expect(t, "SUB wd.presence 1")
+	b.Watch(userTopicPrefix + "alice")
+	server.expect(t, "SUB wd.user.alice 2")
+
+	// Payloads are framed by length, so they may hold CRLF
+	b.Publish(userTopicPrefix+"alice", []byte("hello\r\nworld"))
+	server.expect(t, "PUB wd.user.alice 12")
+	server.expect(t, "hello\r\nworld\r\n")
+	if got := <-received; got != (event{userTopicPrefix + "alice", "hello\r\nworld"}) {
+		t.Errorf("received %+v", got)
+	}
+
+	// A reply subject doesn't change where the payload length is
+	conn.Write([]byte("MSG wd.presence 1 _INBOX.x 2\r\nhi\r\n"))
+	if got := <-received; got != (event{presenceTopic, "hi"}) {
+		t.Errorf("received %+v", got)
+	}
+
+	conn.Write([]byte("PING\r\n"))
+	server.expect(t, "PONG")
+
+	b.Unwatch(userTopicPrefix + "alice")
+	server.expect(t, "UNSUB 2")
+}
+
+func TestNATSBrokerTokenAndErrors(t *testing.T) {
+	server := newFakeNATS(t, "")
+	b, err := NewNATSBroker("nats://s3cret@"+server.listener.Addr().String(), "wd.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	if options := server.expectConnect(t); options["auth_token"] != "s3cret" || options["user"] != nil {
+		t.Errorf("CONNECT options %v", options)
+	}
+
+	refusing := newFakeNATS(t, "Authorization Violation")
+	if _, err := NewNATSBroker("nats://"+refusing.listener.Addr().String(), "wd."); err == nil || !strings.Contains(err.Error(), "Authorization Violation") {
+		t.Errorf("NewNATSBroker = %v, want the server's error", err)
+	}
+
+	for _, url := range []string{"redis://localhost", "nats://"} {
+		if _, err := NewNATSBroker(url, "wd."); err == nil {
+			t.Errorf("NewNATSBroker(%q) succeeded", url)
+		}
+	}
+}
+
+func TestNATSReceiveRejectsBadFraming(t *testing.T) {
+	b := &NATSBroker{prefix: "wd.", queue: make(chan natsCommand, 1), handler: func(string, []byte) {}}
+	for _, input := range []string{
+		"MSG wd.presence 1\r\n",
+		"MSG wd.presence 1 x\r\n",
+		"MSG wd.presence 1 -1\r\n",
+		"MSG wd.presence 1 2\r\nhiXX",
+		"MSG wd.presence 1 99999999999\r\n",
+	} {
+		client, server := net.Pipe()
+		go func() {
+			server.Write([]byte(input))
+			server.Close()
+		}()
+		if err := b.receive(client, bufio.NewReader(client)); err == nil || err == io.EOF {
+			t.Errorf("receive(%q) = %v, want a framing error", input, err)
+		}
+		client.Close()
+	}
+}
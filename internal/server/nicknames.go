@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxNicknameRunes bounds a private nickname's length
+const maxNicknameRunes = 64
+
+var errNicknameTooLong = errors.New("nickname too long")
+
+// NicknameRequest is the body of PUT /api/users/{username}/nickname
+type NicknameRequest struct {
+	Nickname string `json:"nickname"`
+}
+
+// SetNickname sets owner's private nickname for username; empty clears it.
+// It returns the stored nickname and false if username doesn't exist.
+func (h *Hub) SetNickname(owner, username, nickname string) (string, bool, error) {
+	nickname = strings.TrimSpace(h.Sanitizer.Sanitize(nickname))
+	if utf8.RuneCountInString(nickname) > maxNicknameRunes {
+		return "", true, errNicknameTooLong
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, exists := h.Users[username]; !exists {
+		return "", false, nil
+	}
+	if nickname == "" {
+		delete(h.Nicknames[owner], username)
+		return "", true, nil
+	}
+	nicknames, exists := h.Nicknames[owner]
+	if !exists {
+		nicknames = make(map[string]string)
+		h.Nicknames[owner] = nicknames
+	}
+	nicknames[username] = nickname
+	return nickname, true, nil
+}
+
+// GetNicknames returns owner's nicknames keyed by username
+func (h *Hub) GetNicknames(owner string) map[string]string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	nicknames := make(map[string]string, len(h.Nicknames[owner]))
+	for username, nickname := range h.Nicknames[owner] {
+		nicknames[username] = nickname
+	}
+	return nicknames
+}
+
+// HandleNicknames handles GET /api/me/nicknames
+func (h *HTTPHandlers) HandleNicknames(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Hub.GetNicknames(session.Username))
+}
+
+// handleNickname handles PUT and DELETE /api/users/{username}/nickname
+func (h *HTTPHandlers) handleNickname(w http.ResponseWriter, r *http.Request, owner, username string) {
+	var req NicknameRequest
+	if r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	nickname, exists, err := h.Hub.SetNickname(owner, username, req.Nickname)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !exists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NicknameRequest{Nickname: nickname})
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"fmt"
+
+	"whatsdown/internal/models"
+)
+
+// Notification levels for NotificationPreferences.DirectMessages and Groups
+const (
+	NotifyAll      = "all"
+	NotifyMentions = "mentions"
+	NotifyNone     = "none"
+)
+
+// normalizePreferences fills in unset notification levels and rejects unknown ones
+func normalizePreferences(prefs *models.NotificationPreferences) error {
+	for _, level := range []*string{&prefs.DirectMessages, &prefs.Groups} {
+		switch *level {
+		case "":
+			*level = NotifyAll
+		case NotifyAll, NotifyMentions, NotifyNone:
+		default:
+			return fmt.Errorf("notification level must be %s, %s or %s", NotifyAll, NotifyMentions, NotifyNone)
+		}
+	}
+	return nil
+}
+
+// shouldAlert reports whether message should alert username, by push or by
+// the client's own sound and banner, given their mutes and notification
+// preferences. Urgent messages always alert. Callers must hold h.mu.
+func (h *Hub) shouldAlert(username string, message *models.Message) bool {
+	if message.Urgent {
+		return true
+	}
+	if h.isMuted(username, message.ConvKey()) {
+		return false
+	}
+
+	prefs := models.DefaultNotificationPreferences()
+	if h.Push != nil {
+		prefs = h.Push.Preferences(username)
+	}
+	if !prefs.Enabled {
+		return false
+	}
+
+	level := prefs.DirectMessages
+	if message.GroupID != "" {
+		level = prefs.Groups
+	}
+	switch level {
+	case NotifyNone:
+		return false
+	case NotifyMentions:
+		// Every direct message is addressed to its recipient
+		return message.GroupID == "" || containsString(message.Mentions, username)
+	default:
+		return true
+	}
+}
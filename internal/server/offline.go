@@ -0,0 +1,176 @@
+package server
+
+import (
+	"log"
+	"sort"
+
+	"whatsdown/internal/models"
+)
+
+// flushOfflineMessages delivers direct messages that arrived while username
+// was offline, oldest first, and acks each one to its sender. Callers must
+// hold h.mu.
+func (h *Hub) flushOfflineMessages(client *Client) {
+	username := client.Username
+
+	pending := []*models.Message{}
+	for _, message := range h.takePending(username) {
+		if message.Status == "sent" && !message.Deleted && !message.HiddenFrom(username) {
+			pending = append(pending, message)
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].Timestamp.Before(pending[j].Timestamp)
+	})
+
+	log.Printf("Flushing %d offline messages to %s", len(pending), username)
+	for _, message := range pending {
+		outbound := newOutboundMessage(message, "delivered")
+		outbound.Silent = !h.shouldAlert(username, message)
+		// Translating needs the network, which can't happen under h.mu
+		outbound.Translation = h.cachedTranslationFor(message, username)
+		h.sendToClient(client, messageEventType(message), outbound)
+		h.recordDelivery(message, client)
+
+		h.sendToUser(message.From, "ack", &models.AckEvent{
+			MessageID: message.ID,
+			Status:    "delivered",
+		})
+	}
+}
+
+// holdPending indexes a direct message stored while none of its recipient's
+// devices was connected, so that flushOfflineMessages finds it without
+// scanning every conversation
+func (h *Hub) holdPending(message *models.Message) {
+	s := h.shard(message.To)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	held, exists := s.pending[message.To]
+	if !exists {
+		held = make(map[string]*models.Message)
+		s.pending[message.To] = held
+	}
+	held[message.ID] = message
+}
+
+// takePending returns the direct messages held for username and stops
+// holding them. Some may since have been delivered, read or deleted.
+func (h *Hub) takePending(username string) map[string]*models.Message {
+	s := h.shard(username)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	held := s.pending[username]
+	delete(s.pending, username)
+	return held
+}
+
+// releasePending stops holding message for its recipient
+func (h *Hub) releasePending(message *models.Message) {
+	if message.To == "" {
+		return
+	}
+	s := h.shard(message.To)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if held, exists := s.pending[message.To]; exists {
+		delete(held, message.ID)
+		if len(held) == 0 {
+			delete(s.pending, message.To)
+		}
+	}
+}
+
+// offlineEvent is an event held for a user while none of their devices is
+// connected
+type offlineEvent struct {
+	msgType string
+	payload interface{}
+
+	// Set for messages, which are rebuilt when delivered so that edits and
+	// deletions in the meantime apply
+	message *models.Message
+}
+
+// queueOffline holds an event for username until one of their devices
+// connects, if none is connected now. Once h.OfflineEventLimit events are
+// held the oldest is dropped, and the user is told how many were when they
+// reconnect. Callers must hold h.mu.
+func (h *Hub) queueOffline(username string, event offlineEvent) {
+	if h.OfflineEventLimit <= 0 || h.isConnected(username) {
+		return
+	}
+	if _, exists := h.Users[username]; !exists || username == BotUsername {
+		return
+	}
+	s := h.shard(username)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queue := s.offline[username]
+	if len(queue) >= h.OfflineEventLimit {
+		log.Printf("Offline queue for %s is full, dropping its oldest %s event", username, queue[0].msgType)
+		queue = append(queue[:0], queue[1:]...)
+		s.offlineDropped[username]++
+	}
+	s.offline[username] = append(queue, event)
+	h.markOfflineChanged(username)
+}
+
+// flushOfflineEvents delivers the events held for client's user while they
+// were offline, in the order they were queued. A device that resumed its
+// stream has already had them replayed, so they are only discarded. Callers
+// must hold h.mu.
+func (h *Hub) flushOfflineEvents(client *Client, resumed bool) {
+	username := client.Username
+	s := h.shard(username)
+	s.mu.Lock()
+	queue := s.offline[username]
+	dropped := s.offlineDropped[username]
+	delete(s.offline, username)
+	delete(s.offlineDropped, username)
+	s.mu.Unlock()
+	if len(queue) == 0 && dropped == 0 {
+		return
+	}
+	h.markOfflineChanged(username)
+	if resumed {
+		return
+	}
+
+	events := make([]*models.WSMessage, 0, len(queue)+1)
+	if dropped > 0 {
+		// The queue overflowed, so the client has to resync what it missed
+		events = append(events, &models.WSMessage{Type: "offline_overflow", Payload: &models.OfflineOverflowEvent{Dropped: dropped}})
+	}
+	for _, event := range queue {
+		payload := event.payload
+		if message := event.message; message != nil {
+			if message.Deleted || message.HiddenFrom(username) {
+				continue
+			}
+			outbound := newOutboundMessage(message, "delivered")
+			outbound.Silent = !h.shouldAlert(username, message)
+			outbound.Translation = h.cachedTranslationFor(message, username)
+			h.recordDelivery(message, client)
+			payload = outbound
+		}
+		events = append(events, &models.WSMessage{Type: event.msgType, Payload: payload})
+	}
+	log.Printf("Flushing %d offline events to %s", len(events), username)
+	h.sendBatch(client, events)
+}
+
+// messageEventType returns the event type a message was originally sent as
+func messageEventType(message *models.Message) string {
+	switch {
+	case message.Encrypted != nil:
+		return "encrypted"
+	case message.ThreadID != "":
+		return "thread_message"
+	default:
+		return "message"
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"whatsdown/internal/models"
+)
+
+// flush runs flushOfflineMessages for client and returns the content of the
+// messages it sent, in order
+func flush(t *testing.T, hub *Hub, client *Client) []string {
+	t.Helper()
+	hub.mu.Lock()
+	hub.flushOfflineMessages(client)
+	hub.mu.Unlock()
+
+	var contents []string
+	for {
+		select {
+		case data := <-client.Send:
+			var event struct {
+				Type    string                 `json:"type"`
+				Payload models.OutboundMessage `json:"payload"`
+			}
+			if err := json.Unmarshal(data, &event); err != nil {
+				t.Fatal(err)
+			}
+			if event.Type == "message" {
+				contents = append(contents, event.Payload.Content)
+			}
+		default:
+			return contents
+		}
+	}
+}
+
+func TestFlushOfflineMessages(t *testing.T) {
+	hub := newTestHub(t, "alice", "bob", "carol")
+	for _, content := range []string{"one", "deleted", "two"} {
+		hub.handleInboundMessageWithSender("alice", &models.InboundMessage{To: "bob", Content: content})
+		if content == "deleted" {
+			message := lastMessage(t, hub, &models.Message{From: "alice", To: "bob"})
+			if err := hub.DeleteMessage(message.ID, "alice", DeleteForEveryone); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	hub.handleInboundMessageWithSender("alice", &models.InboundMessage{To: "carol", Content: "for carol"})
+
+	bob := newTestClient(t, hub, "bob")
+	got := flush(t, hub, bob)
+	if len(got) != 2 || got[0] != "one" || got[1] != "two" {
+		t.Errorf("flushed %q, want one and two", got)
+	}
+	if got := flush(t, hub, bob); len(got) != 0 {
+		t.Errorf("second flush sent %q again", got)
+	}
+}
+
+func TestEvictedMessagesAreNotHeldForFlush(t *testing.T) {
+	hub := newTestHub(t, "alice", "bob")
+	hub.MaxConversationMessages = 1
+	hub.handleInboundMessageWithSender("alice", &models.InboundMessage{To: "bob", Content: "evicted"})
+	hub.handleInboundMessageWithSender("alice", &models.InboundMessage{To: "bob", Content: "kept"})
+
+	if got := flush(t, hub, newTestClient(t, hub, "bob")); len(got) != 1 || got[0] != "kept" {
+		t.Errorf("flushed %q, want only kept", got)
+	}
+}
+
+func TestOfflineQueueSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	hub := newTestHub(t, "alice", "bob")
+	hub.OfflineEventLimit = 2
+	if err := hub.LoadOfflineQueues(dir); err != nil {
+		t.Fatal(err)
+	}
+	hub.mu.Lock()
+	for _, id := range []string{"dropped", "first", "second"} {
+		hub.queueOffline("bob", offlineEvent{msgType: "contact", payload: &models.ContactEvent{Username: id}})
+	}
+	hub.mu.Unlock()
+	hub.saveOfflineQueues()
+
+	restarted := newTestHub(t, "alice", "bob")
+	if err := restarted.LoadOfflineQueues(dir); err != nil {
+		t.Fatal(err)
+	}
+	bob := newTestClient(t, restarted, "bob")
+	restarted.mu.Lock()
+	restarted.flushOfflineEvents(bob, false)
+	restarted.mu.Unlock()
+
+	var overflow models.OfflineOverflowEvent
+	if err := json.Unmarshal(nextEvent(t, bob, "offline_overflow"), &overflow); err != nil {
+		t.Fatal(err)
+	}
+	if overflow.Dropped != 1 {
+		t.Errorf("Dropped = %d, want 1", overflow.Dropped)
+	}
+	for _, want := range []string{"first", "second"} {
+		var contact models.ContactEvent
+		if err := json.Unmarshal(nextEvent(t, bob, "contact"), &contact); err != nil {
+			t.Fatal(err)
+		}
+		if contact.Username != want {
+			t.Errorf("contact event for %q, want %q", contact.Username, want)
+		}
+	}
+
+	restarted.saveOfflineQueues()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("flushed queue still saved: %v", entries)
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long after a user's offline queue changes it is saved, so a burst of
+// events for offline users is written once
+const offlineSaveDelay = time.Second
+
+// offlineStore saves offline event queues to a directory, one JSON file per
+// user, so they survive restarts. Changed users are marked and saved together
+// shortly after; a crash loses at most the last offlineSaveDelay of changes.
+type offlineStore struct {
+	dir string
+
+	// Users whose queue changed since the last save, and the timer that will
+	// save them. mu is a leaf lock.
+	mu    sync.Mutex
+	dirty map[string]bool
+	timer *time.Timer
+
+	// Serializes saves, so an older snapshot never overwrites a newer one.
+	// Taken before h.mu.
+	saving sync.Mutex
+}
+
+// savedOfflineQueue is the file a user's offline queue is saved to
+type savedOfflineQueue struct {
+	Dropped int                 `json:"dropped,omitempty"`
+	Events  []savedOfflineEvent `json:"events"`
+}
+
+type savedOfflineEvent struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// LoadOfflineQueues keeps offline event queues in dir from now on, loading
+// the ones saved there before. An empty dir keeps them in memory only.
+// Saved messages are delivered as they were when saved.
+func (h *Hub) LoadOfflineQueues(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name, isQueue := strings.CutSuffix(entry.Name(), ".json")
+		if !isQueue || entry.IsDir() {
+			continue
+		}
+		username, err := url.PathUnescape(name)
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		var saved savedOfflineQueue
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return err
+		}
+
+		queue := make([]offlineEvent, 0, len(saved.Events))
+		for _, event := range saved.Events {
+			queue = append(queue, offlineEvent{msgType: event.Type, payload: event.Payload})
+		}
+		s := h.shard(username)
+		s.mu.Lock()
+		s.offline[username] = queue
+		if saved.Dropped > 0 {
+			s.offlineDropped[username] = saved.Dropped
+		}
+		s.mu.Unlock()
+	}
+
+	h.offlineStore = &offlineStore{dir: dir, dirty: make(map[string]bool)}
+	return nil
+}
+
+// markOfflineChanged schedules username's offline queue to be saved
+func (h *Hub) markOfflineChanged(username string) {
+	store := h.offlineStore
+	if store == nil {
+		return
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.dirty[username] = true
+	if store.timer == nil {
+		store.timer = time.AfterFunc(offlineSaveDelay, h.saveOfflineQueues)
+	}
+}
+
+// saveOfflineQueues writes the offline queues changed since the last save.
+// Callers must not hold h.mu.
+func (h *Hub) saveOfflineQueues() {
+	store := h.offlineStore
+	if store == nil {
+		return
+	}
+	store.saving.Lock()
+	defer store.saving.Unlock()
+
+	store.mu.Lock()
+	dirty := store.dirty
+	store.dirty = make(map[string]bool)
+	if store.timer != nil {
+		store.timer.Stop()
+		store.timer = nil
+	}
+	store.mu.Unlock()
+
+	queues := make(map[string]*savedOfflineQueue, len(dirty))
+	h.mu.RLock()
+	for username := range dirty {
+		queues[username] = h.snapshotOffline(username)
+	}
+	h.mu.RUnlock()
+
+	for username, queue := range queues {
+		if err := store.write(username, queue); err != nil {
+			log.Printf("Error saving offline queue for %s: %v", username, err)
+		}
+	}
+}
+
+// snapshotOffline encodes username's offline queue for saving, or returns nil
+// if nothing is held for them. Callers must hold h.mu.
+func (h *Hub) snapshotOffline(username string) *savedOfflineQueue {
+	s := h.shard(username)
+	s.mu.Lock()
+	queue := append([]offlineEvent(nil), s.offline[username]...)
+	dropped := s.offlineDropped[username]
+	s.mu.Unlock()
+	if len(queue) == 0 && dropped == 0 {
+		return nil
+	}
+
+	saved := &savedOfflineQueue{Dropped: dropped, Events: make([]savedOfflineEvent, 0, len(queue))}
+	for _, event := range queue {
+		payload := event.payload
+		if message := event.message; message != nil {
+			if message.Deleted || message.HiddenFrom(username) {
+				continue
+			}
+			payload = newOutboundMessage(message, "delivered")
+		}
+		data, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("Error encoding offline %s event for %s: %v", event.msgType, username, err)
+			continue
+		}
+		saved.Events = append(saved.Events, savedOfflineEvent{Type: event.msgType, Payload: data})
+	}
+	return saved
+}
+
+// write saves username's queue, or removes its file if queue is nil
+func (s *offlineStore) write(username string, queue *savedOfflineQueue) error {
+	path := filepath.Join(s.dir, url.PathEscape(username)+".json")
+	if queue == nil {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(queue)
+	if err != nil {
+		return err
+	}
+	// Write then rename so a crash never leaves a truncated queue
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+const (
+	// First retry delay once a client's send buffer fills; doubles per failed attempt
+	outboxRetryBase = 50 * time.Millisecond
+
+	// Longest delay between retries
+	outboxRetryMax = 5 * time.Second
+
+	// Consecutive retries without progress before the client is dropped
+	// under the "disconnect" policy
+	outboxMaxRetries = 8
+)
+
+// outboxFrame is an encoded frame waiting for room in a client's send buffer
+type outboxFrame struct {
+	data []byte
+
+	// Messages in the frame, so undelivered ones can return to the offline
+	// queue; a batch frame may carry several
+	messageIDs []string
+}
+
+// newOutboxFrame wraps an encoded event with the ID of the message it
+// carries, if any
+func newOutboxFrame(data []byte, payload interface{}) outboxFrame {
+	frame := outboxFrame{data: data}
+	if messageID := outboundMessageID(payload); messageID != "" {
+		frame.messageIDs = []string{messageID}
+	}
+	return frame
+}
+
+// enqueue hands a frame to the write pump, holding it in the outbox when the
+// send buffer is full. Frames already waiting keep their order. Once the
+// outbox holds SlowClientBuffer frames the slow-client policy decides.
+func (c *Client) enqueue(frame outboxFrame) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+	if len(c.outbox) == 0 && c.spill.len() == 0 {
+		select {
+		case c.Send <- frame.data:
+			return true
+		default:
+		}
+	}
+
+	queued := true
+	if len(c.outbox) >= c.Hub.SlowClientBuffer || c.spill.len() > 0 {
+		queued = c.holdOverflow(frame)
+	} else {
+		c.outbox = append(c.outbox, frame)
+	}
+	if queued && c.retryTimer == nil {
+		c.scheduleRetry()
+	}
+	return queued
+}
+
+// scheduleRetry arms the outbox timer with exponential backoff. Callers must hold c.mu.
+func (c *Client) scheduleRetry() {
+	delay := outboxRetryBase << c.retries
+	if delay > outboxRetryMax || delay <= 0 {
+		delay = outboxRetryMax
+	}
+	c.retryTimer = time.AfterFunc(delay, c.retryOutbox)
+}
+
+// retryOutbox moves as many held frames as fit into the send buffer. Under
+// the "disconnect" policy a client that makes no progress for
+// outboxMaxRetries attempts is dropped and its undelivered messages go back
+// to the offline queue.
+func (c *Client) retryOutbox() {
+	c.mu.Lock()
+	c.retryTimer = nil
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+
+	sent := 0
+	for sent < len(c.outbox) && c.trySend(c.outbox[sent].data) {
+		sent++
+	}
+	c.outbox = c.outbox[sent:]
+	c.refillFromSpill()
+
+	if len(c.outbox) == 0 || sent > 0 {
+		c.retries = 0
+	} else {
+		c.retries++
+	}
+
+	if len(c.outbox) > 0 && c.retries >= outboxMaxRetries && c.Hub.SlowClientPolicy == SlowClientDisconnect {
+		undelivered := c.outbox
+		c.outbox = nil
+		c.mu.Unlock()
+
+		log.Printf("Client %s stopped reading, dropping connection with %d frames pending", c.Username, len(undelivered))
+		c.Hub.dropSlowClient(c, undelivered)
+		return
+	}
+	if len(c.outbox) > 0 {
+		c.scheduleRetry()
+	}
+	c.mu.Unlock()
+}
+
+// trySend writes to the send buffer without blocking. Callers must hold c.mu.
+func (c *Client) trySend(data []byte) bool {
+	select {
+	case c.Send <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeSend closes the send channel once, ending the write pump, and discards
+// anything still held in the outbox
+func (c *Client) closeSend() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.Send)
+	if c.retryTimer != nil {
+		c.retryTimer.Stop()
+		c.retryTimer = nil
+	}
+	c.outbox = nil
+	if c.spill != nil {
+		c.spill.close()
+		c.spill = nil
+	}
+}
+
+// dropSlowClient disconnects a client that stopped draining its outbox. Its
+// device's deliveries of messages it never received are forgotten, and direct
+// messages no device has are marked "sent" again so they are flushed when the
+// user reconnects.
+func (h *Hub) dropSlowClient(client *Client, undelivered []outboxFrame) {
+	h.forgetFrames(client, undelivered)
+	h.disconnect(client, CloseTooSlow, "too slow reading events")
+}
+
+// outboundMessageID returns the message ID carried by a payload, if any
+func outboundMessageID(payload interface{}) string {
+	if outbound, ok := payload.(*models.OutboundMessage); ok {
+		return outbound.ID
+	}
+	return ""
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"errors"
+
+	"whatsdown/internal/models"
+)
+
+var errTooManyPins = errors.New("too many pinned messages in this conversation")
+
+// PinMessage pins or unpins a message in its conversation and notifies
+// participants with a "pin" event. Anyone in a direct or group conversation
+// can pin; in channels only publishers can.
+func (h *Hub) PinMessage(messageID, username string, pinned bool) error {
+	h.mu.Lock()
+
+	message, exists := h.message(messageID)
+	if !exists || message.Deleted || !h.canAccessMessage(message, username) {
+		h.mu.Unlock()
+		return errMessageNotFound
+	}
+	if message.ChannelID != "" {
+		if channel := h.Channels[message.ChannelID]; !channel.CanPublish(username) {
+			h.mu.Unlock()
+			return errNotAllowed
+		}
+	}
+
+	convKey := message.ConvKey()
+	pins := h.Pins[convKey]
+	alreadyPinned := containsString(pins, messageID)
+
+	switch {
+	case pinned && alreadyPinned, !pinned && !alreadyPinned:
+		h.mu.Unlock()
+		return nil
+	case pinned:
+		if len(pins) >= h.MaxPinnedMessages {
+			h.mu.Unlock()
+			return errTooManyPins
+		}
+		h.Pins[convKey] = append(pins, messageID)
+	default:
+		h.Pins[convKey] = removeString(pins, messageID)
+	}
+
+	recipients := h.participantClients(message)
+	h.mu.Unlock()
+
+	event := &models.PinEvent{
+		MessageID: messageID,
+		Pinned:    pinned,
+		By:        username,
+	}
+	for _, client := range recipients {
+		h.sendToClient(client, "pin", event)
+	}
+	return nil
+}
+
+// GetPinnedMessages returns the pinned messages in a conversation, in pin
+// order, that username can see
+func (h *Hub) GetPinnedMessages(convKey, username string) []*models.Message {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	pinned := []*models.Message{}
+	for _, messageID := range h.Pins[convKey] {
+		message, exists := h.message(messageID)
+		if !exists || !h.canAccessMessage(message, username) || message.HiddenFrom(username) {
+			continue
+		}
+		pinned = append(pinned, message.Snapshot())
+	}
+	return pinned
+}
+
+// unpinDeleted drops a message deleted for everyone from its conversation's
+// pins. Callers must hold h.mu.
+func (h *Hub) unpinDeleted(message *models.Message) {
+	convKey := message.ConvKey()
+	if containsString(h.Pins[convKey], message.ID) {
+		h.Pins[convKey] = removeString(h.Pins[convKey], message.ID)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"whatsdown/internal/models"
+)
+
+const (
+	// Bounds on the number of poll options
+	minPollOptions = 2
+	maxPollOptions = 12
+
+	// Maximum length of a poll option in runes
+	maxPollOptionRunes = 100
+)
+
+// newPoll validates a poll request, sanitizing its options. The question is
+// the message content.
+func (h *Hub) newPoll(question string, req *models.PollRequest) (*models.Poll, bool) {
+	if question == "" || len(req.Options) < minPollOptions || len(req.Options) > maxPollOptions {
+		return nil, false
+	}
+
+	poll := &models.Poll{MultipleChoice: req.MultipleChoice}
+	seen := make(map[string]bool, len(req.Options))
+	for _, text := range req.Options {
+		text = strings.TrimSpace(h.Sanitizer.Sanitize(text))
+		key := strings.ToLower(text)
+		if text == "" || utf8.RuneCountInString(text) > maxPollOptionRunes || seen[key] {
+			return nil, false
+		}
+		seen[key] = true
+		poll.Options = append(poll.Options, &models.PollOption{Text: text})
+	}
+	return poll, true
+}
+
+// handleVote replaces a user's choices in a poll and pushes the new tally to
+// everyone in the conversation
+func (h *Hub) handleVote(from string, vote *models.VoteEvent) {
+	h.mu.Lock()
+	message, exists := h.message(vote.MessageID)
+	if !exists || message.Poll == nil || message.Deleted || !h.canAccessMessage(message, from) || message.HiddenFrom(from) {
+		h.mu.Unlock()
+		log.Printf("Dropping vote from %s: poll %s not found", from, vote.MessageID)
+		return
+	}
+
+	if !message.Poll.Vote(from, vote.Options) {
+		h.mu.Unlock()
+		log.Printf("Dropping invalid vote from %s on poll %s", from, vote.MessageID)
+		return
+	}
+
+	update := &models.PollEvent{
+		MessageID: message.ID,
+		From:      from,
+		Poll:      message.Poll.Snapshot(),
+	}
+	recipients := h.participantClients(message)
+	h.mu.Unlock()
+
+	for _, client := range recipients {
+		h.sendToClient(client, "poll", update)
+	}
+}
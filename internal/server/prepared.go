@@ -0,0 +1,95 @@
+package server
+
+import (
+	"log"
+	"sync"
+)
+
+// preparedEvent is an event going to many connections, encoded once per wire
+// encoding however many there are. Connections without a stream share one
+// frame; streams number their events, so each wraps the shared payload in an
+// envelope of its own. Queued frames are never modified or reused, which is
+// what makes sharing them safe.
+type preparedEvent struct {
+	Type    string
+	Payload interface{}
+
+	mu      sync.Mutex
+	encoded map[wireCodec]*preparedEncoding
+}
+
+// preparedEncoding is a prepared event in one encoding
+type preparedEncoding struct {
+	payload []byte
+	frame   []byte // Unnumbered envelope, made once first needed
+	err     error
+}
+
+// newPreparedEvent prepares an event; like with sendToClient, the payload
+// must not be changed once it's sent
+func newPreparedEvent(msgType string, payload interface{}) *preparedEvent {
+	return &preparedEvent{
+		Type:    msgType,
+		Payload: payload,
+		encoded: make(map[wireCodec]*preparedEncoding),
+	}
+}
+
+// encoding returns the event encoded with codec, encoding its payload the
+// first time. Callers must hold e.mu.
+func (e *preparedEvent) encoding(codec wireCodec) *preparedEncoding {
+	enc, exists := e.encoded[codec]
+	if !exists {
+		enc = &preparedEncoding{}
+		enc.payload, enc.err = codec.MarshalPayload(e.Payload)
+		e.encoded[codec] = enc
+	}
+	return enc
+}
+
+// payload returns the event's payload encoded with codec
+func (e *preparedEvent) payload(codec wireCodec) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	enc := e.encoding(codec)
+	return enc.payload, enc.err
+}
+
+// frame returns the event as an unnumbered frame encoded with codec
+func (e *preparedEvent) frame(codec wireCodec) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	enc := e.encoding(codec)
+	if enc.err == nil && enc.frame == nil {
+		enc.frame = codec.MarshalEnvelope(e.Type, 0, enc.payload)
+	}
+	return enc.frame, enc.err
+}
+
+// sendPrepared queues a prepared event for client like sendToClient
+func (h *Hub) sendPrepared(client *Client, event *preparedEvent) {
+	h.dispatch(client, func() {
+		h.deliverPrepared(client, event)
+	})
+}
+
+// deliverPrepared hands client its encoding of a prepared event, numbered if
+// the client has a stream
+func (h *Hub) deliverPrepared(client *Client, event *preparedEvent) {
+	if client.stream != nil {
+		if client.stream.sendPrepared(event) {
+			log.Printf("Message queued for client %s, type: %s", client.Username, event.Type)
+		}
+		return
+	}
+
+	data, err := event.frame(client.codec)
+	if err != nil {
+		log.Printf("Error marshaling message: %v", err)
+		return
+	}
+
+	if client.enqueue(newOutboxFrame(data, event.Payload)) {
+		log.Printf("Message queued for client %s, type: %s", client.Username, event.Type)
+	}
+}
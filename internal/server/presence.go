@@ -0,0 +1,289 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"whatsdown/internal/models"
+)
+
+// Presence and profile visibility levels
+const (
+	VisibleToEveryone = "everyone"
+	VisibleToContacts = "contacts"
+	VisibleToNobody   = "nobody"
+)
+
+const (
+	// Longest custom status, in characters
+	maxStatusTextRunes = 140
+
+	// Most users one person can hide their presence from individually
+	maxPresenceHiddenFrom = 500
+)
+
+var (
+	errInvalidPresencePrivacy = errors.New("lastSeen, online, avatar and bio must be everyone, contacts or nobody")
+	errTooManyHiddenFrom      = errors.New("too many users in hiddenFrom")
+)
+
+// StatusTextRequest is the body of PUT /api/me/status
+type StatusTextRequest struct {
+	Text string `json:"text"`
+}
+
+// lastSeenAt is when user was last connected, or nil while they're online
+// or if they never were
+func lastSeenAt(user *models.User) *time.Time {
+	if user == nil || user.Online || user.LastSeen.IsZero() {
+		return nil
+	}
+	lastSeen := user.LastSeen
+	return &lastSeen
+}
+
+// isContact reports whether other is in username's contacts.
+// Callers must hold h.mu.
+func (h *Hub) isContact(username, other string) bool {
+	_, exists := h.Contacts[username][other]
+	return exists
+}
+
+// canSeePresence applies username's privacy level to viewer.
+// Callers must hold h.mu.
+func (h *Hub) canSeePresence(viewer, username string, level func(*models.PresencePrivacy) string) bool {
+	privacy := h.PresencePrivacy[username]
+	if privacy == nil || viewer == username {
+		return true
+	}
+	if containsString(privacy.HiddenFrom, viewer) {
+		return false
+	}
+	switch level(privacy) {
+	case VisibleToNobody:
+		return false
+	case VisibleToContacts:
+		return h.isContact(username, viewer)
+	default:
+		return true
+	}
+}
+
+// canSeeOnline and canSeeLastSeen apply username's presence privacy to viewer.
+// Callers must hold h.mu.
+func (h *Hub) canSeeOnline(viewer, username string) bool {
+	return h.canSeePresence(viewer, username, func(p *models.PresencePrivacy) string { return p.Online })
+}
+
+func (h *Hub) canSeeLastSeen(viewer, username string) bool {
+	return h.canSeePresence(viewer, username, func(p *models.PresencePrivacy) string { return p.LastSeen })
+}
+
+// canSeeAvatar and canSeeBio apply username's profile privacy to viewer.
+// Callers must hold h.mu.
+func (h *Hub) canSeeAvatar(viewer, username string) bool {
+	return h.canSeePresence(viewer, username, func(p *models.PresencePrivacy) string { return p.Avatar })
+}
+
+func (h *Hub) canSeeBio(viewer, username string) bool {
+	return h.canSeePresence(viewer, username, func(p *models.PresencePrivacy) string { return p.Bio })
+}
+
+// visibleUser returns a copy of username's presence as viewer may see it.
+// Callers must hold h.mu.
+func (h *Hub) visibleUser(viewer string, user *models.User) *models.User {
+	visible := &models.User{
+		Username:   user.Username,
+		StatusText: user.StatusText,
+		Nickname:   h.Nicknames[viewer][user.Username],
+	}
+	if h.canSeeOnline(viewer, user.Username) {
+		visible.Online = user.Online
+		visible.Away = user.Away
+	}
+	if h.canSeeLastSeen(viewer, user.Username) {
+		visible.LastSeen = user.LastSeen
+	}
+	return visible
+}
+
+// statusEventFor describes username's presence as viewer may see it.
+// Callers must hold h.mu.
+func (h *Hub) statusEventFor(viewer, username string) *models.StatusEvent {
+	event := &models.StatusEvent{Username: username}
+	if user, exists := h.Users[username]; exists {
+		visible := h.visibleUser(viewer, user)
+		event.Online = visible.Online
+		event.Away = visible.Away
+		event.LastSeen = lastSeenAt(visible)
+		event.StatusText = visible.StatusText
+	}
+	return event
+}
+
+// broadcastPresence sends username's presence audience their presence as
+// each may see it. Callers must hold h.mu.
+func (h *Hub) broadcastPresence(username string) {
+	views := make(statusViews)
+	for _, client := range h.presenceAudience(username) {
+		h.sendPrepared(client, views.event(h.statusEventFor(client.Username, username)))
+	}
+}
+
+// statusViews are the distinct status events a user's presence audience gets
+// for one change, which differ only by what each viewer may see, so each is
+// encoded once however many viewers share it
+type statusViews map[statusView]*preparedEvent
+
+type statusView struct {
+	online, away bool
+	lastSeen     time.Time
+	statusText   string
+}
+
+// event returns the prepared "status" event for status, shared with any
+// earlier viewer who got the same
+func (v statusViews) event(status *models.StatusEvent) *preparedEvent {
+	key := statusView{online: status.Online, away: status.Away, statusText: status.StatusText}
+	if status.LastSeen != nil {
+		key.lastSeen = *status.LastSeen
+	}
+	event, exists := v[key]
+	if !exists {
+		event = newPreparedEvent("status", status)
+		v[key] = event
+	}
+	return event
+}
+
+// SetStatusText sets username's custom status ("In a meeting"); empty clears
+// it. Everyone connected is told through a status event.
+func (h *Hub) SetStatusText(username, text string) string {
+	text = strings.TrimSpace(h.Sanitizer.Sanitize(text))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	user, exists := h.Users[username]
+	if !exists {
+		user = &models.User{Username: username}
+		h.Users[username] = user
+	}
+	user.StatusText = text
+
+	h.broadcastPresence(username)
+	return text
+}
+
+// GetPresencePrivacy returns username's presence privacy settings
+func (h *Hub) GetPresencePrivacy(username string) *models.PresencePrivacy {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if privacy, exists := h.PresencePrivacy[username]; exists {
+		copied := *privacy
+		copied.HiddenFrom = append([]string{}, privacy.HiddenFrom...)
+		return &copied
+	}
+	return &models.PresencePrivacy{
+		LastSeen:   VisibleToEveryone,
+		Online:     VisibleToEveryone,
+		Avatar:     VisibleToEveryone,
+		Bio:        VisibleToEveryone,
+		HiddenFrom: []string{},
+	}
+}
+
+// SetPresencePrivacy replaces username's presence privacy settings and
+// re-sends their presence so clients drop what they may no longer see
+func (h *Hub) SetPresencePrivacy(username string, privacy *models.PresencePrivacy) (*models.PresencePrivacy, error) {
+	for _, level := range []*string{&privacy.LastSeen, &privacy.Online, &privacy.Avatar, &privacy.Bio} {
+		switch *level {
+		case "":
+			*level = VisibleToEveryone
+		case VisibleToEveryone, VisibleToContacts, VisibleToNobody:
+		default:
+			return nil, errInvalidPresencePrivacy
+		}
+	}
+	hiddenFrom := []string{}
+	for _, name := range privacy.HiddenFrom {
+		if name = strings.TrimSpace(name); name != "" && name != username && !containsString(hiddenFrom, name) {
+			hiddenFrom = append(hiddenFrom, name)
+		}
+	}
+	if len(hiddenFrom) > maxPresenceHiddenFrom {
+		return nil, errTooManyHiddenFrom
+	}
+	privacy.HiddenFrom = hiddenFrom
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.PresencePrivacy[username] = privacy
+	h.broadcastPresence(username)
+	return privacy, nil
+}
+
+// HandleMyStatus handles PUT /api/me/status
+func (h *HTTPHandlers) HandleMyStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	var req StatusTextRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(req.Text) > maxStatusTextRunes {
+		http.Error(w, "Status too long", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(StatusTextRequest{Text: h.Hub.SetStatusText(session.Username, req.Text)})
+}
+
+// HandlePresencePrivacy handles GET and PUT /api/me/privacy
+func (h *HTTPHandlers) HandlePresencePrivacy(w http.ResponseWriter, r *http.Request) {
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	var privacy *models.PresencePrivacy
+	switch r.Method {
+	case http.MethodGet:
+		privacy = h.Hub.GetPresencePrivacy(session.Username)
+
+	case http.MethodPut:
+		var req models.PresencePrivacy
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if privacy, err = h.Hub.SetPresencePrivacy(session.Username, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(privacy)
+}
@@ -0,0 +1,95 @@
+package server
+
+import "strings"
+
+// maxPresenceSubscriptions bounds how many users one connection may watch
+const maxPresenceSubscriptions = 1000
+
+// presenceAudience returns the connections to tell about username's presence:
+// those subscribed to them and, while the hub broadcasts presence, every
+// other user's connection that hasn't opted into subscriptions.
+// Callers must hold h.mu.
+func (h *Hub) presenceAudience(username string) []*Client {
+	audience := make([]*Client, 0, len(h.PresenceSubscribers[username]))
+	for client := range h.PresenceSubscribers[username] {
+		audience = append(audience, client)
+	}
+	if !h.PresenceBroadcast {
+		return audience
+	}
+	for uname, devices := range h.everyClient() {
+		if uname == username {
+			continue
+		}
+		for _, client := range devices {
+			if !client.subscribesPresence {
+				audience = append(audience, client)
+			}
+		}
+	}
+	return audience
+}
+
+// subscribePresence switches client to subscription mode and adds usernames
+// to the users it watches, sending each one's current presence
+func (h *Hub) subscribePresence(client *Client, usernames []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	client.subscribesPresence = true
+	if client.presenceSubs == nil {
+		client.presenceSubs = make(map[string]bool)
+	}
+	for _, username := range usernames {
+		username = strings.TrimSpace(username)
+		if username == client.Username || client.presenceSubs[username] {
+			continue
+		}
+		if _, exists := h.Users[username]; !exists {
+			continue
+		}
+		if len(client.presenceSubs) >= maxPresenceSubscriptions {
+			break
+		}
+
+		client.presenceSubs[username] = true
+		subscribers, exists := h.PresenceSubscribers[username]
+		if !exists {
+			subscribers = make(map[*Client]bool)
+			h.PresenceSubscribers[username] = subscribers
+		}
+		subscribers[client] = true
+		h.sendToClient(client, "status", h.statusEventFor(client.Username, username))
+	}
+}
+
+// unsubscribePresence stops client watching usernames
+func (h *Hub) unsubscribePresence(client *Client, usernames []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, username := range usernames {
+		h.dropPresenceSubscription(client, strings.TrimSpace(username))
+	}
+}
+
+// dropPresenceSubscription stops client watching username.
+// Callers must hold h.mu.
+func (h *Hub) dropPresenceSubscription(client *Client, username string) {
+	if !client.presenceSubs[username] {
+		return
+	}
+	delete(client.presenceSubs, username)
+	delete(h.PresenceSubscribers[username], client)
+	if len(h.PresenceSubscribers[username]) == 0 {
+		delete(h.PresenceSubscribers, username)
+	}
+}
+
+// dropPresenceSubscriptions removes all of a closed client's subscriptions.
+// Callers must hold h.mu.
+func (h *Hub) dropPresenceSubscriptions(client *Client) {
+	for username := range client.presenceSubs {
+		h.dropPresenceSubscription(client, username)
+	}
+}
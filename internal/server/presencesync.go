@@ -0,0 +1,142 @@
+package server
+
+import (
+	"log"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+// PresenceStore shares which users are connected to which instance, so every
+// instance agrees on who is online even when one stops without saying so.
+// Each instance's entry only lasts for the ttl of its latest heartbeat.
+type PresenceStore interface {
+	// Heartbeat replaces instanceID's entry with the users connected to
+	// it and their device counts, valid for ttl
+	Heartbeat(instanceID string, devices map[string]int, ttl time.Duration) error
+
+	// Online returns the users connected to instances whose entries are
+	// current: username -> instance ID -> devices
+	Online() (map[string]map[string]int, error)
+
+	// Leave removes instanceID's entry, on shutdown
+	Leave(instanceID string) error
+
+	SetLastSeen(username string, at time.Time) error
+	LastSeen(usernames []string) (map[string]time.Time, error)
+}
+
+// StartPresenceSync heartbeats this instance's users to store every interval
+// and takes everyone else's presence from it. An instance that misses three
+// heartbeats is taken to have gone, and its users to be offline.
+func (h *Hub) StartPresenceSync(store PresenceStore, interval time.Duration) {
+	h.PresenceStore = store
+	h.syncPresence(3 * interval)
+	go func() {
+		defer close(h.presenceStopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				h.syncPresence(3 * interval)
+			case <-h.presenceDone:
+				return
+			}
+		}
+	}()
+}
+
+// StopPresenceSync stops heartbeating and removes this instance's users from
+// the store, so other instances see them go offline without waiting
+func (h *Hub) StopPresenceSync() {
+	if h.PresenceStore == nil {
+		return
+	}
+	close(h.presenceDone)
+	<-h.presenceStopped
+	if err := h.PresenceStore.Leave(h.instanceID); err != nil {
+		log.Printf("Presence store leave failed: %v", err)
+	}
+}
+
+// syncPresence heartbeats and reconciles users' online state with the store
+func (h *Hub) syncPresence(ttl time.Duration) {
+	local := make(map[string]int)
+	for username, devices := range h.everyClient() {
+		local[username] = len(devices)
+	}
+
+	if err := h.PresenceStore.Heartbeat(h.instanceID, local, ttl); err != nil {
+		log.Printf("Presence heartbeat failed: %v", err)
+		return
+	}
+	online, err := h.PresenceStore.Online()
+	if err != nil {
+		log.Printf("Presence store read failed: %v", err)
+		return
+	}
+
+	h.mu.RLock()
+	var gone []string
+	for username, user := range h.Users {
+		if user.Online && online[username] == nil && h.goneElsewhere(username) {
+			gone = append(gone, username)
+		}
+	}
+	h.mu.RUnlock()
+
+	var lastSeen map[string]time.Time
+	if len(gone) > 0 {
+		if lastSeen, err = h.PresenceStore.LastSeen(gone); err != nil {
+			log.Printf("Presence store read failed: %v", err)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for username := range online {
+		user, exists := h.Users[username]
+		if !exists {
+			user = &models.User{Username: username}
+			h.Users[username] = user
+		}
+		if !user.Online {
+			user.Online = true
+			h.sendStatus(username, true)
+		}
+	}
+	for _, username := range gone {
+		user := h.Users[username]
+		if !user.Online || !h.goneElsewhere(username) {
+			continue
+		}
+		user.Online = false
+		if at, known := lastSeen[username]; known {
+			user.LastSeen = at
+		} else {
+			user.LastSeen = time.Now()
+		}
+		h.sendStatus(username, false)
+	}
+}
+
+// goneElsewhere reports whether username being online is only known from
+// other instances: they have no device here and aren't in their reconnect
+// grace period. Callers must hold h.mu.
+func (h *Hub) goneElsewhere(username string) bool {
+	_, pending := h.pendingOffline[username]
+	return !h.isConnected(username) && !pending
+}
+
+// storeLastSeen records when username went offline in the presence store
+func (h *Hub) storeLastSeen(username string, at time.Time) {
+	if h.PresenceStore == nil {
+		return
+	}
+	go func() {
+		if err := h.PresenceStore.SetLastSeen(username, at); err != nil {
+			log.Printf("Presence store write failed: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"whatsdown/internal/models"
+)
+
+const (
+	// Maximum profile field lengths in runes
+	maxDisplayNameRunes = 64
+	maxBioRunes         = 500
+	maxPronounsRunes    = 32
+)
+
+var (
+	errDisplayNameTooLong = errors.New("display name too long")
+	errBioTooLong         = errors.New("bio too long")
+	errPronounsTooLong    = errors.New("pronouns too long")
+	errInvalidAvatarURL   = errors.New("avatar URL must be an absolute http(s) URL")
+)
+
+// displayName returns the name to show for username: their profile's display
+// name, or empty if they haven't set one. Callers must hold h.mu.
+func (h *Hub) displayName(username string) string {
+	if profile, exists := h.Profiles[username]; exists {
+		return profile.DisplayName
+	}
+	return ""
+}
+
+// GetProfile returns username's profile as viewer may see it, and false if
+// the user doesn't exist. Users who haven't set one get an empty profile.
+func (h *Hub) GetProfile(viewer, username string) (*models.Profile, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if _, exists := h.Users[username]; !exists {
+		return nil, false
+	}
+	profile := models.Profile{Username: username}
+	if stored, exists := h.Profiles[username]; exists {
+		profile = *stored
+	}
+	if !h.canSeeAvatar(viewer, username) {
+		profile.AvatarURL = ""
+	}
+	if !h.canSeeBio(viewer, username) {
+		profile.Bio = ""
+	}
+	return &profile, true
+}
+
+// SetProfile replaces username's profile. Text fields are sanitized; empty
+// fields are cleared.
+func (h *Hub) SetProfile(username string, req *models.Profile) (*models.Profile, error) {
+	profile := &models.Profile{
+		Username:    username,
+		DisplayName: strings.TrimSpace(h.Sanitizer.Sanitize(req.DisplayName)),
+		Bio:         strings.TrimSpace(h.Sanitizer.Sanitize(req.Bio)),
+		AvatarURL:   strings.TrimSpace(req.AvatarURL),
+		Pronouns:    strings.TrimSpace(h.Sanitizer.Sanitize(req.Pronouns)),
+	}
+	switch {
+	case utf8.RuneCountInString(profile.DisplayName) > maxDisplayNameRunes:
+		return nil, errDisplayNameTooLong
+	case utf8.RuneCountInString(profile.Bio) > maxBioRunes:
+		return nil, errBioTooLong
+	case utf8.RuneCountInString(profile.Pronouns) > maxPronounsRunes:
+		return nil, errPronounsTooLong
+	case profile.AvatarURL != "" && !validAvatarURL(profile.AvatarURL):
+		return nil, errInvalidAvatarURL
+	}
+
+	h.mu.Lock()
+	h.Profiles[username] = profile
+	h.mu.Unlock()
+
+	result := *profile
+	return &result, nil
+}
+
+// HandleMyProfile handles GET and PUT /api/me/profile
+func (h *HTTPHandlers) HandleMyProfile(w http.ResponseWriter, r *http.Request) {
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	var profile *models.Profile
+	switch r.Method {
+	case http.MethodGet:
+		profile, _ = h.Hub.GetProfile(session.Username, session.Username)
+
+	case http.MethodPut:
+		var req models.Profile
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if profile, err = h.Hub.SetProfile(session.Username, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profile)
+}
+
+// HandleUser routes the /api/users/{username} subtree:
+//
+//	GET    /api/users/{username}/profile
+//	PUT    /api/users/{username}/nickname
+//	DELETE /api/users/{username}/nickname
+func (h *HTTPHandlers) HandleUser(w http.ResponseWriter, r *http.Request) {
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/users/"), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	username, action := parts[0], parts[1]
+
+	switch {
+	case action == "profile" && r.Method == http.MethodGet:
+		profile, exists := h.Hub.GetProfile(session.Username, username)
+		if !exists {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(profile)
+
+	case action == "nickname" && (r.Method == http.MethodPut || r.Method == http.MethodDelete):
+		h.handleNickname(w, r, session.Username, username)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+
+	"whatsdown/internal/models"
+
+	"github.com/gorilla/websocket"
+)
+
+// protobufCodec sends envelopes as binary protobuf frames, following the
+// Envelope message in internal/models/whatsdown.proto. Payloads are carried
+// as google.protobuf.Value, so any protobuf runtime can decode them with the
+// well-known types and every event type shares one schema.
+type protobufCodec struct{}
+
+// Protobuf wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// Field numbers of Envelope and of the well-known Value, Struct and
+// ListValue messages
+const (
+	envelopeType    = 1
+	envelopePayload = 2
+	envelopeSeq     = 3
+	envelopeBatch   = 4
+
+	valueNull   = 1
+	valueNumber = 2
+	valueString = 3
+	valueBool   = 4
+	valueStruct = 5
+	valueList   = 6
+
+	structFields = 1
+	entryKey     = 1
+	entryValue   = 2
+	listValues   = 1
+)
+
+// Nesting limit when decoding, so a hostile frame can't exhaust the stack
+const protobufMaxDepth = 64
+
+var errProtobufMalformed = errors.New("malformed protobuf")
+
+func (c protobufCodec) Marshal(msg *models.WSMessage) ([]byte, error) {
+	b := getEncodeBuffer()
+	defer putEncodeBuffer(b)
+	if err := encodeProtobufPayload(b, msg.Payload); err != nil {
+		return nil, err
+	}
+	return c.MarshalEnvelope(msg.Type, msg.Seq, b.scratch), nil
+}
+
+func (protobufCodec) MarshalPayload(payload interface{}) ([]byte, error) {
+	b := getEncodeBuffer()
+	defer putEncodeBuffer(b)
+	if err := encodeProtobufPayload(b, payload); err != nil {
+		return nil, err
+	}
+	return bytes.Clone(b.scratch), nil
+}
+
+func (protobufCodec) MarshalEnvelope(msgType string, seq int64, payload []byte) []byte {
+	// Type, payload and seq, each with a tag and at most a 10-byte varint
+	data := make([]byte, 0, len(msgType)+len(payload)+3*(1+binary.MaxVarintLen64))
+	data = appendProtoBytes(data, envelopeType, []byte(msgType))
+	data = appendProtoBytes(data, envelopePayload, payload)
+	if seq != 0 {
+		data = appendProtoVarint(data, envelopeSeq, uint64(seq))
+	}
+	return data
+}
+
+// encodeProtobufPayload encodes payload into b.scratch as a
+// google.protobuf.Value. Payloads are structs with JSON tags; going through
+// JSON gives them the same field names in both encodings.
+func encodeProtobufPayload(b *encodeBuffer, payload interface{}) error {
+	payloadJSON, err := b.encodeJSON(payload)
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	if err := json.Unmarshal(payloadJSON, &value); err != nil {
+		return err
+	}
+	b.scratch = appendProtoValue(b.scratch[:0], value)
+	return nil
+}
+
+func (protobufCodec) Unmarshal(data []byte, msg *models.WSMessage) error {
+	return walkProtoFields(data, func(field int, wireType int, varint uint64, body []byte) error {
+		switch {
+		case field == envelopeType && wireType == protoBytes:
+			msg.Type = string(body)
+		case field == envelopeSeq && wireType == protoVarint:
+			msg.Seq = int64(varint)
+		case field == envelopePayload && wireType == protoBytes:
+			payload, err := parseProtoValue(body, 0)
+			if err != nil {
+				return err
+			}
+			msg.Payload = payload
+		}
+		return nil
+	})
+}
+
+func (protobufCodec) MarshalBatch(frames [][]byte) []byte {
+	data := appendProtoBytes(nil, envelopeType, []byte("batch"))
+	for _, frame := range frames {
+		data = appendProtoBytes(data, envelopeBatch, frame)
+	}
+	return data
+}
+
+// Every envelope starts with its type, so a batch starts with type "batch"
+var protobufBatchPrefix = appendProtoBytes(nil, envelopeType, []byte("batch"))
+
+func (protobufCodec) IsBatch(data []byte) bool {
+	return bytes.HasPrefix(data, protobufBatchPrefix)
+}
+
+func (protobufCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func appendProtoTag(data []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(data, uint64(field)<<3|uint64(wireType))
+}
+
+func appendProtoVarint(data []byte, field int, v uint64) []byte {
+	data = appendProtoTag(data, field, protoVarint)
+	return binary.AppendUvarint(data, v)
+}
+
+func appendProtoBytes(data []byte, field int, body []byte) []byte {
+	data = appendProtoTag(data, field, protoBytes)
+	data = binary.AppendUvarint(data, uint64(len(body)))
+	return append(data, body...)
+}
+
+// appendProtoValue encodes a decoded JSON value as a google.protobuf.Value
+func appendProtoValue(data []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return appendProtoVarint(data, valueNull, 0)
+	case float64:
+		data = appendProtoTag(data, valueNumber, protoFixed64)
+		return binary.LittleEndian.AppendUint64(data, math.Float64bits(v))
+	case string:
+		return appendProtoBytes(data, valueString, []byte(v))
+	case bool:
+		var b uint64
+		if v {
+			b = 1
+		}
+		return appendProtoVarint(data, valueBool, b)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		var fields []byte
+		for _, key := range keys {
+			var entry []byte
+			entry = appendProtoBytes(entry, entryKey, []byte(key))
+			entry = appendProtoBytes(entry, entryValue, appendProtoValue(nil, v[key]))
+			fields = appendProtoBytes(fields, structFields, entry)
+		}
+		return appendProtoBytes(data, valueStruct, fields)
+	case []interface{}:
+		var values []byte
+		for _, item := range v {
+			values = appendProtoBytes(values, listValues, appendProtoValue(nil, item))
+		}
+		return appendProtoBytes(data, valueList, values)
+	}
+	return appendProtoVarint(data, valueNull, 0)
+}
+
+// walkProtoFields calls fn with each field in a protobuf message. varint
+// holds varint values; body holds length-delimited and fixed-size ones.
+func walkProtoFields(data []byte, fn func(field int, wireType int, varint uint64, body []byte) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errProtobufMalformed
+		}
+		data = data[n:]
+		field, wireType := int(tag>>3), int(tag&7)
+
+		var varint uint64
+		var body []byte
+		switch wireType {
+		case protoVarint:
+			varint, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errProtobufMalformed
+			}
+			data = data[n:]
+		case protoFixed64, protoFixed32:
+			size := 8
+			if wireType == protoFixed32 {
+				size = 4
+			}
+			if len(data) < size {
+				return errProtobufMalformed
+			}
+			body, data = data[:size], data[size:]
+		case protoBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return errProtobufMalformed
+			}
+			body, data = data[n:n+int(length)], data[n+int(length):]
+		default:
+			return errProtobufMalformed
+		}
+		if err := fn(field, wireType, varint, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseProtoValue decodes a google.protobuf.Value into the same Go values
+// encoding/json produces. depth counts the structs and lists it is nested in.
+func parseProtoValue(data []byte, depth int) (interface{}, error) {
+	if depth > protobufMaxDepth {
+		return nil, errProtobufMalformed
+	}
+	var value interface{}
+	err := walkProtoFields(data, func(field int, wireType int, varint uint64, body []byte) error {
+		var err error
+		switch {
+		case field == valueNull:
+			value = nil
+		case field == valueNumber && wireType == protoFixed64:
+			value = math.Float64frombits(binary.LittleEndian.Uint64(body))
+		case field == valueString && wireType == protoBytes:
+			value = string(body)
+		case field == valueBool && wireType == protoVarint:
+			value = varint != 0
+		case field == valueStruct && wireType == protoBytes:
+			value, err = parseProtoStruct(body, depth+1)
+		case field == valueList && wireType == protoBytes:
+			value, err = parseProtoList(body, depth+1)
+		}
+		return err
+	})
+	return value, err
+}
+
+func parseProtoStruct(data []byte, depth int) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	err := walkProtoFields(data, func(field int, wireType int, varint uint64, body []byte) error {
+		if field != structFields || wireType != protoBytes {
+			return nil
+		}
+		var key string
+		var value interface{}
+		err := walkProtoFields(body, func(field int, wireType int, varint uint64, body []byte) error {
+			var err error
+			switch {
+			case field == entryKey && wireType == protoBytes:
+				key = string(body)
+			case field == entryValue && wireType == protoBytes:
+				value, err = parseProtoValue(body, depth)
+			}
+			return err
+		})
+		fields[key] = value
+		return err
+	})
+	return fields, err
+}
+
+func parseProtoList(data []byte, depth int) ([]interface{}, error) {
+	values := []interface{}{}
+	err := walkProtoFields(data, func(field int, wireType int, varint uint64, body []byte) error {
+		if field != listValues || wireType != protoBytes {
+			return nil
+		}
+		value, err := parseProtoValue(body, depth)
+		values = append(values, value)
+		return err
+	})
+	return values, err
+}
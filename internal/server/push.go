@@ -0,0 +1,325 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+const (
+	// Maximum registered push devices per user
+	maxPushDevices = 10
+
+	// Time allowed for a single push provider request
+	pushTimeout = 10 * time.Second
+)
+
+var (
+	errUnsupportedPlatform = errors.New("push platform not configured")
+	errPushTokenInvalid    = errors.New("push token no longer valid")
+	errPushTokenTaken      = errors.New("push token registered to another user")
+)
+
+// PushProvider delivers notifications to one mobile platform
+type PushProvider interface {
+	// Platform is the name clients register devices under, e.g. "fcm"
+	Platform() string
+	Send(ctx context.Context, device *models.PushDevice, notification *models.PushNotification) error
+}
+
+// PushService tracks users' device tokens and notification preferences and
+// sends notifications through the configured providers
+type PushService struct {
+	providers map[string]PushProvider
+	devices   map[string][]*models.PushDevice
+	prefs     map[string]*models.NotificationPreferences
+	mu        sync.RWMutex
+}
+
+// RegisterDeviceRequest registers a device token for push notifications
+type RegisterDeviceRequest struct {
+	Platform string `json:"platform"`
+	Token    string `json:"token"`
+}
+
+// NewPushService creates a push service sending through providers
+func NewPushService(providers ...PushProvider) *PushService {
+	p := &PushService{
+		providers: make(map[string]PushProvider),
+		devices:   make(map[string][]*models.PushDevice),
+		prefs:     make(map[string]*models.NotificationPreferences),
+	}
+	for _, provider := range providers {
+		p.providers[provider.Platform()] = provider
+	}
+	return p
+}
+
+// RegisterDevice adds or refreshes a device for username. A token another
+// user registered is refused until they remove it, so knowing someone's
+// token isn't enough to take over their notifications.
+func (p *PushService) RegisterDevice(username string, device *models.PushDevice) (*models.PushDevice, error) {
+	if _, configured := p.providers[device.Platform]; !configured {
+		return nil, errUnsupportedPlatform
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if owner, registered := p.tokenOwner(device.Token); registered && owner != username {
+		return nil, errPushTokenTaken
+	}
+	p.removeToken(device.Token)
+
+	device.CreatedAt = time.Now()
+	devices := append(p.devices[username], device)
+	if len(devices) > maxPushDevices {
+		devices = devices[len(devices)-maxPushDevices:]
+	}
+	p.devices[username] = devices
+	return device, nil
+}
+
+// Devices returns username's registered devices
+func (p *PushService) Devices(username string) []*models.PushDevice {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return append([]*models.PushDevice{}, p.devices[username]...)
+}
+
+// RemoveDevice unregisters one of username's device tokens
+func (p *PushService) RemoveDevice(username, token string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	devices := p.devices[username]
+	for i, device := range devices {
+		if device.Token == token {
+			p.devices[username] = append(devices[:i:i], devices[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// tokenOwner returns the user token is registered to. Callers must hold p.mu.
+func (p *PushService) tokenOwner(token string) (string, bool) {
+	for username, devices := range p.devices {
+		for _, device := range devices {
+			if device.Token == token {
+				return username, true
+			}
+		}
+	}
+	return "", false
+}
+
+// removeToken drops token from every user. Callers must hold p.mu.
+func (p *PushService) removeToken(token string) {
+	for username, devices := range p.devices {
+		for i, device := range devices {
+			if device.Token == token {
+				p.devices[username] = append(devices[:i:i], devices[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Preferences returns username's notification preferences
+func (p *PushService) Preferences(username string) models.NotificationPreferences {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if prefs, exists := p.prefs[username]; exists {
+		return *prefs
+	}
+	return models.DefaultNotificationPreferences()
+}
+
+// SetPreferences replaces username's notification preferences
+func (p *PushService) SetPreferences(username string, prefs models.NotificationPreferences) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.prefs[username] = &prefs
+}
+
+// Notify sends notification to each of username's devices unless they have
+// turned notifications off. Sends run in the background; tokens the provider
+// reports as invalid are unregistered.
+func (p *PushService) Notify(username string, notification *models.PushNotification) {
+	prefs := p.Preferences(username)
+	if !prefs.Enabled && !notification.Urgent {
+		return
+	}
+	if !prefs.ShowPreview {
+		redacted := *notification
+		redacted.Body = "New message"
+		notification = &redacted
+	}
+
+	for _, device := range p.Devices(username) {
+		provider, configured := p.providers[device.Platform]
+		if !configured {
+			continue
+		}
+		go func(device *models.PushDevice) {
+			ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+			defer cancel()
+
+			err := provider.Send(ctx, device, notification)
+			if errors.Is(err, errPushTokenInvalid) {
+				p.RemoveDevice(username, device.Token)
+			} else if err != nil {
+				log.Printf("Push to %s via %s failed: %v", username, device.Platform, err)
+			}
+		}(device)
+	}
+}
+
+// notifyOffline pushes a message to recipients who have no WebSocket connection
+func (h *Hub) notifyOffline(message *models.Message, title string, usernames []string) {
+	if h.Push == nil || len(usernames) == 0 {
+		return
+	}
+
+	notification := &models.PushNotification{
+		Title:     title,
+		Body:      message.Preview(),
+		MessageID: message.ID,
+		From:      message.From,
+		GroupID:   message.GroupID,
+		Urgent:    message.Urgent,
+	}
+
+	// Mutes and notification levels silence alerts, not delivery
+	h.mu.RLock()
+	audible := []string{}
+	for _, username := range usernames {
+		if h.shouldAlert(username, message) {
+			audible = append(audible, username)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, username := range audible {
+		h.Push.Notify(username, notification)
+	}
+}
+
+// HandlePushDevices handles:
+//
+//	GET  /api/push/devices
+//	POST /api/push/devices
+func (h *HTTPHandlers) HandlePushDevices(w http.ResponseWriter, r *http.Request) {
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		devices := h.Hub.Push.Devices(session.Username)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(devices)
+
+	case http.MethodPost:
+		var req RegisterDeviceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		req.Token = strings.TrimSpace(req.Token)
+		if req.Token == "" {
+			http.Error(w, "Token required", http.StatusBadRequest)
+			return
+		}
+
+		device, err := h.Hub.Push.RegisterDevice(session.Username, &models.PushDevice{
+			Platform: req.Platform,
+			Token:    req.Token,
+		})
+		if err == errPushTokenTaken {
+			http.Error(w, "Token is registered to another account", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Unsupported push platform", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(device)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandlePushDevice handles DELETE /api/push/devices/{token}
+func (h *HTTPHandlers) HandlePushDevice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	token := strings.TrimSpace(strings.TrimPrefix(r.URL.Path, "/api/push/devices/"))
+	if token == "" {
+		http.Error(w, "Token required", http.StatusBadRequest)
+		return
+	}
+
+	if !h.Hub.Push.RemoveDevice(session.Username, token) {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandlePushPreferences handles GET and PUT /api/push/preferences
+func (h *HTTPHandlers) HandlePushPreferences(w http.ResponseWriter, r *http.Request) {
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPut:
+		var prefs models.NotificationPreferences
+		if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := normalizePreferences(&prefs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.Hub.Push.SetPreferences(session.Username, prefs)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Hub.Push.Preferences(session.Username))
+}
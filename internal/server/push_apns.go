@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+const (
+	apnsProductionHost = "https://api.push.apple.com"
+	apnsSandboxHost    = "https://api.sandbox.push.apple.com"
+
+	// APNs rejects provider tokens older than an hour
+	apnsTokenLifetime = 50 * time.Minute
+)
+
+// APNsProvider sends notifications through Apple Push Notification service
+// using token-based (.p8 key) authentication
+type APNsProvider struct {
+	host   string
+	keyID  string
+	teamID string
+	topic  string
+	key    *ecdsa.PrivateKey
+	client *http.Client
+
+	jwt      string
+	issuedAt time.Time
+	mu       sync.Mutex
+}
+
+// NewAPNsProvider loads the .p8 signing key for keyID. topic is the app's
+// bundle ID; sandbox targets the development environment.
+func NewAPNsProvider(keyFile, keyID, teamID, topic string, sandbox bool) (*APNsProvider, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("APNs key file is not PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("APNs key is not an ECDSA key")
+	}
+
+	host := apnsProductionHost
+	if sandbox {
+		host = apnsSandboxHost
+	}
+	return &APNsProvider{
+		host:   host,
+		keyID:  keyID,
+		teamID: teamID,
+		topic:  topic,
+		key:    key,
+		client: &http.Client{Timeout: pushTimeout},
+	}, nil
+}
+
+// Platform implements PushProvider
+func (a *APNsProvider) Platform() string {
+	return "apns"
+}
+
+// Send implements PushProvider
+func (a *APNsProvider) Send(ctx context.Context, device *models.PushDevice, notification *models.PushNotification) error {
+	providerToken, err := a.token()
+	if err != nil {
+		return err
+	}
+
+	aps := map[string]interface{}{
+		"alert": map[string]string{
+			"title": notification.Title,
+			"body":  notification.Body,
+		},
+		"sound": "default",
+	}
+	if notification.Urgent {
+		// Breaks through Focus modes the user allows time-sensitive alerts in
+		aps["interruption-level"] = "time-sensitive"
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"aps":       aps,
+		"messageId": notification.MessageID,
+		"from":      notification.From,
+		"groupId":   notification.GroupID,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.host+"/3/device/"+device.Token, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+providerToken)
+	req.Header.Set("apns-topic", a.topic)
+	req.Header.Set("apns-push-type", "alert")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	var result struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode == http.StatusGone || result.Reason == "BadDeviceToken" {
+		return errPushTokenInvalid
+	}
+	return fmt.Errorf("apns returned %s: %s", resp.Status, result.Reason)
+}
+
+// token returns the cached provider JWT, re-signing it before APNs would reject it
+func (a *APNsProvider) token() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.jwt != "" && time.Since(a.issuedAt) < apnsTokenLifetime {
+		return a.jwt, nil
+	}
+
+	now := time.Now()
+	jwt, err := signJWT(
+		map[string]string{"alg": "ES256", "kid": a.keyID},
+		map[string]interface{}{"iss": a.teamID, "iat": now.Unix()},
+		func(digest []byte) ([]byte, error) {
+			return signES256(a.key, digest)
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	a.jwt = jwt
+	a.issuedAt = now
+	return a.jwt, nil
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"whatsdown/internal/models"
+)
+
+// writePKCS8 saves key as a PEM PKCS #8 file and returns its path
+func writePKCS8(t *testing.T, key any) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.p8")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// decodeJWT splits a compact JWS, decoding its header and claims into the
+// given values
+func decodeJWT(t *testing.T, token string, header, claims any) (signingInput string, signature []byte) {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token has %d parts", len(parts))
+	}
+	if err := json.Unmarshal(b64(t, parts[0]), header); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b64(t, parts[1]), claims); err != nil {
+		t.Fatal(err)
+	}
+	return parts[0] + "." + parts[1], b64(t, parts[2])
+}
+
+func TestAPNsToken(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := NewAPNsProvider(writePKCS8(t, key), "KEY123", "TEAM456", "com.example.app", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := provider.token()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var header map[string]string
+	var claims struct {
+		Iss string `json:"iss"`
+		Iat int64  `json:"iat"`
+	}
+	signingInput, signature := decodeJWT(t, token, &header, &claims)
+	if header["alg"] != "ES256" || header["kid"] != "KEY123" {
+		t.Errorf("header = %v", header)
+	}
+	if claims.Iss != "TEAM456" || claims.Iat == 0 {
+		t.Errorf("claims = %+v", claims)
+	}
+	if len(signature) != 64 {
+		t.Fatalf("signature is %d bytes", len(signature))
+	}
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+		t.Error("signature doesn't verify")
+	}
+
+	if again, err := provider.token(); err != nil || again != token {
+		t.Errorf("token wasn't reused: %v", err)
+	}
+}
+
+func TestNewAPNsProviderRejectsKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notPEM := filepath.Join(t.TempDir(), "key.p8")
+	os.WriteFile(notPEM, []byte("not a key"), 0600)
+
+	for name, path := range map[string]string{
+		"missing": filepath.Join(t.TempDir(), "missing.p8"),
+		"not PEM": notPEM,
+		"RSA":     writePKCS8(t, rsaKey),
+	} {
+		if _, err := NewAPNsProvider(path, "k", "t", "topic", false); err == nil {
+			t.Errorf("%s key accepted", name)
+		}
+	}
+}
+
+func TestAPNsSend(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	provider, err := NewAPNsProvider(writePKCS8(t, key), "KEY123", "TEAM456", "com.example.app", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var status int
+	var reason string
+	var got *http.Request
+	var body map[string]any
+	apns := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(status)
+		if reason != "" {
+			json.NewEncoder(w).Encode(map[string]string{"reason": reason})
+		}
+	}))
+	defer apns.Close()
+	provider.host = apns.URL
+
+	device := &models.PushDevice{Platform: "apns", Token: "device-token"}
+	notification := &models.PushNotification{Title: "alice", Body: "hi", MessageID: "m1", From: "alice", Urgent: true}
+	tests := []struct {
+		status  int
+		reason  string
+		invalid bool
+	}{
+		{http.StatusOK, "", false},
+		{http.StatusGone, "Unregistered", true},
+		{http.StatusBadRequest, "BadDeviceToken", true},
+		{http.StatusInternalServerError, "InternalServerError", false},
+	}
+	for _, tt := range tests {
+		status, reason = tt.status, tt.reason
+		err := provider.Send(context.Background(), device, notification)
+		if errors.Is(err, errPushTokenInvalid) != tt.invalid || (err == nil) != (tt.status == http.StatusOK) {
+			t.Errorf("Send with %d %s = %v", tt.status, tt.reason, err)
+		}
+	}
+
+	if got.URL.Path != "/3/device/device-token" || got.Header.Get("apns-topic") != "com.example.app" || !strings.HasPrefix(got.Header.Get("Authorization"), "bearer ") {
+		t.Errorf("request = %s %v", got.URL.Path, got.Header)
+	}
+	aps, _ := body["aps"].(map[string]any)
+	if aps["interruption-level"] != "time-sensitive" || body["messageId"] != "m1" {
+		t.Errorf("body = %v", body)
+	}
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeServiceAccount saves a service account key file for key
+func writeServiceAccount(t *testing.T, key *rsa.PrivateKey, tokenURI string) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(&fcmServiceAccount{
+		ProjectID:   "demo-project",
+		ClientEmail: "push@demo-project.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:    tokenURI,
+	})
+	path := filepath.Join(t.TempDir(), "service-account.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFCMToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exchanges := 0
+	oauth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exchanges++
+		if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			t.Errorf("grant_type = %q", r.FormValue("grant_type"))
+		}
+
+		var header map[string]string
+		var claims struct {
+			Iss   string `json:"iss"`
+			Scope string `json:"scope"`
+			Aud   string `json:"aud"`
+			Iat   int64  `json:"iat"`
+			Exp   int64  `json:"exp"`
+		}
+		signingInput, signature := decodeJWT(t, r.FormValue("assertion"), &header, &claims)
+		if header["alg"] != "RS256" {
+			t.Errorf("header = %v", header)
+		}
+		if claims.Iss != "push@demo-project.iam.gserviceaccount.com" || claims.Scope != fcmScope || claims.Aud != "http://"+r.Host+"/token" || claims.Exp-claims.Iat != 3600 {
+			t.Errorf("claims = %+v", claims)
+		}
+		digest := sha256.Sum256([]byte(signingInput))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			t.Errorf("signature doesn't verify: %v", err)
+		}
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "ya29.token", "expires_in": 3599})
+	}))
+	defer oauth.Close()
+
+	provider, err := NewFCMProvider(writeServiceAccount(t, key, oauth.URL+"/token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		token, err := provider.token(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "ya29.token" {
+			t.Errorf("token = %q", token)
+		}
+	}
+	if exchanges != 1 {
+		t.Errorf("token exchanged %d times, want once", exchanges)
+	}
+}
+
+func TestNewFCMProviderRejectsAccounts(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 1024)
+	valid := writeServiceAccount(t, key, "https://oauth2.googleapis.com/token")
+	data, _ := os.ReadFile(valid)
+
+	write := func(account map[string]string) string {
+		var base map[string]string
+		json.Unmarshal(data, &base)
+		for k, v := range account {
+			base[k] = v
+		}
+		encoded, _ := json.Marshal(base)
+		path := filepath.Join(t.TempDir(), "service-account.json")
+		os.WriteFile(path, encoded, 0600)
+		return path
+	}
+	for name, path := range map[string]string{
+		"missing":    filepath.Join(t.TempDir(), "missing.json"),
+		"no project": write(map[string]string{"project_id": ""}),
+		"not PEM":    write(map[string]string{"private_key": "not a key"}),
+	} {
+		if _, err := NewFCMProvider(path); err == nil {
+			t.Errorf("%s service account accepted", name)
+		}
+	}
+	if _, err := NewFCMProvider(valid); err != nil {
+		t.Errorf("valid service account: %v", err)
+	}
+}
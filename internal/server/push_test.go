@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"whatsdown/internal/models"
+)
+
+// stubProvider accepts every notification for "fcm" devices
+type stubProvider struct{}
+
+func (stubProvider) Platform() string { return "fcm" }
+
+func (stubProvider) Send(ctx context.Context, device *models.PushDevice, notification *models.PushNotification) error {
+	return nil
+}
+
+func TestRegisterDeviceRefusesTakeover(t *testing.T) {
+	push := NewPushService(stubProvider{})
+	if _, err := push.RegisterDevice("alice", &models.PushDevice{Platform: "fcm", Token: "t1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := push.RegisterDevice("mallory", &models.PushDevice{Platform: "fcm", Token: "t1"}); err != errPushTokenTaken {
+		t.Errorf("registering alice's token as mallory: %v, want errPushTokenTaken", err)
+	}
+	if devices := push.Devices("alice"); len(devices) != 1 {
+		t.Errorf("alice has %d devices, want her token kept", len(devices))
+	}
+
+	// Refreshing your own token, or one given up, is fine
+	if _, err := push.RegisterDevice("alice", &models.PushDevice{Platform: "fcm", Token: "t1"}); err != nil {
+		t.Errorf("re-registering: %v", err)
+	}
+	if devices := push.Devices("alice"); len(devices) != 1 {
+		t.Errorf("alice has %d devices after refreshing, want 1", len(devices))
+	}
+	push.RemoveDevice("alice", "t1")
+	if _, err := push.RegisterDevice("bob", &models.PushDevice{Platform: "fcm", Token: "t1"}); err != nil {
+		t.Errorf("registering a removed token: %v", err)
+	}
+	if _, err := push.RegisterDevice("bob", &models.PushDevice{Platform: "apns", Token: "t2"}); err != errUnsupportedPlatform {
+		t.Errorf("unconfigured platform: %v, want errUnsupportedPlatform", err)
+	}
+}
+
+func TestHandlePushDevicesConflict(t *testing.T) {
+	hub := NewHub()
+	hub.Push = NewPushService(stubProvider{})
+	h := &HTTPHandlers{Hub: hub}
+	if _, err := hub.Push.RegisterDevice("alice", &models.PushDevice{Platform: "fcm", Token: "t1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(&RegisterDeviceRequest{Platform: "fcm", Token: "t1"})
+	req := httptest.NewRequest(http.MethodPost, "/api/push/devices", bytes.NewReader(body))
+	req.AddCookie(&http.Cookie{Name: "session_id", Value: sessionStore.CreateSession("mallory", "192.0.2.1", "test")})
+	rec := httptest.NewRecorder()
+	h.HandlePushDevices(rec, req)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("POST = %d, want 409", rec.Code)
+	}
+}
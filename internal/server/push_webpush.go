@@ -0,0 +1,408 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+const (
+	// How long push services hold a notification for an offline browser
+	webPushTTL = 24 * time.Hour
+
+	// Record size advertised in the aes128gcm header; payloads fit in one record
+	webPushRecordSize = 4096
+)
+
+// WebPushProvider sends notifications to browsers using the Web Push protocol
+// (RFC 8030) with VAPID authentication (RFC 8292) and aes128gcm payload
+// encryption (RFC 8291)
+type WebPushProvider struct {
+	subject   string
+	key       *ecdsa.PrivateKey
+	publicKey []byte // uncompressed P-256 point
+	hosts     []string
+	client    *http.Client
+}
+
+var errWebPushAddress = errors.New("web push endpoint resolves to a non-public address")
+
+// WebPushSubscription is a browser PushSubscription as serialized by toJSON()
+type WebPushSubscription struct {
+	Endpoint string              `json:"endpoint"`
+	Keys     *models.WebPushKeys `json:"keys"`
+}
+
+// NewWebPushProvider creates a provider identified by subject (a mailto: or
+// https: contact). privateKey is the base64url VAPID private key; if empty a
+// key is generated, which invalidates browser subscriptions on restart.
+// Subscriptions are only accepted for endpoints on hosts, or their
+// subdomains.
+func NewWebPushProvider(subject, privateKey string, hosts []string) (*WebPushProvider, error) {
+	var key *ecdsa.PrivateKey
+	if privateKey == "" {
+		generated, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		key = generated
+		log.Println("No VAPID key configured; generated one for this run")
+	} else {
+		scalar, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(privateKey, "="))
+		if err != nil {
+			return nil, errors.New("VAPID private key must be base64url")
+		}
+		ecdhKey, err := ecdh.P256().NewPrivateKey(scalar)
+		if err != nil {
+			return nil, err
+		}
+		point := ecdhKey.PublicKey().Bytes()
+		key = &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(point[1:33]),
+				Y:     new(big.Int).SetBytes(point[33:]),
+			},
+			D: new(big.Int).SetBytes(scalar),
+		}
+	}
+
+	ecdhKey, err := key.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	return &WebPushProvider{
+		subject:   subject,
+		key:       key,
+		publicKey: ecdhKey.PublicKey().Bytes(),
+		hosts:     hosts,
+		client:    newWebPushClient(),
+	}, nil
+}
+
+// newWebPushClient returns a client that only connects to public addresses
+// and doesn't follow redirects, so an endpoint whose name resolves, or
+// redirects, into the server's network is refused
+func newWebPushClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: pushTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip, err := netip.ParseAddr(host)
+			if err != nil || !publicAddr(ip) {
+				return errWebPushAddress
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout:   pushTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: pushTimeout},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// publicAddr reports whether ip may be a push service's: not loopback,
+// private, link-local, multicast or unspecified
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// Ranges netip doesn't class as private that still aren't reachable on the
+// internet: "this network" and carrier-grade NAT
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// AllowsEndpoint reports whether a subscription endpoint is an https URL on
+// one of the provider's push service hosts
+func (w *WebPushProvider) AllowsEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "https" || u.User != nil || (u.Port() != "" && u.Port() != "443") {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range w.hosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Platform implements PushProvider
+func (w *WebPushProvider) Platform() string {
+	return "webpush"
+}
+
+// PublicKey returns the VAPID application server key browsers subscribe with
+func (w *WebPushProvider) PublicKey() string {
+	return base64.RawURLEncoding.EncodeToString(w.publicKey)
+}
+
+// Send implements PushProvider. The device token is the subscription endpoint.
+func (w *WebPushProvider) Send(ctx context.Context, device *models.PushDevice, notification *models.PushNotification) error {
+	if device.Keys == nil || !w.AllowsEndpoint(device.Token) {
+		return errPushTokenInvalid
+	}
+
+	plaintext, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	body, err := encryptWebPush(device.Keys, plaintext)
+	if err != nil {
+		return err
+	}
+
+	endpoint, err := url.Parse(device.Token)
+	if err != nil {
+		return errPushTokenInvalid
+	}
+	jwt, err := w.vapidToken(endpoint.Scheme + "://" + endpoint.Host)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, device.Token, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "vapid t="+jwt+", k="+w.PublicKey())
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", fmt.Sprint(int(webPushTTL.Seconds())))
+	if notification.Urgent {
+		req.Header.Set("Urgency", "high")
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		// The browser unsubscribed or the subscription expired
+		return errPushTokenInvalid
+	default:
+		return fmt.Errorf("web push returned %s", resp.Status)
+	}
+}
+
+// vapidToken signs a VAPID JWT for the push service at audience
+func (w *WebPushProvider) vapidToken(audience string) (string, error) {
+	return signJWT(
+		map[string]string{"alg": "ES256", "typ": "JWT"},
+		map[string]interface{}{
+			"aud": audience,
+			"exp": time.Now().Add(12 * time.Hour).Unix(),
+			"sub": w.subject,
+		},
+		func(digest []byte) ([]byte, error) {
+			return signES256(w.key, digest)
+		},
+	)
+}
+
+// encryptWebPush encrypts plaintext for a subscription as a single aes128gcm record
+func encryptWebPush(keys *models.WebPushKeys, plaintext []byte) ([]byte, error) {
+	uaPublicBytes, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(keys.P256dh, "="))
+	if err != nil {
+		return nil, errPushTokenInvalid
+	}
+	authSecret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(keys.Auth, "="))
+	if err != nil {
+		return nil, errPushTokenInvalid
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, errPushTokenInvalid
+	}
+
+	// Fresh application server key pair and salt for every message
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return sealWebPush(uaPublic, authSecret, asPrivate, salt, plaintext)
+}
+
+// sealWebPush encrypts plaintext for the user agent's key and auth secret
+// with the given application server key and salt
+func sealWebPush(uaPublic *ecdh.PublicKey, authSecret []byte, asPrivate *ecdh.PrivateKey, salt, plaintext []byte) ([]byte, error) {
+	uaPublicBytes := uaPublic.Bytes()
+	asPublicBytes := asPrivate.PublicKey().Bytes()
+	sharedSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublicBytes...)
+	keyInfo = append(keyInfo, asPublicBytes...)
+	ikm := hkdfExpand(hkdfExtract(authSecret, sharedSecret), keyInfo, 32)
+
+	prk := hkdfExtract(salt, ikm)
+	contentKey := hkdfExpand(prk, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdfExpand(prk, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// 0x02 marks the final record
+	record := append(append(make([]byte, 0, len(plaintext)+1), plaintext...), 0x02)
+	ciphertext := gcm.Seal(nil, nonce, record, nil)
+
+	header := make([]byte, 0, 16+4+1+len(asPublicBytes))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webPushRecordSize)
+	header = append(header, byte(len(asPublicBytes)))
+	header = append(header, asPublicBytes...)
+	return append(header, ciphertext...), nil
+}
+
+// hkdfExtract is HKDF-Extract (RFC 5869) with SHA-256
+func hkdfExtract(salt, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+// hkdfExpand is HKDF-Expand (RFC 5869) with SHA-256 for lengths up to one hash block
+func hkdfExpand(prk, info []byte, length int) []byte {
+	mac := hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{0x01})
+	return mac.Sum(nil)[:length]
+}
+
+// signES256 signs digest, returning the raw 64-byte r||s form JWS expects
+func signES256(key *ecdsa.PrivateKey, digest []byte) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+	if err != nil {
+		return nil, err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signature, nil
+}
+
+// HandleWebPush handles:
+//
+//	GET    /api/push/webpush - the VAPID public key to subscribe with
+//	POST   /api/push/webpush - register a browser PushSubscription
+//	DELETE /api/push/webpush - unregister a subscription by endpoint
+func (h *HTTPHandlers) HandleWebPush(w http.ResponseWriter, r *http.Request) {
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	if h.WebPush == nil {
+		http.Error(w, "Web Push is not configured", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"publicKey": h.WebPush.PublicKey()})
+
+	case http.MethodPost:
+		var sub WebPushSubscription
+		if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if sub.Keys == nil || sub.Keys.P256dh == "" || sub.Keys.Auth == "" {
+			http.Error(w, "Subscription needs p256dh and auth keys", http.StatusBadRequest)
+			return
+		}
+		if !h.WebPush.AllowsEndpoint(sub.Endpoint) {
+			http.Error(w, "Subscription endpoint must be https on a known push service", http.StatusBadRequest)
+			return
+		}
+
+		device, err := h.Hub.Push.RegisterDevice(session.Username, &models.PushDevice{
+			Platform: h.WebPush.Platform(),
+			Token:    sub.Endpoint,
+			Keys:     sub.Keys,
+		})
+		if err == errPushTokenTaken {
+			http.Error(w, "Subscription is registered to another account", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Web Push is not configured", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(device)
+
+	case http.MethodDelete:
+		var sub WebPushSubscription
+		if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !h.Hub.Push.RemoveDevice(session.Username, sub.Endpoint) {
+			http.Error(w, "Subscription not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"whatsdown/internal/models"
+)
+
+func b64(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// openWebPush decrypts a single-record aes128gcm message as a user agent
+// would (RFC 8291 section 3.4)
+func openWebPush(t *testing.T, uaPrivate *ecdh.PrivateKey, authSecret, message []byte) []byte {
+	t.Helper()
+	if len(message) < 21 {
+		t.Fatal("message too short for a header")
+	}
+	salt := message[:16]
+	if size := binary.BigEndian.Uint32(message[16:20]); size != webPushRecordSize {
+		t.Fatalf("record size %d", size)
+	}
+	idLen := int(message[20])
+	asPublic, err := ecdh.P256().NewPublicKey(message[21 : 21+idLen])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharedSecret, err := uaPrivate.ECDH(asPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPrivate.PublicKey().Bytes()...)
+	keyInfo = append(keyInfo, asPublic.Bytes()...)
+	ikm := hkdfExpand(hkdfExtract(authSecret, sharedSecret), keyInfo, 32)
+	prk := hkdfExtract(salt, ikm)
+	block, _ := aes.NewCipher(hkdfExpand(prk, []byte("Content-Encoding: aes128gcm\x00"), 16))
+	gcm, _ := cipher.NewGCM(block)
+	record, err := gcm.Open(nil, hkdfExpand(prk, []byte("Content-Encoding: nonce\x00"), 12), message[21+idLen:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record) == 0 || record[len(record)-1] != 0x02 {
+		t.Fatal("record isn't marked final")
+	}
+	return record[:len(record)-1]
+}
+
+// TestSealWebPushVector checks the example in RFC 8291 appendix A
+func TestSealWebPushVector(t *testing.T) {
+	asPrivate, err := ecdh.P256().NewPrivateKey(b64(t, "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(b64(t, "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := sealWebPush(uaPublic, b64(t, "BTBZMqHH6r4Tts7J_aSIgg"), asPrivate, b64(t, "DGv6ra1nlYgDCS1FRnbzlw"), []byte("When I grow up, I want to be a watermelon"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+	if got := base64.RawURLEncoding.EncodeToString(message); got != want {
+		t.Errorf("sealWebPush =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestEncryptWebPushRoundTrip(t *testing.T) {
+	uaPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authSecret := make([]byte, 16)
+	rand.Read(authSecret)
+	keys := &models.WebPushKeys{
+		P256dh: base64.RawURLEncoding.EncodeToString(uaPrivate.PublicKey().Bytes()),
+		Auth:   base64.URLEncoding.EncodeToString(authSecret), // Padded, as some browsers send it
+	}
+
+	for _, plaintext := range [][]byte{{}, []byte(`{"title":"hi"}`), bytes.Repeat([]byte("x"), 3000)} {
+		message, err := encryptWebPush(keys, plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := openWebPush(t, uaPrivate, authSecret, message); !bytes.Equal(got, plaintext) {
+			t.Errorf("decrypted %q, want %q", got, plaintext)
+		}
+	}
+
+	bad := []*models.WebPushKeys{
+		{P256dh: "not base64!", Auth: keys.Auth},
+		{P256dh: keys.P256dh, Auth: "not base64!"},
+		{P256dh: base64.RawURLEncoding.EncodeToString([]byte("short")), Auth: keys.Auth},
+	}
+	for _, keys := range bad {
+		if _, err := encryptWebPush(keys, []byte("x")); !errors.Is(err, errPushTokenInvalid) {
+			t.Errorf("encryptWebPush(%+v) error = %v, want errPushTokenInvalid", keys, err)
+		}
+	}
+}
+
+func TestVAPIDToken(t *testing.T) {
+	provider, err := NewWebPushProvider("mailto:ops@example.com", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := provider.vapidToken("https://fcm.googleapis.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token has %d parts", len(parts))
+	}
+
+	var claims struct {
+		Aud string `json:"aud"`
+		Sub string `json:"sub"`
+		Exp int64  `json:"exp"`
+	}
+	if err := json.Unmarshal(b64(t, parts[1]), &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Aud != "https://fcm.googleapis.com" || claims.Sub != "mailto:ops@example.com" || claims.Exp == 0 {
+		t.Errorf("claims = %+v", claims)
+	}
+
+	signature := b64(t, parts[2])
+	if len(signature) != 64 {
+		t.Fatalf("signature is %d bytes", len(signature))
+	}
+	point := b64(t, provider.PublicKey())
+	x, y := new(big.Int).SetBytes(point[1:33]), new(big.Int).SetBytes(point[33:])
+	publicKey := &ecdsa.PublicKey{Curve: provider.key.Curve, X: x, Y: y}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(publicKey, digest[:], r, s) {
+		t.Error("signature doesn't verify with the published key")
+	}
+}
+
+func TestWebPushAllowsEndpoint(t *testing.T) {
+	provider, err := NewWebPushProvider("mailto:ops@example.com", "", DefaultConfig().WebPushHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		endpoint string
+		want     bool
+	}{
+		{"https://fcm.googleapis.com/fcm/send/abc", true},
+		{"https://updates.push.services.mozilla.com/wpush/v2/abc", true},
+		{"https://web.push.apple.com/abc", true},
+		{"https://wns2-by3p.notify.windows.com/w/?token=abc", true},
+		{"https://FCM.googleapis.com:443/fcm/send/abc", true},
+		{"http://fcm.googleapis.com/fcm/send/abc", false},
+		{"https://fcm.googleapis.com:8443/fcm/send/abc", false},
+		{"https://user@fcm.googleapis.com/fcm/send/abc", false},
+		{"https://fcm.googleapis.com.evil.example/abc", false},
+		{"https://evilfcm.googleapis.com.example/abc", false},
+		{"https://127.0.0.1/abc", false},
+		{"https://169.254.169.254/latest/meta-data", false},
+		{"https://localhost/abc", false},
+		{"not a url", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := provider.AllowsEndpoint(tt.endpoint); got != tt.want {
+			t.Errorf("AllowsEndpoint(%q) = %v, want %v", tt.endpoint, got, tt.want)
+		}
+	}
+}
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"142.250.74.10", true},
+		{"2a00:1450:4001:80b::200a", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"100.64.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:8.8.8.8", true},
+		{"224.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := publicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("publicAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+// The push client refuses to connect to the server's own network, so a
+// listed host whose name resolves there, or a redirect, gets nowhere
+func TestWebPushClientRefusesLoopback(t *testing.T) {
+	hits := 0
+	push := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+	}))
+	defer push.Close()
+
+	client := newWebPushClient()
+	client.Transport.(*http.Transport).TLSClientConfig = push.Client().Transport.(*http.Transport).TLSClientConfig
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, push.URL, nil)
+	resp, err := client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	if !errors.Is(err, errWebPushAddress) {
+		t.Errorf("Do error = %v, want errWebPushAddress", err)
+	}
+	if hits != 0 {
+		t.Errorf("push endpoint was hit %d times", hits)
+	}
+}
+
+func TestHandleWebPushRejectsEndpoints(t *testing.T) {
+	provider, err := NewWebPushProvider("mailto:ops@example.com", "", DefaultConfig().WebPushHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &HTTPHandlers{Hub: NewHub(), WebPush: provider}
+	sessionID := sessionStore.CreateSession("webpush-user", "192.0.2.1", "test")
+
+	for _, endpoint := range []string{"https://127.0.0.1/push", "https://internal.example/push", "http://fcm.googleapis.com/fcm/send/x"} {
+		body, _ := json.Marshal(&WebPushSubscription{Endpoint: endpoint, Keys: &models.WebPushKeys{P256dh: "k", Auth: "a"}})
+		req := httptest.NewRequest(http.MethodPost, "/api/push/webpush", bytes.NewReader(body))
+		req.AddCookie(&http.Cookie{Name: "session_id", Value: sessionID})
+		rec := httptest.NewRecorder()
+		h.HandleWebPush(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("POST %s = %d, want 400", endpoint, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+// frameLimiter is a token bucket limiting the frames a connection may send.
+// Only the client's read pump, or a long-poll client's send handler, uses it.
+type frameLimiter struct {
+	rate    float64 // Tokens added per second
+	burst   float64
+	tokens  float64
+	last    time.Time
+	limited bool // Whether the client has been told it is being limited
+	dropped int  // Frames dropped since the client was last allowed one
+}
+
+func newFrameLimiter(perSecond, burst int) *frameLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &frameLimiter{
+		rate:   float64(perSecond),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token if one is available. A nil limiter allows everything.
+func (l *frameLimiter) allow() bool {
+	if l == nil {
+		return true
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	l.limited = false
+	l.dropped = 0
+	return true
+}
+
+// rateLimited drops a frame over the client's rate limit, telling the client
+// once per run of dropped frames rather than answering each one. A client
+// that sends another full burst while limited is disconnected.
+func (c *Client) rateLimited() {
+	c.limiter.dropped++
+	if c.limiter.dropped >= int(c.limiter.burst) {
+		c.closeWith(CloseRateLimited, "rate limited")
+		return
+	}
+	if c.limiter.limited {
+		return
+	}
+	c.limiter.limited = true
+	c.sendError(&models.ErrorEvent{
+		Code:    ErrorRateLimited,
+		Message: "too many frames; slow down",
+		Limit:   int(c.limiter.rate),
+	})
+}
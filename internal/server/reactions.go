@@ -0,0 +1,61 @@
+package server
+
+import (
+	"log"
+	"unicode"
+	"unicode/utf8"
+
+	"whatsdown/internal/models"
+)
+
+// Maximum length of a reaction in runes; allows multi-codepoint emoji such as
+// flags and skin-tone or ZWJ sequences
+const maxReactionRunes = 16
+
+// validReaction reports whether emoji looks like an emoji rather than text
+func validReaction(emoji string) bool {
+	if emoji == "" {
+		return true
+	}
+	if utf8.RuneCountInString(emoji) > maxReactionRunes {
+		return false
+	}
+	for _, r := range emoji {
+		if r < utf8.RuneSelf || unicode.IsLetter(r) || unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleReaction records a user's reaction to a message and pushes the
+// updated aggregate to everyone in the conversation
+func (h *Hub) handleReaction(from string, event *models.ReactionEvent) {
+	if !validReaction(event.Emoji) {
+		log.Printf("Dropping invalid reaction from %s on %s", from, event.MessageID)
+		return
+	}
+
+	h.mu.Lock()
+	message, exists := h.message(event.MessageID)
+	if !exists || message.Deleted || !h.canAccessMessage(message, from) {
+		h.mu.Unlock()
+		log.Printf("Dropping reaction from %s: message %s not found", from, event.MessageID)
+		return
+	}
+
+	message.React(from, event.Emoji)
+
+	update := &models.ReactionEvent{
+		MessageID: message.ID,
+		Emoji:     event.Emoji,
+		From:      from,
+		Reactions: message.Snapshot().Reactions,
+	}
+	recipients := h.participantClients(message)
+	h.mu.Unlock()
+
+	for _, client := range recipients {
+		h.sendToClient(client, "reaction", update)
+	}
+}
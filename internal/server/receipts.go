@@ -0,0 +1,179 @@
+package server
+
+import (
+	"log"
+
+	"whatsdown/internal/models"
+)
+
+// handleRead marks messages in a conversation as read by reader, acks each
+// newly read message back to its sender, and syncs the reader's new position
+// to their clients as a "read_marker" event. Only the messages between the
+// reader's previous position and the new one are looked at; those before it
+// were marked when it was reached.
+func (h *Hub) handleRead(reader string, event *models.ReadEvent) {
+	h.mu.Lock()
+
+	var convKey string
+	var group *models.Group
+	switch {
+	case event.GroupID != "":
+		g, exists := h.Groups[event.GroupID]
+		if !exists || !g.IsMember(reader) {
+			h.mu.Unlock()
+			log.Printf("Dropping read event from %s: not a member of %s", reader, event.GroupID)
+			return
+		}
+		group = g
+		convKey = models.GroupConvKey(g.ID)
+	case event.ChannelID != "":
+		channel, exists := h.Channels[event.ChannelID]
+		if !exists || !(h.Subscriptions[channel.ID][reader] || channel.CanPublish(reader)) {
+			h.mu.Unlock()
+			log.Printf("Dropping read event from %s: not subscribed to %s", reader, event.ChannelID)
+			return
+		}
+		// Channels have no receipts, only the reader's position
+		convKey = models.ChannelConvKey(channel.ID)
+		h.advanceReadPosition(reader, convKey, event.UpTo)
+		marker := h.readMarker(reader, convKey, event)
+		readerClients := h.clientsFor([]string{reader})
+		h.mu.Unlock()
+
+		h.syncReadMarker(readerClients, marker)
+		return
+	default:
+		if _, exists := h.Users[event.Peer]; !exists {
+			h.mu.Unlock()
+			log.Printf("Dropping read event from %s: unknown user %s", reader, event.Peer)
+			return
+		}
+		convKey = models.ConvKey(reader, event.Peer)
+	}
+	previous := h.ReadPositions[reader][convKey]
+	h.advanceReadPosition(reader, convKey, event.UpTo)
+	messages := h.conversation(convKey)
+	newlyRead := messages[readCount(messages, previous):readCount(messages, h.ReadPositions[reader][convKey])]
+
+	acks := make(map[string][]string) // sender -> message IDs now read
+	for _, message := range newlyRead {
+		if message.From != reader && message.Status != "read" && !message.Deleted {
+			if group == nil {
+				message.Status = "read"
+				acks[message.From] = append(acks[message.From], message.ID)
+				h.emitDelivery(message, reader, "", "read")
+			} else if !containsString(message.ReadBy, reader) {
+				message.ReadBy = append(message.ReadBy, reader)
+				h.emitDelivery(message, reader, "", "read")
+				if len(message.ReadBy) >= len(group.Members)-1 {
+					message.Status = "read"
+					acks[message.From] = append(acks[message.From], message.ID)
+				}
+			}
+		}
+	}
+
+	senders := make(map[string][]*Client, len(acks))
+	for sender, messageIDs := range acks {
+		senders[sender] = h.clientsOf(sender)
+		for _, messageID := range messageIDs {
+			h.queueOffline(sender, offlineEvent{msgType: "ack", payload: &models.AckEvent{
+				MessageID: messageID,
+				Status:    "read",
+			}})
+		}
+	}
+	marker := h.readMarker(reader, convKey, event)
+	readerClients := h.clientsFor([]string{reader})
+	h.mu.Unlock()
+
+	h.syncReadMarker(readerClients, marker)
+
+	for sender, clients := range senders {
+		for _, messageID := range acks[sender] {
+			ack := &models.AckEvent{
+				MessageID: messageID,
+				Status:    "read",
+			}
+			for _, client := range clients {
+				h.sendToClient(client, "ack", ack)
+			}
+		}
+	}
+}
+
+// readMarker describes username's read position in a conversation, which
+// event identifies. Callers must hold h.mu.
+func (h *Hub) readMarker(username, convKey string, event *models.ReadEvent) *models.ReadMarkerEvent {
+	marker := &models.ReadMarkerEvent{
+		Peer:        event.Peer,
+		GroupID:     event.GroupID,
+		ChannelID:   event.ChannelID,
+		UnreadCount: h.unreadCount(username, convKey),
+	}
+	messages := h.conversation(convKey)
+	if read := readCount(messages, h.ReadPositions[username][convKey]); read > 0 {
+		marker.UpTo = messages[read-1].ID
+	}
+	return marker
+}
+
+// syncReadMarker sends a reader's new read position to their clients so
+// unread badges clear on every device
+func (h *Hub) syncReadMarker(clients []*Client, marker *models.ReadMarkerEvent) {
+	for _, client := range clients {
+		h.sendToClient(client, "read_marker", marker)
+	}
+}
+
+// advanceReadPosition moves username's read position in a conversation up to
+// and including upTo, or to the end if upTo is empty or unknown. Positions
+// never move backwards. Callers must hold h.mu.
+func (h *Hub) advanceReadPosition(username, convKey, upTo string) {
+	position := h.lastSeq(convKey)
+	if message, exists := h.message(upTo); exists && message.ConvKey() == convKey {
+		position = message.Seq
+	}
+
+	positions, exists := h.ReadPositions[username]
+	if !exists {
+		positions = make(map[string]int64)
+		h.ReadPositions[username] = positions
+	}
+	if position > positions[convKey] {
+		positions[convKey] = position
+	}
+}
+
+// unreadCount counts messages from others after username's read position,
+// ignoring deleted, hidden, and thread reply messages. Callers must hold h.mu.
+func (h *Hub) unreadCount(username, convKey string) int {
+	messages := h.conversation(convKey)
+	count := 0
+	for _, message := range messages[readCount(messages, h.ReadPositions[username][convKey]):] {
+		if message.From == username || message.Deleted || message.ThreadID != "" || message.HiddenFrom(username) {
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// readCount returns how many of messages, a run of a conversation, are at or
+// before the read position seq. Old messages may have been evicted, so the
+// run needn't start at seq 1.
+func readCount(messages []*models.Message, seq int64) int {
+	if len(messages) == 0 {
+		return 0
+	}
+	return int(min(max(seq-messages[0].Seq+1, 0), int64(len(messages))))
+}
+
+func containsString(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"testing"
+
+	"whatsdown/internal/models"
+)
+
+func TestHandleReadAdvancesFromPreviousPosition(t *testing.T) {
+	hub := newTestHub(t, "alice", "bob")
+	var sent []*models.Message
+	for _, content := range []string{"one", "two", "three"} {
+		hub.handleInboundMessageWithSender("alice", &models.InboundMessage{To: "bob", Content: content})
+		sent = append(sent, lastMessage(t, hub, &models.Message{From: "alice", To: "bob"}))
+	}
+
+	hub.handleRead("bob", &models.ReadEvent{Peer: "alice", UpTo: sent[1].ID})
+	hub.mu.RLock()
+	statuses := []string{sent[0].Status, sent[1].Status, sent[2].Status}
+	hub.mu.RUnlock()
+	if statuses[0] != "read" || statuses[1] != "read" || statuses[2] == "read" {
+		t.Fatalf("statuses after reading up to two = %v", statuses)
+	}
+
+	// Reading an earlier message doesn't move the position back
+	hub.handleRead("bob", &models.ReadEvent{Peer: "alice", UpTo: sent[0].ID})
+	hub.handleRead("bob", &models.ReadEvent{Peer: "alice"})
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	if sent[2].Status != "read" {
+		t.Errorf("third message is %s, want read", sent[2].Status)
+	}
+	if position := hub.ReadPositions["bob"][models.ConvKey("alice", "bob")]; position != sent[2].Seq {
+		t.Errorf("read position = %d, want %d", position, sent[2].Seq)
+	}
+}
+
+func TestHandleReadChecksChannelSubscription(t *testing.T) {
+	hub := newTestHub(t, "alice", "bob", "carol")
+	channel := hub.CreateChannel("alice", "news", "")
+	if _, err := hub.Subscribe(channel.ID, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	hub.handleInboundMessageWithSender("alice", &models.InboundMessage{ChannelID: channel.ID, Content: "hello"})
+
+	hub.handleRead("bob", &models.ReadEvent{ChannelID: channel.ID})
+	hub.handleRead("carol", &models.ReadEvent{ChannelID: channel.ID})
+	hub.handleRead("carol", &models.ReadEvent{ChannelID: "no-such-channel"})
+
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	if hub.ReadPositions["bob"][models.ChannelConvKey(channel.ID)] == 0 {
+		t.Error("subscriber's read position didn't move")
+	}
+	if len(hub.ReadPositions["carol"]) != 0 {
+		t.Errorf("non-subscriber has read positions %v", hub.ReadPositions["carol"])
+	}
+}
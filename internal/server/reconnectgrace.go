@@ -0,0 +1,55 @@
+package server
+
+import "time"
+
+// holdOffline marks username offline once h.ReconnectGrace has passed
+// since their last device disconnected at disconnectedAt, unless a device
+// reconnects first. A phone moving from Wi-Fi to LTE drops its socket and
+// reconnects from a new address moments later; peers shouldn't see it go
+// offline and back. Callers must hold h.mu.
+func (h *Hub) holdOffline(username string, disconnectedAt time.Time) {
+	if h.ReconnectGrace <= 0 {
+		h.markOffline(username, disconnectedAt)
+		return
+	}
+
+	h.cancelOffline(username)
+	var timer *time.Timer
+	timer = time.AfterFunc(h.ReconnectGrace, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.pendingOffline[username] != timer {
+			return
+		}
+		delete(h.pendingOffline, username)
+		if !h.isConnected(username) {
+			h.markOffline(username, disconnectedAt)
+		}
+	})
+	h.pendingOffline[username] = timer
+}
+
+// cancelOffline stops username from being marked offline after a
+// disconnect, reporting whether they were still within the grace period.
+// Callers must hold h.mu.
+func (h *Hub) cancelOffline(username string) bool {
+	timer, pending := h.pendingOffline[username]
+	if !pending {
+		return false
+	}
+	timer.Stop()
+	delete(h.pendingOffline, username)
+	return true
+}
+
+// markOffline records that username went offline at lastSeen and tells
+// their presence audience. Callers must hold h.mu.
+func (h *Hub) markOffline(username string, lastSeen time.Time) {
+	if user, exists := h.Users[username]; exists {
+		user.Online = false
+		user.Away = false
+		user.LastSeen = lastSeen
+	}
+	h.storeLastSeen(username, lastSeen)
+	h.broadcastStatus(username, false)
+}
@@ -0,0 +1,424 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	redisDialTimeout = 5 * time.Second
+	redisMaxBackoff  = 30 * time.Second
+	redisQueueSize   = 4096
+
+	// Limits on replies, so a bad server can't make us allocate without
+	// bound: Redis's own largest string, and how deep arrays may nest
+	redisMaxBulk  = 512 << 20
+	redisMaxDepth = 8
+)
+
+// redisEndpoint is a Redis server and the credentials to connect with
+type redisEndpoint struct {
+	addr     string
+	username string
+	password string
+	tls      bool
+}
+
+// RedisBroker relays events between instances over Redis pub/sub. Each topic
+// is a channel under the prefix. One connection publishes from a queue, so
+// Publish never blocks the hub, and another subscribes to every channel
+// under the prefix; both reconnect with backoff. Events published while a
+// connection is down are lost, as with any pub/sub.
+type RedisBroker struct {
+	redisEndpoint
+	prefix string
+
+	queue chan redisMessage
+	done  chan struct{}
+	once  sync.Once
+
+	// Open connections, closed by Close to end blocked reads
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+}
+
+type redisMessage struct {
+	channel string
+	data    []byte
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// parseRedisURL reads redis://[user:password@]host[:port], or rediss:// for
+// TLS
+func parseRedisURL(rawURL string) (redisEndpoint, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redisEndpoint{}, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return redisEndpoint{}, fmt.Errorf("unsupported scheme %q; use redis:// or rediss://", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return redisEndpoint{}, errors.New("missing host")
+	}
+	endpoint := redisEndpoint{addr: u.Host, tls: u.Scheme == "rediss"}
+	if u.Port() == "" {
+		endpoint.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		endpoint.password, _ = u.User.Password()
+		if endpoint.password == "" {
+			// redis://password@host
+			endpoint.password = u.User.Username()
+		} else {
+			endpoint.username = u.User.Username()
+		}
+	}
+	return endpoint, nil
+}
+
+// connect opens and authenticates a connection
+func (e redisEndpoint) connect() (net.Conn, *bufio.Reader, error) {
+	dialer := &net.Dialer{Timeout: redisDialTimeout}
+	var conn net.Conn
+	var err error
+	if e.tls {
+		conn, err = tls.DialWithDialer(dialer, "tcp", e.addr, nil)
+	} else {
+		conn, err = dialer.Dial("tcp", e.addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	if e.password != "" {
+		args := []string{"AUTH", e.password}
+		if e.username != "" {
+			args = []string{"AUTH", e.username, e.password}
+		}
+		conn.SetDeadline(time.Now().Add(redisDialTimeout))
+		if _, err := redisCommand(conn, r, args...); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn.SetDeadline(time.Time{})
+	}
+	return conn, r, nil
+}
+
+// NewRedisBroker connects to the server at rawURL, redis://[user:password@]host[:port]
+// or rediss:// for TLS, using channels named prefix + topic
+func NewRedisBroker(rawURL, prefix string) (*RedisBroker, error) {
+	endpoint, err := parseRedisURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	b := &RedisBroker{
+		redisEndpoint: endpoint,
+		prefix:        prefix,
+		queue:         make(chan redisMessage, redisQueueSize),
+		done:          make(chan struct{}),
+		conns:         make(map[net.Conn]bool),
+	}
+
+	// Fail at startup rather than on the first event if Redis can't be reached
+	conn, _, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	b.forget(conn)
+
+	go b.publishLoop()
+	return b, nil
+}
+
+// Publish queues data for the publisher connection, dropping it if the queue
+// is full
+func (b *RedisBroker) Publish(topic string, data []byte) {
+	select {
+	case b.queue <- redisMessage{channel: b.prefix + topic, data: data}:
+	default:
+		log.Printf("Redis publish queue full; dropping event on %s", topic)
+	}
+}
+
+// Subscribe subscribes to every channel under the prefix, calling handler
+// from a single goroutine with the topic each message was published on
+func (b *RedisBroker) Subscribe(handler func(topic string, data []byte)) error {
+	conn, r, err := b.psubscribe()
+	if err != nil {
+		return err
+	}
+	go b.subscribeLoop(conn, r, handler)
+	return nil
+}
+
+// Close stops publishing and subscribing and closes the connections
+func (b *RedisBroker) Close() error {
+	b.once.Do(func() {
+		close(b.done)
+		b.mu.Lock()
+		for conn := range b.conns {
+			conn.Close()
+		}
+		b.mu.Unlock()
+	})
+	return nil
+}
+
+func (b *RedisBroker) closed() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// dial opens a connection that Close will close
+func (b *RedisBroker) dial() (net.Conn, *bufio.Reader, error) {
+	conn, r, err := b.connect()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed() {
+		conn.Close()
+		return nil, nil, net.ErrClosed
+	}
+	b.conns[conn] = true
+	return conn, r, nil
+}
+
+// forget closes a connection and stops tracking it
+func (b *RedisBroker) forget(conn net.Conn) {
+	b.mu.Lock()
+	delete(b.conns, conn)
+	b.mu.Unlock()
+	conn.Close()
+}
+
+// redisCommand sends a command and returns its reply, or the error it
+// replied with
+func redisCommand(conn net.Conn, r *bufio.Reader, args ...string) (interface{}, error) {
+	if err := writeRedisCommand(conn, args...); err != nil {
+		return nil, err
+	}
+	reply, err := readRedisReply(r)
+	if err != nil {
+		return nil, err
+	}
+	if replyErr, ok := reply.(redisError); ok {
+		return nil, replyErr
+	}
+	return reply, nil
+}
+
+func (b *RedisBroker) publishLoop() {
+	var conn net.Conn
+	var r *bufio.Reader
+	var retryAt time.Time
+	backoff := time.Second
+
+	for {
+		var msg redisMessage
+		select {
+		case <-b.done:
+			return
+		case msg = <-b.queue:
+		}
+
+		if conn == nil {
+			// While Redis is unreachable, events are dropped rather than
+			// held, since they'd be stale by the time it's back
+			if time.Now().Before(retryAt) {
+				continue
+			}
+			var err error
+			if conn, r, err = b.dial(); err != nil {
+				if !b.closed() {
+					log.Printf("Redis publisher can't connect, retrying in %v: %v", backoff, err)
+				}
+				retryAt = time.Now().Add(backoff)
+				backoff = min(backoff*2, redisMaxBackoff)
+				continue
+			}
+			backoff = time.Second
+		}
+
+		conn.SetDeadline(time.Now().Add(redisDialTimeout))
+		if _, err := redisCommand(conn, r, "PUBLISH", msg.channel, string(msg.data)); err != nil {
+			if !b.closed() {
+				log.Printf("Redis publish on %s failed: %v", msg.channel, err)
+			}
+			var replyErr redisError
+			if !errors.As(err, &replyErr) {
+				b.forget(conn)
+				conn = nil
+			}
+		}
+	}
+}
+
+// psubscribe opens a connection subscribed to every channel under the prefix
+func (b *RedisBroker) psubscribe() (net.Conn, *bufio.Reader, error) {
+	conn, r, err := b.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(redisDialTimeout))
+	if _, err := redisCommand(conn, r, "PSUBSCRIBE", b.prefix+"*"); err != nil {
+		b.forget(conn)
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, r, nil
+}
+
+func (b *RedisBroker) subscribeLoop(conn net.Conn, r *bufio.Reader, handler func(topic string, data []byte)) {
+	backoff := time.Second
+	for {
+		err := b.receive(r, handler)
+		b.forget(conn)
+		if b.closed() {
+			return
+		}
+		log.Printf("Redis subscription lost: %v", err)
+
+		for {
+			select {
+			case <-b.done:
+				return
+			case <-time.After(backoff):
+			}
+			if conn, r, err = b.psubscribe(); err == nil {
+				backoff = time.Second
+				break
+			}
+			backoff = min(backoff*2, redisMaxBackoff)
+			log.Printf("Redis subscriber can't connect, retrying in %v: %v", backoff, err)
+		}
+	}
+}
+
+// receive hands pmessage replies to handler until the connection fails
+func (b *RedisBroker) receive(r *bufio.Reader, handler func(topic string, data []byte)) error {
+	for {
+		reply, err := readRedisReply(r)
+		if err != nil {
+			return err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 4 {
+			continue
+		}
+		kind, _ := parts[0].(string)
+		channel, _ := parts[2].(string)
+		data, _ := parts[3].(string)
+		if kind != "pmessage" || len(channel) < len(b.prefix) {
+			continue
+		}
+		handler(channel[len(b.prefix):], []byte(data))
+	}
+}
+
+// writeRedisCommand writes a command as a RESP array of bulk strings
+func writeRedisCommand(w io.Writer, args ...string) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// readRedisReply reads one RESP reply: a string for simple and bulk strings,
+// an int64, a redisError, nil, or a []interface{} of those
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	return readRedisValue(r, 0)
+}
+
+func readRedisValue(r *bufio.Reader, depth int) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return redisError(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		if n > redisMaxBulk {
+			return nil, fmt.Errorf("redis: %d byte string is too long", n)
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if data[n] != '\r' || data[n+1] != '\n' {
+			return nil, errors.New("redis: string not terminated by CRLF")
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		if depth >= redisMaxDepth {
+			return nil, errors.New("redis: arrays nested too deeply")
+		}
+		// Grown as items arrive rather than sized from the count, which
+		// the server could set to anything
+		items := make([]interface{}, 0, min(n, 16))
+		for i := 0; i < n; i++ {
+			item, err := readRedisValue(r, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestWriteRedisCommand(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeRedisCommand(&buf, "PUBLISH", "wd:events", "a\r\nb"); err != nil {
+		t.Fatal(err)
+	}
+	want := "*3\r\n$7\r\nPUBLISH\r\n$9\r\nwd:events\r\n$4\r\na\r\nb\r\n"
+	if buf.String() != want {
+		t.Errorf("writeRedisCommand = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestReadRedisReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  interface{}
+		err   bool
+	}{
+		{"simple string", "+OK\r\n", "OK", false},
+		{"error", "-ERR unknown command 'FOO'\r\n", redisError("ERR unknown command 'FOO'"), false},
+		{"integer", ":42\r\n", int64(42), false},
+		{"bulk string", "$5\r\nhello\r\n", "hello", false},
+		{"bulk string with CRLF", "$4\r\na\r\nb\r\n", "a\r\nb", false},
+		{"empty bulk string", "$0\r\n\r\n", "", false},
+		{"nil bulk string", "$-1\r\n", nil, false},
+		{"nil array", "*-1\r\n", nil, false},
+		{"pmessage", "*4\r\n$8\r\npmessage\r\n$4\r\nwd:*\r\n$9\r\nwd:events\r\n$2\r\nhi\r\n", []interface{}{"pmessage", "wd:*", "wd:events", "hi"}, false},
+		{"nested", "*2\r\n*1\r\n:1\r\n-ERR inner\r\n", []interface{}{[]interface{}{int64(1)}, redisError("ERR inner")}, false},
+		{"missing CR", "+OK\n", nil, true},
+		{"unknown type", "!oops\r\n", nil, true},
+		{"bad integer", ":x\r\n", nil, true},
+		{"truncated bulk string", "$5\r\nhel", nil, true},
+		{"unterminated bulk string", "$2\r\nhiXX", nil, true},
+		{"huge bulk string", "$9223372036854775807\r\n", nil, true},
+		{"huge array", "*9223372036854775807\r\n", nil, true},
+		{"deep nesting", strings.Repeat("*1\r\n", 100) + ":1\r\n", nil, true},
+		{"truncated array", "*2\r\n:1\r\n", nil, true},
+	}
+	for _, tt := range tests {
+		// Reading a byte at a time checks replies split across reads
+		for _, split := range []bool{false, true} {
+			var r *bufio.Reader
+			if split {
+				r = bufio.NewReader(iotest.OneByteReader(strings.NewReader(tt.input)))
+			} else {
+				r = bufio.NewReader(strings.NewReader(tt.input))
+			}
+			got, err := readRedisReply(r)
+			if tt.err {
+				if err == nil {
+					t.Errorf("%s: readRedisReply = %#v, want error", tt.name, got)
+				}
+				continue
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: readRedisReply = %#v, %v, want %#v", tt.name, got, err, tt.want)
+			}
+		}
+	}
+}
+
+func TestRedisCommandReturnsErrorReplies(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		r := bufio.NewReader(server)
+		readRedisReply(r)
+		server.Write([]byte("-WRONGPASS invalid username-password pair\r\n"))
+		readRedisReply(r)
+		server.Write([]byte("+OK\r\n"))
+	}()
+
+	r := bufio.NewReader(client)
+	var replyErr redisError
+	if _, err := redisCommand(client, r, "AUTH", "wrong"); !errors.As(err, &replyErr) || !strings.HasPrefix(string(replyErr), "WRONGPASS") {
+		t.Errorf("AUTH wrong = %v, want a WRONGPASS redisError", err)
+	}
+	if reply, err := redisCommand(client, r, "AUTH", "right"); err != nil || reply != "OK" {
+		t.Errorf("AUTH right = %v, %v", reply, err)
+	}
+}
+
+func TestParseRedisURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want redisEndpoint
+		err  bool
+	}{
+		{url: "redis://localhost", want: redisEndpoint{addr: "localhost:6379"}},
+		{url: "redis://cache:6380", want: redisEndpoint{addr: "cache:6380"}},
+		{url: "rediss://user:pw@cache", want: redisEndpoint{addr: "cache:6379", username: "user", password: "pw", tls: true}},
+		{url: "redis://secret@cache", want: redisEndpoint{addr: "cache:6379", password: "secret"}},
+		{url: "http://cache", err: true},
+		{url: "redis://", err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRedisURL(tt.url)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("parseRedisURL(%q) = %+v, %v", tt.url, got, err)
+		}
+	}
+}
+
+// fakeRedis is enough of a Redis server for the broker: AUTH, PUBLISH and
+// PSUBSCRIBE with the pattern taken as a prefix. PUBLISH to a channel ending
+// in "bad" is refused with an error reply.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu          sync.Mutex
+	subscribers []net.Conn
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{listener: listener, password: password}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		reply, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+		args, _ := reply.([]interface{})
+		if len(args) == 0 {
+			return
+		}
+		var command []string
+		for _, arg := range args {
+			s, _ := arg.(string)
+			command = append(command, s)
+		}
+
+		switch strings.ToUpper(command[0]) {
+		case "AUTH":
+			if command[len(command)-1] != f.password {
+				conn.Write([]byte("-WRONGPASS invalid username-password pair\r\n"))
+				continue
+			}
+			conn.Write([]byte("+OK\r\n"))
+		case "PSUBSCRIBE":
+			f.mu.Lock()
+			f.subscribers = append(f.subscribers, conn)
+			f.mu.Unlock()
+			writeRedisCommand(conn, "psubscribe", command[1])
+		case "PUBLISH":
+			if strings.HasSuffix(command[1], "bad") {
+				conn.Write([]byte("-ERR refused\r\n"))
+				continue
+			}
+			f.mu.Lock()
+			for _, subscriber := range f.subscribers {
+				writeRedisCommand(subscriber, "pmessage", "wd:*", command[1], command[2])
+			}
+			f.mu.Unlock()
+			conn.Write([]byte(":1\r\n"))
+		default:
+			conn.Write([]byte("-ERR unknown command\r\n"))
+		}
+	}
+}
+
+func TestRedisBroker(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	if _, err := NewRedisBroker("redis://wrong@"+server.listener.Addr().String(), "wd:"); err == nil {
+		t.Fatal("connected with the wrong password")
+	}
+
+	broker, err := NewRedisBroker("redis://secret@"+server.listener.Addr().String(), "wd:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	received := make(chan string, 4)
+	if err := broker.Subscribe(func(topic string, data []byte) {
+		received <- topic + "=" + string(data)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An error reply doesn't drop the publisher's connection
+	broker.Publish("bad", []byte("x"))
+	broker.Publish("events", []byte("hello\r\nworld"))
+	select {
+	case got := <-received:
+		if got != "events=hello\r\nworld" {
+			t.Errorf("received %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message received")
+	}
+}
+
+func FuzzReadRedisReply(f *testing.F) {
+	for _, seed := range []string{"+OK\r\n", "-ERR x\r\n", ":1\r\n", "$2\r\nhi\r\n", "*2\r\n$1\r\na\r\n*1\r\n:2\r\n", "$-1\r\n"} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		readRedisReply(bufio.NewReader(bytes.NewReader(data)))
+	})
+}
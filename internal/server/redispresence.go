@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisPresenceStore keeps presence in Redis under the prefix:
+//
+//   - presence:instances, a sorted set of instance IDs scored by when their
+//     entries expire
+//   - presence:instance:<id>, a hash of username -> devices, expiring with
+//     the instance's entry
+//   - presence:lastseen, a hash of username -> last seen (Unix ms)
+//
+// Expiry is measured on the Redis server's clock, so instances' clocks
+// needn't agree.
+type RedisPresenceStore struct {
+	endpoint redisEndpoint
+	prefix   string
+
+	// One connection, reopened after an error. Commands for one call are
+	// sent together under mu so a transaction isn't interleaved.
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewRedisPresenceStore connects to the server at rawURL, as for
+// NewRedisBroker
+func NewRedisPresenceStore(rawURL, prefix string) (*RedisPresenceStore, error) {
+	endpoint, err := parseRedisURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	s := &RedisPresenceStore{endpoint: endpoint, prefix: prefix}
+	if _, err := s.do([]string{"PING"}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *RedisPresenceStore) instancesKey() string {
+	return s.prefix + "presence:instances"
+}
+
+func (s *RedisPresenceStore) instanceKey(instanceID string) string {
+	return s.prefix + "presence:instance:" + instanceID
+}
+
+func (s *RedisPresenceStore) lastSeenKey() string {
+	return s.prefix + "presence:lastseen"
+}
+
+// do sends commands in order and returns their replies. Any error closes the
+// connection, so it is never left partway through a transaction.
+func (s *RedisPresenceStore) do(commands ...[]string) ([]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		conn, r, err := s.endpoint.connect()
+		if err != nil {
+			return nil, err
+		}
+		s.conn, s.r = conn, r
+	}
+	s.conn.SetDeadline(time.Now().Add(redisDialTimeout))
+
+	replies := make([]interface{}, 0, len(commands))
+	for _, args := range commands {
+		reply, err := redisCommand(s.conn, s.r, args...)
+		if err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return nil, err
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
+
+// now returns the Redis server's time in Unix ms
+func (s *RedisPresenceStore) now() (int64, error) {
+	replies, err := s.do([]string{"TIME"})
+	if err != nil {
+		return 0, err
+	}
+	parts, ok := replies[0].([]interface{})
+	if !ok || len(parts) != 2 {
+		return 0, errors.New("redis: unexpected TIME reply")
+	}
+	seconds, _ := parts[0].(string)
+	micros, _ := parts[1].(string)
+	sec, err1 := strconv.ParseInt(seconds, 10, 64)
+	usec, err2 := strconv.ParseInt(micros, 10, 64)
+	if err1 != nil || err2 != nil {
+		return 0, errors.New("redis: unexpected TIME reply")
+	}
+	return sec*1000 + usec/1000, nil
+}
+
+// Heartbeat replaces instanceID's hash and pushes back its expiry
+func (s *RedisPresenceStore) Heartbeat(instanceID string, devices map[string]int, ttl time.Duration) error {
+	now, err := s.now()
+	if err != nil {
+		return err
+	}
+	expires := strconv.FormatInt(now+ttl.Milliseconds(), 10)
+	key := s.instanceKey(instanceID)
+
+	commands := [][]string{{"MULTI"}, {"DEL", key}}
+	if len(devices) > 0 {
+		hset := []string{"HSET", key}
+		for username, count := range devices {
+			hset = append(hset, username, strconv.Itoa(count))
+		}
+		commands = append(commands, hset, []string{"PEXPIRE", key, strconv.FormatInt(ttl.Milliseconds(), 10)})
+	}
+	commands = append(commands,
+		[]string{"ZADD", s.instancesKey(), expires, instanceID},
+		[]string{"ZREMRANGEBYSCORE", s.instancesKey(), "-inf", "(" + strconv.FormatInt(now, 10)},
+		[]string{"EXEC"},
+	)
+	replies, err := s.do(commands...)
+	if err != nil {
+		return err
+	}
+	if replies[len(replies)-1] == nil {
+		return errors.New("redis: heartbeat transaction aborted")
+	}
+	return nil
+}
+
+// Online reads the hashes of the instances that haven't expired
+func (s *RedisPresenceStore) Online() (map[string]map[string]int, error) {
+	now, err := s.now()
+	if err != nil {
+		return nil, err
+	}
+	replies, err := s.do([]string{"ZRANGEBYSCORE", s.instancesKey(), strconv.FormatInt(now, 10), "+inf"})
+	if err != nil {
+		return nil, err
+	}
+	ids := redisStrings(replies[0])
+	online := make(map[string]map[string]int)
+	if len(ids) == 0 {
+		return online, nil
+	}
+
+	commands := make([][]string, len(ids))
+	for i, id := range ids {
+		commands[i] = []string{"HGETALL", s.instanceKey(id)}
+	}
+	if replies, err = s.do(commands...); err != nil {
+		return nil, err
+	}
+	for i, reply := range replies {
+		fields := redisStrings(reply)
+		for j := 0; j+1 < len(fields); j += 2 {
+			count, err := strconv.Atoi(fields[j+1])
+			if err != nil || count <= 0 {
+				continue
+			}
+			if online[fields[j]] == nil {
+				online[fields[j]] = make(map[string]int)
+			}
+			online[fields[j]][ids[i]] = count
+		}
+	}
+	return online, nil
+}
+
+// Leave deletes instanceID's entry
+func (s *RedisPresenceStore) Leave(instanceID string) error {
+	_, err := s.do(
+		[]string{"DEL", s.instanceKey(instanceID)},
+		[]string{"ZREM", s.instancesKey(), instanceID},
+	)
+	return err
+}
+
+func (s *RedisPresenceStore) SetLastSeen(username string, at time.Time) error {
+	_, err := s.do([]string{"HSET", s.lastSeenKey(), username, strconv.FormatInt(at.UnixMilli(), 10)})
+	return err
+}
+
+func (s *RedisPresenceStore) LastSeen(usernames []string) (map[string]time.Time, error) {
+	replies, err := s.do(append([]string{"HMGET", s.lastSeenKey()}, usernames...))
+	if err != nil {
+		return nil, err
+	}
+	values, ok := replies[0].([]interface{})
+	if !ok || len(values) != len(usernames) {
+		return nil, fmt.Errorf("redis: unexpected HMGET reply")
+	}
+	lastSeen := make(map[string]time.Time, len(usernames))
+	for i, value := range values {
+		text, _ := value.(string)
+		if ms, err := strconv.ParseInt(text, 10, 64); err == nil {
+			lastSeen[usernames[i]] = time.UnixMilli(ms)
+		}
+	}
+	return lastSeen, nil
+}
+
+// Close closes the connection
+func (s *RedisPresenceStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return nil
+}
+
+// redisStrings returns the strings in an array reply, skipping nils
+func redisStrings(reply interface{}) []string {
+	items, _ := reply.([]interface{})
+	strs := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+	return strs
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Sanitizer transforms message content before it is stored and fanned out
+type Sanitizer func(content string) string
+
+// SanitizerPipeline applies sanitizers in order
+type SanitizerPipeline []Sanitizer
+
+var (
+	// Elements whose contents are dropped along with the tags
+	dangerousElementPattern = regexp.MustCompile(`(?is)<(?:script|style|iframe|object|embed|noscript|template)\b[^>]*>.*?</(?:script|style|iframe|object|embed|noscript|template)\s*>`)
+	htmlCommentPattern      = regexp.MustCompile(`(?s)<!--.*?-->`)
+	// Only matches things that look like tags so text like "a <3 b" survives.
+	// A tag left open at the end is matched too, so it can't be completed by
+	// whatever the content is embedded in.
+	htmlTagPattern = regexp.MustCompile(`</?[a-zA-Z][^>]*(?:>|$)`)
+)
+
+// sanitizers maps config names to sanitizer implementations
+var sanitizers = map[string]Sanitizer{
+	"normalize":   normalizeContent,
+	"strip_tags":  stripTags,
+	"escape_html": html.EscapeString,
+	"emoji":       expandEmojiShortcodes,
+}
+
+// NewSanitizerPipeline builds a pipeline from sanitizer names
+func NewSanitizerPipeline(names []string) (SanitizerPipeline, error) {
+	pipeline := SanitizerPipeline{}
+	for _, name := range names {
+		sanitizer, exists := sanitizers[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown sanitizer: %q", name)
+		}
+		pipeline = append(pipeline, sanitizer)
+	}
+	return pipeline, nil
+}
+
+// Sanitize runs content through every sanitizer in the pipeline
+func (p SanitizerPipeline) Sanitize(content string) string {
+	for _, sanitizer := range p {
+		content = sanitizer(content)
+	}
+	return content
+}
+
+// normalizeContent unifies line endings, drops control and bidi override
+// characters (which can disguise content), and trims surrounding whitespace
+func normalizeContent(content string) string {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	content = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\t':
+			return r
+		case r < 0x20 || r == 0x7f:
+			return -1
+		case r >= 0x202a && r <= 0x202e, r >= 0x2066 && r <= 0x2069:
+			return -1
+		}
+		return r
+	}, content)
+	return strings.TrimSpace(content)
+}
+
+// stripTags removes HTML tags, comments, and the contents of script-like
+// elements. Removing one can join the text around it into a new tag, as in
+// "<<b>img onerror=...>", so it repeats until nothing more is removed.
+func stripTags(content string) string {
+	for {
+		stripped := dangerousElementPattern.ReplaceAllString(content, "")
+		stripped = htmlCommentPattern.ReplaceAllString(stripped, "")
+		stripped = htmlTagPattern.ReplaceAllString(stripped, "")
+		if stripped == content {
+			return content
+		}
+		content = stripped
+	}
+}
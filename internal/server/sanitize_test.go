@@ -0,0 +1,80 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStripTags(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"plain text", "hello there", "hello there"},
+		{"less-than heart", "a <3 b", "a <3 b"},
+		{"comparison", "1 < 2 > 0", "1 < 2 > 0"},
+		{"simple tags", "<b>bold</b> and <i>italic</i>", "bold and italic"},
+		{"script element", "hi<script>alert(1)</script>!", "hi!"},
+		{"comment", "a<!-- hidden -->b", "ab"},
+		{"nested tag bypass", "<<b>img src=x onerror=alert(1)>", ""},
+		{"split script bypass", "<scr<script>x</script>ipt>alert(1)</script>", "alert(1)"},
+		{"split comment bypass", "<!<!-- -->-- x --><img src=x>", ""},
+		{"unterminated tag", "hi <img src=x onerror=alert(1)", "hi "},
+		{"deep nesting", strings.Repeat("<", 50) + "b" + strings.Repeat(">", 50) + "x", strings.Repeat("<", 49) + strings.Repeat(">", 49) + "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripTags(tt.content); got != tt.want {
+				t.Errorf("stripTags(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeContent(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"  hello  ", "hello"},
+		{"a\r\nb", "a\nb"},
+		{"tab\there", "tab\there"},
+		{"bell\x07", "bell"},
+		{"abc‮dcba", "abcdcba"},
+		{"⁦isolate⁩", "isolate"},
+	}
+	for _, tt := range tests {
+		if got := normalizeContent(tt.content); got != tt.want {
+			t.Errorf("normalizeContent(%q) = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizerPipeline(t *testing.T) {
+	pipeline, err := NewSanitizerPipeline([]string{"normalize", "strip_tags", "escape_html"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pipeline.Sanitize("  <b>fish</b> & chips\x00 "), "fish &amp; chips"; got != want {
+		t.Errorf("Sanitize = %q, want %q", got, want)
+	}
+	if _, err := NewSanitizerPipeline([]string{"nope"}); err == nil {
+		t.Error("unknown sanitizer accepted")
+	}
+}
+
+func FuzzStripTags(f *testing.F) {
+	for _, seed := range []string{"<<b>img src=x onerror=alert(1)>", "a <3 b", "<scr<script>ipt>", "<!<!-- -->--><x"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, content string) {
+		got := stripTags(content)
+		if stripTags(got) != got {
+			t.Errorf("stripTags(%q) = %q still has tags", content, got)
+		}
+		if htmlTagPattern.MatchString(got) {
+			t.Errorf("stripTags(%q) = %q leaves a tag", content, got)
+		}
+	})
+}
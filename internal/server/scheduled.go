@@ -0,0 +1,252 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"whatsdown/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// How far ahead a message may be scheduled
+const maxScheduleAhead = 365 * 24 * time.Hour
+
+var errScheduledNotFound = errors.New("scheduled message not found")
+
+// Scheduler holds messages until their send time. Pending messages are kept in
+// memory and, if a path is configured, rewritten to a JSON file on every change
+// so they survive restarts.
+type Scheduler struct {
+	path    string
+	pending map[string]*models.ScheduledMessage
+	timers  map[string]*time.Timer
+	deliver func(*models.ScheduledMessage)
+	mu      sync.Mutex
+}
+
+// NewScheduler creates a scheduler, loading pending messages from path if non-empty
+func NewScheduler(path string) (*Scheduler, error) {
+	s := &Scheduler{
+		path:    path,
+		pending: make(map[string]*models.ScheduledMessage),
+		timers:  make(map[string]*time.Timer),
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var saved []*models.ScheduledMessage
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	for _, scheduled := range saved {
+		s.pending[scheduled.ID] = scheduled
+	}
+	return s, nil
+}
+
+// Start arms timers for all pending messages; deliver is called as each comes
+// due. Messages whose time passed while the server was down are sent immediately.
+func (s *Scheduler) Start(deliver func(*models.ScheduledMessage)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deliver = deliver
+	for id, scheduled := range s.pending {
+		s.arm(id, scheduled.SendAt)
+	}
+}
+
+// Add queues msg from username for delivery at its SendAt time
+func (s *Scheduler) Add(username string, msg *models.InboundMessage) *models.ScheduledMessage {
+	scheduled := &models.ScheduledMessage{
+		ID:        uuid.New().String(),
+		From:      username,
+		Message:   *msg,
+		SendAt:    *msg.SendAt,
+		CreatedAt: time.Now(),
+	}
+	scheduled.Message.SendAt = nil
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending[scheduled.ID] = scheduled
+	if s.deliver != nil {
+		s.arm(scheduled.ID, scheduled.SendAt)
+	}
+	s.save()
+	return scheduled
+}
+
+// List returns username's pending messages, soonest first
+func (s *Scheduler) List(username string) []*models.ScheduledMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scheduled := []*models.ScheduledMessage{}
+	for _, pending := range s.pending {
+		if pending.From == username {
+			scheduled = append(scheduled, pending)
+		}
+	}
+	sort.Slice(scheduled, func(i, j int) bool {
+		return scheduled[i].SendAt.Before(scheduled[j].SendAt)
+	})
+	return scheduled
+}
+
+// Cancel removes one of username's pending messages
+func (s *Scheduler) Cancel(username, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scheduled, exists := s.pending[id]
+	if !exists || scheduled.From != username {
+		return errScheduledNotFound
+	}
+	if timer, armed := s.timers[id]; armed {
+		timer.Stop()
+		delete(s.timers, id)
+	}
+	delete(s.pending, id)
+	s.save()
+	return nil
+}
+
+// arm starts the timer for a pending message. Callers must hold s.mu.
+func (s *Scheduler) arm(id string, sendAt time.Time) {
+	s.timers[id] = time.AfterFunc(time.Until(sendAt), func() {
+		s.fire(id)
+	})
+}
+
+// fire removes a due message from the queue and hands it to deliver
+func (s *Scheduler) fire(id string) {
+	s.mu.Lock()
+	scheduled, exists := s.pending[id]
+	if !exists {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.pending, id)
+	delete(s.timers, id)
+	s.save()
+	deliver := s.deliver
+	s.mu.Unlock()
+
+	deliver(scheduled)
+}
+
+// save rewrites the pending queue to disk. Callers must hold s.mu.
+func (s *Scheduler) save() {
+	if s.path == "" {
+		return
+	}
+
+	saved := make([]*models.ScheduledMessage, 0, len(s.pending))
+	for _, scheduled := range s.pending {
+		saved = append(saved, scheduled)
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		log.Printf("Error marshaling scheduled messages: %v", err)
+		return
+	}
+
+	// Write then rename so a crash never leaves a truncated queue
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("Error writing scheduled messages: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		log.Printf("Error saving scheduled messages: %v", err)
+	}
+}
+
+// StartScheduler begins delivering scheduled messages through the hub
+func (h *Hub) StartScheduler() {
+	h.Scheduler.Start(func(scheduled *models.ScheduledMessage) {
+		h.handleInboundMessageWithSender(scheduled.From, &scheduled.Message)
+	})
+}
+
+// scheduleMessage queues msg instead of sending it now and confirms to the
+// sender with a "scheduled" event
+func (h *Hub) scheduleMessage(from string, msg *models.InboundMessage) {
+	if msg.SendAt.After(time.Now().Add(maxScheduleAhead)) {
+		log.Printf("Dropping scheduled message from %s: sendAt %s is too far ahead", from, msg.SendAt)
+		return
+	}
+
+	scheduled := h.Scheduler.Add(from, msg)
+
+	h.mu.RLock()
+	clients := h.clientsOf(from)
+	h.mu.RUnlock()
+
+	for _, client := range clients {
+		h.sendToClient(client, "scheduled", scheduled)
+	}
+}
+
+// HandleScheduled handles GET /api/scheduled
+func (h *HTTPHandlers) HandleScheduled(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	scheduled := h.Hub.Scheduler.List(session.Username)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scheduled)
+}
+
+// HandleScheduledMessage handles DELETE /api/scheduled/{id}
+func (h *HTTPHandlers) HandleScheduledMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	id := strings.TrimSpace(strings.TrimPrefix(r.URL.Path, "/api/scheduled/"))
+	if id == "" {
+		http.Error(w, "Scheduled message ID required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Hub.Scheduler.Cancel(session.Username, id); err != nil {
+		http.Error(w, "Scheduled message not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"whatsdown/internal/models"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// SearchResult is a message matching a conversation search
+type SearchResult struct {
+	Message *models.Message `json:"message"`
+
+	// Index of the message in the conversation as returned by the history endpoint
+	Offset int `json:"offset"`
+
+	Score int `json:"score"`
+
+	// Rune ranges [start, end) of each match within the content, for highlighting
+	Matches [][2]int `json:"matches"`
+}
+
+// SearchConversation finds messages in a conversation containing every term
+// in query, best matches first. Full-phrase matches rank above scattered
+// terms; ties go to the most recent message.
+func (h *Hub) SearchConversation(convKey, username, query string, limit int) []*SearchResult {
+	terms := strings.Fields(strings.ToLower(query))
+	results := []*SearchResult{}
+	if len(terms) == 0 {
+		return results
+	}
+	phrase := strings.Join(terms, " ")
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	offset := 0
+	for _, message := range h.conversation(convKey) {
+		if message.HiddenFrom(username) {
+			continue
+		}
+		if result := matchMessage(message, terms, phrase); result != nil {
+			result.Offset = offset
+			results = append(results, result)
+		}
+		offset++
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Message.Timestamp.After(results[j].Message.Timestamp)
+	})
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// matchMessage scores message against the search terms, returning nil unless
+// every term occurs in it
+func matchMessage(message *models.Message, terms []string, phrase string) *SearchResult {
+	if message.Deleted || message.Encrypted != nil {
+		return nil
+	}
+	content := strings.ToLower(message.Content)
+
+	score := 0
+	var matches [][2]int
+	for _, term := range terms {
+		count := 0
+		for start := 0; ; {
+			i := strings.Index(content[start:], term)
+			if i < 0 {
+				break
+			}
+			begin := start + i
+			matches = append(matches, [2]int{
+				utf8.RuneCountInString(content[:begin]),
+				utf8.RuneCountInString(content[:begin+len(term)]),
+			})
+			count++
+			start = begin + len(term)
+		}
+		if count == 0 {
+			return nil
+		}
+		score += count
+	}
+	if len(terms) > 1 && strings.Contains(content, phrase) {
+		score += 5 * len(terms)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i][0] < matches[j][0]
+	})
+
+	return &SearchResult{
+		Message: message.Snapshot(),
+		Score:   score,
+		Matches: matches,
+	}
+}
+
+// searchLimit parses the limit query parameter, clamped to maxSearchLimit
+func searchLimit(value string) int {
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		return defaultSearchLimit
+	}
+	if limit > maxSearchLimit {
+		return maxSearchLimit
+	}
+	return limit
+}
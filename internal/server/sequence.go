@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"whatsdown/internal/models"
+)
+
+// nextSeq assigns message the next sequence number in its conversation.
+// Callers must hold the conversation's shard lock.
+func (s *hubShard) nextSeq(message *models.Message) {
+	convKey := message.ConvKey()
+	s.sequences[convKey]++
+	message.Seq = s.sequences[convKey]
+}
+
+// messagesAfter returns the messages with a sequence number above seq.
+// messages must be in conversation order.
+func messagesAfter(messages []*models.Message, seq int64) []*models.Message {
+	i := sort.Search(len(messages), func(i int) bool {
+		return messages[i].Seq > seq
+	})
+	return messages[i:]
+}
+
+// parseSinceSeq reads the optional sinceSeq query parameter; zero returns everything
+func parseSinceSeq(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	value := r.URL.Query().Get("sinceSeq")
+	if value == "" {
+		return 0, true
+	}
+
+	seq, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seq < 0 {
+		http.Error(w, "sinceSeq must be a non-negative integer", http.StatusBadRequest)
+		return 0, false
+	}
+	return seq, true
+}
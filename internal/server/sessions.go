@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+// SessionResponse represents a session in the session management API
+type SessionResponse struct {
+	ID        string `json:"id"`
+	CreatedAt string `json:"createdAt"`
+	ExpiresAt string `json:"expiresAt"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"userAgent"`
+	Current   bool   `json:"current"`
+}
+
+// currentSession resolves the caller's session, writing a 401 if there is none
+func currentSession(w http.ResponseWriter, r *http.Request) (string, *models.Session, bool) {
+	sessionID := getSessionIDFromRequest(r)
+	if sessionID == "" {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return "", nil, false
+	}
+
+	session, exists := sessionStore.GetSession(sessionID)
+	if !exists {
+		http.Error(w, "Invalid session", http.StatusUnauthorized)
+		return "", nil, false
+	}
+
+	return sessionID, session, true
+}
+
+// HandleSessions handles GET /api/sessions
+func (h *HTTPHandlers) HandleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	sessions := sessionStore.ListSessions(session.Username)
+
+	resp := make([]SessionResponse, 0, len(sessions))
+	for id, s := range sessions {
+		resp = append(resp, SessionResponse{
+			ID:        s.ID,
+			CreatedAt: s.CreatedAt.Format(time.RFC3339),
+			ExpiresAt: s.ExpiresAt.Format(time.RFC3339),
+			IP:        s.IP,
+			UserAgent: s.UserAgent,
+			Current:   id == sessionID,
+		})
+	}
+
+	// Most recently created first
+	sort.Slice(resp, func(i, j int) bool {
+		return resp[i].CreatedAt > resp[j].CreatedAt
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HandleRefreshSession handles POST /api/sessions/refresh
+func (h *HTTPHandlers) HandleRefreshSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID := getSessionIDFromRequest(r)
+	if sessionID == "" {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+
+	session, exists := sessionStore.RefreshSession(sessionID)
+	if !exists {
+		http.Error(w, "Invalid session", http.StatusUnauthorized)
+		return
+	}
+
+	setSessionCookie(w, sessionID)
+
+	resp := SessionResponse{
+		ID:        session.ID,
+		CreatedAt: session.CreatedAt.Format(time.RFC3339),
+		ExpiresAt: session.ExpiresAt.Format(time.RFC3339),
+		IP:        session.IP,
+		UserAgent: session.UserAgent,
+		Current:   true,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HandleSession handles DELETE /api/sessions/{id}
+func (h *HTTPHandlers) HandleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	publicID := strings.TrimSpace(strings.TrimPrefix(r.URL.Path, "/api/sessions/"))
+	if publicID == "" {
+		http.Error(w, "Session ID required", http.StatusBadRequest)
+		return
+	}
+
+	revokedID, revoked := sessionStore.RevokeSession(session.Username, publicID)
+	if !revoked {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	// Close any WebSocket connection opened with the revoked session
+	h.Hub.DisconnectSession(session.Username, revokedID)
+	h.Audit.Record(AuditSessionRevoked, session.Username, clientIP(r), publicID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
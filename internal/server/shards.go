@@ -0,0 +1,188 @@
+package server
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"whatsdown/internal/models"
+)
+
+// hubShards is how many shards conversations, stored messages and
+// connections are spread across
+const hubShards = 64
+
+// hubShard holds the part of the hub's busiest state whose keys hash to it,
+// under its own lock, so that sends in unrelated conversations and
+// connections of unrelated users don't wait on one another:
+//
+//   - conversations, their latest sequence numbers and who archived them, by
+//     conversation key
+//   - stored messages by ID
+//   - recently used tempIds, and recently sent content, by sender
+//   - connected devices, and events held while none is, by username
+//   - direct messages stored while none of the recipient's devices was
+//     connected, by recipient and message ID
+//   - locks serializing sends, by conversation key
+//
+// Users, groups, channels, read positions and the fields of stored messages
+// aren't sharded and stay under h.mu. Connecting, disconnecting and marking
+// messages read change them, so those take h.mu for writing and still wait on
+// one another across the hub; only sends get by with it held for reading.
+//
+// A shard's maps are only touched holding its lock, which is taken after h.mu
+// and before stream.mu and c.mu. No one holds two shards' locks at once.
+type hubShard struct {
+	mu sync.RWMutex
+
+	conversations  map[string][]*models.Message
+	sequences      map[string]int64
+	archived       map[string]map[string]bool
+	messages       map[string]*models.Message
+	tempIDs        map[string]*sentTempID
+	recent         map[string][]sentContent
+	clients        map[string]map[*Client]bool
+	offline        map[string][]offlineEvent
+	offlineDropped map[string]int
+	pending        map[string]map[string]*models.Message
+	sending        map[string]*conversationLock
+}
+
+func newHubShard() *hubShard {
+	return &hubShard{
+		conversations:  make(map[string][]*models.Message),
+		sequences:      make(map[string]int64),
+		archived:       make(map[string]map[string]bool),
+		messages:       make(map[string]*models.Message),
+		tempIDs:        make(map[string]*sentTempID),
+		recent:         make(map[string][]sentContent),
+		clients:        make(map[string]map[*Client]bool),
+		offline:        make(map[string][]offlineEvent),
+		offlineDropped: make(map[string]int),
+		pending:        make(map[string]map[string]*models.Message),
+		sending:        make(map[string]*conversationLock),
+	}
+}
+
+// shard returns the shard key hashes to: a conversation key, message ID or
+// username depending on the state wanted
+func (h *Hub) shard(key string) *hubShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return h.shards[hash.Sum32()%hubShards]
+}
+
+// conversation returns the messages in convKey, oldest first. Conversations
+// are only ever appended to, or replaced, so the slice stays valid after the
+// shard's lock is released; the messages' fields are guarded by h.mu.
+func (h *Hub) conversation(convKey string) []*models.Message {
+	s := h.shard(convKey)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.conversations[convKey]
+}
+
+// conversations returns every conversation by key
+func (h *Hub) conversations() map[string][]*models.Message {
+	all := make(map[string][]*models.Message)
+	for _, s := range h.shards {
+		s.mu.RLock()
+		for convKey, messages := range s.conversations {
+			all[convKey] = messages
+		}
+		s.mu.RUnlock()
+	}
+	return all
+}
+
+// lastSeq returns the sequence number of the latest message in convKey
+func (h *Hub) lastSeq(convKey string) int64 {
+	s := h.shard(convKey)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sequences[convKey]
+}
+
+// message returns the stored message with ID messageID
+func (h *Hub) message(messageID string) (*models.Message, bool) {
+	s := h.shard(messageID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	message, exists := s.messages[messageID]
+	return message, exists
+}
+
+// deleteConversation forgets convKey and the messages in it
+func (h *Hub) deleteConversation(convKey string) {
+	s := h.shard(convKey)
+	s.mu.Lock()
+	messages := s.conversations[convKey]
+	delete(s.conversations, convKey)
+	delete(s.sequences, convKey)
+	delete(s.archived, convKey)
+	s.mu.Unlock()
+	h.forgetHistory(convKey)
+	h.forgetMessages(messages)
+}
+
+// connectedClients returns username's connected devices
+func (h *Hub) connectedClients(username string) []*Client {
+	s := h.shard(username)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	clients := make([]*Client, 0, len(s.clients[username]))
+	for client := range s.clients[username] {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// everyClient returns the connected devices of every user with one
+func (h *Hub) everyClient() map[string][]*Client {
+	all := make(map[string][]*Client)
+	for _, s := range h.shards {
+		s.mu.RLock()
+		for username, devices := range s.clients {
+			for client := range devices {
+				all[username] = append(all[username], client)
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return all
+}
+
+// conversationLock serializes sends in one conversation
+type conversationLock struct {
+	sync.Mutex
+
+	// Senders holding or waiting for the lock
+	holders int
+}
+
+// lockConversation waits for any other send in convKey to finish and returns
+// the function ending this one. Messages in a conversation are stored and
+// fanned out one at a time, so every device gets them in sequence order,
+// while sends in other conversations carry on. It's taken before h.mu, and
+// only exists while a send is in progress.
+func (h *Hub) lockConversation(convKey string) (unlock func()) {
+	s := h.shard(convKey)
+	s.mu.Lock()
+	lock, exists := s.sending[convKey]
+	if !exists {
+		lock = &conversationLock{}
+		s.sending[convKey] = lock
+	}
+	lock.holders++
+	s.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		s.mu.Lock()
+		lock.holders--
+		if lock.holders == 0 {
+			delete(s.sending, convKey)
+		}
+		s.mu.Unlock()
+	}
+}
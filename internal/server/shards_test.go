@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"whatsdown/internal/models"
+)
+
+func TestConcurrentSendsInOneConversation(t *testing.T) {
+	hub := newTestHub(t, "alice", "bob", "carol")
+	watcher := newTestClient(t, hub, "carol")
+	const perSender = 50
+
+	// Alice and Bob both write to Carol, and to each other, at once
+	peers := map[string]string{"alice": "bob", "bob": "alice"}
+	var wg sync.WaitGroup
+	for _, sender := range []string{"alice", "bob"} {
+		wg.Add(2)
+		go func(sender string) {
+			defer wg.Done()
+			for i := 0; i < perSender; i++ {
+				hub.handleInboundMessageWithSender(sender, &models.InboundMessage{To: "carol", Content: fmt.Sprint(i)})
+			}
+		}(sender)
+		go func(sender string) {
+			defer wg.Done()
+			for i := 0; i < perSender; i++ {
+				hub.handleInboundMessageWithSender(sender, &models.InboundMessage{To: peers[sender], Content: fmt.Sprint(i)})
+			}
+		}(sender)
+	}
+	wg.Wait()
+
+	for convKey, want := range map[string]int{
+		models.ConvKey("alice", "carol"): perSender,
+		models.ConvKey("bob", "carol"):   perSender,
+		models.ConvKey("alice", "bob"):   2 * perSender,
+	} {
+		messages := hub.conversation(convKey)
+		if len(messages) != want {
+			t.Fatalf("%s: %d messages stored, want %d", convKey, len(messages), want)
+		}
+		for i, message := range messages {
+			if message.Seq != int64(i+1) {
+				t.Fatalf("%s: message %d has seq %d", convKey, i, message.Seq)
+			}
+			if stored, _ := hub.message(message.ID); stored != message {
+				t.Fatalf("message %s isn't stored by ID", message.ID)
+			}
+		}
+	}
+
+	// Each conversation reaches Carol in sequence order
+	last := make(map[string]int64)
+	for i := 0; i < 2*perSender; i++ {
+		var message models.Message
+		if err := json.Unmarshal(nextEvent(t, watcher, "message"), &message); err != nil {
+			t.Fatal(err)
+		}
+		if message.Seq != last[message.From]+1 {
+			t.Fatalf("carol got seq %d from %s after %d", message.Seq, message.From, last[message.From])
+		}
+		last[message.From] = message.Seq
+	}
+}
+
+func TestConcurrentConnects(t *testing.T) {
+	users := []string{"alice", "bob", "carol", "dave", "erin", "frank"}
+	hub := newTestHub(t, users...)
+	hub.ReconnectGrace = 0
+	const rounds = 20
+
+	// Users connect and disconnect devices while others send to them
+	var wg sync.WaitGroup
+	for _, username := range users {
+		wg.Add(2)
+		go func(username string) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				client := &Client{
+					Username:        username,
+					DeviceID:        fmt.Sprintf("%s-%d", username, i%2),
+					Send:            make(chan []byte, 256),
+					Hub:             hub,
+					codec:           jsonCodec{},
+					protocolVersion: MinProtocolVersion,
+				}
+				hub.registerClient(client)
+				if i%2 == 1 {
+					hub.unregisterClient(client)
+				}
+			}
+		}(username)
+		go func(username string) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				hub.handleInboundMessageWithSender(username, &models.InboundMessage{To: users[i%len(users)], Content: "hi"})
+			}
+		}(username)
+	}
+	wg.Wait()
+
+	// Each user is left with the even device of the last round
+	everyone := hub.everyClient()
+	for _, username := range users {
+		clients := hub.connectedClients(username)
+		if len(clients) != 1 || clients[0].DeviceID != username+"-0" {
+			t.Errorf("%s has %d devices connected, want only %s-0", username, len(clients), username)
+		}
+		if len(everyone[username]) != len(clients) {
+			t.Errorf("everyClient lists %d devices for %s, want %d", len(everyone[username]), username, len(clients))
+		}
+	}
+}
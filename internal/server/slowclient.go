@@ -0,0 +1,168 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+)
+
+// What to do with a client whose held frames reach SlowClientBuffer:
+//
+//   - disconnect: drop new frames, and drop the client once it makes no
+//     progress for outboxMaxRetries attempts (the default)
+//   - grow: drop new frames but keep the client for as long as it stays
+//     connected, however slowly it reads
+//   - drop_oldest: discard the oldest held frame to make room; messages in
+//     it return to the offline queue
+//   - spill: hold further frames in a per-client file under SpillDir and
+//     feed them back in order as the client catches up
+const (
+	SlowClientDisconnect = "disconnect"
+	SlowClientGrow       = "grow"
+	SlowClientDropOldest = "drop_oldest"
+	SlowClientSpill      = "spill"
+)
+
+// ValidSlowClientPolicy reports whether policy is one of the above
+func ValidSlowClientPolicy(policy string) bool {
+	switch policy {
+	case SlowClientDisconnect, SlowClientGrow, SlowClientDropOldest, SlowClientSpill:
+		return true
+	}
+	return false
+}
+
+// holdOverflow deals with a frame arriving when the outbox is full, or while
+// earlier frames are spilled, according to the hub's slow-client policy.
+// Callers must hold c.mu.
+func (c *Client) holdOverflow(frame outboxFrame) bool {
+	switch c.Hub.SlowClientPolicy {
+	case SlowClientDropOldest:
+		dropped := c.outbox[0]
+		c.outbox = append(c.outbox[1:], frame)
+		if len(dropped.messageIDs) > 0 {
+			go c.Hub.forgetFrames(c, []outboxFrame{dropped})
+		}
+		return true
+
+	case SlowClientSpill:
+		if c.spill == nil {
+			spill, err := newSpillQueue(c.Hub.SpillDir)
+			if err != nil {
+				log.Printf("Client %s outbox full and spilling failed, dropping frame: %v", c.Username, err)
+				return false
+			}
+			c.spill = spill
+		}
+		if err := c.spill.push(frame); err != nil {
+			log.Printf("Client %s spill failed, dropping frame: %v", c.Username, err)
+			return false
+		}
+		return true
+	}
+
+	log.Printf("Client %s outbox full, dropping frame", c.Username)
+	return false
+}
+
+// refillFromSpill moves spilled frames back into the outbox as it drains.
+// Callers must hold c.mu.
+func (c *Client) refillFromSpill() {
+	for c.spill.len() > 0 && len(c.outbox) < c.Hub.SlowClientBuffer {
+		frame, err := c.spill.pop()
+		if err != nil {
+			log.Printf("Client %s spill unreadable, discarding %d frames: %v", c.Username, c.spill.len(), err)
+			c.spill.close()
+			c.spill = nil
+			return
+		}
+		c.outbox = append(c.outbox, frame)
+	}
+}
+
+// forgetFrames undoes the recorded deliveries of messages in frames the
+// client will never receive
+func (h *Hub) forgetFrames(client *Client, frames []outboxFrame) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, frame := range frames {
+		for _, messageID := range frame.messageIDs {
+			if message, exists := h.message(messageID); exists {
+				h.forgetDelivery(message, client)
+			}
+		}
+	}
+}
+
+// spillQueue is a FIFO of frames in a temporary file. Frame data lives on
+// disk; only sizes and message IDs are kept in memory.
+type spillQueue struct {
+	file    *os.File
+	readAt  int64
+	writeAt int64
+	frames  []spilledFrame // Oldest first
+}
+
+type spilledFrame struct {
+	size       int
+	messageIDs []string
+}
+
+var errSpillShort = errors.New("short spill read")
+
+func newSpillQueue(dir string) (*spillQueue, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(dir, "client-*.spill")
+	if err != nil {
+		return nil, err
+	}
+	return &spillQueue{file: file}, nil
+}
+
+// len returns the number of spilled frames; a nil queue is empty
+func (q *spillQueue) len() int {
+	if q == nil {
+		return 0
+	}
+	return len(q.frames)
+}
+
+func (q *spillQueue) push(frame outboxFrame) error {
+	if _, err := q.file.WriteAt(frame.data, q.writeAt); err != nil {
+		return err
+	}
+	q.writeAt += int64(len(frame.data))
+	q.frames = append(q.frames, spilledFrame{size: len(frame.data), messageIDs: frame.messageIDs})
+	return nil
+}
+
+func (q *spillQueue) pop() (outboxFrame, error) {
+	next := q.frames[0]
+	data := make([]byte, next.size)
+	n, err := q.file.ReadAt(data, q.readAt)
+	if n < next.size {
+		if err == nil || err == io.EOF {
+			err = errSpillShort
+		}
+		return outboxFrame{}, err
+	}
+	q.frames = q.frames[1:]
+	q.readAt += int64(next.size)
+
+	// Reuse the file from the start once it's empty
+	if len(q.frames) == 0 {
+		q.readAt, q.writeAt = 0, 0
+		q.file.Truncate(0)
+	}
+	return outboxFrame{data: data, messageIDs: next.messageIDs}, nil
+}
+
+// close deletes the spill file and everything still in it
+func (q *spillQueue) close() {
+	q.file.Close()
+	os.Remove(q.file.Name())
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"whatsdown/internal/models"
+)
+
+// StarMessage adds or removes a message from username's starred list and
+// syncs the change to their connected client
+func (h *Hub) StarMessage(messageID, username string, starred bool) error {
+	h.mu.Lock()
+
+	message, exists := h.message(messageID)
+	if !exists || message.Deleted || !h.canAccessMessage(message, username) || message.HiddenFrom(username) {
+		h.mu.Unlock()
+		return errMessageNotFound
+	}
+
+	stars := removeString(h.Starred[username], messageID)
+	starrers := removeString(h.starredBy[messageID], username)
+	if starred {
+		stars = append(stars, messageID)
+		starrers = append(starrers, username)
+	}
+	h.Starred[username] = stars
+	if len(starrers) > 0 {
+		h.starredBy[messageID] = starrers
+	} else {
+		delete(h.starredBy, messageID)
+	}
+
+	clients := h.clientsOf(username)
+	h.mu.Unlock()
+
+	for _, client := range clients {
+		h.sendToClient(client, "star", &models.StarEvent{
+			MessageID: messageID,
+			Starred:   starred,
+		})
+	}
+	return nil
+}
+
+// GetStarredMessages returns username's starred messages, most recently starred first
+func (h *Hub) GetStarredMessages(username string) []*models.Message {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	stars := h.Starred[username]
+	starred := []*models.Message{}
+	for i := len(stars) - 1; i >= 0; i-- {
+		message, exists := h.message(stars[i])
+		if !exists || message.Deleted || !h.canAccessMessage(message, username) || message.HiddenFrom(username) {
+			continue
+		}
+		starred = append(starred, message.Snapshot())
+	}
+	return starred
+}
+
+// HandleStarred handles GET /api/starred
+func (h *HTTPHandlers) HandleStarred(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	messages := h.Hub.GetStarredMessages(session.Username)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
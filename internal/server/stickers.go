@@ -0,0 +1,342 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"whatsdown/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// Sticker pack kinds
+const (
+	PackStickers = "sticker"
+	PackEmoji    = "emoji"
+)
+
+const (
+	// Largest sticker or custom emoji image accepted
+	maxStickerBytes = 512 << 10
+
+	// Longest pack name in runes
+	maxPackNameRunes = 64
+)
+
+var (
+	errPackNotFound    = errors.New("sticker pack not found")
+	errStickerNotFound = errors.New("sticker not found")
+	errShortcodeTaken  = errors.New("shortcode already used in this pack")
+)
+
+var shortcodePattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+// Image types accepted for stickers, matched against the sniffed content type
+var stickerContentTypes = map[string]bool{
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+	"image/jpeg": true,
+}
+
+// StickerStore holds the admin-managed sticker and custom emoji packs
+type StickerStore struct {
+	packs map[string]*models.StickerPack
+	order []string
+	mu    sync.RWMutex
+}
+
+// StickerPackRequest creates a sticker pack
+type StickerPackRequest struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"` // "sticker" (default) or "emoji"
+}
+
+// NewStickerStore creates an empty sticker store
+func NewStickerStore() *StickerStore {
+	return &StickerStore{
+		packs: make(map[string]*models.StickerPack),
+	}
+}
+
+// CreatePack adds an empty pack
+func (s *StickerStore) CreatePack(name, kind, createdBy string) (*models.StickerPack, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxPackNameRunes {
+		return nil, fmt.Errorf("pack name must be 1-%d characters", maxPackNameRunes)
+	}
+	if kind == "" {
+		kind = PackStickers
+	}
+	if kind != PackStickers && kind != PackEmoji {
+		return nil, errors.New("kind must be sticker or emoji")
+	}
+
+	pack := &models.StickerPack{
+		ID:        uuid.New().String(),
+		Name:      name,
+		Kind:      kind,
+		Stickers:  []*models.Sticker{},
+		CreatedBy: createdBy,
+		CreatedAt: time.Now(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.packs[pack.ID] = pack
+	s.order = append(s.order, pack.ID)
+	return pack.Snapshot(), nil
+}
+
+// Packs returns every pack in creation order
+func (s *StickerStore) Packs() []*models.StickerPack {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	packs := make([]*models.StickerPack, 0, len(s.order))
+	for _, id := range s.order {
+		packs = append(packs, s.packs[id].Snapshot())
+	}
+	return packs
+}
+
+// DeletePack removes a pack. Messages that already used its stickers keep
+// rendering them.
+func (s *StickerStore) DeletePack(packID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.packs[packID]; !exists {
+		return errPackNotFound
+	}
+	delete(s.packs, packID)
+	for i, id := range s.order {
+		if id == packID {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// AddSticker adds an uploaded image to a pack under shortcode
+func (s *StickerStore) AddSticker(packID, shortcode, mediaID string) (*models.Sticker, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pack, exists := s.packs[packID]
+	if !exists {
+		return nil, errPackNotFound
+	}
+	for _, sticker := range pack.Stickers {
+		if sticker.Shortcode == shortcode {
+			return nil, errShortcodeTaken
+		}
+	}
+
+	sticker := &models.Sticker{
+		ID:        uuid.New().String(),
+		PackID:    packID,
+		Shortcode: shortcode,
+		MediaID:   mediaID,
+		URL:       "/api/media/" + mediaID,
+	}
+	pack.Stickers = append(pack.Stickers, sticker)
+	copied := *sticker
+	return &copied, nil
+}
+
+// RemoveSticker removes a sticker from its pack
+func (s *StickerStore) RemoveSticker(packID, stickerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pack, exists := s.packs[packID]
+	if !exists {
+		return errPackNotFound
+	}
+	for i, sticker := range pack.Stickers {
+		if sticker.ID == stickerID {
+			pack.Stickers = append(pack.Stickers[:i], pack.Stickers[i+1:]...)
+			return nil
+		}
+	}
+	return errStickerNotFound
+}
+
+// Get returns a copy of a sticker
+func (s *StickerStore) Get(packID, stickerID string) (*models.Sticker, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pack, exists := s.packs[packID]
+	if !exists {
+		return nil, errPackNotFound
+	}
+	for _, sticker := range pack.Stickers {
+		if sticker.ID == stickerID {
+			copied := *sticker
+			return &copied, nil
+		}
+	}
+	return nil, errStickerNotFound
+}
+
+// stickerErrorStatus maps sticker errors to HTTP status codes
+func stickerErrorStatus(err error) int {
+	switch err {
+	case errPackNotFound, errStickerNotFound:
+		return http.StatusNotFound
+	case errShortcodeTaken:
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// HandleStickers handles GET /api/stickers
+func (h *HTTPHandlers) HandleStickers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, _, ok := currentSession(w, r); !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Hub.Stickers.Packs())
+}
+
+// HandleAdminStickers handles POST /api/admin/stickers
+func (h *HTTPHandlers) HandleAdminStickers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	admin, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var req StickerPackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	pack, err := h.Hub.Stickers.CreatePack(h.Hub.Sanitizer.Sanitize(req.Name), req.Kind, admin.Username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.Audit.Record(AuditAdminAction, admin.Username, clientIP(r), "create sticker pack "+pack.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(pack)
+}
+
+// HandleAdminStickerPack handles the /api/admin/stickers/{packId} subtree:
+//
+//	DELETE /api/admin/stickers/{packId}
+//	POST   /api/admin/stickers/{packId}/items?shortcode=<code>  (raw image body)
+//	DELETE /api/admin/stickers/{packId}/items/{stickerId}
+func (h *HTTPHandlers) HandleAdminStickerPack(w http.ResponseWriter, r *http.Request) {
+	admin, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/stickers/"), "/"), "/")
+	packID := parts[0]
+	if packID == "" {
+		http.Error(w, "Pack ID required", http.StatusBadRequest)
+		return
+	}
+
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodDelete:
+		if err := h.Hub.Stickers.DeletePack(packID); err != nil {
+			http.Error(w, err.Error(), stickerErrorStatus(err))
+			return
+		}
+		h.Audit.Record(AuditAdminAction, admin.Username, clientIP(r), "delete sticker pack "+packID)
+		w.WriteHeader(http.StatusNoContent)
+
+	case action == "items" && len(parts) == 2 && r.Method == http.MethodPost:
+		h.uploadSticker(w, r, admin.Username, packID)
+
+	case action == "items" && len(parts) == 3 && r.Method == http.MethodDelete:
+		if err := h.Hub.Stickers.RemoveSticker(packID, parts[2]); err != nil {
+			http.Error(w, err.Error(), stickerErrorStatus(err))
+			return
+		}
+		h.Audit.Record(AuditAdminAction, admin.Username, clientIP(r), fmt.Sprintf("delete sticker %s from pack %s", parts[2], packID))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// uploadSticker stores the request body as an image and adds it to packID
+func (h *HTTPHandlers) uploadSticker(w http.ResponseWriter, r *http.Request, admin, packID string) {
+	shortcode := strings.ToLower(strings.Trim(strings.TrimSpace(r.URL.Query().Get("shortcode")), ":"))
+	if !shortcodePattern.MatchString(shortcode) {
+		http.Error(w, "shortcode must be 1-32 lowercase letters, digits or underscores", http.StatusBadRequest)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxStickerBytes))
+	if err != nil {
+		http.Error(w, errMediaTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Trust the bytes rather than the declared Content-Type
+	contentType := http.DetectContentType(data)
+	if !stickerContentTypes[contentType] {
+		http.Error(w, "Stickers must be PNG, GIF, WebP or JPEG images", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	media, err := h.Hub.Media.Save(&models.Media{
+		Owner:       admin,
+		Kind:        MediaSticker,
+		ContentType: contentType,
+	}, data)
+	if err != nil {
+		log.Printf("Error saving sticker: %v", err)
+		http.Error(w, "Failed to store media", http.StatusInternalServerError)
+		return
+	}
+
+	sticker, err := h.Hub.Stickers.AddSticker(packID, shortcode, media.ID)
+	if err != nil {
+		http.Error(w, err.Error(), stickerErrorStatus(err))
+		return
+	}
+	h.Audit.Record(AuditAdminAction, admin, clientIP(r), fmt.Sprintf("add sticker :%s: to pack %s", shortcode, packID))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sticker)
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"whatsdown/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// streamFrame is a sequenced frame kept for replay
+type streamFrame struct {
+	seq  int64
+	data []byte
+
+	// Set for messages, so client acknowledgements can mark them received
+	messageID string
+}
+
+// eventStream numbers the frames sent to one device and keeps the latest so
+// a reconnecting device can have the ones it missed replayed
+type eventStream struct {
+	ID       string
+	Username string
+	DeviceID string
+
+	// Recording client while no connection is attached; guarded by Hub.mu
+	detached *Client
+
+	// Connection frames are queued to, nil while detached; guarded by mu.
+	// Deliveries to a device's earlier connection that run after it resumed
+	// on a new one still reach the new one, numbered after the replay.
+	client *Client
+
+	// Frames are kept encoded, so only a connection negotiating the same
+	// encoding and protocol version can resume the stream
+	codec   wireCodec
+	version int
+
+	mu     sync.Mutex
+	seq    int64
+	acked  int64         // Latest seq the client acknowledged receiving
+	frames []streamFrame // Unacknowledged, oldest first, at most limit
+	limit  int
+}
+
+func newEventStream(username, deviceID string, codec wireCodec, version, limit int) *eventStream {
+	return &eventStream{
+		ID:       uuid.New().String(),
+		Username: username,
+		DeviceID: deviceID,
+		codec:    codec,
+		version:  version,
+		limit:    limit,
+	}
+}
+
+// send numbers an event, keeps it for replay and queues it to the attached
+// connection, if any. Numbering and queueing happen together so frames reach
+// the socket in sequence order.
+func (s *eventStream) send(msgType string, payload interface{}) bool {
+	return s.sendEncoded(payload, func(seq int64) ([]byte, error) {
+		return s.codec.Marshal(&models.WSMessage{Type: msgType, Seq: seq, Payload: payload})
+	})
+}
+
+// sendPrepared sends a prepared event like send, wrapping its shared payload
+// in an envelope numbered for this stream
+func (s *eventStream) sendPrepared(event *preparedEvent) bool {
+	return s.sendEncoded(event.Payload, func(seq int64) ([]byte, error) {
+		payload, err := event.payload(s.codec)
+		if err != nil {
+			return nil, err
+		}
+		return s.codec.MarshalEnvelope(event.Type, seq, payload), nil
+	})
+}
+
+// sendEncoded numbers, keeps and queues the frame encode makes for the next
+// seq
+func (s *eventStream) sendEncoded(payload interface{}, encode func(seq int64) ([]byte, error)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := encode(s.seq + 1)
+	if err != nil {
+		log.Printf("Error marshaling message: %v", err)
+		return false
+	}
+	s.record(data, payload)
+
+	if s.client == nil {
+		return false
+	}
+	return s.client.enqueue(newOutboxFrame(data, payload))
+}
+
+// record keeps an event encoded with the next seq for replay. Callers must
+// hold s.mu.
+func (s *eventStream) record(data []byte, payload interface{}) {
+	s.seq++
+	if len(s.frames) >= s.limit {
+		s.frames = append(s.frames[:0], s.frames[1:]...)
+	}
+	s.frames = append(s.frames, streamFrame{seq: s.seq, data: data, messageID: outboundMessageID(payload)})
+}
+
+// since returns the frames after seq, and false if some of them have already
+// been dropped from the buffer. Callers must hold s.mu.
+func (s *eventStream) since(seq int64) ([][]byte, bool) {
+	if seq < 0 || seq > s.seq {
+		return nil, false
+	}
+	// Everything acknowledged was received, whatever the client now says
+	if seq < s.acked {
+		seq = s.acked
+	}
+	if seq == s.seq {
+		return nil, true
+	}
+	if len(s.frames) == 0 || s.frames[0].seq > seq+1 {
+		return nil, false
+	}
+	missed := make([][]byte, 0, s.seq-seq)
+	for _, frame := range s.frames {
+		if frame.seq > seq {
+			missed = append(missed, frame.data)
+		}
+	}
+	return missed, true
+}
+
+// lastSeq returns the sequence number of the latest frame
+func (s *eventStream) lastSeq() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seq
+}
+
+// resumeRequest reads ?resume=<streamId>&lastSeq=<n> from a WebSocket
+// request; ok is false if lastSeq is malformed
+func resumeRequest(r *http.Request) (streamID string, lastSeq int64, ok bool) {
+	streamID = r.URL.Query().Get("resume")
+	if streamID == "" {
+		return "", 0, true
+	}
+	lastSeq, err := strconv.ParseInt(r.URL.Query().Get("lastSeq"), 10, 64)
+	if err != nil || lastSeq < 0 {
+		return "", 0, false
+	}
+	return streamID, lastSeq, true
+}
+
+// attachStream gives a newly registered client its device's event stream:
+// the one it asked to resume if the missed frames are still buffered, which
+// are then replayed, or a fresh one. The client is told which in a "stream"
+// event before any other event. It reports whether the stream was resumed.
+// Callers must hold h.mu.
+func (h *Hub) attachStream(client *Client) bool {
+	if h.ResumeWindow <= 0 {
+		return false
+	}
+
+	streams, exists := h.Streams[client.Username]
+	if !exists {
+		streams = make(map[string]*eventStream)
+		h.Streams[client.Username] = streams
+	}
+
+	// The stream is attached, and what was missed replayed, under its lock
+	// so no frame is numbered in between and left out of both
+	event := &models.StreamEvent{}
+	var missed [][]byte
+	stream := streams[client.DeviceID]
+	if stream != nil && client.resumeStream == stream.ID && client.codec == stream.codec && client.protocolVersion == stream.version {
+		stream.mu.Lock()
+		missed, event.Resumed = stream.since(client.resumeSeq)
+		if !event.Resumed {
+			stream.mu.Unlock()
+		}
+	}
+	if event.Resumed {
+		event.Replayed = len(missed)
+	} else {
+		// A device has one stream; whatever it missed on an older one is lost
+		stream = newEventStream(client.Username, client.DeviceID, client.codec, client.protocolVersion, h.ResumeBuffer)
+		streams[client.DeviceID] = stream
+		stream.mu.Lock()
+	}
+	defer stream.mu.Unlock()
+	stream.detached = nil
+	stream.client = client
+	client.stream = stream
+	event.StreamID = stream.ID
+	event.Seq = stream.seq
+
+	data, err := client.codec.Marshal(&models.WSMessage{Type: "stream", Payload: event})
+	if err != nil {
+		log.Printf("Error marshaling stream event: %v", err)
+		return event.Resumed
+	}
+	client.enqueue(outboxFrame{data: data})
+	for len(missed) > 0 {
+		if !client.supportsBatches() || len(missed) == 1 {
+			client.enqueue(outboxFrame{data: missed[0]})
+			missed = missed[1:]
+			continue
+		}
+		n := min(len(missed), maxBatchEvents)
+		client.enqueue(outboxFrame{data: client.codec.MarshalBatch(missed[:n])})
+		missed = missed[n:]
+	}
+	if event.Resumed {
+		log.Printf("Resumed stream for %s (device %s), replaying %d events", client.Username, client.DeviceID, event.Replayed)
+	}
+	return event.Resumed
+}
+
+// detachStream keeps a disconnected client's stream recording for
+// h.ResumeWindow so the device can resume it. Callers must hold h.mu.
+func (h *Hub) detachStream(client *Client) {
+	stream := client.stream
+	if stream == nil || h.Streams[client.Username][client.DeviceID] != stream {
+		return
+	}
+
+	recorder := &Client{
+		Username:        client.Username,
+		SessionID:       client.SessionID,
+		DeviceID:        client.DeviceID,
+		Hub:             h,
+		codec:           stream.codec,
+		protocolVersion: stream.version,
+		stream:          stream,
+		detached:        true,
+	}
+	stream.detached = recorder
+	stream.mu.Lock()
+	if stream.client == client {
+		stream.client = nil
+	}
+	stream.mu.Unlock()
+	time.AfterFunc(h.ResumeWindow, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if stream.detached == recorder {
+			h.dropStream(client.Username, client.DeviceID)
+		}
+	})
+}
+
+// dropStream forgets a device's stream. Callers must hold h.mu.
+func (h *Hub) dropStream(username, deviceID string) {
+	delete(h.Streams[username], deviceID)
+	if len(h.Streams[username]) == 0 {
+		delete(h.Streams, username)
+	}
+}
+
+// detachedClients returns the recorders of username's streams that are
+// waiting to be resumed. Callers must hold h.mu.
+func (h *Hub) detachedClients(username string) []*Client {
+	var clients []*Client
+	for _, stream := range h.Streams[username] {
+		if stream.detached != nil {
+			clients = append(clients, stream.detached)
+		}
+	}
+	return clients
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+// canReplyInThread reports whether message may be posted in the thread rooted
+// at threadID: the root must be in the same conversation, visible to the
+// sender, and not itself a thread reply
+func (h *Hub) canReplyInThread(message *models.Message, threadID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	root, exists := h.message(threadID)
+	if !exists || root.ConvKey() != message.ConvKey() || root.ThreadID != "" {
+		return false
+	}
+	return !root.Deleted && !root.HiddenFrom(message.From)
+}
+
+// updateThread bumps the root's reply stats for a newly stored reply and
+// notifies the conversation so thread previews stay current
+func (h *Hub) updateThread(reply *models.Message) {
+	h.mu.Lock()
+
+	root, exists := h.message(reply.ThreadID)
+	if !exists {
+		h.mu.Unlock()
+		return
+	}
+	root.ThreadReplies++
+	lastReplyAt := reply.Timestamp
+	root.ThreadLastReplyAt = &lastReplyAt
+
+	event := &models.ThreadEvent{
+		ThreadID:    root.ID,
+		ReplyCount:  root.ThreadReplies,
+		LastReplyAt: reply.Timestamp.Format(time.RFC3339),
+		LastReplyBy: reply.From,
+	}
+	recipients := h.participantClients(root)
+	h.mu.Unlock()
+
+	for _, client := range recipients {
+		h.sendToClient(client, "thread", event)
+	}
+}
+
+// GetThread returns a thread's root followed by its replies, as visible to username
+func (h *Hub) GetThread(threadID, username string) ([]*models.Message, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	root, exists := h.message(threadID)
+	if !exists || !h.canAccessMessage(root, username) || root.HiddenFrom(username) {
+		return nil, errMessageNotFound
+	}
+
+	thread := []*models.Message{root.Snapshot()}
+	for _, message := range h.conversation(root.ConvKey()) {
+		if message.ThreadID == threadID && !message.HiddenFrom(username) {
+			thread = append(thread, message.Snapshot())
+		}
+	}
+	return thread, nil
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"testing"
+
+	"whatsdown/internal/models"
+)
+
+func TestRejectedThreadReplyIsNotCounted(t *testing.T) {
+	hub := newTestHub(t, "alice", "bob")
+	group, err := hub.CreateGroup("alice", "team", []string{"bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.handleInboundMessageWithSender("alice", &models.InboundMessage{GroupID: group.ID, Content: "root"})
+	root := lastMessage(t, hub, &models.Message{GroupID: group.ID})
+
+	hub.handleInboundMessageWithSender("bob", &models.InboundMessage{GroupID: group.ID, Content: "first", ThreadID: root.ID})
+	if err := hub.LeaveGroup(group.ID, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	hub.handleInboundMessageWithSender("bob", &models.InboundMessage{GroupID: group.ID, Content: "second", ThreadID: root.ID})
+
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	if root.ThreadReplies != 1 {
+		t.Errorf("ThreadReplies = %d, want 1", root.ThreadReplies)
+	}
+}
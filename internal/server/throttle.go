@@ -0,0 +1,84 @@
+package server
+
+import (
+	"crypto/sha256"
+	"strings"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+// Error code for messages throttled as copy-paste spam
+const ErrorDuplicateSpam = "DUPLICATE_SPAM"
+
+// sentContent records one message a sender sent, for duplicate detection
+type sentContent struct {
+	hash   [sha256.Size]byte
+	target string // conversation key
+	at     time.Time
+}
+
+// contentHash identifies content regardless of case and spacing, so trivial
+// variations still count as duplicates
+func contentHash(content string) [sha256.Size]byte {
+	normalized := strings.Join(strings.Fields(strings.ToLower(content)), " ")
+	return sha256.Sum256([]byte(normalized))
+}
+
+// allowDuplicate reports whether from may send content to the conversation
+// target, refusing once the same content already went to
+// DuplicateRecipientLimit other conversations within DuplicateWindow
+func (h *Hub) allowDuplicate(from, target, content string) bool {
+	if h.DuplicateRecipientLimit <= 0 || content == "" {
+		return true
+	}
+
+	s := h.shard(from)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-h.DuplicateWindow)
+	hash := contentHash(content)
+
+	recent := s.recent[from][:0]
+	targets := make(map[string]bool)
+	for _, sent := range s.recent[from] {
+		if sent.at.Before(cutoff) {
+			continue
+		}
+		recent = append(recent, sent)
+		if sent.hash == hash && sent.target != target {
+			targets[sent.target] = true
+		}
+	}
+
+	if len(targets) >= h.DuplicateRecipientLimit {
+		s.recent[from] = recent
+		return false
+	}
+	s.recent[from] = append(recent, sentContent{hash: hash, target: target, at: now})
+	return true
+}
+
+// inboundConvKey returns the conversation an inbound message is addressed to
+func inboundConvKey(from string, msg *models.InboundMessage) string {
+	switch {
+	case msg.GroupID != "":
+		return models.GroupConvKey(msg.GroupID)
+	case msg.ChannelID != "":
+		return models.ChannelConvKey(msg.ChannelID)
+	default:
+		return models.ConvKey(from, msg.To)
+	}
+}
+
+// throttleDuplicate tells from their message was throttled as spam
+func (h *Hub) throttleDuplicate(from, tempID string) {
+	h.sendError(from, &models.ErrorEvent{
+		Code:    ErrorDuplicateSpam,
+		Message: "the same message was sent to too many conversations; try again later",
+		Limit:   h.DuplicateRecipientLimit,
+		TempID:  tempID,
+	})
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // register decoders for image.Decode
+	"image/jpeg"
+	_ "image/png"
+	"log"
+	"os"
+)
+
+// Thumbnail sizes, as the longest edge in pixels
+var thumbnailSizes = map[string]int{
+	"small":  160,
+	"medium": 640,
+}
+
+const (
+	// Largest image, in pixels, decoded for thumbnails
+	maxThumbnailSourcePixels = 40_000_000
+
+	// Images waiting for thumbnails before new ones are skipped
+	thumbnailQueueSize = 256
+
+	thumbnailQuality = 80
+)
+
+// Content types thumbnails can be generated from
+var thumbnailSourceTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// StartThumbnailer starts workers that generate thumbnails for queued images
+func (m *MediaStore) StartThumbnailer(workers int) {
+	m.thumbnailQueue = make(chan string, thumbnailQueueSize)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for id := range m.thumbnailQueue {
+				m.generateThumbnails(id)
+			}
+		}()
+	}
+}
+
+// QueueThumbnails schedules thumbnail generation for an uploaded image, or a
+// poster frame and thumbnails for a video. It never blocks; when the queue is
+// full the media is served without them.
+func (m *MediaStore) QueueThumbnails(id, contentType string) {
+	isVideo := attachmentType(contentType) == AttachmentVideo && m.FFmpegPath != ""
+	if m.thumbnailQueue == nil || (!thumbnailSourceTypes[contentType] && !isVideo) {
+		return
+	}
+	select {
+	case m.thumbnailQueue <- id:
+	default:
+		log.Printf("Thumbnail queue full, skipping %s", id)
+	}
+}
+
+// generateThumbnails writes a JPEG for each size smaller than the image, or
+// than a video's poster frame, and records which sizes are ready
+func (m *MediaStore) generateThumbnails(id string) {
+	m.mu.RLock()
+	media, exists := m.items[id]
+	isVideo := exists && attachmentType(media.ContentType) == AttachmentVideo
+	m.mu.RUnlock()
+
+	source := m.path(id)
+	ready := []string{}
+	if isVideo {
+		if err := m.extractPoster(id); err != nil {
+			log.Printf("Error extracting poster for %s: %v", id, err)
+			return
+		}
+		source = m.thumbnailPath(id, posterSize)
+		ready = append(ready, posterSize)
+		// Publish the poster before the smaller sizes are done
+		m.setThumbnails(id, ready)
+	}
+
+	file, err := os.Open(source)
+	if err != nil {
+		log.Printf("Error opening %s for thumbnails: %v", id, err)
+		return
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil || config.Width*config.Height > maxThumbnailSourcePixels {
+		log.Printf("Skipping thumbnails for %s: unsupported or too large", id)
+		return
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return
+	}
+	decoded, _, err := image.Decode(file)
+	if err != nil {
+		log.Printf("Error decoding %s for thumbnails: %v", id, err)
+		return
+	}
+
+	for size, edge := range thumbnailSizes {
+		bounds := decoded.Bounds()
+		if bounds.Dx() <= edge && bounds.Dy() <= edge {
+			// The original is small enough to serve as is
+			continue
+		}
+		if err := m.writeThumbnail(id, size, scaleToFit(decoded, edge)); err != nil {
+			log.Printf("Error writing %s thumbnail for %s: %v", size, id, err)
+			continue
+		}
+		ready = append(ready, size)
+	}
+	m.setThumbnails(id, ready)
+}
+
+func (m *MediaStore) setThumbnails(id string, ready []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if media, exists := m.items[id]; exists {
+		media.Thumbnails = append([]string(nil), ready...)
+	}
+}
+
+func (m *MediaStore) writeThumbnail(id, size string, thumbnail image.Image) error {
+	file, err := os.OpenFile(m.thumbnailPath(id, size), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(file, thumbnail, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (m *MediaStore) thumbnailPath(id, size string) string {
+	return m.path(id) + "_" + size + ".jpg"
+}
+
+// OpenThumbnail opens a generated thumbnail, reporting false if that size
+// isn't available and the original should be served instead
+func (m *MediaStore) OpenThumbnail(id, size string) (*os.File, bool) {
+	m.mu.RLock()
+	media, exists := m.items[id]
+	ready := exists && containsString(media.Thumbnails, size)
+	m.mu.RUnlock()
+
+	if !ready {
+		return nil, false
+	}
+	file, err := os.Open(m.thumbnailPath(id, size))
+	if err != nil {
+		return nil, false
+	}
+	return file, true
+}
+
+// scaleToFit shrinks source so its longest edge is edge pixels, averaging the
+// source pixels under each output pixel, over a white background
+func scaleToFit(source image.Image, edge int) image.Image {
+	bounds := source.Bounds()
+	width, height := edge, edge
+	if bounds.Dx() > bounds.Dy() {
+		height = max(1, bounds.Dy()*edge/bounds.Dx())
+	} else {
+		width = max(1, bounds.Dx()*edge/bounds.Dy())
+	}
+
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*bounds.Dy()/height)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := max(x0+1, bounds.Min.X+(x+1)*bounds.Dx()/width)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := source.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			scaled.SetRGBA64(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+
+	// JPEG has no alpha, so flatten transparent images onto white
+	flattened := image.NewRGBA(scaled.Bounds())
+	draw.Draw(flattened, flattened.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flattened, flattened.Bounds(), scaled, image.Point{}, draw.Over)
+	return flattened
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+func init() {
+	RegisterWSHandler("time", func(c *Client, payload json.RawMessage) error {
+		received := time.Now()
+		var request models.TimeRequest
+		if err := json.Unmarshal(payload, &request); err != nil {
+			return err
+		}
+		c.sendTime(request.ClientTime, received)
+		return nil
+	})
+}
+
+// sendTime answers a "time" request with when the server received it and
+// when it replied, so the client can work out its clock offset and the round
+// trip. Like "hello" the reply isn't numbered: replaying it after a
+// reconnect would only give stale times.
+func (c *Client) sendTime(clientTime int64, received time.Time) {
+	event := &models.TimeEvent{
+		ClientTime:     clientTime,
+		ServerReceived: received.UnixMilli(),
+		ServerSent:     time.Now().UnixMilli(),
+	}
+	data, err := c.codec.Marshal(&models.WSMessage{Type: "time", Payload: event})
+	if err != nil {
+		log.Printf("Error marshaling time event: %v", err)
+		return
+	}
+	c.enqueue(outboxFrame{data: data})
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+// Time allowed for one translation request
+const translationTimeout = 3 * time.Second
+
+var languagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// Translator translates message text into a target language
+type Translator interface {
+	// Translate returns text in language, or a nil translation if it is
+	// already in that language
+	Translate(ctx context.Context, text, language string) (*models.Translation, error)
+}
+
+// HTTPTranslator calls a LibreTranslate-compatible translation API
+type HTTPTranslator struct {
+	endpoint string
+	apiKey   string
+	client   *http.Client
+}
+
+// LanguageRequest sets the language incoming messages are translated into
+type LanguageRequest struct {
+	Language string `json:"language"` // BCP 47 tag, e.g. "es" or "pt-BR"; empty turns translation off
+}
+
+// LanguageResponse is a user's translation setting
+type LanguageResponse struct {
+	Language  string `json:"language"`
+	Available bool   `json:"available"` // whether the server has a translation backend
+}
+
+// NewHTTPTranslator translates with the /translate endpoint at baseURL
+func NewHTTPTranslator(baseURL, apiKey string) *HTTPTranslator {
+	return &HTTPTranslator{
+		endpoint: strings.TrimRight(baseURL, "/") + "/translate",
+		apiKey:   apiKey,
+		client:   &http.Client{Timeout: translationTimeout},
+	}
+}
+
+// Translate implements Translator
+func (t *HTTPTranslator) Translate(ctx context.Context, text, language string) (*models.Translation, error) {
+	body, err := json.Marshal(map[string]string{
+		"q":       text,
+		"source":  "auto",
+		"target":  language,
+		"format":  "text",
+		"api_key": t.apiKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("translation backend returned %s", resp.Status)
+	}
+
+	var result struct {
+		TranslatedText   string `json:"translatedText"`
+		DetectedLanguage struct {
+			Language string `json:"language"`
+		} `json:"detectedLanguage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	source := result.DetectedLanguage.Language
+	if sameLanguage(source, language) || result.TranslatedText == "" || result.TranslatedText == text {
+		return nil, nil
+	}
+	return &models.Translation{
+		Language:       language,
+		SourceLanguage: source,
+		Text:           result.TranslatedText,
+	}, nil
+}
+
+// sameLanguage compares the primary subtags of two language tags
+func sameLanguage(a, b string) bool {
+	primary := func(tag string) string {
+		return strings.ToLower(strings.SplitN(tag, "-", 2)[0])
+	}
+	return a != "" && primary(a) == primary(b)
+}
+
+// SetLanguage sets the language username's incoming messages are translated into
+func (h *Hub) SetLanguage(username, language string) error {
+	if language != "" && !languagePattern.MatchString(language) {
+		return errors.New("language must be a BCP 47 tag such as \"es\" or \"pt-BR\"")
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if language == "" {
+		delete(h.Languages, username)
+	} else {
+		h.Languages[username] = language
+	}
+	return nil
+}
+
+// GetLanguage returns the language username's incoming messages are translated into
+func (h *Hub) GetLanguage(username string) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.Languages[username]
+}
+
+// translateLater sends recipients a "translation" event for message once it
+// is translated into their preferred language. Each language is requested
+// once, in the background, so delivery never waits on the backend. Callers
+// must not hold h.mu.
+func (h *Hub) translateLater(message *models.Message, recipients []*Client) {
+	if h.Translator == nil {
+		return
+	}
+
+	h.mu.RLock()
+	content := message.Content
+	byLanguage := make(map[string][]*Client)
+	if content != "" && message.Encrypted == nil {
+		for _, client := range recipients {
+			language := h.Languages[client.Username]
+			if language != "" && client.Username != message.From {
+				byLanguage[language] = append(byLanguage[language], client)
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	for language, clients := range byLanguage {
+		go h.sendTranslation(message, content, language, clients)
+	}
+}
+
+// sendTranslation translates content into language, caching the result on
+// message for later deliveries, and sends it to clients. Nothing is sent if
+// it needs no translation or the backend fails.
+func (h *Hub) sendTranslation(message *models.Message, content, language string, clients []*Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), translationTimeout)
+	defer cancel()
+
+	translation, err := h.Translator.Translate(ctx, content, language)
+	if err != nil {
+		// Leave it uncached so a later delivery can retry
+		log.Printf("Error translating message %s into %s: %v", message.ID, language, err)
+		return
+	}
+
+	h.mu.Lock()
+	if message.Translations == nil {
+		message.Translations = make(map[string]*models.Translation)
+	}
+	message.Translations[language] = translation
+	h.mu.Unlock()
+
+	if translation == nil {
+		return
+	}
+	event := &models.TranslationEvent{
+		MessageID:   message.ID,
+		Translation: translation,
+	}
+	for _, client := range clients {
+		h.sendToClient(client, "translation", event)
+	}
+}
+
+// cachedTranslationFor returns an already fetched translation of message for
+// username. Callers must hold h.mu.
+func (h *Hub) cachedTranslationFor(message *models.Message, username string) *models.Translation {
+	language := h.Languages[username]
+	if language == "" || message.From == username {
+		return nil
+	}
+	return message.Translations[language]
+}
+
+// HandleTranslation handles GET and PUT /api/translation
+func (h *HTTPHandlers) HandleTranslation(w http.ResponseWriter, r *http.Request) {
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPut:
+		var req LanguageRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := h.Hub.SetLanguage(session.Username, strings.TrimSpace(req.Language)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&LanguageResponse{
+		Language:  h.Hub.GetLanguage(session.Username),
+		Available: h.Hub.Translator != nil,
+	})
+}
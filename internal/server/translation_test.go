@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"whatsdown/internal/models"
+)
+
+// blockingTranslator counts requests per language and holds them until
+// released
+type blockingTranslator struct {
+	mu      sync.Mutex
+	calls   map[string]int
+	release chan struct{}
+}
+
+func (b *blockingTranslator) Translate(ctx context.Context, text, language string) (*models.Translation, error) {
+	b.mu.Lock()
+	b.calls[language]++
+	b.mu.Unlock()
+	<-b.release
+	return &models.Translation{Language: language, Text: language + ": " + text}, nil
+}
+
+func TestTranslationDoesNotHoldUpDelivery(t *testing.T) {
+	hub := newTestHub(t, "alice", "bob", "carol", "dave")
+	translator := &blockingTranslator{calls: make(map[string]int), release: make(chan struct{})}
+	hub.Translator = translator
+	for username, language := range map[string]string{"bob": "es", "carol": "es", "dave": "fr"} {
+		if err := hub.SetLanguage(username, language); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clients := map[string]*Client{}
+	for _, username := range []string{"bob", "carol", "dave"} {
+		clients[username] = newTestClient(t, hub, username)
+	}
+	group, err := hub.CreateGroup("alice", "team", []string{"bob", "carol", "dave"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(chan struct{})
+	go func() {
+		hub.handleInboundMessageWithSender("alice", &models.InboundMessage{GroupID: group.ID, Content: "hello"})
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("send waited on the translator")
+	}
+	for _, client := range clients {
+		nextEvent(t, client, "message")
+	}
+
+	close(translator.release)
+	for username, want := range map[string]string{"bob": "es: hello", "carol": "es: hello", "dave": "fr: hello"} {
+		var event models.TranslationEvent
+		if err := json.Unmarshal(nextEvent(t, clients[username], "translation"), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Translation == nil || event.Translation.Text != want {
+			t.Errorf("%s got translation %+v, want %q", username, event.Translation, want)
+		}
+	}
+
+	translator.mu.Lock()
+	defer translator.mu.Unlock()
+	if translator.calls["es"] != 1 || translator.calls["fr"] != 1 {
+		t.Errorf("translator calls = %v, want one per language", translator.calls)
+	}
+}
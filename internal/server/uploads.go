@@ -0,0 +1,229 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"whatsdown/internal/models"
+)
+
+// Attachment types, derived from the content type
+const (
+	AttachmentImage = "image"
+	AttachmentAudio = "audio"
+	AttachmentVideo = "video"
+	AttachmentFile  = "file"
+)
+
+const (
+	// Most attachments one message may carry
+	maxAttachmentsPerMessage = 10
+
+	// Longest stored file name in runes
+	maxFileNameRunes = 255
+)
+
+var errTooManyAttachments = errors.New("too many attachments")
+
+// attachmentType classifies a content type for clients
+func attachmentType(contentType string) string {
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		return AttachmentImage
+	case strings.HasPrefix(contentType, "audio/"):
+		return AttachmentAudio
+	case strings.HasPrefix(contentType, "video/"):
+		return AttachmentVideo
+	default:
+		return AttachmentFile
+	}
+}
+
+// cleanFileName reduces an uploaded file name to a safe base name
+func cleanFileName(name string) string {
+	name = strings.TrimSpace(filepath.Base(strings.ReplaceAll(name, "\\", "/")))
+	if name == "." || name == "/" {
+		name = ""
+	}
+	name = normalizeContent(name)
+	for utf8.RuneCountInString(name) > maxFileNameRunes {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "" {
+		name = "file"
+	}
+	return name
+}
+
+// newAttachment describes uploaded media for delivery
+func newAttachment(media *models.Media) *models.Attachment {
+	attachment := &models.Attachment{
+		ID:          media.ID,
+		Name:        media.Name,
+		ContentType: media.ContentType,
+		Size:        media.Size,
+		Type:        attachmentType(media.ContentType),
+		URL:         "/api/media/" + media.ID,
+		Codec:       media.Codec,
+		Duration:    media.Duration,
+		Width:       media.Width,
+		Height:      media.Height,
+	}
+	if attachment.Type == AttachmentVideo {
+		// Thumbnail and poster URLs return 404 until ffmpeg has run
+		attachment.Poster = attachment.URL + "/" + posterSize
+	}
+	if thumbnailSourceTypes[media.ContentType] || attachment.Type == AttachmentVideo {
+		// Image thumbnail URLs serve the original until generation finishes
+		attachment.Thumbnails = map[string]string{}
+		for size := range thumbnailSizes {
+			attachment.Thumbnails[size] = attachment.URL + "/thumbnail/" + size
+		}
+	}
+	return attachment
+}
+
+// newAttachments validates that from uploaded every media ID as an attachment
+func (h *Hub) newAttachments(from string, mediaIDs []string) ([]*models.Attachment, error) {
+	if len(mediaIDs) > maxAttachmentsPerMessage {
+		return nil, errTooManyAttachments
+	}
+	if h.Media == nil {
+		return nil, errMediaNotFound
+	}
+
+	attachments := []*models.Attachment{}
+	seen := make(map[string]bool)
+	for _, id := range mediaIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		media, exists := h.Media.Get(id)
+		if !exists || media.Owner != from || media.Kind != MediaAttachment {
+			return nil, errMediaNotFound
+		}
+		attachments = append(attachments, newAttachment(media))
+	}
+	return attachments, nil
+}
+
+// HandleUploads handles POST /api/uploads, a multipart form with the file in
+// its "file" field
+func (h *HTTPHandlers) HandleUploads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, session, ok := currentSession(w, r)
+	if !ok {
+		return
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected a multipart/form-data body", http.StatusBadRequest)
+		return
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			http.Error(w, "Missing file field", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Invalid multipart body", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		h.storeUpload(w, session.Username, part.FileName(), part.Header.Get("Content-Type"), part)
+		return
+	}
+}
+
+// storeUpload saves one uploaded file as an attachment and responds with it
+func (h *HTTPHandlers) storeUpload(w http.ResponseWriter, owner, fileName, declaredType string, body io.Reader) {
+	// The type isn't known until the body is read, so read up to the larger limit
+	data, err := io.ReadAll(io.LimitReader(body, max(h.Config.MaxUploadBytes, h.Config.MaxVideoBytes)+1))
+	if err != nil {
+		http.Error(w, "Failed to read upload", http.StatusBadRequest)
+		return
+	}
+
+	contentType, err := h.Config.checkUploadType(declaredType, data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if h.Config.StripImageMetadata {
+		// Photos often carry the GPS position they were taken at
+		data = stripImageMetadata(contentType, data)
+	}
+
+	limit := h.Config.MaxUploadBytes
+	if attachmentType(contentType) == AttachmentVideo {
+		limit = h.Config.MaxVideoBytes
+	}
+	if int64(len(data)) > limit {
+		http.Error(w, errMediaTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	media := &models.Media{
+		Owner:       owner,
+		Kind:        MediaAttachment,
+		Name:        cleanFileName(fileName),
+		ContentType: contentType,
+	}
+	switch attachmentType(contentType) {
+	case AttachmentAudio:
+		// Unreadable audio is still accepted, just without metadata
+		if info, err := probeAudioMetadata(data); err == nil {
+			media.Codec = info.Codec
+			media.Duration = info.Duration.Seconds()
+		}
+	case AttachmentVideo:
+		info, err := probeVideo(data)
+		maxDuration := h.Config.MaxVideoDuration
+		if err != nil && maxDuration > 0 {
+			// The duration limit can't be enforced on a video the server can't read
+			http.Error(w, "Videos must be MP4, QuickTime or WebM", http.StatusUnsupportedMediaType)
+			return
+		}
+		if err == nil {
+			if maxDuration > 0 && info.Duration > maxDuration {
+				http.Error(w, "Video too long", http.StatusRequestEntityTooLarge)
+				return
+			}
+			media.Codec = info.Codec
+			media.Duration = info.Duration.Seconds()
+			media.Width, media.Height = info.Width, info.Height
+		}
+	}
+
+	media, err = h.Hub.Media.Save(media, data)
+	if err != nil {
+		log.Printf("Error saving upload: %v", err)
+		http.Error(w, "Failed to store media", http.StatusInternalServerError)
+		return
+	}
+	h.Hub.Media.QueueThumbnails(media.ID, media.ContentType)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newAttachment(media))
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"testing"
+
+	"whatsdown/internal/models"
+)
+
+func TestDroppedMessageIsNotAttached(t *testing.T) {
+	hub := newTestHub(t, "alice", "bob")
+	media, err := NewMediaStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.Media = media
+	upload, err := media.Save(&models.Media{Owner: "alice", Kind: MediaAttachment, ContentType: "text/plain", Name: "notes.txt"}, []byte("notes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub.handleInboundMessageWithSender("alice", &models.InboundMessage{To: "bob", AttachmentIDs: []string{upload.ID}, ReplyToID: "missing"})
+	hub.handleInboundMessageWithSender("alice", &models.InboundMessage{To: "nobody", AttachmentIDs: []string{upload.ID}})
+	if saved, _ := media.Get(upload.ID); len(saved.MessageIDs) != 0 {
+		t.Fatalf("dropped messages were attached: %v", saved.MessageIDs)
+	}
+
+	hub.handleInboundMessageWithSender("alice", &models.InboundMessage{To: "bob", AttachmentIDs: []string{upload.ID}})
+	message := lastMessage(t, hub, &models.Message{From: "alice", To: "bob"})
+	if saved, _ := media.Get(upload.ID); len(saved.MessageIDs) != 1 || saved.MessageIDs[0] != message.ID {
+		t.Errorf("MessageIDs = %v, want [%s]", saved.MessageIDs, message.ID)
+	}
+}
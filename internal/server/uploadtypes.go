@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var errUploadTypeNotAllowed = errors.New("file type not allowed")
+
+// Types refused unless WHATSDOWN_UPLOAD_DENIED_TYPES says otherwise
+var defaultDeniedUploadTypes = []string{
+	"text/html", "application/xhtml+xml", "text/javascript", "application/javascript",
+	"application/x-msdownload", "application/x-msdos-program",
+}
+
+// Sniffed types too generic to contradict a more specific declared type
+var genericSniffedTypes = map[string]bool{
+	"application/octet-stream": true,
+	"text/plain":               true,
+	"application/zip":          true, // Office documents, APKs, JARs...
+}
+
+// Declared types that refine what the sniffer reports for the same bytes
+var sniffedTypeRefinements = map[string][]string{
+	"video/mp4":       {"audio/mp4", "audio/x-m4a", "video/quicktime"},
+	"application/ogg": {"audio/ogg", "audio/opus", "video/ogg"},
+	"audio/wave":      {"audio/wav", "audio/x-wav", "audio/vnd.wave"},
+	"audio/mpeg":      {"audio/mp3"},
+	"video/webm":      {"audio/webm"},
+}
+
+var (
+	svgPattern       = regexp.MustCompile(`(?i)<svg[\s>]`)
+	activeSVGPattern = regexp.MustCompile(`(?i)<script|<foreignobject|\son[a-z]+\s*=|javascript:`)
+)
+
+// sniffUploadType decides an upload's content type from its bytes. The
+// declared type is only kept when the sniffer can't tell, or when it's a
+// more specific name for what was sniffed.
+func sniffUploadType(declared string, data []byte) string {
+	declared, _, _ = mime.ParseMediaType(declared)
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if svgPattern.Match(data[:min(len(data), 1024)]) {
+		sniffed = "image/svg+xml"
+	}
+
+	switch {
+	case declared == "" || declared == sniffed:
+		return sniffed
+	case genericSniffedTypes[sniffed] && declared != "application/octet-stream":
+		return declared
+	}
+	for _, refinement := range sniffedTypeRefinements[sniffed] {
+		if declared == refinement {
+			return declared
+		}
+	}
+	return sniffed
+}
+
+// isActiveContent reports uploads a browser could run script from if it ever
+// rendered them: HTML, and SVG with scripts or event handlers
+func isActiveContent(contentType string, data []byte) bool {
+	switch contentType {
+	case "text/html", "application/xhtml+xml":
+		return true
+	case "image/svg+xml", "text/xml", "application/xml":
+		return activeSVGPattern.Match(data)
+	}
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	return sniffed == "text/html" || (svgPattern.Match(data) && activeSVGPattern.Match(data))
+}
+
+// matchesMIMEPattern matches types against "type/subtype", "type/*" or "*/*"
+func matchesMIMEPattern(pattern, contentType string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if pattern == "*/*" || pattern == contentType {
+		return true
+	}
+	prefix, found := strings.CutSuffix(pattern, "/*")
+	return found && strings.HasPrefix(contentType, prefix+"/")
+}
+
+// uploadTypeAllowed applies the configured deny list, then the allow list
+// (empty allows everything)
+func (c *Config) uploadTypeAllowed(contentType string) bool {
+	for _, pattern := range c.UploadDeniedTypes {
+		if matchesMIMEPattern(pattern, contentType) {
+			return false
+		}
+	}
+	if len(c.UploadAllowedTypes) == 0 {
+		return true
+	}
+	for _, pattern := range c.UploadAllowedTypes {
+		if matchesMIMEPattern(pattern, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUploadType returns the content type to store data under, or
+// errUploadTypeNotAllowed
+func (c *Config) checkUploadType(declared string, data []byte) (string, error) {
+	contentType := sniffUploadType(declared, data)
+	if isActiveContent(contentType, bytes.TrimSpace(data)) || !c.uploadTypeAllowed(contentType) {
+		return "", errUploadTypeNotAllowed
+	}
+	return contentType, nil
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"time"
+)
+
+// Window UrgentPerHour is counted over
+const urgentWindow = time.Hour
+
+// allowUrgent reports whether from may send another urgent message and, if
+// so, holds one of their hourly allowance for it. refundUrgent gives it back
+// if the message isn't stored, so only sent messages use it up.
+func (h *Hub) allowUrgent(from string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.UrgentPerHour <= 0 {
+		return false
+	}
+
+	cutoff := time.Now().Add(-urgentWindow)
+	recent := h.UrgentSent[from][:0]
+	for _, sentAt := range h.UrgentSent[from] {
+		if sentAt.After(cutoff) {
+			recent = append(recent, sentAt)
+		}
+	}
+	if len(recent) >= h.UrgentPerHour {
+		h.UrgentSent[from] = recent
+		return false
+	}
+	h.UrgentSent[from] = append(recent, time.Now())
+	return true
+}
+
+// refundUrgent returns the allowance allowUrgent held for a message that
+// wasn't stored
+func (h *Hub) refundUrgent(from string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if sent := h.UrgentSent[from]; len(sent) > 0 {
+		h.UrgentSent[from] = sent[:len(sent)-1]
+	}
+}
+
+// urgentRejection explains why an urgent message was refused
+func urgentRejection(limit int) *FilterRejection {
+	reason := "urgent messages are disabled"
+	if limit > 0 {
+		reason = "too many urgent messages; try again later"
+	}
+	return &FilterRejection{Filter: "urgent", Reason: reason}
+}
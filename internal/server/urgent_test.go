@@ -0,0 +1,23 @@
+package server
+
+import (
+	"testing"
+
+	"whatsdown/internal/models"
+)
+
+func TestRejectedUrgentSendIsRefunded(t *testing.T) {
+	hub := newTestHub(t, "alice", "bob")
+	hub.UrgentPerHour = 1
+	hub.handleInboundMessageWithSender("alice", &models.InboundMessage{To: "nobody", Content: "wake up", Urgent: true})
+	hub.handleInboundMessageWithSender("alice", &models.InboundMessage{To: "bob", Content: "wake up", Urgent: true})
+	message := lastMessage(t, hub, &models.Message{From: "alice", To: "bob"})
+	if !message.Urgent {
+		t.Fatal("urgent message wasn't stored")
+	}
+
+	hub.handleInboundMessageWithSender("alice", &models.InboundMessage{To: "bob", Content: "again", Urgent: true})
+	if last := lastMessage(t, hub, &models.Message{From: "alice", To: "bob"}); last != message {
+		t.Errorf("second urgent message was allowed past the limit of 1")
+	}
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Longest ffmpeg may take to extract a poster frame
+	posterTimeout = 30 * time.Second
+
+	// Poster frames are scaled to at most this many pixels wide
+	posterWidth = 1280
+
+	// Size name of a video's poster frame among its thumbnails
+	posterSize = "poster"
+)
+
+var errUnsupportedVideo = errors.New("unsupported video format")
+
+// videoInfo is what the server reads from a video container
+type videoInfo struct {
+	Codec    string
+	Duration time.Duration
+	Width    int
+	Height   int
+}
+
+// probeVideo reads MP4/QuickTime and WebM/Matroska containers
+func probeVideo(data []byte) (*videoInfo, error) {
+	switch {
+	case isMP4(data) || (len(data) >= 8 && string(data[4:8]) == "moov"):
+		info, err := probeMP4(data)
+		if err != nil {
+			return nil, errUnsupportedVideo
+		}
+		track, ok := info.track("vide")
+		if !ok {
+			return nil, errUnsupportedVideo
+		}
+		return &videoInfo{Codec: track.Codec, Duration: info.Duration, Width: track.Width, Height: track.Height}, nil
+	case len(data) >= 4 && binary.BigEndian.Uint32(data[:4]) == ebmlHeaderID:
+		return probeWebM(data)
+	default:
+		return nil, errUnsupportedVideo
+	}
+}
+
+// Matroska element IDs, with their length markers as written in the file
+const (
+	ebmlHeaderID      = 0x1A45DFA3
+	ebmlSegmentID     = 0x18538067
+	ebmlInfoID        = 0x1549A966
+	ebmlTimecodeScale = 0x2AD7B1
+	ebmlDurationID    = 0x4489
+	ebmlTracksID      = 0x1654AE6B
+	ebmlTrackEntryID  = 0xAE
+	ebmlTrackTypeID   = 0x83
+	ebmlCodecID       = 0x86
+	ebmlVideoID       = 0xE0
+	ebmlPixelWidthID  = 0xB0
+	ebmlPixelHeightID = 0xBA
+	ebmlClusterID     = 0x1F43B675
+)
+
+// Codec names for Matroska codec IDs
+var webmCodecs = map[string]string{
+	"V_VP8":            "vp8",
+	"V_VP9":            "vp9",
+	"V_AV1":            "av1",
+	"V_MPEG4/ISO/AVC":  "h264",
+	"V_MPEGH/ISO/HEVC": "hevc",
+}
+
+// readEBMLVarInt reads a variable length integer, keeping the length marker
+// for element IDs. unknown is set for all-ones sizes.
+func readEBMLVarInt(data []byte, keepMarker bool) (value uint64, length int, unknown bool, ok bool) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0, false, false
+	}
+	length = 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 || len(data) < length {
+		return 0, 0, false, false
+	}
+	value = uint64(data[0])
+	if !keepMarker {
+		value &= uint64(0xFF >> length)
+	}
+	allOnes := value == uint64(0xFF>>length)
+	for _, b := range data[1:length] {
+		value = value<<8 | uint64(b)
+		allOnes = allOnes && b == 0xFF
+	}
+	return value, length, allOnes && !keepMarker, true
+}
+
+// walkEBML calls fn with each element in data. Elements of unknown size, as
+// live recorders write, extend to the end of data.
+func walkEBML(data []byte, fn func(id uint64, body []byte) bool) {
+	for offset := 0; offset < len(data); {
+		id, idLength, _, ok := readEBMLVarInt(data[offset:], true)
+		if !ok {
+			return
+		}
+		size, sizeLength, unknown, ok := readEBMLVarInt(data[offset+idLength:], false)
+		if !ok {
+			return
+		}
+		start := offset + idLength + sizeLength
+		end := len(data)
+		if !unknown {
+			if size > uint64(len(data)-start) {
+				end = len(data) // truncated; read what's there
+			} else {
+				end = start + int(size)
+			}
+		}
+		if !fn(id, data[start:end]) {
+			return
+		}
+		offset = end
+	}
+}
+
+func ebmlUint(body []byte) uint64 {
+	var value uint64
+	for _, b := range body {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+func ebmlFloat(body []byte) float64 {
+	switch len(body) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(body)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(body))
+	}
+	return 0
+}
+
+// probeWebM reads the segment's Info and Tracks elements, which precede the
+// media clusters
+func probeWebM(data []byte) (*videoInfo, error) {
+	info := &videoInfo{}
+	scale := uint64(1_000_000) // nanoseconds per timecode tick
+	var duration float64
+	found := false
+
+	walkEBML(data, func(id uint64, segment []byte) bool {
+		if id != ebmlSegmentID {
+			return true
+		}
+		walkEBML(segment, func(id uint64, body []byte) bool {
+			switch id {
+			case ebmlInfoID:
+				walkEBML(body, func(id uint64, value []byte) bool {
+					switch id {
+					case ebmlTimecodeScale:
+						scale = ebmlUint(value)
+					case ebmlDurationID:
+						duration = ebmlFloat(value)
+					}
+					return true
+				})
+			case ebmlTracksID:
+				walkEBML(body, func(id uint64, entry []byte) bool {
+					if id != ebmlTrackEntryID || found {
+						return true
+					}
+					track := &videoInfo{}
+					isVideo := false
+					walkEBML(entry, func(id uint64, value []byte) bool {
+						switch id {
+						case ebmlTrackTypeID:
+							isVideo = ebmlUint(value) == 1
+						case ebmlCodecID:
+							codec := strings.TrimRight(string(value), "\x00")
+							track.Codec = webmCodecs[codec]
+							if track.Codec == "" {
+								track.Codec = strings.ToLower(strings.TrimPrefix(codec, "V_"))
+							}
+						case ebmlVideoID:
+							walkEBML(value, func(id uint64, dimension []byte) bool {
+								switch id {
+								case ebmlPixelWidthID:
+									track.Width = int(min(ebmlUint(dimension), math.MaxInt32))
+								case ebmlPixelHeightID:
+									track.Height = int(min(ebmlUint(dimension), math.MaxInt32))
+								}
+								return true
+							})
+						}
+						return true
+					})
+					if isVideo {
+						info.Codec, info.Width, info.Height = track.Codec, track.Width, track.Height
+						found = true
+					}
+					return true
+				})
+			case ebmlClusterID:
+				return false
+			}
+			return true
+		})
+		return false
+	})
+
+	if !found {
+		return nil, errUnsupportedVideo
+	}
+	// Written so that NaN fails too
+	nanoseconds := duration * float64(scale)
+	if !(nanoseconds >= 0 && nanoseconds < float64(maxMediaDuration)) {
+		return nil, errUnsupportedVideo
+	}
+	info.Duration = time.Duration(nanoseconds)
+	return info, nil
+}
+
+// extractPoster has ffmpeg write the video's first frame as a JPEG. The
+// standard library has no video decoders, so without ffmpeg videos get no
+// poster.
+func (m *MediaStore) extractPoster(id string) error {
+	if m.FFmpegPath == "" {
+		return errUnsupportedVideo
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), posterTimeout)
+	defer cancel()
+
+	scale := "scale=min(iw\\," + strconv.Itoa(posterWidth) + "):-2"
+	cmd := exec.CommandContext(ctx, m.FFmpegPath,
+		"-nostdin", "-loglevel", "error", "-y",
+		"-i", m.path(id),
+		"-frames:v", "1", "-vf", scale, "-f", "image2", "-c:v", "mjpeg",
+		m.thumbnailPath(id, posterSize))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return errors.New(strings.TrimSpace(err.Error() + ": " + string(output)))
+	}
+	return nil
+}
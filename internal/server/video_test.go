@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+// ebmlElement encodes an element with an 8-byte size
+func ebmlElement(id uint64, body ...[]byte) []byte {
+	var content []byte
+	for _, b := range body {
+		content = append(content, b...)
+	}
+	var element []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(element) > 0 {
+			element = append(element, b)
+		}
+	}
+	size := binary.BigEndian.AppendUint64(nil, uint64(len(content)))
+	size[0] = 0x01 // Length marker
+	element = append(element, size...)
+	return append(element, content...)
+}
+
+// webmFile builds a WebM with a duration in milliseconds and one track
+func webmFile(duration float64, trackType byte, codec string, width, height uint16) []byte {
+	info := ebmlElement(ebmlInfoID,
+		ebmlElement(ebmlTimecodeScale, binary.BigEndian.AppendUint32(nil, 1_000_000)),
+		ebmlElement(ebmlDurationID, binary.BigEndian.AppendUint64(nil, math.Float64bits(duration))))
+	video := ebmlElement(ebmlVideoID,
+		ebmlElement(ebmlPixelWidthID, binary.BigEndian.AppendUint16(nil, width)),
+		ebmlElement(ebmlPixelHeightID, binary.BigEndian.AppendUint16(nil, height)))
+	track := ebmlElement(ebmlTrackEntryID,
+		ebmlElement(ebmlTrackTypeID, []byte{trackType}),
+		ebmlElement(ebmlCodecID, []byte(codec)),
+		video)
+	segment := ebmlElement(ebmlSegmentID, info, ebmlElement(ebmlTracksID, track), ebmlElement(ebmlClusterID))
+	return append(ebmlElement(ebmlHeaderID, ebmlElement(0x4282, []byte("webm"))), segment...)
+}
+
+func TestProbeVideo(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want *videoInfo
+	}{
+		{"webm", webmFile(2500, 1, "V_VP9", 640, 360), &videoInfo{Codec: "vp9", Duration: 2500 * time.Millisecond, Width: 640, Height: 360}},
+		{"webm unknown codec", webmFile(0, 1, "V_THEORA", 1, 1), &videoInfo{Codec: "theora", Width: 1, Height: 1}},
+		{"webm audio only", webmFile(1000, 2, "A_OPUS", 0, 0), nil},
+		{"webm negative duration", webmFile(-1000, 1, "V_VP8", 1, 1), nil},
+		{"webm NaN duration", webmFile(math.NaN(), 1, "V_VP8", 1, 1), nil},
+		{"webm overflowing duration", webmFile(1e300, 1, "V_VP8", 1, 1), nil},
+		{"mp4", mp4File(30, 300, mp4Trak("vide", "av01")), &videoInfo{Codec: "av1", Duration: 10 * time.Second, Width: 1920, Height: 1080}},
+		{"mp4 audio only", mp4File(30, 300, mp4Trak("soun", "mp4a")), nil},
+		{"empty", nil, nil},
+		{"not video", []byte("GIF89a..."), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := probeVideo(tt.data)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("probeVideo = %+v, want error", info)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("probeVideo: %v", err)
+			}
+			if *info != *tt.want {
+				t.Errorf("probeVideo = %+v, want %+v", info, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzProbeVideo(f *testing.F) {
+	f.Add(webmFile(1000, 1, "V_VP8", 320, 240))
+	f.Add(mp4File(600, 60, mp4Trak("vide", "hvc1")))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		info, err := probeVideo(data)
+		if err != nil {
+			return
+		}
+		if info.Duration < 0 || info.Width < 0 || info.Height < 0 {
+			t.Errorf("probeVideo = %+v", info)
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"whatsdown/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// TicketSigner issues and checks short-lived WebSocket tickets. A ticket
+// stands in for the session cookie on one upgrade, for clients that can't
+// send cookies or headers with it, and can only be used once.
+type TicketSigner struct {
+	secret []byte
+	ttl    time.Duration
+
+	// Nonces of redeemed tickets, kept until they expire
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+// NewTicketSigner signs with secret, or a random per-process key if it's
+// empty
+func NewTicketSigner(secret string, ttl time.Duration) *TicketSigner {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+	}
+	return &TicketSigner{secret: key, ttl: ttl, used: make(map[string]time.Time)}
+}
+
+func (s *TicketSigner) signature(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue returns a ticket for sessionID valid until the returned time
+func (s *TicketSigner) Issue(sessionID string) (string, time.Time) {
+	expires := time.Now().Add(s.ttl).Truncate(time.Second)
+	payload := sessionID + "|" + strconv.FormatInt(expires.Unix(), 10) + "|" + uuid.New().String()
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + s.signature(payload), expires
+}
+
+// Redeem checks a ticket's signature and expiry and returns the session it
+// was issued for. A ticket is only accepted the first time.
+func (s *TicketSigner) Redeem(ticket string) (string, bool) {
+	encoded, sig, found := strings.Cut(ticket, ".")
+	if !found {
+		return "", false
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	payload := string(raw)
+	if !hmac.Equal([]byte(s.signature(payload)), []byte(sig)) {
+		return "", false
+	}
+	parts := strings.Split(payload, "|")
+	if len(parts) != 3 {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", false
+	}
+	now := time.Now()
+	if now.Unix() > expires {
+		return "", false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for nonce, until := range s.used {
+		if now.After(until) {
+			delete(s.used, nonce)
+		}
+	}
+	if _, redeemed := s.used[parts[2]]; redeemed {
+		return "", false
+	}
+	s.used[parts[2]] = time.Unix(expires, 0).Add(time.Second)
+	return parts[0], true
+}
+
+// bearerSessionID returns the session ID from an "Authorization: Bearer"
+// header, falling back to the session cookie
+func bearerSessionID(r *http.Request) string {
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		return strings.TrimSpace(token)
+	}
+	return getSessionIDFromRequest(r)
+}
+
+// wsSessionID returns the session a WebSocket upgrade authenticates as, from
+// ?ticket=, an "Authorization: Bearer" header or the session cookie, in that
+// order. ok is false if a ticket was given but isn't valid; the other ways
+// are checked against the session store by the caller. The session ID itself
+// is never taken from the query string, which ends up in access logs and
+// browser history.
+func (h *HTTPHandlers) wsSessionID(r *http.Request) (sessionID string, ok bool) {
+	if ticket := r.URL.Query().Get("ticket"); ticket != "" {
+		if h.WSTickets == nil {
+			return "", false
+		}
+		return h.WSTickets.Redeem(ticket)
+	}
+	return bearerSessionID(r), true
+}
+
+// HandleWSTicket handles POST /api/ws-ticket. The caller authenticates with
+// the session cookie or an "Authorization: Bearer <session id>" header.
+func (h *HTTPHandlers) HandleWSTicket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID := bearerSessionID(r)
+	if sessionID == "" {
+		http.Error(w, "Not authenticated", http.StatusUnauthorized)
+		return
+	}
+	if _, exists := sessionStore.GetSession(sessionID); !exists {
+		http.Error(w, "Invalid session", http.StatusUnauthorized)
+		return
+	}
+
+	ticket, expires := h.WSTickets.Issue(sessionID)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(&models.WSTicket{Ticket: ticket, ExpiresAt: expires})
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWSSessionID(t *testing.T) {
+	h := &HTTPHandlers{WSTickets: NewTicketSigner("", time.Minute)}
+	ticket, _ := h.WSTickets.Issue("from-ticket")
+
+	tests := []struct {
+		name   string
+		target string
+		header string
+		cookie string
+		want   string
+		ok     bool
+	}{
+		{"ticket", "/ws?ticket=" + ticket, "", "", "from-ticket", true},
+		{"reused ticket", "/ws?ticket=" + ticket, "", "from-cookie", "", false},
+		{"bearer", "/ws", "Bearer from-header", "from-cookie", "from-header", true},
+		{"cookie", "/ws", "", "from-cookie", "from-cookie", true},
+		{"session in query", "/ws?access_token=from-query", "", "", "", true},
+		{"session in query with cookie", "/ws?access_token=from-query", "", "from-cookie", "from-cookie", true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		if tt.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "session_id", Value: tt.cookie})
+		}
+		if got, ok := h.wsSessionID(req); got != tt.want || ok != tt.ok {
+			t.Errorf("%s: wsSessionID = %q, %v, want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+
+	"whatsdown/internal/models"
+)
+
+// WSHandler handles one type of frame from a client. payload is the frame's
+// payload as JSON, whatever encoding the connection uses; an error means it
+// couldn't be decoded and is reported to the client as "invalid_payload".
+type WSHandler func(c *Client, payload json.RawMessage) error
+
+var (
+	wsHandlersMu sync.RWMutex
+	wsHandlers   = make(map[string]WSHandler)
+)
+
+// RegisterWSHandler sets the handler for frames of msgType, so new kinds of
+// frame can be added without touching the read pump. It panics if msgType is
+// empty or already has a handler.
+func RegisterWSHandler(msgType string, handler WSHandler) {
+	wsHandlersMu.Lock()
+	defer wsHandlersMu.Unlock()
+
+	if msgType == "" || handler == nil {
+		panic("server: RegisterWSHandler needs a type and a handler")
+	}
+	if _, exists := wsHandlers[msgType]; exists {
+		panic("server: a handler for " + msgType + " frames is already registered")
+	}
+	wsHandlers[msgType] = handler
+}
+
+// wsHandlerFor returns the handler registered for msgType
+func wsHandlerFor(msgType string) (WSHandler, bool) {
+	wsHandlersMu.RLock()
+	defer wsHandlersMu.RUnlock()
+	handler, ok := wsHandlers[msgType]
+	return handler, ok
+}
+
+// The frame types clients can send
+func init() {
+	RegisterWSHandler("message", func(c *Client, payload json.RawMessage) error {
+		var inboundMsg models.InboundMessage
+		if err := json.Unmarshal(payload, &inboundMsg); err != nil {
+			return err
+		}
+		c.Hub.handleInboundMessageWithSender(c.Username, &inboundMsg)
+		return nil
+	})
+
+	RegisterWSHandler("encrypted", func(c *Client, payload json.RawMessage) error {
+		var encryptedMsg models.InboundEncryptedMessage
+		if err := json.Unmarshal(payload, &encryptedMsg); err != nil {
+			return err
+		}
+		c.Hub.handleEncryptedMessage(c.Username, &encryptedMsg)
+		return nil
+	})
+
+	RegisterWSHandler("reaction", func(c *Client, payload json.RawMessage) error {
+		var reactionEvent models.ReactionEvent
+		if err := json.Unmarshal(payload, &reactionEvent); err != nil {
+			return err
+		}
+		c.Hub.handleReaction(c.Username, &reactionEvent)
+		return nil
+	})
+
+	RegisterWSHandler("vote", func(c *Client, payload json.RawMessage) error {
+		var voteEvent models.VoteEvent
+		if err := json.Unmarshal(payload, &voteEvent); err != nil {
+			return err
+		}
+		c.Hub.handleVote(c.Username, &voteEvent)
+		return nil
+	})
+
+	RegisterWSHandler("location", func(c *Client, payload json.RawMessage) error {
+		var locationUpdate models.LocationUpdate
+		if err := json.Unmarshal(payload, &locationUpdate); err != nil {
+			return err
+		}
+		c.Hub.handleLocationUpdate(c.Username, &locationUpdate)
+		return nil
+	})
+
+	RegisterWSHandler("read", func(c *Client, payload json.RawMessage) error {
+		var readEvent models.ReadEvent
+		if err := json.Unmarshal(payload, &readEvent); err != nil {
+			return err
+		}
+		c.Hub.handleRead(c.Username, &readEvent)
+		return nil
+	})
+
+	RegisterWSHandler("received", func(c *Client, payload json.RawMessage) error {
+		var receivedEvent models.ReceivedEvent
+		if err := json.Unmarshal(payload, &receivedEvent); err != nil {
+			return err
+		}
+		c.Hub.handleReceived(c, &receivedEvent)
+		return nil
+	})
+
+	// Sent by the UI on user interaction; the read pump counts any frame as
+	// activity before dispatching it
+	RegisterWSHandler("activity", func(c *Client, payload json.RawMessage) error {
+		return nil
+	})
+
+	RegisterWSHandler("presence_subscribe", func(c *Client, payload json.RawMessage) error {
+		var subscription models.PresenceSubscription
+		if err := json.Unmarshal(payload, &subscription); err != nil {
+			return err
+		}
+		c.Hub.subscribePresence(c, subscription.Usernames)
+		return nil
+	})
+
+	RegisterWSHandler("presence_unsubscribe", func(c *Client, payload json.RawMessage) error {
+		var subscription models.PresenceSubscription
+		if err := json.Unmarshal(payload, &subscription); err != nil {
+			return err
+		}
+		c.Hub.unsubscribePresence(c, subscription.Usernames)
+		return nil
+	})
+
+	RegisterWSHandler("typing", func(c *Client, payload json.RawMessage) error {
+		var typingEvent models.TypingEvent
+		if err := json.Unmarshal(payload, &typingEvent); err != nil {
+			return err
+		}
+		c.Hub.TypingEvents <- &TypingEventWrapper{
+			From:     c.Username,
+			To:       typingEvent.To,
+			IsTyping: typingEvent.IsTyping,
+		}
+		return nil
+	})
+}